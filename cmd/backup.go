@@ -10,8 +10,9 @@ import (
 	"github.com/spf13/cobra"
 
 	"k8s-backup/pkg/backup"
-	"k8s-backup/pkg/k8s"
-	"k8s-backup/pkg/storage"
+	"k8s-backup/pkg/datamover"
+	"k8s-backup/pkg/hooks"
+	"k8s-backup/pkg/retention"
 	"k8s-backup/pkg/types"
 )
 
@@ -24,6 +25,19 @@ var (
 	excludeNamespaces    []string
 	excludeResourceTypes []string
 	compress             bool
+	backupStorage        string
+	incrementalFrom      string
+	backupConcurrency    int
+	backupSelector       string
+	backupFieldSelector  string
+	namespaceSelector    string
+	snapshotVolumes      bool
+	snapshotTimeout      time.Duration
+	volumeData           []string
+	dataMoverImage       string
+	volumeDataTimeout    time.Duration
+	hooksFile            string
+	skipHooks            bool
 )
 
 // backupCmd represents the backup command
@@ -45,11 +59,41 @@ Examples:
   # Backup only deployments and services
   k8s-backup backup --resource-types deployments,services
 
+  # Backup only objects with matching labels, in namespaces with matching labels
+  k8s-backup backup --selector app=payments,tier!=cache --namespace-selector team=checkout
+
+  # Backup custom resources, qualified by API group
+  k8s-backup backup --resource-types certificates.cert-manager.io
+
   # Create a named backup with compression
   k8s-backup backup --name my-backup --compress
 
   # Backup to a specific directory
-  k8s-backup backup --output ./my-backups/`,
+  k8s-backup backup --output ./my-backups/
+
+  # Also snapshot the data of every PersistentVolumeClaim with CSI VolumeSnapshots
+  k8s-backup backup --snapshot-volumes
+
+  # Copy the files of claims whose storage cannot be snapshotted through helper pods
+  k8s-backup backup --volume-data 'db/data,logs/*'
+
+  # Run the pre- and post-backup commands of a hooks file in matching pods
+  k8s-backup backup --hooks-file ./hooks.yaml
+
+  # Only store what changed since an earlier backup
+  k8s-backup backup --incremental-from backup-2025-09-12-15-00-00
+
+  # Prune old backups after a successful backup
+  k8s-backup backup --keep-daily 7 --keep-weekly 4
+
+  # Encrypt the backup to an age recipient
+  k8s-backup backup --recipient age1ql3z7hjy54pw3hyww5ayyfg7zqgvc7w3j2elw8zmrj2kg5sfn9aqmcac8p
+
+  # Sign the backup manifest so restores can prove where it came from
+  k8s-backup backup --signing-key ./signing.pem
+
+  # Backup to an S3 bucket (or a MinIO-style service with ?endpoint=...)
+  k8s-backup backup --storage s3://my-bucket/cluster-a`,
 
 	Run: runBackup,
 }
@@ -61,10 +105,26 @@ func init() {
 	backupCmd.Flags().StringVar(&backupName, "name", "", "name for the backup (default: auto-generated timestamp)")
 	backupCmd.Flags().StringVarP(&backupPath, "output", "o", "./backups", "output directory for backups")
 	backupCmd.Flags().StringSliceVar(&backupNamespaces, "namespaces", []string{}, "comma-separated list of namespaces to backup (default: all)")
-	backupCmd.Flags().StringSliceVar(&backupResourceTypes, "resource-types", []string{}, "comma-separated list of resource types to backup (default: all supported)")
+	backupCmd.Flags().StringSliceVar(&backupResourceTypes, "resource-types", []string{}, "comma-separated list of resource types to backup as resource or resource.group (default: all discovered)")
 	backupCmd.Flags().StringSliceVar(&excludeNamespaces, "exclude-namespaces", []string{"kube-system", "kube-public", "kube-node-lease"}, "comma-separated list of namespaces to exclude")
 	backupCmd.Flags().StringSliceVar(&excludeResourceTypes, "exclude-resource-types", []string{}, "comma-separated list of resource types to exclude")
 	backupCmd.Flags().BoolVar(&compress, "compress", true, "compress backup files using gzip")
+	backupCmd.Flags().StringVar(&backupStorage, "storage", "", storageFlagUsage+" (default: --output)")
+	backupCmd.Flags().StringVarP(&backupSelector, "selector", "l", "", "label selector to filter resources by (e.g. app=payments,tier!=cache)")
+	backupCmd.Flags().StringVar(&backupFieldSelector, "field-selector", "", "field selector to filter resources by (e.g. metadata.name=web); fields other than metadata.name and metadata.namespace are not supported by every resource type")
+	backupCmd.Flags().StringVar(&namespaceSelector, "namespace-selector", "", "label selector for the namespaces to backup (e.g. team=checkout)")
+	backupCmd.Flags().IntVar(&backupConcurrency, "concurrency", 4, "number of List requests to run in parallel")
+	backupCmd.Flags().BoolVar(&snapshotVolumes, "snapshot-volumes", false, "take a CSI VolumeSnapshot of every backed up PersistentVolumeClaim")
+	backupCmd.Flags().DurationVar(&snapshotTimeout, "snapshot-timeout", 10*time.Minute, "how long to wait for each volume snapshot to become ready")
+	backupCmd.Flags().StringSliceVar(&volumeData, "volume-data", []string{}, "comma-separated namespace/name patterns of PersistentVolumeClaims whose files are copied into the backup, in addition to claims annotated "+types.VolumeDataAnnotation+"=true")
+	backupCmd.Flags().StringVar(&dataMoverImage, "data-mover-image", datamover.DefaultImage, "image of the helper pods that copy volume data; it needs tar")
+	backupCmd.Flags().DurationVar(&volumeDataTimeout, "volume-data-timeout", 5*time.Minute, "how long to wait for each helper pod to start")
+	backupCmd.Flags().StringVar(&hooksFile, "hooks-file", "", "YAML file of commands run in matching pods before and after the backup, in addition to hooks declared through pod annotations")
+	backupCmd.Flags().BoolVar(&skipHooks, "skip-hooks", false, "do not run any pre- or post-backup hooks")
+	backupCmd.Flags().StringVar(&incrementalFrom, "incremental-from", "", "name of a backup in the same storage to take an incremental backup against")
+	addEncryptionFlags(backupCmd, true)
+	addSigningFlags(backupCmd, true)
+	addRetentionFlags(backupCmd)
 }
 
 func runBackup(cmd *cobra.Command, args []string) {
@@ -75,9 +135,13 @@ func runBackup(cmd *cobra.Command, args []string) {
 		backupName = fmt.Sprintf("backup-%s", time.Now().Format("2006-01-02-15-04-05"))
 	}
 
+	if backupStorage == "" {
+		backupStorage = backupPath
+	}
+
 	if verbose {
 		log.Printf("Starting backup: %s", backupName)
-		log.Printf("Output path: %s", backupPath)
+		log.Printf("Output path: %s", backupStorage)
 		if len(backupNamespaces) > 0 {
 			log.Printf("Namespaces: %s", strings.Join(backupNamespaces, ", "))
 		}
@@ -86,17 +150,30 @@ func runBackup(cmd *cobra.Command, args []string) {
 		}
 	}
 
+	// Validate retention rules and hooks before doing any work
+	policy := retentionPolicy()
+
+	var hookConfig *hooks.Config
+	if hooksFile != "" && !skipHooks {
+		var err error
+		hookConfig, err = hooks.LoadConfig(hooksFile)
+		if err != nil {
+			log.Fatalf("Failed to load hooks: %v", err)
+		}
+	}
+
 	// Initialize Kubernetes client
-	client, err := k8s.NewClient(kubeconfig)
+	client, err := newKubernetesClient()
 	if err != nil {
 		log.Fatalf("Failed to create Kubernetes client: %v", err)
 	}
 
 	// Initialize storage
-	storageBackend := storage.NewLocalStorage(backupPath)
+	storageBackend := openEncryptedStorage(backupStorage)
 
 	// Initialize backup manager
 	backupManager := backup.NewManager(client, storageBackend)
+	backupManager.SetHooks(hookConfig)
 
 	// Prepare backup options
 	options := &types.BackupOptions{
@@ -107,6 +184,17 @@ func runBackup(cmd *cobra.Command, args []string) {
 		OutputPath:           backupPath,
 		BackupName:           backupName,
 		Compress:             compress,
+		IncrementalFrom:      incrementalFrom,
+		Concurrency:          backupConcurrency,
+		LabelSelector:        backupSelector,
+		FieldSelector:        backupFieldSelector,
+		NamespaceSelector:    namespaceSelector,
+		SnapshotVolumes:      snapshotVolumes,
+		SnapshotTimeout:      snapshotTimeout,
+		VolumeData:           volumeData,
+		DataMoverImage:       dataMoverImage,
+		VolumeDataTimeout:    volumeDataTimeout,
+		SkipHooks:            skipHooks,
 	}
 
 	// Progress callback
@@ -134,7 +222,22 @@ func runBackup(cmd *cobra.Command, args []string) {
 	fmt.Printf("\n✅ Backup completed successfully!\n")
 	fmt.Printf("Backup name: %s\n", metadata.Name)
 	fmt.Printf("Resources backed up: %d\n", metadata.TotalResources)
+	if metadata.Parent != "" {
+		fmt.Printf("Incremental from: %s (%d deleted)\n", metadata.Parent, len(metadata.Deleted))
+	}
 	fmt.Printf("Namespaces: %s\n", strings.Join(metadata.Namespaces, ", "))
+	if snapshotVolumes {
+		fmt.Printf("Volume snapshots: %d\n", len(metadata.VolumeSnapshots))
+	}
+	if len(metadata.Hooks) > 0 {
+		failed := 0
+		for _, hook := range metadata.Hooks {
+			if !hook.Succeeded {
+				failed++
+			}
+		}
+		fmt.Printf("Hooks run: %d (%d failed)\n", len(metadata.Hooks), failed)
+	}
 	fmt.Printf("Size: %.2f MB\n", float64(metadata.Size)/(1024*1024))
 	fmt.Printf("Location: %s\n", metadata.BackupPath)
 	fmt.Printf("Timestamp: %s\n", metadata.Timestamp.Format(time.RFC3339))
@@ -143,4 +246,16 @@ func runBackup(cmd *cobra.Command, args []string) {
 		fmt.Printf("Resource types: %s\n", strings.Join(metadata.ResourceTypes, ", "))
 		fmt.Printf("Kubernetes version: %s\n", metadata.KubernetesVersion)
 	}
+
+	// Apply retention rules now that the new backup is safely stored
+	if !policy.Empty() {
+		fmt.Println()
+		decisions, err := retention.Prune(storageBackend, policy, time.Now(), false)
+		if decisions != nil {
+			printPruneDecisions(decisions, false)
+		}
+		if err != nil {
+			log.Fatalf("Prune failed: %v", err)
+		}
+	}
 }
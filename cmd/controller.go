@@ -0,0 +1,185 @@
+package cmd
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/spf13/cobra"
+	"k8s.io/apimachinery/pkg/util/uuid"
+
+	"k8s-backup/pkg/controller"
+	"k8s-backup/pkg/encryption"
+	"k8s-backup/pkg/storage"
+)
+
+// serviceAccountNamespaceFile holds the namespace of a pod's service account
+const serviceAccountNamespaceFile = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+
+var (
+	// Controller-specific flags
+	controllerStorage       string
+	allowedStorage          []string
+	controllerNamespace     string
+	controllerWorkers       int
+	installCRDs             bool
+	leaderElect             bool
+	leaderElectionNamespace string
+	leaderElectionID        string
+)
+
+// controllerCmd represents the controller command
+var controllerCmd = &cobra.Command{
+	Use:   "controller",
+	Short: "Run as a Kubernetes operator for Backup, Restore and BackupSchedule resources",
+	Long: `Run as a Kubernetes operator that takes backups and restores them as
+declared by custom resources of the k8s-backup.io API group.
+
+The controller installs the CustomResourceDefinitions of Backup, Restore and
+BackupSchedule unless --install-crds=false, then reconciles every resource in
+--namespace (default: all namespaces):
+
+  Backup          takes a backup with the options of its spec, stored as
+                  <namespace>.<name> after the resource
+  Restore         restores the backup of the Backup named by its spec.backup
+                  in its namespace
+  BackupSchedule  creates a Backup on a cron schedule, one at a time, and
+                  applies its retention policy after each
+
+Backups and Restores run with the controller's credentials, so only those
+in --controller-namespace (default: the pod's namespace) may span the
+cluster and restore any stored backup. Elsewhere, a Backup or Restore covers
+the namespaced objects of its own namespace only.
+
+The phase, progress, counts and errors of each are written to its status.
+Backups and restores run once; one still in progress when the controller
+starts was interrupted and is marked as failed. Storage locations are the
+spec's storage, or --storage, opened with the keys of the encryption and
+signing flags. A spec may only name --storage or a location listed in
+--allowed-storage.
+
+With --leader-elect, replicas compete for a Lease and only its holder
+reconciles resources, so several can run for availability.
+
+Examples:
+  # Run the controller against the current kubeconfig
+  k8s-backup controller --storage s3://my-bucket/cluster-a
+
+  # Run several replicas in a Deployment
+  k8s-backup controller --storage s3://my-bucket/cluster-a --leader-elect --key-file /etc/k8s-backup/backup.key
+
+  # Take a backup of the shop namespace
+  kubectl apply -f - <<EOF
+  apiVersion: k8s-backup.io/v1alpha1
+  kind: Backup
+  metadata:
+    name: before-upgrade
+    namespace: shop
+  spec:
+    snapshotVolumes: true
+  EOF`,
+
+	Run: runController,
+}
+
+func init() {
+	rootCmd.AddCommand(controllerCmd)
+
+	// Controller-specific flags
+	controllerCmd.Flags().StringVar(&controllerStorage, "storage", "./backups", storageFlagUsage+"; used by resources without a storage of their own")
+	controllerCmd.Flags().StringSliceVar(&allowedStorage, "allowed-storage", []string{}, "comma-separated list of other storage locations resources may set in spec.storage (default: none)")
+	controllerCmd.Flags().StringVar(&controllerNamespace, "controller-namespace", "", "namespace whose Backups and Restores may span the cluster; those elsewhere are limited to their own namespace (default: the pod's namespace)")
+	controllerCmd.Flags().IntVar(&controllerWorkers, "workers", 2, "number of resources of each kind reconciled at once")
+	controllerCmd.Flags().BoolVar(&installCRDs, "install-crds", true, "create or update the CustomResourceDefinitions on startup")
+	controllerCmd.Flags().BoolVar(&leaderElect, "leader-elect", false, "elect a leader among controller replicas through a Lease, so only one reconciles resources")
+	controllerCmd.Flags().StringVar(&leaderElectionNamespace, "leader-election-namespace", "", "namespace of the leader election Lease (default: the pod's namespace, or default)")
+	controllerCmd.Flags().StringVar(&leaderElectionID, "leader-election-id", "k8s-backup-controller", "name of the leader election Lease")
+	addEncryptionFlags(controllerCmd, true)
+	addSigningFlags(controllerCmd, true)
+	// The controller also restores backups, so it takes the keys that read
+	// them as well
+	controllerCmd.Flags().StringVar(&identityFile, "identity", "", "age identity file (as written by age-keygen) to decrypt backups with when restoring")
+	controllerCmd.Flags().StringVar(&verifyKeyFile, "verify-key", "", "PEM ed25519 public key; when set, restored backups must carry a valid signature")
+}
+
+func runController(cmd *cobra.Command, args []string) {
+	openStorage := storageOpener()
+
+	client, err := newKubernetesClient()
+	if err != nil {
+		log.Fatalf("Failed to create Kubernetes client: %v", err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if installCRDs {
+		if err := controller.InstallCRDs(ctx, client.APIExtensions()); err != nil {
+			log.Fatalf("Failed to install CustomResourceDefinitions: %v", err)
+		}
+	}
+
+	if controllerNamespace == "" {
+		controllerNamespace = podNamespace()
+	}
+	c := controller.NewController(client, openStorage, controller.Options{
+		Namespace:           namespace,
+		ControllerNamespace: controllerNamespace,
+		DefaultStorage:      controllerStorage,
+		AllowedStorage:      allowedStorage,
+		Workers:             controllerWorkers,
+	})
+
+	if !leaderElect {
+		err = c.Run(ctx)
+	} else {
+		hostname, _ := os.Hostname()
+		err = controller.RunWithLeaderElection(ctx, client.Clientset(), controller.LeaderElection{
+			Namespace: leaseNamespace(),
+			Name:      leaderElectionID,
+			Identity:  hostname + "_" + string(uuid.NewUUID()),
+		}, c.Run)
+	}
+	if err != nil {
+		log.Fatalf("Controller failed: %v", err)
+	}
+}
+
+// storageOpener opens the storage locations of custom resources with the
+// keys of the encryption and signing flags. The default location is opened
+// up front, so missing keys are reported at startup.
+func storageOpener() controller.StorageOpener {
+	openEncryptedStorage(controllerStorage)
+	key := loadEncryptionKey()
+	return func(location string) (storage.Storage, error) {
+		backend, err := storage.Open(location)
+		if err != nil {
+			return nil, err
+		}
+		applySigning(backend)
+		return encryption.NewStorage(backend, key), nil
+	}
+}
+
+// leaseNamespace returns the namespace of the leader election Lease
+func leaseNamespace() string {
+	if leaderElectionNamespace != "" {
+		return leaderElectionNamespace
+	}
+	if ns := podNamespace(); ns != "" {
+		return ns
+	}
+	return "default"
+}
+
+// podNamespace returns the namespace of the controller's pod, or an empty
+// string when it does not run in a pod
+func podNamespace() string {
+	if data, err := os.ReadFile(serviceAccountNamespaceFile); err == nil {
+		return strings.TrimSpace(string(data))
+	}
+	return ""
+}
@@ -0,0 +1,172 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"k8s-backup/pkg/diff"
+	"k8s-backup/pkg/types"
+)
+
+var (
+	// Diff-specific flags
+	diffStorage    string
+	diffNamespaces []string
+	diffOutput     string
+)
+
+// diffCmd represents the diff command
+var diffCmd = &cobra.Command{
+	Use:   "diff <backup>",
+	Short: "Show how the cluster differs from a backup",
+	Long: `Compare the resources of a backup with their live counterparts in the
+cluster, to see what a restore would change.
+
+Both sides are normalised the way backups are (cluster-set metadata, managed
+fields and runtime annotations removed) and status is ignored. Objects in the
+backup but not in the cluster are reported as added, live objects of the kinds
+and namespaces in the backup that the backup does not contain as removed, and
+objects that differ as changed, with a unified diff from the live object to the
+backed up one.
+
+Like diff(1), the command exits with status 0 when there are no differences,
+1 when there are, and 2 when the comparison failed.
+
+The backup can be given as a name, a path or an s3:// URL.
+
+Examples:
+  # Show what restoring a backup would change
+  k8s-backup diff backup-2025-09-12-15-00-00
+
+  # Only compare two namespaces
+  k8s-backup diff backup-2025-09-12-15-00-00 --namespaces app1,app2
+
+  # Machine-readable output for CI gates
+  k8s-backup diff backup-2025-09-12-15-00-00 --output json`,
+
+	Args: cobra.ExactArgs(1),
+	Run:  runDiff,
+}
+
+func init() {
+	rootCmd.AddCommand(diffCmd)
+
+	// Diff-specific flags
+	diffCmd.Flags().StringVar(&diffStorage, "storage", "./backups", storageFlagUsage)
+	diffCmd.Flags().StringSliceVar(&diffNamespaces, "namespaces", []string{}, "comma-separated list of namespaces to compare, \"cluster\" for cluster-scoped resources (default: all from backup)")
+	diffCmd.Flags().StringVarP(&diffOutput, "output", "o", "text", "output format: text or json")
+	addEncryptionFlags(diffCmd, false)
+	addSigningFlags(diffCmd, false)
+}
+
+// diffReport is the JSON output of the diff command
+type diffReport struct {
+	*diff.DiffResult
+	Errors []string `json:"errors,omitempty"`
+}
+
+func runDiff(cmd *cobra.Command, args []string) {
+	if diffOutput != "text" && diffOutput != "json" {
+		log.Printf("Invalid --output %q: expected text or json", diffOutput)
+		os.Exit(2)
+	}
+
+	storageBackend := openEncryptedStorage(diffStorage)
+	backupPath := resolveBackupPath(storageBackend, args[0])
+
+	client, err := newKubernetesClient()
+	if err != nil {
+		log.Printf("Failed to create Kubernetes client: %v", err)
+		os.Exit(2)
+	}
+
+	result, err := diff.NewManager(client, storageBackend).DiffBackup(context.Background(), &types.DiffOptions{
+		BackupPath: backupPath,
+		Namespaces: diffNamespaces,
+	})
+	if err != nil {
+		log.Printf("Diff failed: %v", err)
+		os.Exit(2)
+	}
+
+	writeDiffResult(result, diffOutput)
+}
+
+// writeDiffResult prints a diff in the given format and exits with the
+// status diff(1) would
+func writeDiffResult(result *diff.DiffResult, format string) {
+	if format == "json" {
+		report := diffReport{DiffResult: result}
+		for _, err := range result.Errors {
+			report.Errors = append(report.Errors, err.Error())
+		}
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(report); err != nil {
+			log.Printf("Failed to write diff: %v", err)
+			os.Exit(2)
+		}
+	} else {
+		printDiffResult(result)
+	}
+
+	switch {
+	case len(result.Errors) > 0:
+		os.Exit(2)
+	case result.HasChanges():
+		os.Exit(1)
+	}
+}
+
+// printDiffResult prints each differing resource and a summary
+func printDiffResult(result *diff.DiffResult) {
+	markers := map[diff.Change]string{diff.Added: "+", diff.Removed: "-", diff.Changed: "~"}
+	for _, resource := range result.Resources {
+		name := resource.Name
+		if resource.Namespace != "" {
+			name = resource.Namespace + "/" + name
+		}
+		fmt.Printf("%s %s %s (%s)\n", markers[resource.Change], resource.Kind, name, resource.Change)
+		for _, field := range resource.Fields {
+			fmt.Printf("    %s: %s -> %s\n", field.Path, formatFieldValue(field.From), formatFieldValue(field.To))
+		}
+		if resource.Diff != "" {
+			fmt.Print(resource.Diff)
+			if !strings.HasSuffix(resource.Diff, "\n") {
+				fmt.Println()
+			}
+		}
+	}
+
+	if len(result.Resources) > 0 {
+		fmt.Println()
+	}
+	if result.Base != "" {
+		fmt.Printf("Backups: %s -> %s\n", result.Base, result.Backup)
+	} else {
+		fmt.Printf("Backup: %s\n", result.Backup)
+	}
+	fmt.Printf("Added: %d, removed: %d, changed: %d, unchanged: %d\n", result.Added, result.Removed, result.Changed, result.Unchanged)
+	for _, err := range result.Errors {
+		fmt.Printf("Error: %v\n", err)
+	}
+}
+
+// formatFieldValue formats a field value as compact JSON, or <unset> for a
+// field that is only set on one side
+func formatFieldValue(value interface{}) string {
+	if value == nil {
+		return "<unset>"
+	}
+	content, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Sprint(value)
+	}
+	return string(content)
+}
@@ -0,0 +1,90 @@
+package cmd
+
+import (
+	"log"
+	"os"
+	"strings"
+
+	"filippo.io/age"
+	"github.com/spf13/cobra"
+
+	"k8s-backup/pkg/encryption"
+	"k8s-backup/pkg/storage"
+)
+
+// passphraseEnv holds the backup passphrase when --passphrase-file is not set
+const passphraseEnv = "K8S_BACKUP_PASSPHRASE"
+
+var (
+	// Encryption flags shared by commands that read or write backup contents
+	keyFile        string
+	passphraseFile string
+	recipients     []string
+	identityFile   string
+)
+
+// addEncryptionFlags registers the key flags. Commands that write backups take
+// age recipients; commands that read them take an age identity file.
+func addEncryptionFlags(cmd *cobra.Command, writesBackups bool) {
+	cmd.Flags().StringVar(&keyFile, "key-file", "", "file containing a 32-byte key (raw, hex or base64) for backup encryption")
+	cmd.Flags().StringVar(&passphraseFile, "passphrase-file", "", "file containing a passphrase for backup encryption (or set "+passphraseEnv+")")
+	if writesBackups {
+		cmd.Flags().StringSliceVar(&recipients, "recipient", []string{}, "age recipient (age1...) to encrypt the backup to; may be repeated")
+	} else {
+		cmd.Flags().StringVar(&identityFile, "identity", "", "age identity file (as written by age-keygen) to decrypt the backup with")
+	}
+}
+
+// loadEncryptionKey builds the key selected by the encryption flags, or
+// returns nil when none is set
+func loadEncryptionKey() encryption.Key {
+	passphrase := os.Getenv(passphraseEnv)
+	if passphraseFile != "" {
+		data, err := os.ReadFile(passphraseFile)
+		if err != nil {
+			log.Fatalf("Failed to read passphrase file: %v", err)
+		}
+		passphrase = strings.TrimRight(string(data), "\r\n")
+	}
+
+	selected := 0
+	for _, set := range []bool{keyFile != "", passphrase != "", len(recipients) > 0 || identityFile != ""} {
+		if set {
+			selected++
+		}
+	}
+	if selected > 1 {
+		log.Fatalf("Only one of --key-file, --passphrase-file/%s and --recipient/--identity may be used", passphraseEnv)
+	}
+
+	var key encryption.Key
+	var err error
+	switch {
+	case keyFile != "":
+		key, err = encryption.LoadKeyFile(keyFile)
+	case passphrase != "":
+		key, err = encryption.NewPassphraseKey(passphrase)
+	case len(recipients) > 0 || identityFile != "":
+		var identities []age.Identity
+		if identityFile != "" {
+			identities, err = encryption.LoadAgeIdentities(identityFile)
+			if err != nil {
+				break
+			}
+		}
+		key, err = encryption.NewAgeKey(recipients, identities)
+	}
+	if err != nil {
+		log.Fatalf("Failed to load encryption key: %v", err)
+	}
+	return key
+}
+
+// openEncryptedStorage opens a storage location, encrypting and decrypting
+// backup contents with the key selected by the encryption flags and signing
+// or verifying manifests with the keys selected by the signing flags
+func openEncryptedStorage(location string) storage.Storage {
+	backend := openStorage(location)
+	applySigning(backend)
+	return encryption.NewStorage(backend, loadEncryptionKey())
+}
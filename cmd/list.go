@@ -9,15 +9,15 @@ import (
 
 	"github.com/spf13/cobra"
 
-	"k8s-backup/pkg/storage"
 	"k8s-backup/pkg/types"
 )
 
 var (
 	// List-specific flags
-	listPath   string
-	showDetail bool
-	sortBy     string
+	listPath    string
+	showDetail  bool
+	listStorage string
+	sortBy      string
 )
 
 // listCmd represents the list command
@@ -38,6 +38,9 @@ Examples:
   # List backups from a specific directory
   k8s-backup list --path ./my-backups
 
+  # List backups stored in S3
+  k8s-backup list --storage s3://my-bucket/cluster-a
+
   # Sort backups by size
   k8s-backup list --sort-by size`,
 
@@ -49,17 +52,22 @@ func init() {
 
 	// List-specific flags
 	listCmd.Flags().StringVar(&listPath, "path", "./backups", "path to backup directory")
+	listCmd.Flags().StringVar(&listStorage, "storage", "", storageFlagUsage+" (default: --path)")
 	listCmd.Flags().BoolVarP(&showDetail, "detail", "d", false, "show detailed backup information")
 	listCmd.Flags().StringVar(&sortBy, "sort-by", "timestamp", "sort backups by: timestamp, name, size, resources (default: timestamp)")
 }
 
 func runList(cmd *cobra.Command, args []string) {
+	if listStorage == "" {
+		listStorage = listPath
+	}
+
 	if verbose {
-		log.Printf("Listing backups from: %s", listPath)
+		log.Printf("Listing backups from: %s", listStorage)
 	}
 
 	// Initialize storage
-	storageBackend := storage.NewLocalStorage(listPath)
+	storageBackend := openStorage(listStorage)
 
 	// Get all backups
 	backups, err := storageBackend.ListBackups()
@@ -68,7 +76,7 @@ func runList(cmd *cobra.Command, args []string) {
 	}
 
 	if len(backups) == 0 {
-		fmt.Printf("No backups found in %s\n", listPath)
+		fmt.Printf("No backups found in %s\n", listStorage)
 		return
 	}
 
@@ -107,22 +115,31 @@ func sortBackups(backups []*types.BackupMetadata, sortBy string) {
 }
 
 func printSimpleBackups(backups []*types.BackupMetadata) {
-	fmt.Printf("%-30s %-20s %-10s %-10s %s\n", "NAME", "CREATED", "SIZE", "RESOURCES", "NAMESPACES")
-	fmt.Printf("%-30s %-20s %-10s %-10s %s\n", strings.Repeat("-", 30), strings.Repeat("-", 20), strings.Repeat("-", 10), strings.Repeat("-", 10), strings.Repeat("-", 20))
+	fmt.Printf("%-30s %-20s %-10s %-10s %-30s %s\n", "NAME", "CREATED", "SIZE", "RESOURCES", "PARENT", "NAMESPACES")
+	fmt.Printf("%-30s %-20s %-10s %-10s %-30s %s\n", strings.Repeat("-", 30), strings.Repeat("-", 20), strings.Repeat("-", 10), strings.Repeat("-", 10), strings.Repeat("-", 30), strings.Repeat("-", 20))
 
 	for _, backup := range backups {
 		size := formatSize(backup.Size)
 		created := backup.Timestamp.Format("2006-01-02 15:04:05")
 		namespaces := strings.Join(backup.Namespaces, ",")
+		if backup.Encryption != nil && len(backup.Encryption.Index) > 0 {
+			namespaces = "(encrypted)"
+		}
 		if len(namespaces) > 20 {
 			namespaces = namespaces[:17] + "..."
 		}
 
-		fmt.Printf("%-30s %-20s %-10s %-10d %s\n",
+		parent := backup.Parent
+		if parent == "" {
+			parent = "-"
+		}
+
+		fmt.Printf("%-30s %-20s %-10s %-10d %-30s %s\n",
 			backup.Name,
 			created,
 			size,
 			backup.TotalResources,
+			parent,
 			namespaces,
 		)
 	}
@@ -142,6 +159,21 @@ func printDetailedBackups(backups []*types.BackupMetadata) {
 		fmt.Printf("K8s Version: %s\n", backup.KubernetesVersion)
 		fmt.Printf("Path: %s\n", backup.BackupPath)
 
+		if backup.Parent != "" {
+			fmt.Printf("Type: incremental (%d deleted since parent)\n", len(backup.Deleted))
+			fmt.Printf("Chain: %s\n", strings.Join(append(append([]string{}, backup.Chain...), backup.Name), " -> "))
+		} else {
+			fmt.Printf("Type: full\n")
+		}
+
+		if backup.Schedule != "" {
+			fmt.Printf("Schedule: %s\n", backup.Schedule)
+		}
+
+		if backup.Encryption != nil {
+			fmt.Printf("Encryption: %s (%s)\n", backup.Encryption.Algorithm, describeEncryptionKey(backup.Encryption))
+		}
+
 		if len(backup.Namespaces) > 0 {
 			fmt.Printf("Namespaces (%d): %s\n", len(backup.Namespaces), strings.Join(backup.Namespaces, ", "))
 		}
@@ -156,6 +188,13 @@ func printDetailedBackups(backups []*types.BackupMetadata) {
 	}
 }
 
+func describeEncryptionKey(info *types.EncryptionInfo) string {
+	if info.KeyID == "" {
+		return info.KeyScheme
+	}
+	return info.KeyScheme + " " + info.KeyID
+}
+
 func formatSize(bytes int64) string {
 	const unit = 1024
 	if bytes < unit {
@@ -0,0 +1,79 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"k8s-backup/pkg/retention"
+)
+
+var (
+	// Prune-specific flags
+	pruneStorage string
+	pruneDryRun  bool
+)
+
+// pruneCmd represents the prune command
+var pruneCmd = &cobra.Command{
+	Use:   "prune",
+	Short: "Delete backups according to retention rules",
+	Long: `Delete backups that are not kept by the given retention rules.
+
+Keep rules (--keep-last, --keep-daily, --keep-weekly, --keep-monthly) select the
+backups to keep; a backup is kept if any rule selects it. Without keep rules,
+every backup is kept unless a limit removes it. Limits (--max-age,
+--max-total-size) then delete the oldest of the selected backups.
+
+The newest backup is always kept, as is every backup that a kept incremental
+backup depends on.
+
+Examples:
+  # Show what a grandfather-father-son policy would delete
+  k8s-backup prune --keep-daily 7 --keep-weekly 4 --keep-monthly 12 --dry-run
+
+  # Keep the last 10 backups
+  k8s-backup prune --keep-last 10
+
+  # Delete backups older than 30 days from S3
+  k8s-backup prune --max-age 30d --storage s3://my-bucket/cluster-a
+
+  # Cap the space used by backups
+  k8s-backup prune --max-total-size 50Gi`,
+
+	Run: runPrune,
+}
+
+func init() {
+	rootCmd.AddCommand(pruneCmd)
+
+	// Prune-specific flags
+	pruneCmd.Flags().StringVar(&pruneStorage, "storage", "./backups", storageFlagUsage)
+	pruneCmd.Flags().BoolVar(&pruneDryRun, "dry-run", false, "show which backups would be deleted without deleting them")
+	addRetentionFlags(pruneCmd)
+}
+
+func runPrune(cmd *cobra.Command, args []string) {
+	policy := retentionPolicy()
+	if policy.Empty() {
+		log.Fatalf("At least one retention rule is required")
+	}
+
+	if verbose {
+		log.Printf("Pruning backups in: %s", pruneStorage)
+	}
+
+	decisions, err := retention.Prune(openStorage(pruneStorage), policy, time.Now(), pruneDryRun)
+	if err == nil && len(decisions) == 0 {
+		fmt.Printf("No backups found in %s\n", pruneStorage)
+		return
+	}
+	if decisions != nil {
+		printPruneDecisions(decisions, pruneDryRun)
+	}
+	if err != nil {
+		log.Fatalf("Prune failed: %v", err)
+	}
+}
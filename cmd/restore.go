@@ -3,15 +3,19 @@ package cmd
 import (
 	"context"
 	"fmt"
+	"io"
 	"log"
+	"os"
+	"sort"
 	"strings"
 	"time"
 
 	"github.com/spf13/cobra"
 
+	"k8s-backup/pkg/datamover"
 	"k8s-backup/pkg/k8s"
 	"k8s-backup/pkg/restore"
-	"k8s-backup/pkg/storage"
+	"k8s-backup/pkg/transform"
 	"k8s-backup/pkg/types"
 )
 
@@ -20,10 +24,22 @@ var (
 	restoreBackupPath    string
 	restoreNamespaces    []string
 	restoreResourceTypes []string
-	dryRun               bool
+	dryRun               string
 	waitForReady         bool
 	restoreTimeout       time.Duration
 	overwriteExisting    bool
+	fieldManager         string
+	forceConflicts       bool
+	restoreStorage       string
+	restoreSelector      string
+	namespaceMapping     []string
+	remapClusterScoped   bool
+	transformRules       string
+	existingPolicy       string
+	existingPolicyConfig string
+	skipVolumeSnapshots  bool
+	skipVolumeData       bool
+	restoreMoverImage    string
 )
 
 // restoreCmd represents the restore command
@@ -43,17 +59,48 @@ Examples:
   # Restore from a specific backup
   k8s-backup restore --backup ./backups/backup-2025-09-12-15-00-00
 
+  # Restore an encrypted backup
+  k8s-backup restore --identity ~/.config/k8s-backup/key.txt
+
+  # Only restore a backup signed by the matching private key
+  k8s-backup restore --verify-key ./signing.pub.pem
+
+  # Restore the latest backup stored in S3
+  k8s-backup restore --storage s3://my-bucket/cluster-a
+
   # Restore only specific namespaces
   k8s-backup restore --namespaces app1,app2
 
   # Restore only specific resource types
   k8s-backup restore --resource-types deployments,services
 
-  # Dry run to see what would be restored
+  # Restore prod into a new namespace to inspect it
+  k8s-backup restore --namespace-mapping prod:prod-restore,shop:shop-copy
+
+  # Rewrite images and storage classes for another cluster, previewing the
+  # transformed objects first
+  k8s-backup restore --transform-rules ./rules.yaml --dry-run
+
+  # Restore only resources whose labels matched when they were backed up
+  k8s-backup restore --selector app=payments
+
+  # Dry run to see what would be restored, without contacting the cluster
   k8s-backup restore --dry-run
 
+  # Have the API server validate and admit every resource without persisting it
+  k8s-backup restore --dry-run=server --overwrite
+
   # Wait for resources to become ready
-  k8s-backup restore --wait --timeout 300s`,
+  k8s-backup restore --wait --timeout 300s
+
+  # Overwrite existing resources, taking ownership of conflicting fields
+  k8s-backup restore --overwrite --force-conflicts
+
+  # Recreate existing resources, e.g. to change immutable fields
+  k8s-backup restore --existing-policy replace
+
+  # Choose per kind what happens to existing resources
+  k8s-backup restore --existing-policy-config ./existing-policy.yaml`,
 
 	Run: runRestore,
 }
@@ -65,21 +112,79 @@ func init() {
 	restoreCmd.Flags().StringVar(&restoreBackupPath, "backup", "", "path to backup directory or archive (default: latest backup)")
 	restoreCmd.Flags().StringSliceVar(&restoreNamespaces, "namespaces", []string{}, "comma-separated list of namespaces to restore (default: all from backup)")
 	restoreCmd.Flags().StringSliceVar(&restoreResourceTypes, "resource-types", []string{}, "comma-separated list of resource types to restore (default: all from backup)")
-	restoreCmd.Flags().BoolVar(&dryRun, "dry-run", false, "perform validation without applying changes")
-	restoreCmd.Flags().BoolVar(&waitForReady, "wait", false, "wait for resources to become ready after creation")
-	restoreCmd.Flags().DurationVar(&restoreTimeout, "timeout", 5*time.Minute, "timeout for waiting operations")
-	restoreCmd.Flags().BoolVar(&overwriteExisting, "overwrite", false, "overwrite existing resources if they already exist")
+	restoreCmd.Flags().StringVarP(&restoreSelector, "selector", "l", "", "label selector matched against the labels recorded in the backup")
+	restoreCmd.Flags().StringSliceVar(&namespaceMapping, "namespace-mapping", []string{}, "comma-separated source:target pairs of namespaces to restore into other namespaces")
+	restoreCmd.Flags().BoolVar(&remapClusterScoped, "remap-cluster-resources", false, "with --namespace-mapping, also rewrite namespace references in cluster-scoped objects such as ClusterRoleBindings and PersistentVolumes; they keep their names, so only use this when restoring into another cluster")
+	restoreCmd.Flags().StringVar(&transformRules, "transform-rules", "", "YAML file of transformations applied to every object before it is restored")
+	restoreCmd.Flags().StringVar(&dryRun, "dry-run", "none", "validate without applying changes: \"client\" (or true) parses resources offline, \"server\" sends them to the API server with dryRun=All")
+	restoreCmd.Flags().Lookup("dry-run").NoOptDefVal = "client"
+	restoreCmd.Flags().BoolVar(&waitForReady, "wait", false, "wait for the restored resources to become ready (rolled out, bound, completed, ...) once all are applied")
+	restoreCmd.Flags().DurationVar(&restoreTimeout, "timeout", 5*time.Minute, "timeout for waiting operations; readiness waits share it")
+	restoreCmd.Flags().BoolVar(&overwriteExisting, "overwrite", false, "overwrite existing resources if they already exist (same as --existing-policy=update)")
+	restoreCmd.Flags().StringVar(&existingPolicy, "existing-policy", "", "what to do with resources that already exist: skip, update, replace (delete and recreate), merge (three-way merge patch) or fail (default: skip)")
+	restoreCmd.Flags().StringVar(&existingPolicyConfig, "existing-policy-config", "", "YAML file with a default existing policy and per-kind overrides")
+	restoreCmd.Flags().BoolVar(&skipVolumeSnapshots, "skip-volume-snapshots", false, "restore PersistentVolumeClaims as backed up instead of provisioning them from the backup's volume snapshots")
+	restoreCmd.Flags().BoolVar(&skipVolumeData, "skip-volume-data", false, "restore PersistentVolumeClaims without copying the backup's volume data into them")
+	restoreCmd.Flags().StringVar(&restoreMoverImage, "data-mover-image", datamover.DefaultImage, "image of the helper pods that copy volume data; it needs tar")
+	restoreCmd.Flags().StringVar(&fieldManager, "field-manager", k8s.DefaultFieldManager, "field manager name used for server-side apply")
+	restoreCmd.Flags().StringVar(&restoreStorage, "storage", "./backups", storageFlagUsage)
+	restoreCmd.Flags().BoolVar(&forceConflicts, "force-conflicts", false, "take ownership of fields managed by other field managers when applying")
+	addEncryptionFlags(restoreCmd, false)
+	addSigningFlags(restoreCmd, false)
 }
 
 func runRestore(cmd *cobra.Command, args []string) {
 	ctx := context.Background()
 
+	mode, err := restore.ParseDryRunMode(dryRun)
+	if err != nil {
+		log.Fatalf("Invalid --dry-run: %v", err)
+	}
+	dryRun = mode
+	clientDryRun, serverDryRun := dryRun == "client", dryRun == "server"
+
+	mapping, err := restore.ParseNamespaceMapping(namespaceMapping)
+	if err != nil {
+		log.Fatalf("Invalid --namespace-mapping: %v", err)
+	}
+
+	policyConfig := &restore.PolicyConfig{}
+	if existingPolicyConfig != "" {
+		policyConfig, err = restore.LoadPolicyConfig(existingPolicyConfig)
+		if err != nil {
+			log.Fatalf("Failed to load existing policy: %v", err)
+		}
+	}
+	policy := policyConfig.Default
+	if existingPolicy != "" {
+		policy, err = types.ParseExistingPolicy(existingPolicy)
+		if err != nil {
+			log.Fatalf("Invalid --existing-policy: %v", err)
+		}
+	}
+
+	var pipeline transform.Pipeline
+	if transformRules != "" {
+		pipeline, err = transform.LoadRules(transformRules)
+		if err != nil {
+			log.Fatalf("Failed to load transform rules: %v", err)
+		}
+	}
+
+	// A dry run with transform rules prints the transformed objects to
+	// stdout, so progress and the summary go to stderr
+	var out io.Writer = os.Stdout
+	showTransformed := dryRun != "none" && pipeline != nil
+	if showTransformed {
+		out = os.Stderr
+	}
+
 	if verbose {
 		log.Printf("Starting restore operation")
 		if restoreBackupPath != "" {
 			log.Printf("Backup path: %s", restoreBackupPath)
 		} else {
-			log.Printf("Using latest backup from: ./backups")
+			log.Printf("Using latest backup from: %s", restoreStorage)
 		}
 		if len(restoreNamespaces) > 0 {
 			log.Printf("Namespaces: %s", strings.Join(restoreNamespaces, ", "))
@@ -87,13 +192,13 @@ func runRestore(cmd *cobra.Command, args []string) {
 		if len(restoreResourceTypes) > 0 {
 			log.Printf("Resource types: %s", strings.Join(restoreResourceTypes, ", "))
 		}
-		if dryRun {
-			log.Printf("Dry run mode enabled")
+		if dryRun != "none" {
+			log.Printf("Dry run mode enabled (%s)", dryRun)
 		}
 	}
 
 	// Initialize storage
-	storageBackend := storage.NewLocalStorage("./backups")
+	storageBackend := openEncryptedStorage(restoreStorage)
 
 	// Find backup path if not specified
 	if restoreBackupPath == "" {
@@ -102,7 +207,7 @@ func runRestore(cmd *cobra.Command, args []string) {
 			log.Fatalf("Failed to list backups: %v", err)
 		}
 		if len(backups) == 0 {
-			log.Fatalf("No backups found in ./backups")
+			log.Fatalf("No backups found in %s", restoreStorage)
 		}
 
 		// Find the most recent backup
@@ -119,11 +224,10 @@ func runRestore(cmd *cobra.Command, args []string) {
 		}
 	}
 
-	// Initialize Kubernetes client (not needed for dry run validation)
+	// Initialize Kubernetes client (not needed for client-side dry runs)
 	var client *k8s.Client
-	if !dryRun {
-		var err error
-		client, err = k8s.NewClient(kubeconfig)
+	if !clientDryRun {
+		client, err = newKubernetesClient()
 		if err != nil {
 			log.Fatalf("Failed to create Kubernetes client: %v", err)
 		}
@@ -131,22 +235,40 @@ func runRestore(cmd *cobra.Command, args []string) {
 
 	// Initialize restore manager
 	restoreManager := restore.NewManager(client, storageBackend)
+	if pipeline != nil {
+		restoreManager.SetTransformer(pipeline)
+	}
 
 	// Prepare restore options
 	options := &types.RestoreOptions{
-		BackupPath:        restoreBackupPath,
-		Namespaces:        restoreNamespaces,
-		ResourceTypes:     restoreResourceTypes,
-		DryRun:            dryRun,
-		Wait:              waitForReady,
-		Timeout:           restoreTimeout,
-		OverwriteExisting: overwriteExisting,
+		BackupPath:              restoreBackupPath,
+		Namespaces:              restoreNamespaces,
+		ResourceTypes:           restoreResourceTypes,
+		DryRun:                  clientDryRun,
+		ServerDryRun:            serverDryRun,
+		Wait:                    waitForReady,
+		Timeout:                 restoreTimeout,
+		OverwriteExisting:       overwriteExisting,
+		FieldManager:            fieldManager,
+		ForceConflicts:          forceConflicts,
+		LabelSelector:           restoreSelector,
+		NamespaceMapping:        mapping,
+		RemapClusterResources:   remapClusterScoped,
+		ExistingPolicy:          policy,
+		ExistingPolicyOverrides: policyConfig.Kinds,
+		SkipVolumeSnapshots:     skipVolumeSnapshots,
+		SkipVolumeData:          skipVolumeData,
+		DataMoverImage:          restoreMoverImage,
+	}
+	if showTransformed {
+		options.DryRunOutput = os.Stdout
 	}
 
 	// Progress callback
 	progressCallback := func(progress types.Progress) {
-		// Show progress every 5 items, when verbose, or when complete
-		if verbose || progress.Completed%5 == 0 || progress.Completed == progress.Total {
+		// Show progress every 5 items, when verbose, or when complete, unless
+		// it would be mixed into the transformed objects
+		if !showTransformed && (verbose || progress.Completed%5 == 0 || progress.Completed == progress.Total) {
 			fmt.Printf("\rProgress: %d/%d - %s", progress.Completed, progress.Total, progress.Current)
 			if progress.Completed == progress.Total {
 				fmt.Println()
@@ -165,28 +287,60 @@ func runRestore(cmd *cobra.Command, args []string) {
 	}
 
 	// Print success message
-	if dryRun {
-		fmt.Printf("\n✅ Dry run completed successfully!\n")
-		fmt.Printf("Would restore %d resources\n", result.ProcessedResources)
+	if serverDryRun {
+		printDryRunResults(out, result.DryRun)
+	}
+	if dryRun != "none" {
+		fmt.Fprintf(out, "\n✅ Dry run completed successfully!\n")
+		fmt.Fprintf(out, "Would restore %d resources\n", result.ProcessedResources)
 	} else {
-		fmt.Printf("\n✅ Restore completed successfully!\n")
-		fmt.Printf("Resources restored: %d\n", result.ProcessedResources)
+		fmt.Fprintf(out, "\n✅ Restore completed successfully!\n")
+		fmt.Fprintf(out, "Resources restored: %d\n", result.ProcessedResources)
 	}
 
 	if len(result.Namespaces) > 0 {
-		fmt.Printf("Namespaces: %s\n", strings.Join(result.Namespaces, ", "))
+		fmt.Fprintf(out, "Namespaces: %s\n", strings.Join(result.Namespaces, ", "))
+	}
+
+	if len(result.NamespaceMapping) > 0 {
+		sources := make([]string, 0, len(result.NamespaceMapping))
+		for source := range result.NamespaceMapping {
+			sources = append(sources, source)
+		}
+		sort.Strings(sources)
+		fmt.Fprintf(out, "Namespace mapping:\n")
+		for _, source := range sources {
+			fmt.Fprintf(out, "  %s -> %s\n", source, result.NamespaceMapping[source])
+		}
 	}
 
 	if len(result.ResourceTypes) > 0 {
-		fmt.Printf("Resource types: %s\n", strings.Join(result.ResourceTypes, ", "))
+		fmt.Fprintf(out, "Resource types: %s\n", strings.Join(result.ResourceTypes, ", "))
+	}
+
+	if result.RestoredVolumes > 0 {
+		fmt.Fprintf(out, "Volumes restored from snapshots: %d\n", result.RestoredVolumes)
+	}
+
+	if result.RestoredVolumeData > 0 {
+		fmt.Fprintf(out, "Volumes restored from volume data: %d\n", result.RestoredVolumeData)
 	}
 
 	if result.SkippedResources > 0 {
-		fmt.Printf("Skipped resources: %d\n", result.SkippedResources)
+		fmt.Fprintf(out, "Skipped resources: %d\n", result.SkippedResources)
+	}
+
+	printExistingActions(out, result.Actions)
+
+	if len(result.NotReady) > 0 {
+		fmt.Fprintf(out, "Resources not ready: %d\n", len(result.NotReady))
+		for _, notReady := range result.NotReady {
+			fmt.Fprintf(out, "  - %s\n", notReady.Error())
+		}
 	}
 
 	if len(result.Errors) > 0 {
-		fmt.Printf("Errors encountered: %d\n", len(result.Errors))
+		fmt.Fprintf(out, "Errors encountered: %d\n", len(result.Errors))
 		if verbose {
 			for _, err := range result.Errors {
 				log.Printf("Error: %v", err)
@@ -195,6 +349,54 @@ func runRestore(cmd *cobra.Command, args []string) {
 	}
 
 	if verbose {
-		fmt.Printf("Duration: %s\n", result.Duration.String())
+		fmt.Fprintf(out, "Duration: %s\n", result.Duration.String())
+	}
+}
+
+// printDryRunResults prints what a server-side dry run found for each resource
+func printDryRunResults(out io.Writer, results []restore.DryRunResult) {
+	fmt.Fprintf(out, "\nServer-side dry run:\n")
+	counts := make(map[restore.DryRunAction]int)
+	for _, result := range results {
+		counts[result.Action]++
+		name := result.Resource.Name
+		if result.Resource.Namespace != "" {
+			name = result.Resource.Namespace + "/" + name
+		}
+		line := fmt.Sprintf("  %-12s %s %s", result.Action, result.Resource.Kind, name)
+		switch {
+		case result.Err != nil:
+			line += ": " + result.Err.Error()
+		case result.Note != "":
+			line += " (" + result.Note + ")"
+		}
+		fmt.Fprintln(out, line)
+	}
+	fmt.Fprintf(out, "Would create: %d, update: %d, merge: %d, replace: %d, skip: %d, fail: %d\n",
+		counts[restore.WouldCreate], counts[restore.WouldUpdate], counts[restore.WouldMerge], counts[restore.WouldReplace],
+		counts[restore.WouldSkip], counts[restore.WouldFail])
+}
+
+// printExistingActions prints what was done with every resource that already
+// existed, and the existing policy that decided it. Failures are reported with
+// the other errors.
+func printExistingActions(out io.Writer, actions []restore.ResourceAction) {
+	var existing []restore.ResourceAction
+	for _, action := range actions {
+		if action.Action != restore.Created && action.Action != restore.Failed {
+			existing = append(existing, action)
+		}
+	}
+	if len(existing) == 0 {
+		return
+	}
+
+	fmt.Fprintf(out, "Existing resources:\n")
+	for _, action := range existing {
+		name := action.Resource.Name
+		if action.Resource.Namespace != "" {
+			name = action.Resource.Namespace + "/" + name
+		}
+		fmt.Fprintf(out, "  %-9s %s %s (policy %s)\n", action.Action, action.Resource.Kind, name, action.Policy)
 	}
 }
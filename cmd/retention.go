@@ -0,0 +1,90 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"k8s.io/apimachinery/pkg/api/resource"
+
+	"k8s-backup/pkg/retention"
+)
+
+var (
+	// Retention flags shared by prune and backup
+	keepLast     int
+	keepDaily    int
+	keepWeekly   int
+	keepMonthly  int
+	maxAge       string
+	maxTotalSize string
+)
+
+// addRetentionFlags registers the retention rule flags
+func addRetentionFlags(cmd *cobra.Command) {
+	cmd.Flags().IntVar(&keepLast, "keep-last", 0, "keep the n most recent backups")
+	cmd.Flags().IntVar(&keepDaily, "keep-daily", 0, "keep the newest backup of each of the last n days with backups")
+	cmd.Flags().IntVar(&keepWeekly, "keep-weekly", 0, "keep the newest backup of each of the last n weeks with backups")
+	cmd.Flags().IntVar(&keepMonthly, "keep-monthly", 0, "keep the newest backup of each of the last n months with backups")
+	cmd.Flags().StringVar(&maxAge, "max-age", "", "delete backups older than this (e.g. 720h or 30d)")
+	cmd.Flags().StringVar(&maxTotalSize, "max-total-size", "", "delete the oldest backups once their total size exceeds this (e.g. 50Gi)")
+}
+
+// retentionPolicy builds the policy selected by the retention flags
+func retentionPolicy() retention.Policy {
+	policy := retention.Policy{
+		KeepLast:    keepLast,
+		KeepDaily:   keepDaily,
+		KeepWeekly:  keepWeekly,
+		KeepMonthly: keepMonthly,
+	}
+
+	if maxAge != "" {
+		age, err := retention.ParseAge(maxAge)
+		if err != nil {
+			log.Fatalf("Invalid --max-age: %v", err)
+		}
+		policy.MaxAge = age
+	}
+	if maxTotalSize != "" {
+		size, err := resource.ParseQuantity(maxTotalSize)
+		if err != nil {
+			log.Fatalf("Invalid --max-total-size: %v", err)
+		}
+		policy.MaxTotalSize = size.Value()
+	}
+
+	return policy
+}
+
+// printPruneDecisions prints what happens to each backup and why
+func printPruneDecisions(decisions []*retention.Decision, dryRun bool) {
+	deleteAction := "delete"
+	if dryRun {
+		deleteAction = "would delete"
+	}
+
+	fmt.Printf("%-12s %-30s %-20s %-10s %s\n", "ACTION", "NAME", "CREATED", "SIZE", "REASON")
+	deleted := 0
+	for _, decision := range decisions {
+		action := "keep"
+		if !decision.Keep {
+			action = deleteAction
+			deleted++
+		}
+		fmt.Printf("%-12s %-30s %-20s %-10s %s\n",
+			action,
+			decision.Backup.Name,
+			decision.Backup.Timestamp.Format("2006-01-02 15:04:05"),
+			formatSize(decision.Backup.Size),
+			strings.Join(decision.Reasons, ", "),
+		)
+	}
+
+	if dryRun {
+		fmt.Printf("\n%d of %d backups would be deleted\n", deleted, len(decisions))
+	} else {
+		fmt.Printf("\n%d of %d backups deleted\n", deleted, len(decisions))
+	}
+}
@@ -1,9 +1,13 @@
 package cmd
 
 import (
+	"log"
 	"os"
 
 	"github.com/spf13/cobra"
+
+	"k8s-backup/pkg/k8s"
+	"k8s-backup/pkg/storage"
 )
 
 var (
@@ -11,6 +15,8 @@ var (
 	kubeconfig string
 	namespace  string
 	verbose    bool
+	qps        float32
+	burst      int
 )
 
 // rootCmd represents the base command when called without any subcommands
@@ -23,7 +29,7 @@ It can export your cluster's current state (deployments, services, configmaps, s
 into organized backup files and restore them later to bring your cluster back to its previous state.
 
 Features:
-- Backup cluster resources to local storage
+- Backup cluster resources to local storage or S3-compatible object storage
 - Selective backups by namespace or resource type
 - Restore from backup files with dependency ordering
 - List and manage existing backups
@@ -44,5 +50,24 @@ func init() {
 	rootCmd.PersistentFlags().StringVar(&kubeconfig, "kubeconfig", "", "path to kubeconfig file (default: $HOME/.kube/config)")
 	rootCmd.PersistentFlags().StringVarP(&namespace, "namespace", "n", "", "kubernetes namespace (default: all namespaces)")
 	rootCmd.PersistentFlags().BoolVarP(&verbose, "verbose", "v", false, "verbose output")
+	rootCmd.PersistentFlags().Float32Var(&qps, "qps", k8s.DefaultQPS, "maximum requests per second to the Kubernetes API server")
+	rootCmd.PersistentFlags().IntVar(&burst, "burst", k8s.DefaultBurst, "maximum burst of requests to the Kubernetes API server")
+
+}
+
+// storageFlagUsage describes the --storage flag shared by commands that read or write backups
+const storageFlagUsage = "backup storage location: a local directory or s3://bucket/prefix[?endpoint=URL&region=REGION&pathStyle=true]"
 
+// newKubernetesClient creates a Kubernetes client from the global flags
+func newKubernetesClient() (*k8s.Client, error) {
+	return k8s.NewClientWithOptions(kubeconfig, k8s.ClientOptions{QPS: qps, Burst: burst})
+}
+
+// openStorage opens the storage backend for a location, exiting on failure
+func openStorage(location string) storage.Storage {
+	storageBackend, err := storage.Open(location)
+	if err != nil {
+		log.Fatalf("Failed to open storage %s: %v", location, err)
+	}
+	return storageBackend
 }
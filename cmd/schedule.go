@@ -0,0 +1,210 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"k8s-backup/pkg/backup"
+	"k8s-backup/pkg/hooks"
+	"k8s-backup/pkg/k8s"
+	"k8s-backup/pkg/retention"
+	"k8s-backup/pkg/schedule"
+	"k8s-backup/pkg/storage"
+)
+
+var (
+	// Schedule-specific flags
+	scheduleFile      string
+	scheduleStorage   string
+	scheduleStateFile string
+	scheduleStatus    bool
+)
+
+// scheduleCmd represents the schedule command
+var scheduleCmd = &cobra.Command{
+	Use:   "schedule",
+	Short: "Run backups on cron schedules",
+	Long: `Run as a long-lived daemon that takes backups on the cron schedules of a
+schedule file, applying each schedule's retention policy after every
+successful backup.
+
+Each schedule has a name, a five-field cron expression evaluated in its time
+zone (default UTC), the options of its backups and an optional storage
+location and retention policy. Backups are named after the schedule and
+their scheduled time in UTC, e.g. nightly-20250912-020000, and retention only
+ever deletes backups taken by the same schedule.
+
+Runs of a schedule never overlap: when a backup takes longer than the
+interval, the runs it missed are coalesced into one that starts as soon as it
+completes. The status of every schedule is saved to --state-file, so after a
+restart the latest run missed while the daemon was down, or a run it
+interrupted, is caught up, unless it is older than the schedule's
+startingDeadline.
+
+Example schedule file:
+
+  schedules:
+    - name: nightly
+      schedule: "0 2 * * *"
+      timeZone: Europe/Berlin
+      jitter: 5m
+      startingDeadline: 6h
+      backup:
+        namespaces: [shop]
+        snapshotVolumes: true
+        hooksFile: ./hooks.yaml
+      retention:
+        keepDaily: 7
+        keepWeekly: 4
+    - name: hourly-config
+      schedule: "@hourly"
+      storage: s3://my-bucket/cluster-a
+      backup:
+        resourceTypes: [configmaps, secrets]
+      retention:
+        maxAge: 2d
+
+Examples:
+  # Run the schedules of a file, storing backups in ./backups by default
+  k8s-backup schedule --file ./schedules.yaml
+
+  # Encrypt scheduled backups to an age recipient
+  k8s-backup schedule --file ./schedules.yaml --recipient age1ql3z7hjy54pw3hyww5ayyfg7zqgvc7w3j2elw8zmrj2kg5sfn9aqmcac8p
+
+  # Show when each schedule last ran and runs next
+  k8s-backup schedule --file ./schedules.yaml --status`,
+
+	Run: runSchedule,
+}
+
+func init() {
+	rootCmd.AddCommand(scheduleCmd)
+
+	// Schedule-specific flags
+	scheduleCmd.Flags().StringVarP(&scheduleFile, "file", "f", "", "YAML file of the schedules to run")
+	scheduleCmd.Flags().StringVar(&scheduleStorage, "storage", "./backups", storageFlagUsage+"; used by schedules without a storage of their own")
+	scheduleCmd.Flags().StringVar(&scheduleStateFile, "state-file", "./schedule-state.json", "file the status of every schedule is saved to")
+	scheduleCmd.Flags().BoolVar(&scheduleStatus, "status", false, "print the status of every schedule and exit")
+	scheduleCmd.MarkFlagRequired("file")
+	addEncryptionFlags(scheduleCmd, true)
+	addSigningFlags(scheduleCmd, true)
+}
+
+func runSchedule(cmd *cobra.Command, args []string) {
+	schedules, err := schedule.LoadFile(scheduleFile)
+	if err != nil {
+		log.Fatalf("Failed to load schedules: %v", err)
+	}
+	state, err := schedule.LoadState(scheduleStateFile)
+	if err != nil {
+		log.Fatalf("Failed to load schedule state: %v", err)
+	}
+
+	if scheduleStatus {
+		printScheduleStatus(schedules, state, time.Now())
+		return
+	}
+
+	// Open every storage and load every hooks file up front, so mistakes
+	// show at startup rather than at the first run
+	runner := &scheduleRunner{
+		storages: make(map[string]storage.Storage),
+		hooks:    make(map[string]*hooks.Config),
+	}
+	for _, s := range schedules {
+		location := s.Storage
+		if location == "" {
+			location = scheduleStorage
+		}
+		runner.storages[s.Name] = openEncryptedStorage(location)
+
+		config, err := s.Backup.HookConfig()
+		if err != nil {
+			log.Fatalf("Failed to load hooks of schedule %s: %v", s.Name, err)
+		}
+		if config != nil {
+			runner.hooks[s.Name] = config
+		}
+	}
+
+	runner.client, err = newKubernetesClient()
+	if err != nil {
+		log.Fatalf("Failed to create Kubernetes client: %v", err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	log.Printf("Running %d schedules, saving their status to %s", len(schedules), scheduleStateFile)
+	schedule.NewScheduler(schedules, runner, state).Run(ctx)
+	log.Printf("Stopped")
+}
+
+// scheduleRunner takes the backups of the schedule command and applies
+// retention after each
+type scheduleRunner struct {
+	client   *k8s.Client
+	storages map[string]storage.Storage
+	hooks    map[string]*hooks.Config
+}
+
+// RunBackup implements schedule.Runner
+func (r *scheduleRunner) RunBackup(ctx context.Context, s *schedule.Schedule, backupName string) error {
+	storageBackend := r.storages[s.Name]
+	backupManager := backup.NewManager(r.client, storageBackend)
+	backupManager.SetHooks(r.hooks[s.Name])
+
+	metadata, err := backupManager.CreateBackup(ctx, s.Options(backupName), nil)
+	if err != nil {
+		return err
+	}
+	log.Printf("Schedule %s: backed up %d resources (%s) to %s", s.Name, metadata.TotalResources, formatSize(metadata.Size), metadata.BackupPath)
+
+	policy := s.Policy()
+	if policy.Empty() {
+		return nil
+	}
+	decisions, err := retention.PruneSchedule(storageBackend, s.Name, policy, time.Now(), false)
+	for _, decision := range decisions {
+		if !decision.Keep {
+			log.Printf("Schedule %s: deleted backup %s", s.Name, decision.Backup.Name)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("failed to apply retention: %w", err)
+	}
+	return nil
+}
+
+// printScheduleStatus prints when each schedule last ran and runs next
+func printScheduleStatus(schedules []*schedule.Schedule, state *schedule.State, now time.Time) {
+	fmt.Printf("%-20s %-20s %-20s %-12s %-35s %s\n", "NAME", "SCHEDULE", "NEXT RUN", "LAST RUN", "LAST BACKUP", "LAST SUCCESS")
+	for _, s := range schedules {
+		next := "-"
+		if t := s.Next(now); !t.IsZero() {
+			next = t.Local().Format("2006-01-02 15:04")
+		}
+		lastRun, lastBackup, lastSuccess := "-", "-", "-"
+		if status, ok := state.Get(s.Name); ok {
+			lastRun = string(status.Phase)
+			lastBackup = status.LastBackup
+			if !status.LastSuccessTime.IsZero() {
+				lastSuccess = formatDuration(now.Sub(status.LastSuccessTime)) + " ago"
+			}
+		}
+		fmt.Printf("%-20s %-20s %-20s %-12s %-35s %s\n", s.Name, s.Schedule, next, lastRun, lastBackup, lastSuccess)
+	}
+
+	for _, s := range schedules {
+		if status, ok := state.Get(s.Name); ok && status.Error != "" {
+			fmt.Printf("\n%s: %s\n", s.Name, status.Error)
+		}
+	}
+}
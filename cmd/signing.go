@@ -0,0 +1,57 @@
+package cmd
+
+import (
+	"log"
+
+	"github.com/spf13/cobra"
+
+	"k8s-backup/pkg/storage"
+)
+
+var (
+	// Signing flags shared by commands that read or write backup contents
+	signingKeyFile string
+	verifyKeyFile  string
+)
+
+// signer is implemented by storage backends that sign and verify manifests
+type signer interface {
+	SetSigning(signing storage.Signing)
+}
+
+// addSigningFlags registers the manifest signing flags. Commands that write
+// backups take a private key; commands that read them take a public key.
+func addSigningFlags(cmd *cobra.Command, writesBackups bool) {
+	if writesBackups {
+		cmd.Flags().StringVar(&signingKeyFile, "signing-key", "", "PEM ed25519 private key to sign the backup manifest with")
+	} else {
+		cmd.Flags().StringVar(&verifyKeyFile, "verify-key", "", "PEM ed25519 public key; when set, the backup manifest must carry a valid signature")
+	}
+}
+
+// applySigning configures a storage backend with the keys selected by the
+// signing flags
+func applySigning(backend storage.Storage) {
+	if signingKeyFile == "" && verifyKeyFile == "" {
+		return
+	}
+
+	var signing storage.Signing
+	var err error
+	if signingKeyFile != "" {
+		if signing.PrivateKey, err = storage.LoadSigningKey(signingKeyFile); err != nil {
+			log.Fatalf("Failed to load signing key: %v", err)
+		}
+	}
+	if verifyKeyFile != "" {
+		if signing.PublicKey, err = storage.LoadVerificationKey(verifyKeyFile); err != nil {
+			log.Fatalf("Failed to load verification key: %v", err)
+		}
+	}
+
+	s, ok := backend.(signer)
+	if !ok {
+		log.Fatalf("Storage backend does not support signed backups")
+	}
+	s.SetSigning(signing)
+}
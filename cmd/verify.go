@@ -0,0 +1,139 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/spf13/cobra"
+
+	"k8s-backup/pkg/storage"
+	"k8s-backup/pkg/types"
+)
+
+var (
+	// Verify-specific flags
+	verifyStorage string
+)
+
+// verifyCmd represents the verify command
+var verifyCmd = &cobra.Command{
+	Use:   "verify <backup>",
+	Short: "Check the integrity of a backup",
+	Long: `Check the integrity of a backup without restoring it.
+
+Every file is checked against the checksums recorded in the manifest, the
+manifest is checked against its digest (and signature, with --verify-key), and
+every resource is parsed. Missing, corrupt, extra and invalid entries are
+reported and the command exits with a non-zero status if any are found.
+
+The backup can be given as a name, a path or an s3:// URL.
+
+Examples:
+  # Verify a local backup
+  k8s-backup verify backup-2025-09-12-15-00-00
+
+  # Verify a signed backup stored in S3
+  k8s-backup verify backup-2025-09-12-15-00-00 --storage s3://my-bucket/cluster-a --verify-key ./signing.pub.pem
+
+  # Verify an encrypted backup, including its decrypted contents
+  k8s-backup verify ./backups/backup-2025-09-12-15-00-00.tar.gz --key-file ./backup.key`,
+
+	Args: cobra.ExactArgs(1),
+	Run:  runVerify,
+}
+
+func init() {
+	rootCmd.AddCommand(verifyCmd)
+
+	// Verify-specific flags
+	verifyCmd.Flags().StringVar(&verifyStorage, "storage", "./backups", storageFlagUsage)
+	addEncryptionFlags(verifyCmd, false)
+	addSigningFlags(verifyCmd, false)
+}
+
+func runVerify(cmd *cobra.Command, args []string) {
+	storageBackend := openEncryptedStorage(verifyStorage)
+	backupPath := resolveBackupPath(storageBackend, args[0])
+
+	if verbose {
+		log.Printf("Verifying backup: %s", backupPath)
+	}
+
+	report, err := storageBackend.VerifyBackup(context.Background(), backupPath, storage.ValidateResource)
+	if err != nil {
+		log.Fatalf("Failed to verify backup: %v", err)
+	}
+
+	printVerificationReport(report)
+	if !report.OK() {
+		os.Exit(1)
+	}
+}
+
+// resolveBackupPath returns the path of the backup with the given name, or
+// the argument itself when no listed backup has that name
+func resolveBackupPath(storageBackend storage.Storage, backup string) string {
+	if metadata, err := storage.FindBackup(storageBackend, backup); err == nil {
+		return metadata.BackupPath
+	}
+	return backup
+}
+
+func printVerificationReport(report *types.VerificationReport) {
+	if report.Manifest != nil {
+		fmt.Printf("Backup: %s\n", report.Manifest.Metadata.Name)
+		fmt.Printf("Resources: %d (%d verified)\n", len(report.Manifest.Resources), report.Verified-len(report.Invalid))
+		if len(report.Manifest.Volumes) > 0 {
+			failed := 0
+			for _, volume := range report.Manifest.Volumes {
+				if volume.Phase != types.VolumeDataCompleted {
+					failed++
+				}
+			}
+			fmt.Printf("Volume data: %d (%d verified, %d failed during backup)\n", len(report.Manifest.Volumes), report.VerifiedVolumes, failed)
+		}
+	}
+
+	if report.ManifestVerified {
+		fmt.Printf("Manifest digest: ok\n")
+	} else {
+		fmt.Printf("Manifest digest: not verified\n")
+	}
+	switch {
+	case report.SignatureVerified:
+		fmt.Printf("Signature: valid\n")
+	case report.Signed:
+		fmt.Printf("Signature: present, not checked\n")
+	default:
+		fmt.Printf("Signature: none\n")
+	}
+
+	printPaths := func(label string, paths []string) {
+		if len(paths) == 0 {
+			return
+		}
+		fmt.Printf("%s (%d):\n", label, len(paths))
+		for _, path := range paths {
+			fmt.Printf("  - %s\n", path)
+		}
+	}
+	printPaths("Missing", report.Missing)
+	printPaths("Corrupt", report.Corrupt)
+	printPaths("Extra", report.Extra)
+	printPaths("Invalid", report.Invalid)
+
+	for _, warning := range report.Warnings {
+		fmt.Printf("Warning: %s\n", warning)
+	}
+	for _, err := range report.Errors {
+		fmt.Printf("Error: %v\n", err)
+	}
+
+	if report.OK() {
+		fmt.Printf("\n✅ Backup verified successfully\n")
+	} else {
+		fmt.Printf("\n❌ Backup failed verification\n")
+	}
+}
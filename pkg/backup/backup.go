@@ -2,29 +2,37 @@ package backup
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io"
 	"log"
-	"reflect"
 	"sort"
 	"strings"
 	"time"
 
-	corev1 "k8s.io/api/core/v1"
-	rbacv1 "k8s.io/api/rbac/v1"
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/schema"
 	"sigs.k8s.io/yaml"
 
+	"k8s-backup/pkg/datamover"
+	"k8s-backup/pkg/hooks"
 	"k8s-backup/pkg/k8s"
+	"k8s-backup/pkg/snapshot"
 	"k8s-backup/pkg/storage"
 	"k8s-backup/pkg/types"
 )
 
 // Manager handles backup operations
 type Manager struct {
-	k8sClient *k8s.Client
-	storage   storage.Storage
+	k8sClient  *k8s.Client
+	storage    storage.Storage
+	hookConfig *hooks.Config
 }
 
 // NewManager creates a new backup manager
@@ -35,10 +43,24 @@ func NewManager(k8sClient *k8s.Client, storage storage.Storage) *Manager {
 	}
 }
 
+// SetHooks sets the hooks run in matching pods around every backup, in
+// addition to those declared through pod annotations
+func (m *Manager) SetHooks(config *hooks.Config) {
+	m.hookConfig = config
+}
+
 // CreateBackup performs a backup operation with the given options
 func (m *Manager) CreateBackup(ctx context.Context, options *types.BackupOptions, progressCallback types.ProgressCallback) (*types.BackupMetadata, error) {
 	log.Printf("Starting backup: %s", options.BackupName)
 
+	selectors, labelSelector, err := listSelectors(options)
+	if err != nil {
+		return nil, err
+	}
+	if err := datamover.ValidateSelection(options.VolumeData); err != nil {
+		return nil, err
+	}
+
 	// Get Kubernetes version
 	k8sVersion, err := m.k8sClient.GetServerVersion()
 	if err != nil {
@@ -52,17 +74,18 @@ func (m *Manager) CreateBackup(ctx context.Context, options *types.BackupOptions
 	}
 
 	// Get resource types to backup
-	resourceTypesToBackup := m.getResourceTypesToBackup(options)
-
-	// Estimate total resources for better memory allocation
-	estimatedTotal := m.estimateResourceCount(len(namespacesToBackup), resourceTypesToBackup)
+	resourceTypesToBackup, err := m.getResourceTypesToBackup(options)
+	if err != nil {
+		return nil, fmt.Errorf("failed to determine resource types to backup: %w", err)
+	}
 
-	// Pre-allocate slices for better memory efficiency
-	allResources := make([]types.ResourceWithContent, 0, estimatedTotal)
-	var errors []error
+	// One List call per resource type. When backing up all namespaces,
+	// namespaced types are listed across the cluster and bucketed client-side
+	// rather than listed once per namespace.
+	tasks := listTasks(namespacesToBackup, resourceTypesToBackup, len(options.Namespaces) == 0, selectors)
 
 	progress := types.Progress{
-		Total:     estimatedTotal,
+		Total:     len(tasks),
 		Completed: 0,
 		Current:   "Starting backup...",
 		Errors:    []error{},
@@ -72,22 +95,9 @@ func (m *Manager) CreateBackup(ctx context.Context, options *types.BackupOptions
 		progressCallback(progress)
 	}
 
-	// Backup cluster-scoped resources first
-	clusterResources, clusterErrors := m.backupClusterScopedResources(ctx, resourceTypesToBackup)
-	allResources = append(allResources, clusterResources...)
-	errors = append(errors, clusterErrors...)
-	m.updateProgress(&progress, len(clusterResources), fmt.Sprintf("Backed up %d cluster resources", len(clusterResources)), progressCallback)
-
-	// Backup namespaced resources
-	for _, ns := range namespacesToBackup {
-		if ctx.Err() != nil {
-			return nil, ctx.Err()
-		}
-
-		nsResources, nsErrors := m.backupNamespacedResources(ctx, ns, resourceTypesToBackup)
-		allResources = append(allResources, nsResources...)
-		errors = append(errors, nsErrors...)
-		m.updateProgress(&progress, len(allResources), fmt.Sprintf("Backed up namespace: %s (%d resources)", ns, len(nsResources)), progressCallback)
+	resourceTypeNames := make([]string, 0, len(resourceTypesToBackup))
+	for _, rt := range resourceTypesToBackup {
+		resourceTypeNames = append(resourceTypeNames, rt.String())
 	}
 
 	// Create backup metadata
@@ -97,33 +107,207 @@ func (m *Manager) CreateBackup(ctx context.Context, options *types.BackupOptions
 		Version:           types.BackupFormatVersion,
 		KubernetesVersion: k8sVersion,
 		Namespaces:        namespacesToBackup,
-		ResourceTypes:     resourceTypesToBackup,
-		TotalResources:    len(allResources),
+		ResourceTypes:     resourceTypeNames,
 		BackupPath:        "",
 		Size:              0,
 		Compress:          options.Compress,
+		Schedule:          options.Schedule,
+	}
+
+	// Incremental backups only store what changed since the parent
+	var parent *parentState
+	if options.IncrementalFrom != "" {
+		m.updateProgress(&progress, progress.Completed, fmt.Sprintf("Reading parent backup %s...", options.IncrementalFrom), progressCallback)
+
+		parent, err = m.loadParentState(ctx, options.IncrementalFrom, metadata)
+		if err != nil {
+			return nil, fmt.Errorf("failed to prepare incremental backup: %w", err)
+		}
+	}
+
+	// Pre hooks run before anything is captured. Post hooks run once
+	// everything has been, or when the backup fails.
+	hookRunner := hooks.NewRunner(m.k8sClient, m.hookConfig)
+	defer func() {
+		if err := hookRunner.RunPost(ctx); err != nil {
+			log.Printf("Warning: %v", err)
+		}
+	}()
+	if !options.SkipHooks {
+		m.updateProgress(&progress, progress.Completed, "Running pre-backup hooks...", progressCallback)
+
+		pods, err := hookRunner.Pods(ctx, namespacesToBackup, len(options.Namespaces) == 0, options.LabelSelector)
+		if err != nil {
+			return nil, fmt.Errorf("failed to run hooks: %w", err)
+		}
+		if err := hookRunner.RunPre(ctx, pods); err != nil {
+			return nil, err
+		}
+	}
+
+	// Resources are written to storage as they are collected
+	writer, err := m.storage.OpenBackupWriter(ctx, metadata)
+	if err != nil {
+		return nil, fmt.Errorf("failed to save backup: %w", err)
+	}
+
+	collected, written := 0, 0
+	var claims, dataClaims []*unstructured.Unstructured
+	warnings, err := m.collectResources(ctx, tasks, namespacesToBackup, options.Concurrency, &progress, progressCallback, func(resource types.ResourceWithContent) error {
+		collected++
+		// Claims are snapshotted or have their data copied whether or not
+		// their object changed
+		if resource.Info.APIVersion == "v1" && resource.Info.Kind == "PersistentVolumeClaim" {
+			if claim, ok := resource.Object.(*unstructured.Unstructured); ok {
+				switch {
+				case datamover.Selected(claim, options.VolumeData):
+					dataClaims = append(dataClaims, claim)
+				case options.SnapshotVolumes:
+					claims = append(claims, claim)
+				}
+			}
+		}
+		if parent != nil && !parent.changed(resource) {
+			return nil
+		}
+		written++
+		if err := writer.WriteResource(ctx, resource); err != nil {
+			return fmt.Errorf("failed to save backup: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		writer.Abort()
+		return nil, err
+	}
+
+	metadata.TotalResources = collected
+	if parent != nil {
+		// Resources that failed to be listed are not recorded as deleted
+		metadata.Deleted = parent.deleted(backupScope(namespacesToBackup, resourceTypesToBackup, labelSelector, failedTasks(warnings)))
+		metadata.TotalResources = parent.total(metadata.Deleted)
+		log.Printf("Incremental backup against %s: %d changed, %d deleted", metadata.Parent, written, len(metadata.Deleted))
+	}
+
+	// Snapshot the data of every backed up claim
+	if len(claims) > 0 {
+		m.updateProgress(&progress, progress.Completed, fmt.Sprintf("Snapshotting %d volumes...", len(claims)), progressCallback)
+
+		snapshots, snapshotWarnings, err := snapshot.NewManager(m.k8sClient).SnapshotClaims(ctx, metadata.Name, claims, options.SnapshotTimeout)
+		if err != nil {
+			writer.Abort()
+			return nil, fmt.Errorf("failed to snapshot volumes: %w", err)
+		}
+		for _, warning := range snapshotWarnings {
+			log.Printf("Warning: %v", warning)
+		}
+		warnings = append(warnings, snapshotWarnings...)
+		metadata.VolumeSnapshots = snapshots
+	}
+
+	// Copy the files of the claims selected for the data mover
+	if len(dataClaims) > 0 {
+		dataWarnings, err := m.backupVolumeData(ctx, writer, metadata.Name, dataClaims, options, &progress, progressCallback)
+		if err != nil {
+			writer.Abort()
+			return nil, fmt.Errorf("failed to save volume data: %w", err)
+		}
+		warnings = append(warnings, dataWarnings...)
+	}
+
+	if !options.SkipHooks {
+		m.updateProgress(&progress, progress.Completed, "Running post-backup hooks...", progressCallback)
+	}
+	err = hookRunner.RunPost(ctx)
+	metadata.Hooks = hookRunner.Results()
+	warnings = append(warnings, hookRunner.Warnings()...)
+	if err != nil {
+		writer.Abort()
+		return nil, err
 	}
 
 	// Save backup
 	m.updateProgress(&progress, progress.Completed, "Saving backup files...", progressCallback)
 
-	err = m.storage.SaveBackup(ctx, metadata, allResources)
-	if err != nil {
+	if err := writer.Commit(ctx); err != nil {
 		return nil, fmt.Errorf("failed to save backup: %w", err)
 	}
 
-	// Final progress report
+	// Final progress report, carrying the warnings of the whole backup
+	progress.Errors = warnings
 	m.updateProgress(&progress, progress.Completed, "Backup completed", progressCallback)
 
 	log.Printf("Backup completed: %s (%d resources)", metadata.Name, metadata.TotalResources)
 
-	if len(errors) > 0 {
-		log.Printf("Backup completed with %d warnings", len(errors))
+	if len(warnings) > 0 {
+		log.Printf("Backup completed with %d warnings", len(warnings))
 	}
 
 	return metadata, nil
 }
 
+// backupVolumeData streams the files of each claim from a helper pod into the
+// backup. Copies that fail are recorded in the manifest and returned as
+// warnings; an error means the backup can no longer be written.
+func (m *Manager) backupVolumeData(ctx context.Context, writer storage.BackupWriter, backupName string, claims []*unstructured.Unstructured, options *types.BackupOptions, progress *types.Progress, progressCallback types.ProgressCallback) ([]error, error) {
+	mover := datamover.NewMover(m.k8sClient)
+	mover.SetImage(options.DataMoverImage)
+	mover.SetTimeout(options.VolumeDataTimeout)
+
+	var warnings []error
+	for i, claim := range claims {
+		volume := types.VolumeDataInfo{Namespace: claim.GetNamespace(), PersistentVolumeClaim: claim.GetName(), StartTime: time.Now()}
+		message := fmt.Sprintf("Copying volume data %s (%d/%d)", volume.Key(), i+1, len(claims))
+		m.updateProgress(progress, progress.Completed, message+"...", progressCallback)
+
+		// The helper pod writes into a pipe the backup is read from
+		pipeReader, pipeWriter := io.Pipe()
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			pipeWriter.CloseWithError(mover.BackupVolume(ctx, backupName, volume.Namespace, volume.PersistentVolumeClaim, pipeWriter))
+		}()
+		data := &progressReader{Reader: pipeReader, report: func(bytes int64) {
+			m.updateProgress(progress, progress.Completed, fmt.Sprintf("%s: %d bytes copied", message, bytes), progressCallback)
+		}}
+		volume, err := writer.WriteVolume(ctx, volume, data)
+		pipeReader.CloseWithError(errVolumeWritten)
+		<-done
+
+		if err != nil && volume.Phase != types.VolumeDataFailed {
+			return warnings, err
+		}
+		if err != nil {
+			log.Printf("Warning: %v", err)
+			warnings = append(warnings, err)
+			continue
+		}
+		log.Printf("Copied volume data %s: %d bytes, %s", volume.Key(), volume.Size, volume.Checksum)
+	}
+	return warnings, nil
+}
+
+// errVolumeWritten stops a helper pod whose data is no longer read
+var errVolumeWritten = errors.New("volume data is no longer read")
+
+// progressReader reports how much has been read at most once a second
+type progressReader struct {
+	io.Reader
+	report   func(bytes int64)
+	bytes    int64
+	reported time.Time
+}
+
+func (r *progressReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.bytes += int64(n)
+	if now := time.Now(); now.Sub(r.reported) >= time.Second {
+		r.reported = now
+		r.report(r.bytes)
+	}
+	return n, err
+}
+
 // updateProgress centralizes progress update logic
 func (m *Manager) updateProgress(progress *types.Progress, completed int, message string, callback types.ProgressCallback) {
 	progress.Completed = completed
@@ -133,61 +317,47 @@ func (m *Manager) updateProgress(progress *types.Progress, completed int, messag
 	}
 }
 
-// estimateResourceCount provides memory pre-allocation estimates
-func (m *Manager) estimateResourceCount(namespaceCount int, resourceTypes []string) int {
-	estimates := map[string]int{
-		// Cluster-scoped resources
-		"namespaces":          namespaceCount + 10,
-		"clusterroles":        50,
-		"clusterrolebindings": 50,
-		"persistentvolumes":   20,
-		"storageclasses":      20,
-		// Namespaced resources (per namespace)
-		"deployments":            10,
-		"services":               10,
-		"configmaps":             20,
-		"secrets":                20,
-		"persistentvolumeclaims": 5,
-		"serviceaccounts":        5,
-		"roles":                  5,
-		"rolebindings":           5,
-		"ingresses":              5,
-		"networkpolicies":        5,
-		"statefulsets":           5,
-		"daemonsets":             5,
-		"jobs":                   5,
-		"cronjobs":               5,
-		"poddisruptionbudgets":   5,
-	}
-
-	total := 0
-	for _, rt := range resourceTypes {
-		if estimate, exists := estimates[rt]; exists {
-			if types.IsClusterScoped(rt) {
-				total += estimate
-			} else {
-				total += estimate * namespaceCount
-			}
-		} else {
-			// Default estimate for unknown resources
-			if types.IsClusterScoped(rt) {
-				total += 10
-			} else {
-				total += 5 * namespaceCount
-			}
-		}
+// listSelectors validates the label and field selectors of a backup and
+// returns them as the options of every List call, along with the parsed
+// label selector
+func listSelectors(options *types.BackupOptions) (metav1.ListOptions, labels.Selector, error) {
+	labelSelector, err := labels.Parse(options.LabelSelector)
+	if err != nil {
+		return metav1.ListOptions{}, nil, fmt.Errorf("invalid selector: %w", err)
 	}
-
-	if total < 100 {
-		return 100
+	if _, err := fields.ParseSelector(options.FieldSelector); err != nil {
+		return metav1.ListOptions{}, nil, fmt.Errorf("invalid field selector: %w", err)
+	}
+	if _, err := labels.Parse(options.NamespaceSelector); err != nil {
+		return metav1.ListOptions{}, nil, fmt.Errorf("invalid namespace selector: %w", err)
+	}
+	// An object missing from an incremental backup is only known to be
+	// deleted if the selectors can be evaluated against the parent's manifest
+	if options.FieldSelector != "" && options.IncrementalFrom != "" {
+		return metav1.ListOptions{}, nil, fmt.Errorf("field selectors cannot be used with incremental backups")
 	}
-	return total
+	return metav1.ListOptions{LabelSelector: options.LabelSelector, FieldSelector: options.FieldSelector}, labelSelector, nil
 }
 
 // getNamespacesToBackup determines which namespaces to include in the backup
 func (m *Manager) getNamespacesToBackup(ctx context.Context, options *types.BackupOptions) ([]string, error) {
-	// Get all namespaces
-	allNamespaces, err := m.k8sClient.Clientset().CoreV1().Namespaces().List(ctx, metav1.ListOptions{})
+	// Get all namespaces, or those matching the namespace selector
+	var allNamespaces []string
+	selected := make(map[string]bool)
+	list := func(ctx context.Context, options metav1.ListOptions) (runtime.Object, error) {
+		return m.k8sClient.Clientset().CoreV1().Namespaces().List(ctx, options)
+	}
+	err := listPages(ctx, list, metav1.ListOptions{LabelSelector: options.NamespaceSelector}, func(items []runtime.Object, _ string) error {
+		for _, obj := range items {
+			accessor, err := meta.Accessor(obj)
+			if err != nil {
+				return err
+			}
+			allNamespaces = append(allNamespaces, accessor.GetName())
+			selected[accessor.GetName()] = true
+		}
+		return nil
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -201,15 +371,15 @@ func (m *Manager) getNamespacesToBackup(ctx context.Context, options *types.Back
 	// If specific namespaces are specified, use only those
 	if len(options.Namespaces) > 0 {
 		for _, ns := range options.Namespaces {
-			if !excludeMap[ns] {
+			if !excludeMap[ns] && (options.NamespaceSelector == "" || selected[ns]) {
 				namespacesToBackup = append(namespacesToBackup, ns)
 			}
 		}
 	} else {
 		// Include all namespaces except excluded ones
-		for _, ns := range allNamespaces.Items {
-			if !excludeMap[ns.Name] {
-				namespacesToBackup = append(namespacesToBackup, ns.Name)
+		for _, ns := range allNamespaces {
+			if !excludeMap[ns] {
+				namespacesToBackup = append(namespacesToBackup, ns)
 			}
 		}
 	}
@@ -218,135 +388,212 @@ func (m *Manager) getNamespacesToBackup(ctx context.Context, options *types.Back
 	return namespacesToBackup, nil
 }
 
-// getResourceTypesToBackup determines which resource types to include
-func (m *Manager) getResourceTypesToBackup(options *types.BackupOptions) []string {
-	excludeMap := make(map[string]bool)
-	for _, rt := range options.ExcludeResourceTypes {
-		excludeMap[rt] = true
+// getResourceTypesToBackup resolves the requested resource types against the
+// resources discovered on the server. Without an explicit list, every
+// discovered resource except types.DefaultExcludedResourceTypes is included.
+func (m *Manager) getResourceTypesToBackup(options *types.BackupOptions) ([]k8s.APIResource, error) {
+	discovered, err := m.k8sClient.DiscoverResources()
+	if err != nil {
+		return nil, err
 	}
 
-	var resourceTypes []string
-	if len(options.ResourceTypes) > 0 {
-		// Use specified resource types
-		for _, rt := range options.ResourceTypes {
-			if !excludeMap[rt] {
-				resourceTypes = append(resourceTypes, rt)
+	var resourceTypes []k8s.APIResource
+	for _, res := range discovered {
+		if matchesAnyResourceType(res, options.ExcludeResourceTypes) || (options.ExcludeClusterResources && !res.Namespaced) {
+			continue
+		}
+
+		if len(options.ResourceTypes) > 0 {
+			if matchesAnyResourceType(res, options.ResourceTypes) {
+				resourceTypes = append(resourceTypes, res)
 			}
+		} else if !matchesAnyResourceType(res, types.DefaultExcludedResourceTypes) {
+			resourceTypes = append(resourceTypes, res)
 		}
-	} else {
-		// Use all supported resource types
-		for _, rt := range types.SupportedResourceTypes {
-			if !excludeMap[rt] {
-				resourceTypes = append(resourceTypes, rt)
+	}
+
+	// Report requested types that the server does not know about
+	for _, name := range options.ResourceTypes {
+		found := false
+		for _, res := range discovered {
+			if matchesResourceType(res, name) {
+				found = true
+				break
 			}
 		}
+		if !found {
+			log.Printf("Warning: resource type %q not found on the server", name)
+		}
 	}
 
-	return resourceTypes
+	return resourceTypes, nil
 }
 
-func (m *Manager) backupClusterScopedResources(ctx context.Context, resourceTypes []string) ([]types.ResourceWithContent, []error) {
-	resources := make([]types.ResourceWithContent, 0, 100)
-	var errors []error
+// matchesAnyResourceType reports whether res matches any of the given names
+func matchesAnyResourceType(res k8s.APIResource, names []string) bool {
+	for _, name := range names {
+		if matchesResourceType(res, name) {
+			return true
+		}
+	}
+	return false
+}
 
-	// Map resource types to their backup functions
-	clusterBackupFuncs := map[string]func(context.Context) ([]types.ResourceWithContent, error){
-		"namespaces":          m.backupNamespaces,
-		"persistentvolumes":   m.backupPersistentVolumes,
-		"clusterroles":        m.backupClusterRoles,
-		"clusterrolebindings": m.backupClusterRoleBindings,
-		"storageclasses":      m.backupStorageClasses,
+// matchesResourceType reports whether name refers to res. Names are matched
+// case-insensitively against the plural, singular, kind and short names, and
+// may be qualified with a group ("deployments.apps", "certificates.cert-manager.io").
+func matchesResourceType(res k8s.APIResource, name string) bool {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if name == "" {
+		return false
 	}
 
-	for _, rt := range resourceTypes {
-		if !types.IsClusterScoped(rt) {
-			continue
+	gvr := res.GroupVersionResource
+	resourceName, group := name, ""
+	if i := strings.Index(name, "."); i >= 0 {
+		resourceName, group = name[:i], name[i+1:]
+		if group != gvr.Group {
+			return false
 		}
+	}
 
-		if backupFunc, exists := clusterBackupFuncs[rt]; exists {
-			if res, err := backupFunc(ctx); err != nil {
-				errors = append(errors, fmt.Errorf("failed to backup %s: %w", rt, err))
-			} else {
-				resources = append(resources, res...)
-			}
+	if resourceName == gvr.Resource || resourceName == res.SingularName || resourceName == strings.ToLower(res.Kind) {
+		return true
+	}
+	for _, shortName := range res.ShortNames {
+		if resourceName == shortName {
+			return true
 		}
 	}
-
-	return resources, errors
+	return false
 }
 
-func (m *Manager) backupNamespacedResources(ctx context.Context, namespace string, resourceTypes []string) ([]types.ResourceWithContent, []error) {
-	resources := make([]types.ResourceWithContent, 0, 50)
-	var errors []error
-
-	namespacedBackupFuncs := map[string]func(context.Context, string) ([]types.ResourceWithContent, error){
-		"deployments":            m.backupDeployments,
-		"services":               m.backupServices,
-		"configmaps":             m.backupConfigMaps,
-		"secrets":                m.backupSecrets,
-		"persistentvolumeclaims": m.backupPersistentVolumeClaims,
-		"serviceaccounts":        m.backupServiceAccounts,
-		"roles":                  m.backupRoles,
-		"rolebindings":           m.backupRoleBindings,
-		"ingresses":              m.backupIngresses,
-		"networkpolicies":        m.backupNetworkPolicies,
-		"statefulsets":           m.backupStatefulSets,
-		"daemonsets":             m.backupDaemonSets,
-		"jobs":                   m.backupJobs,
-		"cronjobs":               m.backupCronJobs,
-		"poddisruptionbudgets":   m.backupPodDisruptionBudgets,
-	}
-
-	for _, resourceType := range resourceTypes {
-		if types.IsClusterScoped(resourceType) {
-			continue
-		}
+// backupResources lists every object of the given resource in the namespace
+// (across all namespaces, or cluster-wide for cluster-scoped resources, when
+// namespace is empty) that match the selectors, a page at a time, converting
+// each page for storage and passing it to send
+func (m *Manager) backupResources(ctx context.Context, resource k8s.APIResource, namespace string, selectors metav1.ListOptions, send func([]types.ResourceWithContent) error) error {
+	client := m.k8sClient.Dynamic().Resource(resource.GroupVersionResource).Namespace(namespace)
+	list := func(ctx context.Context, options metav1.ListOptions) (runtime.Object, error) {
+		return client.List(ctx, options)
+	}
 
-		if backupFunc, exists := namespacedBackupFuncs[resourceType]; exists {
-			if res, err := backupFunc(ctx, namespace); err != nil {
-				errors = append(errors, fmt.Errorf("failed to backup %s in %s: %w", resourceType, namespace, err))
-			} else {
-				resources = append(resources, res...)
+	return listPages(ctx, list, selectors, func(items []runtime.Object, resourceVersion string) error {
+		resources := make([]types.ResourceWithContent, 0, len(items))
+		for _, obj := range items {
+			item, ok := obj.(*unstructured.Unstructured)
+			if !ok {
+				return fmt.Errorf("unexpected %T in %s list", obj, resource)
 			}
+
+			if ShouldSkip(resource, item) {
+				continue
+			}
+
+			// List items may omit their type information; fill it from discovery
+			if item.GetKind() == "" {
+				item.SetGroupVersionKind(resource.GroupVersionResource.GroupVersion().WithKind(resource.Kind))
+			}
+
+			converted, err := m.convertToResourceWithContent(item, item.GetNamespace())
+			if err != nil {
+				return fmt.Errorf("failed to convert %s %s: %w", resource.Kind, item.GetName(), err)
+			}
+			converted.Info.ResourceVersion = resourceVersion
+			resources = append(resources, converted)
 		}
+		return send(resources)
+	})
+}
+
+// backupCustomResourceDefinitions backs up CRDs through the apiextensions
+// client so they are always stored as apiextensions.k8s.io/v1 objects. Custom
+// resource instances are picked up by discovery like any other resource.
+func (m *Manager) backupCustomResourceDefinitions(ctx context.Context, resource k8s.APIResource, selectors metav1.ListOptions, send func([]types.ResourceWithContent) error) error {
+	list := func(ctx context.Context, options metav1.ListOptions) (runtime.Object, error) {
+		return m.k8sClient.APIExtensions().ApiextensionsV1().CustomResourceDefinitions().List(ctx, options)
 	}
 
-	return resources, errors
-}
+	return listPages(ctx, list, selectors, func(items []runtime.Object, resourceVersion string) error {
+		resources := make([]types.ResourceWithContent, 0, len(items))
+		for _, obj := range items {
+			crd, ok := obj.(*apiextensionsv1.CustomResourceDefinition)
+			if !ok {
+				return fmt.Errorf("unexpected %T in CustomResourceDefinition list", obj)
+			}
+			content, err := runtime.DefaultUnstructuredConverter.ToUnstructured(crd)
+			if err != nil {
+				return fmt.Errorf("failed to convert CustomResourceDefinition %s: %w", crd.Name, err)
+			}
+			item := &unstructured.Unstructured{Object: content}
+			item.SetGroupVersionKind(apiextensionsv1.SchemeGroupVersion.WithKind("CustomResourceDefinition"))
 
-func (m *Manager) convertToResourceWithContent(obj runtime.Object, namespace, kind string) (types.ResourceWithContent, error) {
-	// Clean up the object for backup (remove runtime fields)
-	m.cleanObject(obj)
+			if ShouldSkip(resource, item) {
+				continue
+			}
 
-	// Get API info for this kind
-	apiInfo := m.getAPIInfo(kind)
+			// Status is recomputed by the API server once the CRD is restored
+			unstructured.RemoveNestedField(item.Object, "status")
 
-	// Set the ObjectKind properly (client-go objects don't have this populated by default)
-	obj.GetObjectKind().SetGroupVersionKind(schema.GroupVersionKind{
-		Group:   apiInfo.Group,
-		Version: apiInfo.Version,
-		Kind:    kind,
+			converted, err := m.convertToResourceWithContent(item, "")
+			if err != nil {
+				return fmt.Errorf("failed to convert CustomResourceDefinition %s: %w", item.GetName(), err)
+			}
+			converted.Info.ResourceVersion = resourceVersion
+			resources = append(resources, converted)
+		}
+		return send(resources)
 	})
+}
+
+var (
+	customResourceDefinitionsResource = apiextensionsv1.Resource("customresourcedefinitions")
+	namespacesResource                = schema.GroupResource{Resource: "namespaces"}
+	secretsResource                   = schema.GroupResource{Resource: "secrets"}
+	serviceAccountsResource           = schema.GroupResource{Resource: "serviceaccounts"}
+	clusterRolesResource              = schema.GroupResource{Group: "rbac.authorization.k8s.io", Resource: "clusterroles"}
+	clusterRoleBindingsResource       = schema.GroupResource{Group: "rbac.authorization.k8s.io", Resource: "clusterrolebindings"}
+)
+
+// ShouldSkip filters out objects that must not be restored: objects managed
+// by a controller (their owner recreates them, and the garbage collector would
+// delete them anyway once restored with a stale owner UID), auto-generated
+// service account tokens, default service accounts and system RBAC objects.
+func ShouldSkip(resource k8s.APIResource, obj *unstructured.Unstructured) bool {
+	if metav1.GetControllerOfNoCopy(obj) != nil {
+		return true
+	}
+
+	switch resource.GroupResource() {
+	case secretsResource:
+		secretType, _, _ := unstructured.NestedString(obj.Object, "type")
+		return secretType == "kubernetes.io/service-account-token"
+	case serviceAccountsResource:
+		return obj.GetName() == "default"
+	case clusterRolesResource, clusterRoleBindingsResource:
+		return strings.HasPrefix(obj.GetName(), "system:")
+	}
+
+	return false
+}
+
+func (m *Manager) convertToResourceWithContent(obj *unstructured.Unstructured, namespace string) (types.ResourceWithContent, error) {
+	// Clean up the object for backup (remove runtime fields)
+	CleanObject(obj)
 
 	// Convert to YAML
-	content, err := yaml.Marshal(obj)
+	content, err := yaml.Marshal(obj.Object)
 	if err != nil {
 		return types.ResourceWithContent{}, fmt.Errorf("failed to marshal to YAML: %w", err)
 	}
 
-	// Get object metadata
-	metaObj, ok := obj.(metav1.Object)
-	if !ok {
-		return types.ResourceWithContent{}, fmt.Errorf("object does not implement metav1.Object")
-	}
-
 	info := types.ResourceInfo{
-		APIVersion:  apiInfo.APIVersion,
-		Kind:        kind,
+		APIVersion:  obj.GetAPIVersion(),
+		Kind:        obj.GetKind(),
 		Namespace:   namespace,
-		Name:        metaObj.GetName(),
-		Labels:      metaObj.GetLabels(),
-		Annotations: metaObj.GetAnnotations(),
+		Name:        obj.GetName(),
+		Labels:      obj.GetLabels(),
+		Annotations: obj.GetAnnotations(),
 	}
 
 	return types.ResourceWithContent{
@@ -356,61 +603,8 @@ func (m *Manager) convertToResourceWithContent(obj runtime.Object, namespace, ki
 	}, nil
 }
 
-// APIInfo holds API version information for different resource types
-type APIInfo struct {
-	Group      string
-	Version    string
-	APIVersion string
-}
-
-// getAPIInfo returns API version information for Kubernetes resource kinds
-func (m *Manager) getAPIInfo(kind string) APIInfo {
-	resourceMap := map[string]APIInfo{
-		// Core resources (no group)
-		"Namespace":             {Group: "", Version: "v1", APIVersion: "v1"},
-		"Service":               {Group: "", Version: "v1", APIVersion: "v1"},
-		"ConfigMap":             {Group: "", Version: "v1", APIVersion: "v1"},
-		"Secret":                {Group: "", Version: "v1", APIVersion: "v1"},
-		"PersistentVolumeClaim": {Group: "", Version: "v1", APIVersion: "v1"},
-		"PersistentVolume":      {Group: "", Version: "v1", APIVersion: "v1"},
-		"ServiceAccount":        {Group: "", Version: "v1", APIVersion: "v1"},
-
-		// Apps group
-		"Deployment":  {Group: "apps", Version: "v1", APIVersion: "apps/v1"},
-		"StatefulSet": {Group: "apps", Version: "v1", APIVersion: "apps/v1"},
-		"DaemonSet":   {Group: "apps", Version: "v1", APIVersion: "apps/v1"},
-
-		// Batch group
-		"Job":     {Group: "batch", Version: "v1", APIVersion: "batch/v1"},
-		"CronJob": {Group: "batch", Version: "v1", APIVersion: "batch/v1"},
-
-		// RBAC group
-		"Role":               {Group: "rbac.authorization.k8s.io", Version: "v1", APIVersion: "rbac.authorization.k8s.io/v1"},
-		"RoleBinding":        {Group: "rbac.authorization.k8s.io", Version: "v1", APIVersion: "rbac.authorization.k8s.io/v1"},
-		"ClusterRole":        {Group: "rbac.authorization.k8s.io", Version: "v1", APIVersion: "rbac.authorization.k8s.io/v1"},
-		"ClusterRoleBinding": {Group: "rbac.authorization.k8s.io", Version: "v1", APIVersion: "rbac.authorization.k8s.io/v1"},
-
-		// Networking group
-		"Ingress":       {Group: "networking.k8s.io", Version: "v1", APIVersion: "networking.k8s.io/v1"},
-		"NetworkPolicy": {Group: "networking.k8s.io", Version: "v1", APIVersion: "networking.k8s.io/v1"},
-
-		// Storage group
-		"StorageClass": {Group: "storage.k8s.io", Version: "v1", APIVersion: "storage.k8s.io/v1"},
-
-		// Policy group
-		"PodDisruptionBudget": {Group: "policy", Version: "v1", APIVersion: "policy/v1"},
-	}
-
-	if info, exists := resourceMap[kind]; exists {
-		return info
-	}
-
-	// Default to core/v1 for unknown resources
-	return APIInfo{Group: "", Version: "v1", APIVersion: "v1"}
-}
-
-// cleanObject removes runtime fields that shouldn't be included in backups
-func (m *Manager) cleanObject(obj runtime.Object) {
+// CleanObject removes runtime fields that shouldn't be included in backups
+func CleanObject(obj runtime.Object) {
 	if metaObj, ok := obj.(metav1.Object); ok {
 		// Remove fields that are set by the cluster
 		metaObj.SetResourceVersion("")
@@ -438,205 +632,10 @@ func (m *Manager) cleanObject(obj runtime.Object) {
 				}
 			}
 
+			if len(annotations) == 0 {
+				annotations = nil
+			}
 			metaObj.SetAnnotations(annotations)
 		}
 	}
 }
-
-// backupResources is a generic function for backing up any Kubernetes resource type
-func (m *Manager) backupResources(ctx context.Context, namespace, kind string, listFunc func() (interface{}, error), shouldSkip func(interface{}) bool) ([]types.ResourceWithContent, error) {
-	result, err := listFunc()
-	if err != nil {
-		return nil, err
-	}
-
-	// Use reflection to handle different list types
-	items := reflect.ValueOf(result).Elem().FieldByName("Items")
-	if !items.IsValid() {
-		return nil, fmt.Errorf("invalid list result for %s", kind)
-	}
-
-	resources := make([]types.ResourceWithContent, 0, items.Len())
-	for i := 0; i < items.Len(); i++ {
-		item := items.Index(i).Addr().Interface().(runtime.Object)
-
-		// Apply skip logic if provided
-		if shouldSkip != nil && shouldSkip(item) {
-			continue
-		}
-
-		resource, err := m.convertToResourceWithContent(item, namespace, kind)
-		if err != nil {
-			return nil, fmt.Errorf("failed to convert %s: %w", kind, err)
-		}
-		resources = append(resources, resource)
-	}
-
-	return resources, nil
-}
-
-// Cluster-scoped resource backup functions
-func (m *Manager) backupNamespaces(ctx context.Context) ([]types.ResourceWithContent, error) {
-	return m.backupResources(ctx, "", "Namespace",
-		func() (interface{}, error) {
-			return m.k8sClient.Clientset().CoreV1().Namespaces().List(ctx, metav1.ListOptions{})
-		}, nil)
-}
-
-// Namespaced resource backup functions
-func (m *Manager) backupDeployments(ctx context.Context, namespace string) ([]types.ResourceWithContent, error) {
-	return m.backupResources(ctx, namespace, "Deployment",
-		func() (interface{}, error) {
-			return m.k8sClient.Clientset().AppsV1().Deployments(namespace).List(ctx, metav1.ListOptions{})
-		}, nil)
-}
-
-func (m *Manager) backupServices(ctx context.Context, namespace string) ([]types.ResourceWithContent, error) {
-	return m.backupResources(ctx, namespace, "Service",
-		func() (interface{}, error) {
-			return m.k8sClient.Clientset().CoreV1().Services(namespace).List(ctx, metav1.ListOptions{})
-		}, nil)
-}
-
-func (m *Manager) backupConfigMaps(ctx context.Context, namespace string) ([]types.ResourceWithContent, error) {
-	return m.backupResources(ctx, namespace, "ConfigMap",
-		func() (interface{}, error) {
-			return m.k8sClient.Clientset().CoreV1().ConfigMaps(namespace).List(ctx, metav1.ListOptions{})
-		}, nil)
-}
-
-func (m *Manager) backupSecrets(ctx context.Context, namespace string) ([]types.ResourceWithContent, error) {
-	return m.backupResources(ctx, namespace, "Secret",
-		func() (interface{}, error) {
-			return m.k8sClient.Clientset().CoreV1().Secrets(namespace).List(ctx, metav1.ListOptions{})
-		},
-		func(obj interface{}) bool {
-			if secret, ok := obj.(*corev1.Secret); ok {
-				return secret.Type == "kubernetes.io/service-account-token"
-			}
-			return false
-		})
-}
-
-func (m *Manager) backupPersistentVolumeClaims(ctx context.Context, namespace string) ([]types.ResourceWithContent, error) {
-	return m.backupResources(ctx, namespace, "PersistentVolumeClaim",
-		func() (interface{}, error) {
-			return m.k8sClient.Clientset().CoreV1().PersistentVolumeClaims(namespace).List(ctx, metav1.ListOptions{})
-		}, nil)
-}
-
-func (m *Manager) backupPersistentVolumes(ctx context.Context) ([]types.ResourceWithContent, error) {
-	return m.backupResources(ctx, "", "PersistentVolume",
-		func() (interface{}, error) {
-			return m.k8sClient.Clientset().CoreV1().PersistentVolumes().List(ctx, metav1.ListOptions{})
-		}, nil)
-}
-
-func (m *Manager) backupServiceAccounts(ctx context.Context, namespace string) ([]types.ResourceWithContent, error) {
-	return m.backupResources(ctx, namespace, "ServiceAccount",
-		func() (interface{}, error) {
-			return m.k8sClient.Clientset().CoreV1().ServiceAccounts(namespace).List(ctx, metav1.ListOptions{})
-		},
-		func(obj interface{}) bool {
-			if sa, ok := obj.(*corev1.ServiceAccount); ok {
-				return sa.Name == "default"
-			}
-			return false
-		})
-}
-
-func (m *Manager) backupRoles(ctx context.Context, namespace string) ([]types.ResourceWithContent, error) {
-	return m.backupResources(ctx, namespace, "Role",
-		func() (interface{}, error) {
-			return m.k8sClient.Clientset().RbacV1().Roles(namespace).List(ctx, metav1.ListOptions{})
-		}, nil)
-}
-
-func (m *Manager) backupRoleBindings(ctx context.Context, namespace string) ([]types.ResourceWithContent, error) {
-	return m.backupResources(ctx, namespace, "RoleBinding",
-		func() (interface{}, error) {
-			return m.k8sClient.Clientset().RbacV1().RoleBindings(namespace).List(ctx, metav1.ListOptions{})
-		}, nil)
-}
-
-func (m *Manager) backupClusterRoles(ctx context.Context) ([]types.ResourceWithContent, error) {
-	return m.backupResources(ctx, "", "ClusterRole",
-		func() (interface{}, error) {
-			return m.k8sClient.Clientset().RbacV1().ClusterRoles().List(ctx, metav1.ListOptions{})
-		},
-		func(obj interface{}) bool {
-			if cr, ok := obj.(*rbacv1.ClusterRole); ok {
-				return strings.HasPrefix(cr.Name, "system:")
-			}
-			return false
-		})
-}
-
-func (m *Manager) backupClusterRoleBindings(ctx context.Context) ([]types.ResourceWithContent, error) {
-	return m.backupResources(ctx, "", "ClusterRoleBinding",
-		func() (interface{}, error) {
-			return m.k8sClient.Clientset().RbacV1().ClusterRoleBindings().List(ctx, metav1.ListOptions{})
-		},
-		func(obj interface{}) bool {
-			if crb, ok := obj.(*rbacv1.ClusterRoleBinding); ok {
-				return strings.HasPrefix(crb.Name, "system:")
-			}
-			return false
-		})
-}
-
-func (m *Manager) backupIngresses(ctx context.Context, namespace string) ([]types.ResourceWithContent, error) {
-	return m.backupResources(ctx, namespace, "Ingress",
-		func() (interface{}, error) {
-			return m.k8sClient.Clientset().NetworkingV1().Ingresses(namespace).List(ctx, metav1.ListOptions{})
-		}, nil)
-}
-
-func (m *Manager) backupNetworkPolicies(ctx context.Context, namespace string) ([]types.ResourceWithContent, error) {
-	return m.backupResources(ctx, namespace, "NetworkPolicy",
-		func() (interface{}, error) {
-			return m.k8sClient.Clientset().NetworkingV1().NetworkPolicies(namespace).List(ctx, metav1.ListOptions{})
-		}, nil)
-}
-
-func (m *Manager) backupStatefulSets(ctx context.Context, namespace string) ([]types.ResourceWithContent, error) {
-	return m.backupResources(ctx, namespace, "StatefulSet",
-		func() (interface{}, error) {
-			return m.k8sClient.Clientset().AppsV1().StatefulSets(namespace).List(ctx, metav1.ListOptions{})
-		}, nil)
-}
-
-func (m *Manager) backupDaemonSets(ctx context.Context, namespace string) ([]types.ResourceWithContent, error) {
-	return m.backupResources(ctx, namespace, "DaemonSet",
-		func() (interface{}, error) {
-			return m.k8sClient.Clientset().AppsV1().DaemonSets(namespace).List(ctx, metav1.ListOptions{})
-		}, nil)
-}
-
-func (m *Manager) backupJobs(ctx context.Context, namespace string) ([]types.ResourceWithContent, error) {
-	return m.backupResources(ctx, namespace, "Job",
-		func() (interface{}, error) {
-			return m.k8sClient.Clientset().BatchV1().Jobs(namespace).List(ctx, metav1.ListOptions{})
-		}, nil)
-}
-
-func (m *Manager) backupCronJobs(ctx context.Context, namespace string) ([]types.ResourceWithContent, error) {
-	return m.backupResources(ctx, namespace, "CronJob",
-		func() (interface{}, error) {
-			return m.k8sClient.Clientset().BatchV1().CronJobs(namespace).List(ctx, metav1.ListOptions{})
-		}, nil)
-}
-
-func (m *Manager) backupStorageClasses(ctx context.Context) ([]types.ResourceWithContent, error) {
-	return m.backupResources(ctx, "", "StorageClass",
-		func() (interface{}, error) {
-			return m.k8sClient.Clientset().StorageV1().StorageClasses().List(ctx, metav1.ListOptions{})
-		}, nil)
-}
-
-func (m *Manager) backupPodDisruptionBudgets(ctx context.Context, namespace string) ([]types.ResourceWithContent, error) {
-	return m.backupResources(ctx, namespace, "PodDisruptionBudget",
-		func() (interface{}, error) {
-			return m.k8sClient.Clientset().PolicyV1().PodDisruptionBudgets(namespace).List(ctx, metav1.ListOptions{})
-		}, nil)
-}
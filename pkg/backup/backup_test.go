@@ -0,0 +1,388 @@
+package backup
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	apiextensionsfake "k8s.io/apiextensions-apiserver/pkg/client/clientset/clientset/fake"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	k8stypes "k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/version"
+	fakediscovery "k8s.io/client-go/discovery/fake"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+	clienttesting "k8s.io/client-go/testing"
+
+	"k8s-backup/pkg/k8s"
+	"k8s-backup/pkg/storage"
+	"k8s-backup/pkg/types"
+)
+
+var testAPIResources = []*metav1.APIResourceList{
+	{
+		GroupVersion: "v1",
+		APIResources: []metav1.APIResource{
+			{Name: "namespaces", SingularName: "namespace", Kind: "Namespace", ShortNames: []string{"ns"}, Verbs: metav1.Verbs{"get", "list"}},
+			{Name: "configmaps", SingularName: "configmap", Kind: "ConfigMap", ShortNames: []string{"cm"}, Namespaced: true, Verbs: metav1.Verbs{"get", "list"}},
+			{Name: "secrets", SingularName: "secret", Kind: "Secret", Namespaced: true, Verbs: metav1.Verbs{"get", "list"}},
+			{Name: "events", SingularName: "event", Kind: "Event", Namespaced: true, Verbs: metav1.Verbs{"get", "list"}},
+			{Name: "pods/log", Kind: "Pod", Namespaced: true, Verbs: metav1.Verbs{"get"}},
+		},
+	},
+	{
+		GroupVersion: "apiextensions.k8s.io/v1",
+		APIResources: []metav1.APIResource{
+			{Name: "customresourcedefinitions", SingularName: "customresourcedefinition", Kind: "CustomResourceDefinition", ShortNames: []string{"crd"}, Verbs: metav1.Verbs{"get", "list"}},
+		},
+	},
+	{
+		GroupVersion: "apps/v1",
+		APIResources: []metav1.APIResource{
+			{Name: "deployments", SingularName: "deployment", Kind: "Deployment", ShortNames: []string{"deploy"}, Namespaced: true, Verbs: metav1.Verbs{"get", "list"}},
+		},
+	},
+	{
+		GroupVersion: "example.com/v1",
+		APIResources: []metav1.APIResource{
+			{Name: "widgets", SingularName: "widget", Kind: "Widget", Namespaced: true, Verbs: metav1.Verbs{"get", "list"}},
+		},
+	},
+}
+
+func newTestObject(apiVersion, kind, namespace, name string) *unstructured.Unstructured {
+	obj := &unstructured.Unstructured{}
+	obj.SetAPIVersion(apiVersion)
+	obj.SetKind(kind)
+	obj.SetNamespace(namespace)
+	obj.SetName(name)
+	obj.SetResourceVersion("123")
+	obj.SetUID(k8stypes.UID("uid-" + name))
+	return obj
+}
+
+func newTestCRD() *apiextensionsv1.CustomResourceDefinition {
+	return &apiextensionsv1.CustomResourceDefinition{
+		ObjectMeta: metav1.ObjectMeta{Name: "widgets.example.com", ResourceVersion: "42"},
+		Spec: apiextensionsv1.CustomResourceDefinitionSpec{
+			Group: "example.com",
+			Names: apiextensionsv1.CustomResourceDefinitionNames{Plural: "widgets", Singular: "widget", Kind: "Widget", ListKind: "WidgetList"},
+			Scope: apiextensionsv1.NamespaceScoped,
+			Versions: []apiextensionsv1.CustomResourceDefinitionVersion{
+				{Name: "v1", Served: true, Storage: true},
+			},
+		},
+		Status: apiextensionsv1.CustomResourceDefinitionStatus{
+			Conditions: []apiextensionsv1.CustomResourceDefinitionCondition{
+				{Type: apiextensionsv1.Established, Status: apiextensionsv1.ConditionTrue},
+			},
+			StoredVersions: []string{"v1"},
+		},
+	}
+}
+
+func newTestClient(t testing.TB, objects ...runtime.Object) *k8s.Client {
+	t.Helper()
+
+	clientset := kubefake.NewSimpleClientset()
+	fakeDiscovery := clientset.Discovery().(*fakediscovery.FakeDiscovery)
+	fakeDiscovery.Resources = testAPIResources
+	fakeDiscovery.FakedServerVersion = &version.Info{GitVersion: "v1.28.4"}
+
+	listKinds := map[schema.GroupVersionResource]string{
+		{Version: "v1", Resource: "namespaces"}:                    "NamespaceList",
+		{Version: "v1", Resource: "configmaps"}:                    "ConfigMapList",
+		{Version: "v1", Resource: "secrets"}:                       "SecretList",
+		{Version: "v1", Resource: "events"}:                        "EventList",
+		{Group: "apps", Version: "v1", Resource: "deployments"}:    "DeploymentList",
+		{Group: "example.com", Version: "v1", Resource: "widgets"}: "WidgetList",
+	}
+	dynamicClient := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), listKinds, objects...)
+
+	return k8s.NewClientFromInterfaces(clientset, apiextensionsfake.NewSimpleClientset(newTestCRD()), dynamicClient)
+}
+
+func TestMatchesResourceType(t *testing.T) {
+	deployments := k8s.APIResource{
+		GroupVersionResource: schema.GroupVersionResource{Group: "apps", Version: "v1", Resource: "deployments"},
+		Kind:                 "Deployment",
+		SingularName:         "deployment",
+		ShortNames:           []string{"deploy"},
+		Namespaced:           true,
+	}
+
+	tests := []struct {
+		name     string
+		expected bool
+	}{
+		{"deployments", true},
+		{"deployment", true},
+		{"Deployment", true},
+		{"deploy", true},
+		{"deployments.apps", true},
+		{"deployments.extensions", false},
+		{"services", false},
+		{"", false},
+	}
+
+	for _, test := range tests {
+		if result := matchesResourceType(deployments, test.name); result != test.expected {
+			t.Errorf("matchesResourceType(%q) = %t, expected %t", test.name, result, test.expected)
+		}
+	}
+}
+
+func TestGetResourceTypesToBackup(t *testing.T) {
+	manager := NewManager(newTestClient(t), nil)
+
+	tests := []struct {
+		name     string
+		options  types.BackupOptions
+		expected []string
+	}{
+		{
+			name:     "defaults skip excluded and non-listable resources",
+			options:  types.BackupOptions{},
+			expected: []string{"configmaps", "namespaces", "secrets", "customresourcedefinitions.apiextensions.k8s.io", "deployments.apps", "widgets.example.com"},
+		},
+		{
+			name:     "explicit types include default exclusions",
+			options:  types.BackupOptions{ResourceTypes: []string{"events", "widgets.example.com"}},
+			expected: []string{"events", "widgets.example.com"},
+		},
+		{
+			name:     "exclusions apply to discovered types",
+			options:  types.BackupOptions{ExcludeResourceTypes: []string{"cm", "secret"}},
+			expected: []string{"namespaces", "customresourcedefinitions.apiextensions.k8s.io", "deployments.apps", "widgets.example.com"},
+		},
+		{
+			name:     "cluster-scoped types can be left out",
+			options:  types.BackupOptions{ExcludeClusterResources: true},
+			expected: []string{"configmaps", "secrets", "deployments.apps", "widgets.example.com"},
+		},
+	}
+
+	for _, test := range tests {
+		resourceTypes, err := manager.getResourceTypesToBackup(&test.options)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", test.name, err)
+		}
+
+		var names []string
+		for _, rt := range resourceTypes {
+			names = append(names, rt.String())
+		}
+		if len(names) != len(test.expected) {
+			t.Fatalf("%s: expected %v, got %v", test.name, test.expected, names)
+		}
+		for i := range names {
+			if names[i] != test.expected[i] {
+				t.Errorf("%s: expected %v, got %v", test.name, test.expected, names)
+				break
+			}
+		}
+	}
+}
+
+func TestCreateBackup(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "k8s-backup-test-*")
+	if err != nil {
+		t.Fatalf("Failed to create temp directory: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	tokenSecret := newTestObject("v1", "Secret", "default", "default-token")
+	tokenSecret.Object["type"] = "kubernetes.io/service-account-token"
+
+	owned := newTestObject("v1", "ConfigMap", "default", "owned")
+	controller := true
+	owned.SetOwnerReferences([]metav1.OwnerReference{{APIVersion: "apps/v1", Kind: "Deployment", Name: "web", UID: "uid-web", Controller: &controller}})
+
+	client := newTestClient(t,
+		newTestObject("v1", "Namespace", "", "default"),
+		newTestObject("v1", "Namespace", "", "kube-system"),
+		newTestObject("v1", "ConfigMap", "default", "settings"),
+		newTestObject("v1", "ConfigMap", "kube-system", "ignored"),
+		newTestObject("apps/v1", "Deployment", "default", "web"),
+		newTestObject("example.com/v1", "Widget", "default", "gadget"),
+		tokenSecret,
+		owned,
+	)
+
+	manager := NewManager(client, storage.NewLocalStorage(tempDir))
+	metadata, err := manager.CreateBackup(context.Background(), &types.BackupOptions{
+		Namespaces:        []string{"default"},
+		ExcludeNamespaces: []string{"kube-system"},
+		BackupName:        "test-backup",
+	}, nil)
+	if err != nil {
+		t.Fatalf("CreateBackup failed: %v", err)
+	}
+
+	if metadata.KubernetesVersion != "v1.28.4" {
+		t.Errorf("Expected Kubernetes version v1.28.4, got %s", metadata.KubernetesVersion)
+	}
+
+	_, resources, err := storage.NewLocalStorage(tempDir).LoadBackup(context.Background(), metadata.BackupPath)
+	if err != nil {
+		t.Fatalf("Failed to load backup: %v", err)
+	}
+
+	expected := map[string]bool{
+		"CustomResourceDefinition//widgets.example.com": true,
+		"Namespace//default":                            true,
+		"ConfigMap/default/settings":                    true,
+		"Deployment/default/web":                        true,
+		"Widget/default/gadget":                         true,
+	}
+	if len(resources) != len(expected) {
+		t.Errorf("Expected %d resources, got %d", len(expected), len(resources))
+	}
+	for _, r := range resources {
+		key := r.Info.Kind + "/" + r.Info.Namespace + "/" + r.Info.Name
+		if !expected[key] {
+			t.Errorf("Unexpected resource in backup: %s", key)
+		}
+		if r.Info.Kind == "Widget" && r.Info.APIVersion != "example.com/v1" {
+			t.Errorf("Expected Widget apiVersion example.com/v1, got %s", r.Info.APIVersion)
+		}
+		if r.Info.Kind == "CustomResourceDefinition" {
+			if r.Info.APIVersion != "apiextensions.k8s.io/v1" {
+				t.Errorf("Expected CRD apiVersion apiextensions.k8s.io/v1, got %s", r.Info.APIVersion)
+			}
+			if strings.Contains(string(r.Content), "status:") || strings.Contains(string(r.Content), "resourceVersion") {
+				t.Errorf("Expected CRD status and resourceVersion to be removed:\n%s", r.Content)
+			}
+		}
+	}
+}
+
+func TestCreateBackupWithSelectors(t *testing.T) {
+	labeled := func(obj *unstructured.Unstructured, labels map[string]string) *unstructured.Unstructured {
+		obj.SetLabels(labels)
+		return obj
+	}
+	client := newTestClient(t,
+		newTestObject("v1", "Namespace", "", "shop"),
+		labeled(newTestObject("v1", "ConfigMap", "shop", "payments"), map[string]string{"app": "payments", "tier": "web"}),
+		labeled(newTestObject("v1", "ConfigMap", "shop", "cache"), map[string]string{"app": "payments", "tier": "cache"}),
+		labeled(newTestObject("apps/v1", "Deployment", "shop", "payments"), map[string]string{"app": "payments"}),
+		labeled(newTestObject("apps/v1", "Deployment", "other", "payments"), map[string]string{"app": "payments"}),
+		newTestObject("apps/v1", "Deployment", "shop", "unlabeled"),
+	)
+	for name, labels := range map[string]map[string]string{"shop": {"team": "checkout"}, "other": {"team": "search"}} {
+		namespace := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: name, Labels: labels}}
+		if _, err := client.Clientset().CoreV1().Namespaces().Create(context.Background(), namespace, metav1.CreateOptions{}); err != nil {
+			t.Fatalf("Failed to create namespace: %v", err)
+		}
+	}
+
+	var fieldSelectors []string
+	fake := client.Dynamic().(*dynamicfake.FakeDynamicClient)
+	fake.PrependReactor("list", "*", func(action clienttesting.Action) (bool, runtime.Object, error) {
+		fieldSelectors = append(fieldSelectors, action.(clienttesting.ListAction).GetListRestrictions().Fields.String())
+		return false, nil, nil
+	})
+
+	dir := t.TempDir()
+	manager := NewManager(client, storage.NewLocalStorage(dir))
+	metadata, err := manager.CreateBackup(context.Background(), &types.BackupOptions{
+		BackupName:        "selected",
+		LabelSelector:     "app=payments,tier!=cache",
+		FieldSelector:     "metadata.name!=ignored",
+		NamespaceSelector: "team=checkout",
+		Concurrency:       1,
+	}, nil)
+	if err != nil {
+		t.Fatalf("CreateBackup failed: %v", err)
+	}
+
+	if !reflect.DeepEqual(metadata.Namespaces, []string{"shop"}) {
+		t.Errorf("Expected only the namespace matching the namespace selector, got %v", metadata.Namespaces)
+	}
+	_, resources, err := storage.NewLocalStorage(dir).LoadBackup(context.Background(), metadata.BackupPath)
+	if err != nil {
+		t.Fatalf("Failed to load backup: %v", err)
+	}
+	var keys []string
+	for _, r := range resources {
+		keys = append(keys, r.Info.Kind+"/"+r.Info.Namespace+"/"+r.Info.Name)
+	}
+	if expected := []string{"ConfigMap/shop/payments", "Deployment/shop/payments"}; !reflect.DeepEqual(keys, expected) {
+		t.Errorf("Expected %v, got %v", expected, keys)
+	}
+	if len(fieldSelectors) == 0 {
+		t.Error("Expected List calls through the dynamic client")
+	}
+	for _, selector := range fieldSelectors {
+		if selector != "metadata.name!=ignored" {
+			t.Errorf("Expected every List call to carry the field selector, got %q", selector)
+		}
+	}
+
+	_, err = manager.CreateBackup(context.Background(), &types.BackupOptions{BackupName: "invalid", LabelSelector: "app in (payments"}, nil)
+	if err == nil {
+		t.Error("Expected an invalid selector to fail the backup")
+	}
+}
+
+func TestCreateBackupWithHooks(t *testing.T) {
+	client := newTestClient(t,
+		newTestObject("v1", "Namespace", "", "shop"),
+		newTestObject("v1", "ConfigMap", "shop", "settings"),
+	)
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "shop", Name: "postgres-0", Annotations: map[string]string{
+			"k8s-backup.io/pre-hook-command":  "psql -c CHECKPOINT",
+			"k8s-backup.io/pre-hook-on-error": "continue",
+		}},
+		Spec:   corev1.PodSpec{Containers: []corev1.Container{{Name: "postgres"}}},
+		Status: corev1.PodStatus{Phase: corev1.PodRunning},
+	}
+	pods := client.Clientset().CoreV1().Pods("shop")
+	if _, err := pods.Create(context.Background(), pod, metav1.CreateOptions{}); err != nil {
+		t.Fatalf("Failed to create pod: %v", err)
+	}
+
+	// The fake client cannot exec, so every hook fails
+	dir := t.TempDir()
+	manager := NewManager(client, storage.NewLocalStorage(dir))
+	metadata, err := manager.CreateBackup(context.Background(), &types.BackupOptions{Namespaces: []string{"shop"}, BackupName: "continued"}, nil)
+	if err != nil {
+		t.Fatalf("Expected a hook set to continue not to fail the backup, got %v", err)
+	}
+	manifest, _, err := storage.NewLocalStorage(dir).LoadBackup(context.Background(), metadata.BackupPath)
+	if err != nil {
+		t.Fatalf("Failed to load backup: %v", err)
+	}
+	hooks := manifest.Metadata.Hooks
+	if len(hooks) != 1 || hooks[0].Succeeded || hooks[0].Pod != "postgres-0" || hooks[0].Container != "postgres" || hooks[0].Error == "" {
+		t.Errorf("Expected the failed hook in the manifest, got %+v", hooks)
+	}
+
+	// Skipped hooks are not run at all
+	metadata, err = manager.CreateBackup(context.Background(), &types.BackupOptions{Namespaces: []string{"shop"}, BackupName: "skipped", SkipHooks: true}, nil)
+	if err != nil || len(metadata.Hooks) != 0 {
+		t.Errorf("Expected no hooks to run, got %+v, %v", metadata, err)
+	}
+
+	pod.Annotations["k8s-backup.io/pre-hook-on-error"] = "fail"
+	if _, err := pods.Update(context.Background(), pod, metav1.UpdateOptions{}); err != nil {
+		t.Fatalf("Failed to update pod: %v", err)
+	}
+	_, err = manager.CreateBackup(context.Background(), &types.BackupOptions{Namespaces: []string{"shop"}, BackupName: "failed"}, nil)
+	if err == nil || !strings.Contains(err.Error(), "pre hook annotations failed in pod shop/postgres-0") {
+		t.Errorf("Expected the failing hook to fail the backup, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "failed")); !os.IsNotExist(err) {
+		t.Errorf("Expected no backup to be written, got %v", err)
+	}
+}
@@ -0,0 +1,254 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"k8s-backup/pkg/k8s"
+	"k8s-backup/pkg/types"
+)
+
+// listTask is a single List call made while collecting a backup
+type listTask struct {
+	resource k8s.APIResource
+	// namespace is empty for cluster-scoped resources and for namespaced
+	// resources listed across all namespaces
+	namespace     string
+	allNamespaces bool
+	// selectors holds the label and field selectors of every List call
+	selectors metav1.ListOptions
+}
+
+func (t listTask) String() string {
+	switch {
+	case t.allNamespaces:
+		return fmt.Sprintf("%s in all namespaces", t.resource)
+	case t.namespace == "":
+		return t.resource.String()
+	default:
+		return fmt.Sprintf("%s in %s", t.resource, t.namespace)
+	}
+}
+
+// listTasks returns the List calls for a backup in restore order, so backups
+// can be restored as they are read. With clusterWide, each namespaced resource
+// is listed once across all namespaces; otherwise it is listed for each
+// namespace in turn. Every List call filters with the given selectors.
+func listTasks(namespaces []string, resourceTypes []k8s.APIResource, clusterWide bool, selectors metav1.ListOptions) []listTask {
+	var tasks []listTask
+	for _, rt := range resourceTypes {
+		if !rt.Namespaced {
+			tasks = append(tasks, listTask{resource: rt, selectors: selectors})
+		}
+	}
+
+	if clusterWide {
+		for _, rt := range resourceTypes {
+			if rt.Namespaced {
+				tasks = append(tasks, listTask{resource: rt, allNamespaces: true, selectors: selectors})
+			}
+		}
+	} else {
+		for _, ns := range namespaces {
+			for _, rt := range resourceTypes {
+				if rt.Namespaced {
+					tasks = append(tasks, listTask{resource: rt, namespace: ns, selectors: selectors})
+				}
+			}
+		}
+	}
+
+	sort.SliceStable(tasks, func(i, j int) bool {
+		return types.GetResourceOrder(tasks[i].resource.Kind) < types.GetResourceOrder(tasks[j].resource.Kind)
+	})
+	return tasks
+}
+
+// listTaskError is the warning of a list task that failed
+type listTaskError struct {
+	task listTask
+	err  error
+}
+
+func (e *listTaskError) Error() string {
+	return fmt.Sprintf("failed to backup %s: %v", e.task, e.err)
+}
+
+func (e *listTaskError) Unwrap() error {
+	return e.err
+}
+
+// failedTasks returns the list tasks whose failures are among warnings
+func failedTasks(warnings []error) []listTask {
+	var failed []listTask
+	for _, warning := range warnings {
+		var taskErr *listTaskError
+		if errors.As(warning, &taskErr) {
+			failed = append(failed, taskErr.task)
+		}
+	}
+	return failed
+}
+
+// taskResults carries the pages of resources listed by one task
+type taskResults struct {
+	pages chan []types.ResourceWithContent
+	// err is set before pages is closed
+	err error
+}
+
+// collectResources runs the list tasks on a bounded pool of workers and
+// passes every resource to emit, a page at a time, in task order whatever
+// order the tasks finish in, so backups are deterministic. Workers wait for
+// earlier tasks to be emitted rather than buffering their results, which
+// keeps memory bounded by the number of workers. A task that fails is
+// reported as a *listTaskError warning; resources it listed before failing
+// are kept.
+// Progress is reported once per finished task, and neither the callback nor
+// emit is ever called concurrently.
+func (m *Manager) collectResources(ctx context.Context, tasks []listTask, namespaces []string, concurrency int, progress *types.Progress, progressCallback types.ProgressCallback, emit func(types.ResourceWithContent) error) ([]error, error) {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	// Only keep objects in (and Namespace objects for) namespaces that are
+	// part of the backup
+	namespaceSet := make(map[string]bool, len(namespaces))
+	for _, ns := range namespaces {
+		namespaceSet[ns] = true
+	}
+
+	// Workers are cancelled before they are waited for
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	workerCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make([]*taskResults, len(tasks))
+	for i := range results {
+		results[i] = &taskResults{pages: make(chan []types.ResourceWithContent, 1)}
+	}
+	indexes := make(chan int)
+
+	for w := 0; w < concurrency; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				result := results[i]
+				result.err = m.runListTask(workerCtx, tasks[i], namespaces, namespaceSet, func(page []types.ResourceWithContent) error {
+					select {
+					case result.pages <- page:
+						return nil
+					case <-workerCtx.Done():
+						return workerCtx.Err()
+					}
+				})
+				close(result.pages)
+			}
+		}()
+	}
+
+	go func() {
+		defer close(indexes)
+		for i := range tasks {
+			select {
+			case indexes <- i:
+			case <-workerCtx.Done():
+				return
+			}
+		}
+	}()
+
+	var warnings []error
+	for i, result := range results {
+		count := 0
+	receive:
+		for {
+			select {
+			case page, ok := <-result.pages:
+				if !ok {
+					break receive
+				}
+				for _, resource := range page {
+					if err := emit(resource); err != nil {
+						return nil, err
+					}
+				}
+				count += len(page)
+			case <-workerCtx.Done():
+				return nil, workerCtx.Err()
+			}
+		}
+
+		if result.err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			warnings = append(warnings, &listTaskError{task: tasks[i], err: result.err})
+		}
+		m.updateProgress(progress, progress.Completed+1, fmt.Sprintf("Backed up %s (%d resources)", tasks[i], count), progressCallback)
+	}
+
+	return warnings, nil
+}
+
+// runListTask lists and converts the objects of a single task, passing them
+// to send a page at a time
+func (m *Manager) runListTask(ctx context.Context, task listTask, namespaces []string, namespaceSet map[string]bool, send func([]types.ResourceWithContent) error) error {
+	if task.resource.GroupResource() == customResourceDefinitionsResource {
+		return m.backupCustomResourceDefinitions(ctx, task.resource, task.selectors, send)
+	}
+
+	if task.allNamespaces {
+		sent := false
+		err := m.backupResources(ctx, task.resource, metav1.NamespaceAll, task.selectors, func(page []types.ResourceWithContent) error {
+			sent = true
+			return send(filterResources(page, func(r types.ResourceWithContent) bool {
+				return namespaceSet[r.Info.Namespace]
+			}))
+		})
+		if apierrors.IsForbidden(err) && !sent {
+			// RBAC may only grant access within individual namespaces
+			log.Printf("Listing %s across all namespaces is forbidden, listing per namespace", task.resource)
+			return m.backupPerNamespace(ctx, task.resource, namespaces, task.selectors, send)
+		}
+		return err
+	}
+
+	if task.resource.GroupResource() != namespacesResource {
+		return m.backupResources(ctx, task.resource, task.namespace, task.selectors, send)
+	}
+	return m.backupResources(ctx, task.resource, task.namespace, task.selectors, func(page []types.ResourceWithContent) error {
+		return send(filterResources(page, func(r types.ResourceWithContent) bool {
+			return namespaceSet[r.Info.Name]
+		}))
+	})
+}
+
+// backupPerNamespace lists a namespaced resource in each namespace in turn
+func (m *Manager) backupPerNamespace(ctx context.Context, resource k8s.APIResource, namespaces []string, selectors metav1.ListOptions, send func([]types.ResourceWithContent) error) error {
+	for _, ns := range namespaces {
+		if err := m.backupResources(ctx, resource, ns, selectors, send); err != nil {
+			return fmt.Errorf("in namespace %s: %w", ns, err)
+		}
+	}
+	return nil
+}
+
+func filterResources(resources []types.ResourceWithContent, keep func(types.ResourceWithContent) bool) []types.ResourceWithContent {
+	filtered := resources[:0]
+	for _, r := range resources {
+		if keep(r) {
+			filtered = append(filtered, r)
+		}
+	}
+	return filtered
+}
@@ -0,0 +1,197 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync/atomic"
+	"testing"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	clienttesting "k8s.io/client-go/testing"
+
+	"k8s-backup/pkg/types"
+)
+
+func newCollectTestManager(t testing.TB) (*Manager, []string) {
+	return newCollectTestManagerWithNamespaces(t, 4)
+}
+
+// newCollectTestManagerWithNamespaces returns a manager for a cluster with the
+// given number of namespaces, each holding 3 ConfigMaps and 3 Deployments
+func newCollectTestManagerWithNamespaces(t testing.TB, count int) (*Manager, []string) {
+	t.Helper()
+
+	var namespaces []string
+	var objects []runtime.Object
+	for n := 0; n < count; n++ {
+		ns := fmt.Sprintf("ns-%03d", n)
+		namespaces = append(namespaces, ns)
+		objects = append(objects, newTestObject("v1", "Namespace", "", ns))
+		for i := 0; i < 3; i++ {
+			objects = append(objects,
+				newTestObject("v1", "ConfigMap", ns, fmt.Sprintf("config-%d", i)),
+				newTestObject("apps/v1", "Deployment", ns, fmt.Sprintf("app-%d", i)),
+			)
+		}
+	}
+	return NewManager(newTestClient(t, objects...), nil), namespaces
+}
+
+// countLists counts the List requests made through the manager's dynamic client
+func countLists(manager *Manager) *int64 {
+	var lists int64
+	fake := manager.k8sClient.Dynamic().(*dynamicfake.FakeDynamicClient)
+	fake.PrependReactor("list", "*", func(action clienttesting.Action) (bool, runtime.Object, error) {
+		atomic.AddInt64(&lists, 1)
+		return false, nil, nil
+	})
+	return &lists
+}
+
+func collectKeys(t testing.TB, manager *Manager, namespaces []string, clusterWide bool) []string {
+	t.Helper()
+
+	resourceTypes, err := manager.getResourceTypesToBackup(&types.BackupOptions{})
+	if err != nil {
+		t.Fatalf("Failed to get resource types: %v", err)
+	}
+	tasks := listTasks(namespaces, resourceTypes, clusterWide, metav1.ListOptions{})
+	var keys []string
+	errs, err := manager.collectResources(context.Background(), tasks, namespaces, 4, &types.Progress{}, nil, appendKey(&keys))
+	if err != nil || len(errs) > 0 {
+		t.Fatalf("collectResources failed: %v %v", err, errs)
+	}
+	return keys
+}
+
+// appendKey returns an emit function that records the key of each resource
+func appendKey(keys *[]string) func(types.ResourceWithContent) error {
+	return func(r types.ResourceWithContent) error {
+		*keys = append(*keys, r.Info.Kind+"/"+r.Info.Namespace+"/"+r.Info.Name)
+		return nil
+	}
+}
+
+func TestCollectResourcesConcurrently(t *testing.T) {
+	manager, namespaces := newCollectTestManager(t)
+	resourceTypes, err := manager.getResourceTypesToBackup(&types.BackupOptions{})
+	if err != nil {
+		t.Fatalf("Failed to get resource types: %v", err)
+	}
+	tasks := listTasks(namespaces, resourceTypes, false, metav1.ListOptions{})
+
+	var sequential []string
+	for _, concurrency := range []int{1, 8} {
+		var inCallback int32
+		var completed []int
+		progress := &types.Progress{Total: len(tasks)}
+		callback := func(p types.Progress) {
+			if !atomic.CompareAndSwapInt32(&inCallback, 0, 1) {
+				t.Errorf("concurrency %d: progress callback called concurrently", concurrency)
+			}
+			completed = append(completed, p.Completed)
+			atomic.StoreInt32(&inCallback, 0)
+		}
+
+		var keys []string
+		errs, err := manager.collectResources(context.Background(), tasks, namespaces, concurrency, progress, callback, appendKey(&keys))
+		if err != nil || len(errs) > 0 {
+			t.Fatalf("concurrency %d: collectResources failed: %v %v", concurrency, err, errs)
+		}
+		if concurrency == 1 {
+			sequential = keys
+		} else if !reflect.DeepEqual(keys, sequential) {
+			t.Errorf("concurrency %d: resource order differs from a sequential run:\n%v\n%v", concurrency, keys, sequential)
+		}
+
+		if len(completed) != len(tasks) {
+			t.Fatalf("concurrency %d: expected %d progress reports, got %d", concurrency, len(tasks), len(completed))
+		}
+		for i, c := range completed {
+			if c != i+1 {
+				t.Errorf("concurrency %d: progress report %d has Completed=%d", concurrency, i, c)
+			}
+		}
+	}
+
+	// 4 namespaces, the CRD, and 3 ConfigMaps and 3 Deployments per namespace
+	if len(sequential) != 4+1+4*6 {
+		t.Errorf("Expected %d resources, got %d", 4+1+4*6, len(sequential))
+	}
+}
+
+func TestCollectResourcesCancelled(t *testing.T) {
+	manager, namespaces := newCollectTestManager(t)
+	resourceTypes, err := manager.getResourceTypesToBackup(&types.BackupOptions{})
+	if err != nil {
+		t.Fatalf("Failed to get resource types: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	var keys []string
+	_, err = manager.collectResources(ctx, listTasks(namespaces, resourceTypes, false, metav1.ListOptions{}), namespaces, 4, &types.Progress{}, nil, appendKey(&keys))
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected context.Canceled, got %v", err)
+	}
+}
+
+func TestCollectResourcesClusterWide(t *testing.T) {
+	manager, namespaces := newCollectTestManager(t)
+	perNamespace := collectKeys(t, manager, namespaces[:3], false)
+
+	// Objects in namespaces outside the backup are dropped client-side
+	lists := countLists(manager)
+	clusterWide := collectKeys(t, manager, namespaces[:3], true)
+	if !reflect.DeepEqual(clusterWide, perNamespace) {
+		t.Errorf("Cluster-wide lists produced different resources:\n%v\n%v", clusterWide, perNamespace)
+	}
+	// Namespaces, ConfigMaps, Secrets, Deployments and Widgets; Events and
+	// the CRD are not listed through the dynamic client
+	if *lists != 5 {
+		t.Errorf("Expected 5 List calls, got %d", *lists)
+	}
+}
+
+func TestCollectResourcesClusterWideForbidden(t *testing.T) {
+	manager, namespaces := newCollectTestManager(t)
+	expected := collectKeys(t, manager, namespaces, false)
+
+	fake := manager.k8sClient.Dynamic().(*dynamicfake.FakeDynamicClient)
+	fake.PrependReactor("list", "configmaps", func(action clienttesting.Action) (bool, runtime.Object, error) {
+		if action.GetNamespace() == "" {
+			return true, nil, apierrors.NewForbidden(schema.GroupResource{Resource: "configmaps"}, "", fmt.Errorf("cluster-wide access denied"))
+		}
+		return false, nil, nil
+	})
+
+	if got := collectKeys(t, manager, namespaces, true); !reflect.DeepEqual(got, expected) {
+		t.Errorf("Expected a per-namespace fallback to produce the same resources:\n%v\n%v", got, expected)
+	}
+}
+
+func BenchmarkCollectResources(b *testing.B) {
+	for _, clusterWide := range []bool{false, true} {
+		name := "per-namespace"
+		if clusterWide {
+			name = "cluster-wide"
+		}
+		b.Run(name, func(b *testing.B) {
+			manager, namespaces := newCollectTestManagerWithNamespaces(b, 100)
+			lists := countLists(manager)
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				collectKeys(b, manager, namespaces, clusterWide)
+			}
+			b.ReportMetric(float64(*lists)/float64(b.N), "lists/op")
+		})
+	}
+}
@@ -0,0 +1,147 @@
+package backup
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+
+	"k8s-backup/pkg/k8s"
+	"k8s-backup/pkg/storage"
+	"k8s-backup/pkg/types"
+)
+
+// parentState is what an incremental backup is compared against: the
+// content hash of every resource in the full state of its parent backup
+type parentState struct {
+	hashes map[string][sha256.Size]byte
+	// resources identifies the parent's resources, in the parent's order
+	resources []types.ResourceInfo
+	seen      map[string]bool
+	added     int
+}
+
+func newParentState() *parentState {
+	return &parentState{hashes: make(map[string][sha256.Size]byte), seen: make(map[string]bool)}
+}
+
+// loadParentState streams the full state of the named parent backup,
+// recording the parent chain in the metadata
+func (m *Manager) loadParentState(ctx context.Context, parentName string, metadata *types.BackupMetadata) (*parentState, error) {
+	parent, err := storage.FindBackup(m.storage, parentName)
+	if err != nil {
+		return nil, err
+	}
+	reader, err := storage.NewChainStorage(m.storage).OpenBackupReader(ctx, parent.BackupPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load parent backup %s: %w", parentName, err)
+	}
+	defer reader.Close()
+
+	state := newParentState()
+	for {
+		resource, err := reader.Next(ctx)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to load parent backup %s: %w", parentName, err)
+		}
+		state.add(resource)
+	}
+
+	parentManifest := reader.Manifest()
+	metadata.Parent = parentManifest.Metadata.Name
+	metadata.Chain = append(append([]string{}, parentManifest.Metadata.Chain...), metadata.Parent)
+	return state, nil
+}
+
+func (p *parentState) add(resource types.ResourceWithContent) {
+	p.hashes[resource.Info.Key()] = sha256.Sum256(resource.Content)
+	p.resources = append(p.resources, types.ResourceInfo{
+		APIVersion: resource.Info.APIVersion,
+		Kind:       resource.Info.Kind,
+		Namespace:  resource.Info.Namespace,
+		Name:       resource.Info.Name,
+		Labels:     resource.Info.Labels,
+	})
+}
+
+// changed reports whether a current resource is new or its content hash
+// differs from the parent's, and records that it still exists
+func (p *parentState) changed(resource types.ResourceWithContent) bool {
+	key := resource.Info.Key()
+	p.seen[key] = true
+	hash, ok := p.hashes[key]
+	if !ok {
+		p.added++
+	}
+	return !ok || hash != sha256.Sum256(resource.Content)
+}
+
+// deleted returns tombstones for the parent resources within scope that no
+// current resource was compared against
+func (p *parentState) deleted(inScope func(types.ResourceInfo) bool) []types.ResourceInfo {
+	var deleted []types.ResourceInfo
+	for _, info := range p.resources {
+		if !p.seen[info.Key()] && inScope(info) {
+			deleted = append(deleted, info)
+		}
+	}
+	return deleted
+}
+
+// total returns the number of resources in the full state of a backup taken
+// against the parent with the given tombstones
+func (p *parentState) total(deleted []types.ResourceInfo) int {
+	return len(p.resources) - len(deleted) + p.added
+}
+
+// backupScope reports whether a backup of the given namespaces and resource
+// types, with the given label selector, would have included a resource, so
+// that its absence means it was deleted rather than filtered out. Resources
+// of failed list tasks are out of scope: they may exist without having been
+// seen.
+func backupScope(namespaces []string, resourceTypes []k8s.APIResource, selector labels.Selector, failed []listTask) func(types.ResourceInfo) bool {
+	namespaceSet := make(map[string]bool, len(namespaces))
+	for _, ns := range namespaces {
+		namespaceSet[ns] = true
+	}
+	kinds := make(map[schema.GroupKind]bool, len(resourceTypes))
+	for _, rt := range resourceTypes {
+		kinds[schema.GroupKind{Group: rt.GroupVersionResource.Group, Kind: rt.Kind}] = true
+	}
+	// Failed tasks that listed a kind everywhere, and those that listed it
+	// in a single namespace
+	failedKinds := make(map[schema.GroupKind]bool)
+	failedNamespaces := make(map[schema.GroupKind]map[string]bool)
+	for _, task := range failed {
+		gk := schema.GroupKind{Group: task.resource.GroupVersionResource.Group, Kind: task.resource.Kind}
+		if task.namespace == "" {
+			failedKinds[gk] = true
+			continue
+		}
+		if failedNamespaces[gk] == nil {
+			failedNamespaces[gk] = make(map[string]bool)
+		}
+		failedNamespaces[gk][task.namespace] = true
+	}
+
+	return func(info types.ResourceInfo) bool {
+		gv, err := schema.ParseGroupVersion(info.APIVersion)
+		if err != nil {
+			return false
+		}
+		gk := gv.WithKind(info.Kind).GroupKind()
+		if !kinds[gk] || failedKinds[gk] || failedNamespaces[gk][info.Namespace] || !selector.Matches(labels.Set(info.Labels)) {
+			return false
+		}
+		if info.Namespace == "" {
+			return info.Kind != "Namespace" || namespaceSet[info.Name]
+		}
+		return namespaceSet[info.Namespace]
+	}
+}
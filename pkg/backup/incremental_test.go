@@ -0,0 +1,178 @@
+package backup
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	clienttesting "k8s.io/client-go/testing"
+
+	"k8s-backup/pkg/storage"
+	"k8s-backup/pkg/types"
+)
+
+func resourceKeys(infos []types.ResourceInfo) []string {
+	keys := make([]string, 0, len(infos))
+	for _, info := range infos {
+		keys = append(keys, info.Kind+"/"+info.Namespace+"/"+info.Name)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func TestIncrementalBackupChain(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	configMaps := schema.GroupVersionResource{Version: "v1", Resource: "configmaps"}
+	deployments := schema.GroupVersionResource{Group: "apps", Version: "v1", Resource: "deployments"}
+
+	client := newTestClient(t,
+		newTestObject("v1", "Namespace", "", "default"),
+		newTestObject("v1", "ConfigMap", "default", "settings"),
+		newTestObject("apps/v1", "Deployment", "default", "web"),
+		newTestObject("example.com/v1", "Widget", "default", "gadget"),
+	)
+	backend := storage.NewLocalStorage(dir)
+	manager := NewManager(client, backend)
+	backupOptions := func(name, parent string) *types.BackupOptions {
+		return &types.BackupOptions{Namespaces: []string{"default"}, BackupName: name, IncrementalFrom: parent}
+	}
+
+	if _, err := manager.CreateBackup(ctx, backupOptions("base", ""), nil); err != nil {
+		t.Fatalf("Full backup failed: %v", err)
+	}
+
+	// Change one object, delete one and create one
+	settings := newTestObject("v1", "ConfigMap", "default", "settings")
+	settings.Object["data"] = map[string]interface{}{"mode": "updated"}
+	if _, err := client.Dynamic().Resource(configMaps).Namespace("default").Update(ctx, settings, metav1.UpdateOptions{}); err != nil {
+		t.Fatalf("Failed to update ConfigMap: %v", err)
+	}
+	if err := client.Dynamic().Resource(deployments).Namespace("default").Delete(ctx, "web", metav1.DeleteOptions{}); err != nil {
+		t.Fatalf("Failed to delete Deployment: %v", err)
+	}
+	if _, err := client.Dynamic().Resource(configMaps).Namespace("default").Create(ctx, newTestObject("v1", "ConfigMap", "default", "added"), metav1.CreateOptions{}); err != nil {
+		t.Fatalf("Failed to create ConfigMap: %v", err)
+	}
+
+	first, err := manager.CreateBackup(ctx, backupOptions("first", "base"), nil)
+	if err != nil {
+		t.Fatalf("First incremental backup failed: %v", err)
+	}
+	manifest, _, err := backend.LoadBackup(ctx, first.BackupPath)
+	if err != nil {
+		t.Fatalf("Failed to load incremental backup: %v", err)
+	}
+	if got, want := resourceKeys(manifest.Resources), []string{"ConfigMap/default/added", "ConfigMap/default/settings"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected only changed resources %v to be stored, got %v", want, got)
+	}
+	if got := resourceKeys(first.Deleted); !reflect.DeepEqual(got, []string{"Deployment/default/web"}) {
+		t.Errorf("Expected a tombstone for the deleted Deployment, got %v", got)
+	}
+	if first.Parent != "base" || !reflect.DeepEqual(first.Chain, []string{"base"}) || first.TotalResources != 5 {
+		t.Errorf("Unexpected incremental metadata: parent=%s chain=%v total=%d", first.Parent, first.Chain, first.TotalResources)
+	}
+
+	if err := client.Dynamic().Resource(configMaps).Namespace("default").Delete(ctx, "added", metav1.DeleteOptions{}); err != nil {
+		t.Fatalf("Failed to delete ConfigMap: %v", err)
+	}
+	second, err := manager.CreateBackup(ctx, backupOptions("second", "first"), nil)
+	if err != nil {
+		t.Fatalf("Second incremental backup failed: %v", err)
+	}
+	if !reflect.DeepEqual(second.Chain, []string{"base", "first"}) {
+		t.Errorf("Expected chain [base first], got %v", second.Chain)
+	}
+
+	// Loading through the chain reconstructs the point-in-time state
+	manifest, resources, err := storage.NewChainStorage(backend).LoadBackup(ctx, second.BackupPath)
+	if err != nil {
+		t.Fatalf("Failed to load backup chain: %v", err)
+	}
+	want := []string{"ConfigMap/default/settings", "CustomResourceDefinition//widgets.example.com", "Namespace//default", "Widget/default/gadget"}
+	if got := resourceKeys(manifest.Resources); !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected reconstructed state %v, got %v", want, got)
+	}
+	for _, resource := range resources {
+		if resource.Info.Name == "settings" && !strings.Contains(string(resource.Content), "updated") {
+			t.Errorf("Expected the latest version of the ConfigMap, got:\n%s", resource.Content)
+		}
+	}
+}
+
+func TestIncrementalBackupWithFailedList(t *testing.T) {
+	ctx := context.Background()
+	backend := storage.NewLocalStorage(t.TempDir())
+	client := newTestClient(t,
+		newTestObject("v1", "Namespace", "", "default"),
+		newTestObject("v1", "ConfigMap", "default", "settings"),
+		newTestObject("apps/v1", "Deployment", "default", "web"),
+	)
+	manager := NewManager(client, backend)
+	if _, err := manager.CreateBackup(ctx, &types.BackupOptions{Namespaces: []string{"default"}, BackupName: "base"}, nil); err != nil {
+		t.Fatalf("Full backup failed: %v", err)
+	}
+
+	// Deployments cannot be listed during the incremental backup
+	client.Dynamic().(*dynamicfake.FakeDynamicClient).PrependReactor("list", "deployments", func(action clienttesting.Action) (bool, runtime.Object, error) {
+		return true, nil, apierrors.NewServiceUnavailable("try again later")
+	})
+	var warnings []error
+	incremental, err := manager.CreateBackup(ctx, &types.BackupOptions{Namespaces: []string{"default"}, BackupName: "incremental", IncrementalFrom: "base"}, func(progress types.Progress) {
+		warnings = progress.Errors
+	})
+	if err != nil {
+		t.Fatalf("Incremental backup failed: %v", err)
+	}
+	if len(warnings) != 1 || !strings.Contains(warnings[0].Error(), "deployments") {
+		t.Errorf("Expected a warning for the failed List, got %v", warnings)
+	}
+	if len(incremental.Deleted) != 0 {
+		t.Errorf("Expected no tombstones for resources that failed to be listed, got %v", resourceKeys(incremental.Deleted))
+	}
+
+	manifest, _, err := storage.NewChainStorage(backend).LoadBackup(ctx, incremental.BackupPath)
+	if err != nil {
+		t.Fatalf("Failed to load backup chain: %v", err)
+	}
+	want := []string{"ConfigMap/default/settings", "CustomResourceDefinition//widgets.example.com", "Deployment/default/web", "Namespace//default"}
+	if got := resourceKeys(manifest.Resources); !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected the Deployment to carry over from the parent, got %v", got)
+	}
+}
+
+func TestParentStateOutOfScope(t *testing.T) {
+	parent := []types.ResourceWithContent{
+		{Content: []byte("a"), Info: types.ResourceInfo{APIVersion: "v1", Kind: "ConfigMap", Namespace: "default", Name: "kept"}},
+		{Content: []byte("b"), Info: types.ResourceInfo{APIVersion: "v1", Kind: "ConfigMap", Namespace: "other", Name: "filtered"}},
+	}
+	current := []types.ResourceWithContent{
+		{Content: []byte("a"), Info: types.ResourceInfo{APIVersion: "v1", Kind: "ConfigMap", Namespace: "default", Name: "kept"}},
+	}
+	inScope := func(info types.ResourceInfo) bool { return info.Namespace == "default" }
+
+	state := newParentState()
+	for _, resource := range parent {
+		state.add(resource)
+	}
+	changed := 0
+	for _, resource := range current {
+		if state.changed(resource) {
+			changed++
+		}
+	}
+	deleted := state.deleted(inScope)
+	if changed != 0 || len(deleted) != 0 {
+		t.Errorf("Expected no changes for unchanged and out-of-scope resources, got %d changed and %v deleted", changed, deleted)
+	}
+	if total := state.total(deleted); total != 2 {
+		t.Errorf("Expected the out-of-scope resource to carry over, got %d resources", total)
+	}
+}
@@ -0,0 +1,88 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// listPageSize is the number of objects requested per List call
+const listPageSize = 500
+
+// maxListRestarts bounds how often a list is restarted after its continue
+// token expired
+const maxListRestarts = 3
+
+// listFunc makes a single List call
+type listFunc func(ctx context.Context, options metav1.ListOptions) (runtime.Object, error)
+
+// listPages lists the objects of a collection that match the label and field
+// selectors a page at a time, passing each page's items to fn with the
+// resourceVersion of the collection they were read from. All pages
+// of a list come from the same snapshot of the collection. If a continue token
+// expires, the list restarts from a new snapshot and resumes after the last
+// object passed to fn. Paginated lists are ordered by namespace and name,
+// which continue tokens themselves rely on, so only that last key is kept;
+// objects created during the restart before that key are left out, as if
+// they had been created after the list passed them.
+func listPages(ctx context.Context, list listFunc, selectors metav1.ListOptions, fn func(items []runtime.Object, resourceVersion string) error) error {
+	options := metav1.ListOptions{
+		LabelSelector: selectors.LabelSelector,
+		FieldSelector: selectors.FieldSelector,
+		Limit:         listPageSize,
+	}
+	lastKey := ""
+	restarts := 0
+
+	for {
+		obj, err := list(ctx, options)
+		if err != nil && options.Continue != "" && (apierrors.IsResourceExpired(err) || apierrors.IsGone(err)) {
+			if restarts == maxListRestarts {
+				return fmt.Errorf("list continue token expired %d times: %w", restarts+1, err)
+			}
+			restarts++
+			log.Printf("List continue token expired, restarting the list")
+			options.Continue = ""
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		listMeta, err := meta.ListAccessor(obj)
+		if err != nil {
+			return fmt.Errorf("failed to read list metadata: %w", err)
+		}
+		items, err := meta.ExtractList(obj)
+		if err != nil {
+			return fmt.Errorf("failed to read list items: %w", err)
+		}
+
+		page := make([]runtime.Object, 0, len(items))
+		for _, item := range items {
+			accessor, err := meta.Accessor(item)
+			if err != nil {
+				return fmt.Errorf("failed to read object metadata: %w", err)
+			}
+			key := accessor.GetNamespace() + "/" + accessor.GetName()
+			if restarts > 0 && key <= lastKey {
+				continue
+			}
+			lastKey = key
+			page = append(page, item)
+		}
+		if err := fn(page, listMeta.GetResourceVersion()); err != nil {
+			return err
+		}
+
+		options.Continue = listMeta.GetContinue()
+		if options.Continue == "" {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package backup
+
+import (
+	"context"
+	"reflect"
+	"strconv"
+	"testing"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// fakePagedList serves names two at a time, as snapshots whose
+// resourceVersion is the number of lists started. Continue tokens listed in
+// expire fail once with 410 Gone.
+type fakePagedList struct {
+	names   []string
+	expire  map[string]bool
+	options []metav1.ListOptions
+	lists   int
+}
+
+func (f *fakePagedList) list(_ context.Context, options metav1.ListOptions) (runtime.Object, error) {
+	f.options = append(f.options, options)
+	if f.expire[options.Continue] {
+		delete(f.expire, options.Continue)
+		return nil, apierrors.NewResourceExpired("continue token expired")
+	}
+
+	start := 0
+	if options.Continue == "" {
+		f.lists++
+	} else {
+		start, _ = strconv.Atoi(options.Continue)
+	}
+	end := start + 2
+	if end > len(f.names) {
+		end = len(f.names)
+	}
+
+	list := &unstructured.UnstructuredList{}
+	list.SetResourceVersion(strconv.Itoa(f.lists))
+	if end < len(f.names) {
+		list.SetContinue(strconv.Itoa(end))
+	}
+	for _, name := range f.names[start:end] {
+		list.Items = append(list.Items, *newTestObject("v1", "ConfigMap", "default", name))
+	}
+	return list, nil
+}
+
+func TestListPages(t *testing.T) {
+	fake := &fakePagedList{names: []string{"a", "b", "c", "d", "e"}, expire: map[string]bool{"4": true}}
+
+	var got []string
+	err := listPages(context.Background(), fake.list, metav1.ListOptions{}, func(items []runtime.Object, resourceVersion string) error {
+		for _, item := range items {
+			got = append(got, item.(*unstructured.Unstructured).GetName()+"@"+resourceVersion)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("listPages failed: %v", err)
+	}
+
+	// The expired token restarts the list from a new snapshot, without
+	// repeating the objects already passed on
+	expected := []string{"a@1", "b@1", "c@1", "d@1", "e@2"}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("Expected %v, got %v", expected, got)
+	}
+	for _, options := range fake.options {
+		if options.Limit != listPageSize {
+			t.Errorf("Expected every List call to set Limit %d, got %+v", listPageSize, options)
+		}
+	}
+}
+
+func TestListPagesResumesAfterLastObject(t *testing.T) {
+	fake := &fakePagedList{names: []string{"a", "b", "c", "d", "e"}, expire: map[string]bool{"4": true}}
+	// Objects are created on either side of the last object passed on while
+	// the list restarts
+	list := func(ctx context.Context, options metav1.ListOptions) (runtime.Object, error) {
+		if options.Continue == "" && fake.lists == 1 {
+			fake.names = []string{"a", "b", "bb", "c", "d", "e", "f"}
+		}
+		return fake.list(ctx, options)
+	}
+
+	var got []string
+	err := listPages(context.Background(), list, metav1.ListOptions{}, func(items []runtime.Object, resourceVersion string) error {
+		for _, item := range items {
+			got = append(got, item.(*unstructured.Unstructured).GetName()+"@"+resourceVersion)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("listPages failed: %v", err)
+	}
+
+	expected := []string{"a@1", "b@1", "c@1", "d@1", "e@2", "f@2"}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("Expected %v, got %v", expected, got)
+	}
+}
+
+func TestListPagesExpiresRepeatedly(t *testing.T) {
+	fake := &fakePagedList{names: []string{"a", "b", "c"}, expire: map[string]bool{}}
+	list := func(ctx context.Context, options metav1.ListOptions) (runtime.Object, error) {
+		fake.expire["2"] = true
+		return fake.list(ctx, options)
+	}
+
+	err := listPages(context.Background(), list, metav1.ListOptions{}, func([]runtime.Object, string) error { return nil })
+	if !apierrors.IsResourceExpired(err) {
+		t.Errorf("Expected the expired error after %d restarts, got %v", maxListRestarts, err)
+	}
+	if fake.lists != maxListRestarts+1 {
+		t.Errorf("Expected %d lists, got %d", maxListRestarts+1, fake.lists)
+	}
+}
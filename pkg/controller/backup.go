@@ -0,0 +1,147 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"k8s-backup/pkg/backup"
+	"k8s-backup/pkg/types"
+)
+
+// reconcileBackup takes the backup of a new Backup resource
+func (c *Controller) reconcileBackup(ctx context.Context, namespace, name string) error {
+	var resource Backup
+	found, err := c.get(ctx, BackupsResource, namespace, name, &resource)
+	if err != nil || !found {
+		return err
+	}
+
+	status := resource.Status
+	switch {
+	case status.Phase.Finished():
+		return nil
+	case status.Phase == PhaseInProgress:
+		// A backup runs to completion on the worker that started it, so one
+		// still in progress was interrupted by a controller that stopped
+		status.Phase = PhaseFailed
+		status.CompletionTime = c.now()
+		status.Error = "interrupted: the controller stopped during the backup"
+		log.Printf("Backup %s/%s was interrupted", namespace, name)
+		return c.updateStatus(ctx, BackupsResource, namespace, name, &status)
+	}
+
+	location, err := c.storageLocation(resource.Spec.Storage)
+	if err != nil {
+		status.Phase = PhaseFailed
+		status.CompletionTime = c.now()
+		status.Error = err.Error()
+		log.Printf("Backup %s/%s failed: %v", namespace, name, err)
+		return c.updateStatus(ctx, BackupsResource, namespace, name, &status)
+	}
+	status = BackupStatus{
+		Phase:     PhaseInProgress,
+		StartTime: c.now(),
+		Storage:   location,
+	}
+	if err := c.updateStatus(ctx, BackupsResource, namespace, name, &status); err != nil {
+		return err
+	}
+
+	log.Printf("Backup %s/%s started", namespace, name)
+	metadata, warnings, err := c.runBackup(ctx, &resource, &status)
+	status.Progress = nil
+	status.CompletionTime = c.now()
+	switch {
+	case err != nil:
+		status.Phase = PhaseFailed
+		status.Error = err.Error()
+		if ctx.Err() != nil {
+			status.Error = "interrupted: " + status.Error
+		}
+		log.Printf("Backup %s/%s failed: %v", namespace, name, err)
+	default:
+		status.Phase = PhaseCompleted
+		status.BackupPath = metadata.BackupPath
+		status.TotalResources = metadata.TotalResources
+		status.Size = metadata.Size
+		status.VolumeSnapshots = len(metadata.VolumeSnapshots)
+		status.HooksRun = len(metadata.Hooks)
+		status.WarningCount = len(warnings)
+		status.Warnings = statusMessages(warnings)
+		log.Printf("Backup %s/%s completed: %d resources", namespace, name, metadata.TotalResources)
+	}
+	return c.finalStatus(ctx, BackupsResource, namespace, name, &status)
+}
+
+// runBackup takes the backup of a Backup resource, reporting its progress
+// in status, and returns the backup's metadata and warnings
+func (c *Controller) runBackup(ctx context.Context, resource *Backup, status *BackupStatus) (*types.BackupMetadata, []error, error) {
+	backend, err := c.openStorage(status.Storage)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open storage %s: %w", status.Storage, err)
+	}
+
+	// The controller's filesystem is not the user's, so hooks are declared
+	// inline
+	if resource.Spec.HooksFile != "" {
+		return nil, nil, fmt.Errorf("spec.hooksFile is not supported, declare hooks in spec.hooks")
+	}
+	hookConfig, err := resource.Spec.HookConfig()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	manager := backup.NewManager(c.client, backend)
+	manager.SetHooks(hookConfig)
+
+	options := resource.Spec.Options(storageName(resource.Namespace, resource.Name))
+	if schedule := resource.Labels[ScheduleLabel]; schedule != "" {
+		options.Schedule = scheduleID(resource.Namespace, schedule)
+	}
+	if !c.clusterWide(resource.Namespace) {
+		if err := limitBackup(resource, options); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	// The final progress report carries the warnings of the whole backup
+	var warnings []error
+	report := c.progressReporter(func(progress *Progress) {
+		status.Progress = progress
+		if err := c.updateStatus(ctx, BackupsResource, resource.Namespace, resource.Name, status); err != nil {
+			log.Printf("Warning: %v", err)
+		}
+	})
+	metadata, err := manager.CreateBackup(ctx, options, func(progress types.Progress) {
+		warnings = progress.Errors
+		report(progress)
+	})
+	return metadata, warnings, err
+}
+
+// storageName names the stored backup of a Backup. Storage locations are
+// shared by every namespace, so the name is qualified with the namespace,
+// e.g. shop.before-upgrade. Namespaces cannot contain a dot, so Backups in
+// different namespaces never share a stored name.
+func storageName(namespace, name string) string {
+	return namespace + "." + name
+}
+
+// limitBackup limits a Backup outside the controller's namespace to the
+// namespaced objects of its own namespace. Hook rules can exec into any pod
+// they select, so only the hook annotations of its own pods are run.
+func limitBackup(resource *Backup, options *types.BackupOptions) error {
+	namespace := resource.Namespace
+	if len(resource.Spec.Hooks) > 0 {
+		return fmt.Errorf("spec.hooks is only supported in the controller's namespace; annotate the pods of %s instead", namespace)
+	}
+	for _, ns := range options.Namespaces {
+		if ns != namespace {
+			return fmt.Errorf("spec.namespaces may only list %s, the namespace of the Backup", namespace)
+		}
+	}
+	options.Namespaces = []string{namespace}
+	options.ExcludeClusterResources = true
+	return nil
+}
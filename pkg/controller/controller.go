@@ -0,0 +1,297 @@
+// Package controller runs k8s-backup as a Kubernetes operator. It watches
+// Backup, Restore and BackupSchedule custom resources, takes and restores
+// backups with the backup and restore managers and records their phase,
+// progress and outcome in each resource's status.
+//
+// Backups and Restores run once: a resource that is still in progress when
+// the controller starts was interrupted and is marked as failed.
+// BackupSchedules create a Backup for each scheduled time, one at a time, and
+// apply their retention policy once it has completed.
+package controller
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/retry"
+	"k8s.io/client-go/util/workqueue"
+	"k8s.io/utils/clock"
+
+	"k8s-backup/pkg/k8s"
+	"k8s-backup/pkg/storage"
+	"k8s-backup/pkg/types"
+)
+
+const (
+	// resyncPeriod is how often every resource is reconciled without changes
+	resyncPeriod = 10 * time.Minute
+	// statusTimeout bounds the final status update of a Backup or Restore,
+	// which is made even when the controller is stopping
+	statusTimeout = 30 * time.Second
+)
+
+// StorageOpener opens a storage location, configured with the encryption
+// and signing keys of the controller
+type StorageOpener func(location string) (storage.Storage, error)
+
+// Options configure a controller
+type Options struct {
+	// Namespace limits the controller to the resources of one namespace;
+	// every namespace is watched when empty
+	Namespace string
+	// ControllerNamespace is the namespace the controller runs in. Backups
+	// and Restores run with the controller's credentials, so only those in
+	// this namespace may span the cluster; elsewhere they are limited to
+	// their own namespace.
+	ControllerNamespace string
+	// DefaultStorage is the storage location of resources that do not set one
+	DefaultStorage string
+	// AllowedStorage lists the other storage locations resources may set.
+	// The controller opens them with its own credentials, so any other
+	// location is refused.
+	AllowedStorage []string
+	// Workers is the number of resources of each kind reconciled at once
+	Workers int
+	// ProgressInterval is how often the status of a running Backup or
+	// Restore is updated with its progress
+	ProgressInterval time.Duration
+}
+
+// Controller reconciles Backup, Restore and BackupSchedule resources
+type Controller struct {
+	client      *k8s.Client
+	openStorage StorageOpener
+	options     Options
+	clock       clock.Clock
+
+	backups   workqueue.RateLimitingInterface
+	restores  workqueue.RateLimitingInterface
+	schedules workqueue.RateLimitingInterface
+}
+
+// NewController creates a controller that opens storage locations with
+// openStorage
+func NewController(client *k8s.Client, openStorage StorageOpener, options Options) *Controller {
+	if options.Workers <= 0 {
+		options.Workers = 1
+	}
+	if options.ProgressInterval <= 0 {
+		options.ProgressInterval = 5 * time.Second
+	}
+	return &Controller{
+		client:      client,
+		openStorage: openStorage,
+		options:     options,
+		clock:       clock.RealClock{},
+		backups:     workqueue.NewRateLimitingQueueWithConfig(workqueue.DefaultControllerRateLimiter(), workqueue.RateLimitingQueueConfig{Name: "backups"}),
+		restores:    workqueue.NewRateLimitingQueueWithConfig(workqueue.DefaultControllerRateLimiter(), workqueue.RateLimitingQueueConfig{Name: "restores"}),
+		schedules:   workqueue.NewRateLimitingQueueWithConfig(workqueue.DefaultControllerRateLimiter(), workqueue.RateLimitingQueueConfig{Name: "backupschedules"}),
+	}
+}
+
+// SetClock sets the clock schedules are evaluated against
+func (c *Controller) SetClock(clock clock.Clock) {
+	c.clock = clock
+}
+
+// Run watches the custom resources and reconciles them until ctx is
+// cancelled. Cancelling ctx also cancels running backups and restores, which
+// are marked as failed; Run returns once they have stopped.
+func (c *Controller) Run(ctx context.Context) error {
+	factory := dynamicinformer.NewFilteredDynamicSharedInformerFactory(c.client.Dynamic(), resyncPeriod, c.options.Namespace, nil)
+
+	backupInformer := factory.ForResource(BackupsResource).Informer()
+	backupInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(obj interface{}) { c.backupChanged(obj) },
+		UpdateFunc: func(_, obj interface{}) { c.backupChanged(obj) },
+		DeleteFunc: func(obj interface{}) { c.backupChanged(obj) },
+	})
+	restoreInformer := factory.ForResource(RestoresResource).Informer()
+	restoreInformer.AddEventHandler(enqueueHandler(c.restores))
+	scheduleInformer := factory.ForResource(BackupSchedulesResource).Informer()
+	scheduleInformer.AddEventHandler(enqueueHandler(c.schedules))
+
+	factory.Start(ctx.Done())
+	defer factory.Shutdown()
+	if !cache.WaitForCacheSync(ctx.Done(), backupInformer.HasSynced, restoreInformer.HasSynced, scheduleInformer.HasSynced) {
+		return fmt.Errorf("failed to sync informers: %w", ctx.Err())
+	}
+	log.Printf("Controller started with %d workers per resource", c.options.Workers)
+
+	var wg sync.WaitGroup
+	for _, worker := range []struct {
+		queue     workqueue.RateLimitingInterface
+		reconcile func(ctx context.Context, namespace, name string) error
+	}{
+		{c.backups, c.reconcileBackup},
+		{c.restores, c.reconcileRestore},
+		{c.schedules, c.reconcileSchedule},
+	} {
+		for i := 0; i < c.options.Workers; i++ {
+			wg.Add(1)
+			go func(queue workqueue.RateLimitingInterface, reconcile func(ctx context.Context, namespace, name string) error) {
+				defer wg.Done()
+				for c.processNext(ctx, queue, reconcile) {
+				}
+			}(worker.queue, worker.reconcile)
+		}
+	}
+
+	<-ctx.Done()
+	c.backups.ShutDown()
+	c.restores.ShutDown()
+	c.schedules.ShutDown()
+	wg.Wait()
+	log.Printf("Controller stopped")
+	return nil
+}
+
+// processNext reconciles the next key of a queue, and returns false once the
+// queue is shut down
+func (c *Controller) processNext(ctx context.Context, queue workqueue.RateLimitingInterface, reconcile func(ctx context.Context, namespace, name string) error) bool {
+	item, shutdown := queue.Get()
+	if shutdown {
+		return false
+	}
+	defer queue.Done(item)
+
+	key := item.(string)
+	namespace, name, err := cache.SplitMetaNamespaceKey(key)
+	if err != nil {
+		queue.Forget(item)
+		return true
+	}
+	if err := reconcile(ctx, namespace, name); err != nil {
+		if ctx.Err() == nil {
+			log.Printf("Failed to reconcile %s, retrying: %v", key, err)
+			queue.AddRateLimited(item)
+		}
+		return true
+	}
+	queue.Forget(item)
+	return true
+}
+
+// enqueueHandler adds the key of every changed resource to queue
+func enqueueHandler(queue workqueue.RateLimitingInterface) cache.ResourceEventHandler {
+	enqueue := func(obj interface{}) {
+		if key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj); err == nil {
+			queue.Add(key)
+		}
+	}
+	return cache.ResourceEventHandlerFuncs{
+		AddFunc:    enqueue,
+		UpdateFunc: func(_, obj interface{}) { enqueue(obj) },
+		DeleteFunc: enqueue,
+	}
+}
+
+// backupChanged enqueues a changed Backup, and the BackupSchedule that
+// created it so the schedule sees it finish
+func (c *Controller) backupChanged(obj interface{}) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	backup, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return
+	}
+	c.backups.Add(backup.GetNamespace() + "/" + backup.GetName())
+	if schedule := backup.GetLabels()[ScheduleLabel]; schedule != "" {
+		c.schedules.Add(backup.GetNamespace() + "/" + schedule)
+	}
+}
+
+// get fetches the latest version of a custom resource into its typed form.
+// It returns false when the resource no longer exists.
+func (c *Controller) get(ctx context.Context, resource schema.GroupVersionResource, namespace, name string, into interface{}) (bool, error) {
+	obj, err := c.client.Dynamic().Resource(resource).Namespace(namespace).Get(ctx, name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to get %s %s/%s: %w", resource.Resource, namespace, name, err)
+	}
+	return true, fromUnstructured(obj, into)
+}
+
+// updateStatus replaces the status of a custom resource with status, a
+// pointer to its status struct
+func (c *Controller) updateStatus(ctx context.Context, resource schema.GroupVersionResource, namespace, name string, status interface{}) error {
+	content, err := runtime.DefaultUnstructuredConverter.ToUnstructured(status)
+	if err != nil {
+		return fmt.Errorf("failed to encode status: %w", err)
+	}
+	client := c.client.Dynamic().Resource(resource).Namespace(namespace)
+	err = retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		obj, err := client.Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		obj.Object["status"] = content
+		_, err = client.UpdateStatus(ctx, obj, metav1.UpdateOptions{})
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to update status of %s %s/%s: %w", resource.Resource, namespace, name, err)
+	}
+	return nil
+}
+
+// finalStatus updates the status of a finished Backup or Restore, also when
+// ctx has been cancelled because the controller is stopping
+func (c *Controller) finalStatus(ctx context.Context, resource schema.GroupVersionResource, namespace, name string, status interface{}) error {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), statusTimeout)
+	defer cancel()
+	return c.updateStatus(ctx, resource, namespace, name, status)
+}
+
+// storageLocation returns the storage location of a resource, which must be
+// the default or one of the allowed locations
+func (c *Controller) storageLocation(location string) (string, error) {
+	if location == "" || location == c.options.DefaultStorage {
+		return c.options.DefaultStorage, nil
+	}
+	for _, allowed := range c.options.AllowedStorage {
+		if location == allowed {
+			return location, nil
+		}
+	}
+	return "", fmt.Errorf("storage %s is not allowed by the controller", location)
+}
+
+// clusterWide reports whether the Backups and Restores of a namespace may
+// span the cluster
+func (c *Controller) clusterWide(namespace string) bool {
+	return c.options.ControllerNamespace != "" && namespace == c.options.ControllerNamespace
+}
+
+// progressReporter returns a progress callback that passes the progress of
+// a running Backup or Restore to report at most once per ProgressInterval
+func (c *Controller) progressReporter(report func(progress *Progress)) types.ProgressCallback {
+	var last time.Time
+	return func(progress types.Progress) {
+		now := c.clock.Now()
+		if now.Sub(last) < c.options.ProgressInterval {
+			return
+		}
+		last = now
+		report(&Progress{Total: progress.Total, Completed: progress.Completed, Current: progress.Current})
+	}
+}
+
+// now returns the current time of the controller's clock
+func (c *Controller) now() *metav1.Time {
+	now := metav1.NewTime(c.clock.Now())
+	return &now
+}
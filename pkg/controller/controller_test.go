@@ -0,0 +1,389 @@
+package controller
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	apiextensionsfake "k8s.io/apiextensions-apiserver/pkg/client/clientset/clientset/fake"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	k8stypes "k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/version"
+	fakediscovery "k8s.io/client-go/discovery/fake"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	testclock "k8s.io/utils/clock/testing"
+
+	"k8s-backup/pkg/hooks"
+	"k8s-backup/pkg/k8s"
+	"k8s-backup/pkg/schedule"
+	"k8s-backup/pkg/storage"
+)
+
+var testAPIResources = []*metav1.APIResourceList{
+	{
+		GroupVersion: "v1",
+		APIResources: []metav1.APIResource{
+			{Name: "namespaces", SingularName: "namespace", Kind: "Namespace", Verbs: metav1.Verbs{"get", "list", "patch"}},
+			{Name: "configmaps", SingularName: "configmap", Kind: "ConfigMap", Namespaced: true, Verbs: metav1.Verbs{"get", "list", "patch"}},
+		},
+	},
+}
+
+// testController is a controller against fake clients, storing backups in a
+// temporary directory
+type testController struct {
+	*Controller
+	clock   *testclock.FakeClock
+	storage string
+
+	mu      sync.Mutex
+	applied []string
+}
+
+func newTestController(t *testing.T, objects ...runtime.Object) *testController {
+	t.Helper()
+	clientset := kubefake.NewSimpleClientset()
+	fakeDiscovery := clientset.Discovery().(*fakediscovery.FakeDiscovery)
+	fakeDiscovery.Resources = testAPIResources
+	fakeDiscovery.FakedServerVersion = &version.Info{GitVersion: "v1.28.4"}
+
+	listKinds := map[schema.GroupVersionResource]string{
+		{Version: "v1", Resource: "namespaces"}: "NamespaceList",
+		{Version: "v1", Resource: "configmaps"}: "ConfigMapList",
+		BackupsResource:                         "BackupList",
+		RestoresResource:                        "RestoreList",
+		BackupSchedulesResource:                 "BackupScheduleList",
+	}
+	objects = append(objects,
+		newTestObject("v1", "Namespace", "", "shop"),
+		newTestObject("v1", "ConfigMap", "shop", "settings"),
+	)
+	dynamicClient := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), listKinds, objects...)
+
+	tc := &testController{
+		clock:   testclock.NewFakeClock(time.Date(2025, 9, 12, 1, 59, 0, 0, time.UTC)),
+		storage: t.TempDir(),
+	}
+	dynamicClient.PrependReactor("patch", "*", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		patch := action.(k8stesting.PatchAction)
+		if patch.GetPatchType() != k8stypes.ApplyPatchType {
+			return false, nil, nil
+		}
+		tc.mu.Lock()
+		tc.applied = append(tc.applied, patch.GetResource().Resource+"/"+patch.GetName())
+		tc.mu.Unlock()
+		obj := &unstructured.Unstructured{}
+		if err := obj.UnmarshalJSON(patch.GetPatch()); err != nil {
+			return true, nil, err
+		}
+		return true, obj, nil
+	})
+
+	client := k8s.NewClientFromInterfaces(clientset, apiextensionsfake.NewSimpleClientset(), dynamicClient)
+	tc.Controller = NewController(client, func(location string) (storage.Storage, error) {
+		return storage.NewLocalStorage(location), nil
+	}, Options{ControllerNamespace: "ops", DefaultStorage: tc.storage})
+	tc.SetClock(tc.clock)
+	t.Cleanup(func() {
+		tc.backups.ShutDown()
+		tc.restores.ShutDown()
+		tc.schedules.ShutDown()
+	})
+	return tc
+}
+
+func newTestObject(apiVersion, kind, namespace, name string) *unstructured.Unstructured {
+	obj := &unstructured.Unstructured{}
+	obj.SetAPIVersion(apiVersion)
+	obj.SetKind(kind)
+	obj.SetNamespace(namespace)
+	obj.SetName(name)
+	return obj
+}
+
+// toObject converts a typed custom resource for the fake dynamic client
+func toObject(t *testing.T, resource interface{}) *unstructured.Unstructured {
+	t.Helper()
+	content, err := runtime.DefaultUnstructuredConverter.ToUnstructured(resource)
+	if err != nil {
+		t.Fatalf("Failed to convert resource: %v", err)
+	}
+	return &unstructured.Unstructured{Object: content}
+}
+
+func (tc *testController) getBackup(t *testing.T, namespace, name string) *Backup {
+	t.Helper()
+	var backup Backup
+	found, err := tc.get(context.Background(), BackupsResource, namespace, name, &backup)
+	if err != nil || !found {
+		t.Fatalf("Failed to get backup %s/%s: found=%v, %v", namespace, name, found, err)
+	}
+	return &backup
+}
+
+func newTestBackup(namespace, name string, spec BackupSpec) *Backup {
+	return &Backup{
+		TypeMeta:   metav1.TypeMeta{APIVersion: Group + "/" + Version, Kind: "Backup"},
+		ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name},
+		Spec:       spec,
+	}
+}
+
+func TestInstallCRDs(t *testing.T) {
+	client := apiextensionsfake.NewSimpleClientset()
+	for i := 0; i < 2; i++ {
+		if err := InstallCRDs(context.Background(), client); err != nil {
+			t.Fatalf("InstallCRDs failed: %v", err)
+		}
+	}
+
+	crds, err := client.ApiextensionsV1().CustomResourceDefinitions().List(context.Background(), metav1.ListOptions{})
+	if err != nil {
+		t.Fatalf("Failed to list CRDs: %v", err)
+	}
+	names := map[string]bool{}
+	for _, crd := range crds.Items {
+		names[crd.Name] = true
+		if crd.Spec.Versions[0].Subresources == nil || crd.Spec.Versions[0].Subresources.Status == nil {
+			t.Errorf("Expected %s to have a status subresource", crd.Name)
+		}
+	}
+	for _, name := range []string{"backups.k8s-backup.io", "restores.k8s-backup.io", "backupschedules.k8s-backup.io"} {
+		if !names[name] {
+			t.Errorf("Expected CRD %s, got %v", name, names)
+		}
+	}
+}
+
+func TestReconcileBackup(t *testing.T) {
+	tc := newTestController(t, toObject(t, newTestBackup("ops", "before-upgrade", BackupSpec{
+		Backup: schedule.Backup{Namespaces: []string{"shop"}},
+	})))
+	ctx := context.Background()
+
+	if err := tc.reconcileBackup(ctx, "ops", "before-upgrade"); err != nil {
+		t.Fatalf("reconcileBackup failed: %v", err)
+	}
+	backup := tc.getBackup(t, "ops", "before-upgrade")
+	status := backup.Status
+	if status.Phase != PhaseCompleted || status.Error != "" {
+		t.Fatalf("Expected the backup to complete, got %+v", status)
+	}
+	// The namespace and its config map
+	if status.TotalResources != 2 || status.Storage != tc.storage || status.StartTime == nil || status.CompletionTime == nil || status.Progress != nil {
+		t.Errorf("Unexpected status %+v", status)
+	}
+
+	metadata, err := storage.FindBackup(storage.NewLocalStorage(tc.storage), "ops.before-upgrade")
+	if err != nil {
+		t.Fatalf("Expected the backup in storage: %v", err)
+	}
+	if status.BackupPath != metadata.BackupPath {
+		t.Errorf("Expected the backup path %s in the status, got %s", metadata.BackupPath, status.BackupPath)
+	}
+	if metadata.Schedule != "" || len(metadata.Namespaces) != 1 {
+		t.Errorf("Unexpected backup metadata %+v", metadata)
+	}
+
+	// A finished backup is not taken again
+	if err := tc.reconcileBackup(ctx, "ops", "before-upgrade"); err != nil {
+		t.Fatalf("reconcileBackup failed: %v", err)
+	}
+	if again := tc.getBackup(t, "ops", "before-upgrade"); !again.Status.CompletionTime.Equal(status.CompletionTime) {
+		t.Error("Expected a completed backup to be left alone")
+	}
+}
+
+func TestReconcileBackupFailures(t *testing.T) {
+	interrupted := newTestBackup("ops", "interrupted", BackupSpec{})
+	interrupted.Status.Phase = PhaseInProgress
+	tc := newTestController(t,
+		toObject(t, interrupted),
+		toObject(t, newTestBackup("ops", "invalid", BackupSpec{Backup: schedule.Backup{Selector: "app in"}})),
+		toObject(t, newTestBackup("ops", "elsewhere", BackupSpec{Storage: "s3://other-bucket"})),
+		toObject(t, newTestBackup("ops", "hooks-file", BackupSpec{Backup: schedule.Backup{HooksFile: "/etc/passwd"}})),
+	)
+	ctx := context.Background()
+
+	for name, expected := range map[string]string{
+		"interrupted": "interrupted",
+		"invalid":     "invalid selector",
+		"elsewhere":   "storage s3://other-bucket is not allowed",
+		"hooks-file":  "spec.hooksFile is not supported",
+	} {
+		if err := tc.reconcileBackup(ctx, "ops", name); err != nil {
+			t.Fatalf("reconcileBackup failed: %v", err)
+		}
+		status := tc.getBackup(t, "ops", name).Status
+		if status.Phase != PhaseFailed || !strings.Contains(status.Error, expected) {
+			t.Errorf("%s: expected the backup to fail with %q, got %+v", name, expected, status)
+		}
+	}
+
+	// Deleted resources are ignored
+	if err := tc.reconcileBackup(ctx, "ops", "deleted"); err != nil {
+		t.Errorf("Expected a missing backup to be ignored, got %v", err)
+	}
+}
+
+func TestStorageLocation(t *testing.T) {
+	tc := newTestController(t)
+	tc.options.AllowedStorage = []string{"s3://team-bucket"}
+
+	for location, expected := range map[string]string{
+		"":                 tc.storage,
+		tc.storage:         tc.storage,
+		"s3://team-bucket": "s3://team-bucket",
+	} {
+		if actual, err := tc.storageLocation(location); err != nil || actual != expected {
+			t.Errorf("%q: expected %s, got %s, %v", location, expected, actual, err)
+		}
+	}
+	for _, location := range []string{"s3://other-bucket", "/var/lib/k8s-backup"} {
+		if _, err := tc.storageLocation(location); err == nil {
+			t.Errorf("Expected %s to be refused", location)
+		}
+	}
+}
+
+func TestReconcileRestore(t *testing.T) {
+	restore := func(name, backup string) *unstructured.Unstructured {
+		return toObject(t, &Restore{
+			TypeMeta:   metav1.TypeMeta{APIVersion: Group + "/" + Version, Kind: "Restore"},
+			ObjectMeta: metav1.ObjectMeta{Namespace: "ops", Name: name},
+			Spec:       RestoreSpec{Backup: backup, Namespaces: []string{"shop"}},
+		})
+	}
+	tc := newTestController(t,
+		toObject(t, newTestBackup("ops", "nightly", BackupSpec{Backup: schedule.Backup{Namespaces: []string{"shop"}}})),
+		restore("restore-nightly", "nightly"),
+		restore("restore-missing", "missing"),
+	)
+	ctx := context.Background()
+	if err := tc.reconcileBackup(ctx, "ops", "nightly"); err != nil {
+		t.Fatalf("reconcileBackup failed: %v", err)
+	}
+
+	// The config map is gone by the time it is restored
+	configMaps := schema.GroupVersionResource{Version: "v1", Resource: "configmaps"}
+	if err := tc.client.Dynamic().Resource(configMaps).Namespace("shop").Delete(ctx, "settings", metav1.DeleteOptions{}); err != nil {
+		t.Fatalf("Failed to delete config map: %v", err)
+	}
+
+	if err := tc.reconcileRestore(ctx, "ops", "restore-nightly"); err != nil {
+		t.Fatalf("reconcileRestore failed: %v", err)
+	}
+	var restored Restore
+	if _, err := tc.get(ctx, RestoresResource, "ops", "restore-nightly", &restored); err != nil {
+		t.Fatalf("Failed to get restore: %v", err)
+	}
+	if restored.Status.Phase != PhaseCompleted || restored.Status.ProcessedResources != 1 || restored.Status.SkippedResources != 1 {
+		t.Errorf("Unexpected status %+v", restored.Status)
+	}
+	tc.mu.Lock()
+	applied := strings.Join(tc.applied, ",")
+	tc.mu.Unlock()
+	if applied != "configmaps/settings" {
+		t.Errorf("Expected only the missing config map to be applied, got %s", applied)
+	}
+
+	if err := tc.reconcileRestore(ctx, "ops", "restore-missing"); err != nil {
+		t.Fatalf("reconcileRestore failed: %v", err)
+	}
+	var missing Restore
+	if _, err := tc.get(ctx, RestoresResource, "ops", "restore-missing", &missing); err != nil {
+		t.Fatalf("Failed to get restore: %v", err)
+	}
+	if missing.Status.Phase != PhaseFailed || !strings.Contains(missing.Status.Error, "missing") {
+		t.Errorf("Expected the restore of a missing backup to fail, got %+v", missing.Status)
+	}
+}
+
+func TestReconcileOutsideControllerNamespace(t *testing.T) {
+	restore := func(name string, spec RestoreSpec) *unstructured.Unstructured {
+		return toObject(t, &Restore{
+			TypeMeta:   metav1.TypeMeta{APIVersion: Group + "/" + Version, Kind: "Restore"},
+			ObjectMeta: metav1.ObjectMeta{Namespace: "shop", Name: name},
+			Spec:       spec,
+		})
+	}
+	tc := newTestController(t,
+		toObject(t, newTestBackup("ops", "cluster", BackupSpec{Backup: schedule.Backup{Namespaces: []string{"shop"}}})),
+		toObject(t, newTestBackup("shop", "own", BackupSpec{})),
+		toObject(t, newTestBackup("shop", "other", BackupSpec{Backup: schedule.Backup{Namespaces: []string{"ops"}}})),
+		toObject(t, newTestBackup("shop", "hooks", BackupSpec{Backup: schedule.Backup{Hooks: []hooks.Rule{{
+			Name: "freeze",
+			Pre:  []hooks.Command{{Container: "db", Command: []string{"fsfreeze", "--freeze", "/data"}}},
+		}}}})),
+		toObject(t, newTestBackup("ops", "own", BackupSpec{Backup: schedule.Backup{Namespaces: []string{"ops"}}})),
+		restore("restore-own", RestoreSpec{Backup: "own"}),
+		restore("restore-cluster", RestoreSpec{Backup: "cluster"}),
+		restore("restore-mapped", RestoreSpec{Backup: "own", NamespaceMapping: map[string]string{"shop": "ops"}}),
+	)
+	ctx := context.Background()
+	for _, key := range [][2]string{{"ops", "cluster"}, {"ops", "own"}, {"shop", "own"}, {"shop", "other"}, {"shop", "hooks"}} {
+		if err := tc.reconcileBackup(ctx, key[0], key[1]); err != nil {
+			t.Fatalf("reconcileBackup failed: %v", err)
+		}
+	}
+
+	// Only the namespaced objects of the Backup's namespace are backed up
+	if status := tc.getBackup(t, "shop", "own").Status; status.Phase != PhaseCompleted || status.TotalResources != 1 {
+		t.Errorf("Expected the config map alone to be backed up, got %+v", status)
+	}
+	if status := tc.getBackup(t, "shop", "other").Status; status.Phase != PhaseFailed || !strings.Contains(status.Error, "may only list shop") {
+		t.Errorf("Expected a backup of another namespace to fail, got %+v", status)
+	}
+	if status := tc.getBackup(t, "shop", "hooks").Status; status.Phase != PhaseFailed || !strings.Contains(status.Error, "spec.hooks is only supported") {
+		t.Errorf("Expected a backup with hook rules to fail, got %+v", status)
+	}
+
+	// The namespace and its config map are gone by the time they are restored
+	namespaces := schema.GroupVersionResource{Version: "v1", Resource: "namespaces"}
+	if err := tc.client.Dynamic().Resource(namespaces).Delete(ctx, "shop", metav1.DeleteOptions{}); err != nil {
+		t.Fatalf("Failed to delete namespace: %v", err)
+	}
+	configMaps := schema.GroupVersionResource{Version: "v1", Resource: "configmaps"}
+	if err := tc.client.Dynamic().Resource(configMaps).Namespace("shop").Delete(ctx, "settings", metav1.DeleteOptions{}); err != nil {
+		t.Fatalf("Failed to delete config map: %v", err)
+	}
+
+	for _, name := range []string{"restore-own", "restore-cluster", "restore-mapped"} {
+		if err := tc.reconcileRestore(ctx, "shop", name); err != nil {
+			t.Fatalf("reconcileRestore failed: %v", err)
+		}
+	}
+	var own, cluster, mapped Restore
+	if _, err := tc.get(ctx, RestoresResource, "shop", "restore-own", &own); err != nil {
+		t.Fatalf("Failed to get restore: %v", err)
+	}
+	if own.Status.Phase != PhaseCompleted || own.Status.ProcessedResources != 1 {
+		t.Errorf("Unexpected status %+v", own.Status)
+	}
+	tc.mu.Lock()
+	applied := strings.Join(tc.applied, ",")
+	tc.mu.Unlock()
+	if applied != "configmaps/settings" {
+		t.Errorf("Expected only the config map to be applied, got %s", applied)
+	}
+	// Backups of other namespaces are out of reach
+	if _, err := tc.get(ctx, RestoresResource, "shop", "restore-cluster", &cluster); err != nil {
+		t.Fatalf("Failed to get restore: %v", err)
+	}
+	if cluster.Status.Phase != PhaseFailed || !strings.Contains(cluster.Status.Error, "not found") {
+		t.Errorf("Expected a restore of another namespace's backup to fail, got %+v", cluster.Status)
+	}
+	if _, err := tc.get(ctx, RestoresResource, "shop", "restore-mapped", &mapped); err != nil {
+		t.Fatalf("Failed to get restore: %v", err)
+	}
+	if mapped.Status.Phase != PhaseFailed || !strings.Contains(mapped.Status.Error, "cannot map shop into ops") {
+		t.Errorf("Expected a restore into another namespace to fail, got %+v", mapped.Status)
+	}
+}
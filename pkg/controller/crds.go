@@ -0,0 +1,214 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	apiextensionsclientset "k8s.io/apiextensions-apiserver/pkg/client/clientset/clientset"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// CustomResourceDefinitions returns the definitions of the Backup, Restore
+// and BackupSchedule resources
+func CustomResourceDefinitions() []*apiextensionsv1.CustomResourceDefinition {
+	hookCommand := objectSchema(map[string]apiextensionsv1.JSONSchemaProps{
+		"command":   stringListSchema(),
+		"container": stringSchema(),
+		"timeout":   stringSchema(),
+		"onError":   stringSchema(),
+	})
+	hookCommand.Required = []string{"command"}
+	hookRule := objectSchema(map[string]apiextensionsv1.JSONSchemaProps{
+		"name":       stringSchema(),
+		"namespaces": stringListSchema(),
+		"selector":   stringSchema(),
+		"container":  stringSchema(),
+		"pre":        listSchema(hookCommand),
+		"post":       listSchema(hookCommand),
+	})
+	hookRule.Required = []string{"name"}
+
+	backupOptions := map[string]apiextensionsv1.JSONSchemaProps{
+		"namespaces":           stringListSchema(),
+		"excludeNamespaces":    stringListSchema(),
+		"resourceTypes":        stringListSchema(),
+		"excludeResourceTypes": stringListSchema(),
+		"selector":             stringSchema(),
+		"fieldSelector":        stringSchema(),
+		"namespaceSelector":    stringSchema(),
+		"compress":             booleanSchema(),
+		"concurrency":          integerSchema(),
+		"snapshotVolumes":      booleanSchema(),
+		"snapshotTimeout":      stringSchema(),
+		"volumeData":           stringListSchema(),
+		"dataMoverImage":       stringSchema(),
+		"volumeDataTimeout":    stringSchema(),
+		"hooks":                listSchema(hookRule),
+		"skipHooks":            booleanSchema(),
+	}
+
+	backupSpec := objectSchema(map[string]apiextensionsv1.JSONSchemaProps{"storage": stringSchema()})
+	for name, property := range backupOptions {
+		backupSpec.Properties[name] = property
+	}
+
+	restoreSpec := objectSchema(map[string]apiextensionsv1.JSONSchemaProps{
+		"storage":                 stringSchema(),
+		"backup":                  stringSchema(),
+		"namespaces":              stringListSchema(),
+		"resourceTypes":           stringListSchema(),
+		"selector":                stringSchema(),
+		"namespaceMapping":        stringMapSchema(),
+		"remapClusterResources":   booleanSchema(),
+		"existingPolicy":          stringSchema(),
+		"existingPolicyOverrides": stringMapSchema(),
+		"forceConflicts":          booleanSchema(),
+		"wait":                    booleanSchema(),
+		"timeout":                 stringSchema(),
+		"serverDryRun":            booleanSchema(),
+		"skipVolumeSnapshots":     booleanSchema(),
+		"skipVolumeData":          booleanSchema(),
+		"dataMoverImage":          stringSchema(),
+	})
+	restoreSpec.Required = []string{"backup"}
+
+	scheduleSpec := objectSchema(map[string]apiextensionsv1.JSONSchemaProps{
+		"schedule":         stringSchema(),
+		"timeZone":         stringSchema(),
+		"jitter":           stringSchema(),
+		"startingDeadline": stringSchema(),
+		"suspend":          booleanSchema(),
+		"storage":          stringSchema(),
+		"backup":           objectSchema(backupOptions),
+		"retention": objectSchema(map[string]apiextensionsv1.JSONSchemaProps{
+			"keepLast":     integerSchema(),
+			"keepDaily":    integerSchema(),
+			"keepWeekly":   integerSchema(),
+			"keepMonthly":  integerSchema(),
+			"maxAge":       stringSchema(),
+			"maxTotalSize": stringSchema(),
+		}),
+	})
+	scheduleSpec.Required = []string{"schedule"}
+
+	phaseColumn := apiextensionsv1.CustomResourceColumnDefinition{Name: "Phase", Type: "string", JSONPath: ".status.phase"}
+	ageColumn := apiextensionsv1.CustomResourceColumnDefinition{Name: "Age", Type: "date", JSONPath: ".metadata.creationTimestamp"}
+
+	return []*apiextensionsv1.CustomResourceDefinition{
+		customResourceDefinition("Backup", "backups", backupSpec, phaseColumn,
+			apiextensionsv1.CustomResourceColumnDefinition{Name: "Resources", Type: "integer", JSONPath: ".status.totalResources"},
+			ageColumn),
+		customResourceDefinition("Restore", "restores", restoreSpec,
+			apiextensionsv1.CustomResourceColumnDefinition{Name: "Backup", Type: "string", JSONPath: ".spec.backup"},
+			phaseColumn, ageColumn),
+		customResourceDefinition("BackupSchedule", "backupschedules", scheduleSpec,
+			apiextensionsv1.CustomResourceColumnDefinition{Name: "Schedule", Type: "string", JSONPath: ".spec.schedule"},
+			apiextensionsv1.CustomResourceColumnDefinition{Name: "Suspend", Type: "boolean", JSONPath: ".spec.suspend"},
+			apiextensionsv1.CustomResourceColumnDefinition{Name: "Last Backup", Type: "string", JSONPath: ".status.lastBackup"},
+			apiextensionsv1.CustomResourceColumnDefinition{Name: "Next", Type: "date", JSONPath: ".status.nextScheduleTime"},
+			ageColumn),
+	}
+}
+
+// InstallCRDs creates the custom resource definitions, or updates them to
+// the controller's version. The API server serves the resources shortly
+// after; informers retry until it does.
+func InstallCRDs(ctx context.Context, client apiextensionsclientset.Interface) error {
+	crds := client.ApiextensionsV1().CustomResourceDefinitions()
+	for _, crd := range CustomResourceDefinitions() {
+		existing, err := crds.Get(ctx, crd.Name, metav1.GetOptions{})
+		switch {
+		case apierrors.IsNotFound(err):
+			if _, err := crds.Create(ctx, crd, metav1.CreateOptions{}); err != nil {
+				return fmt.Errorf("failed to create CustomResourceDefinition %s: %w", crd.Name, err)
+			}
+			log.Printf("Created CustomResourceDefinition %s", crd.Name)
+		case err != nil:
+			return fmt.Errorf("failed to get CustomResourceDefinition %s: %w", crd.Name, err)
+		default:
+			existing.Spec = crd.Spec
+			if _, err := crds.Update(ctx, existing, metav1.UpdateOptions{}); err != nil {
+				return fmt.Errorf("failed to update CustomResourceDefinition %s: %w", crd.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// customResourceDefinition defines a namespaced resource with a status
+// subresource. The status is written by the controller only and is not
+// validated.
+func customResourceDefinition(kind, plural string, spec apiextensionsv1.JSONSchemaProps, columns ...apiextensionsv1.CustomResourceColumnDefinition) *apiextensionsv1.CustomResourceDefinition {
+	preserveUnknownFields := true
+	return &apiextensionsv1.CustomResourceDefinition{
+		ObjectMeta: metav1.ObjectMeta{Name: plural + "." + Group},
+		Spec: apiextensionsv1.CustomResourceDefinitionSpec{
+			Group: Group,
+			Names: apiextensionsv1.CustomResourceDefinitionNames{
+				Kind:       kind,
+				ListKind:   kind + "List",
+				Plural:     plural,
+				Singular:   strings.ToLower(kind),
+				Categories: []string{"k8s-backup"},
+			},
+			Scope: apiextensionsv1.NamespaceScoped,
+			Versions: []apiextensionsv1.CustomResourceDefinitionVersion{{
+				Name:    Version,
+				Served:  true,
+				Storage: true,
+				Schema: &apiextensionsv1.CustomResourceValidation{
+					OpenAPIV3Schema: &apiextensionsv1.JSONSchemaProps{
+						Type: "object",
+						Properties: map[string]apiextensionsv1.JSONSchemaProps{
+							"apiVersion": stringSchema(),
+							"kind":       stringSchema(),
+							"metadata":   {Type: "object"},
+							"spec":       spec,
+							"status":     {Type: "object", XPreserveUnknownFields: &preserveUnknownFields},
+						},
+						Required: []string{"spec"},
+					},
+				},
+				Subresources:             &apiextensionsv1.CustomResourceSubresources{Status: &apiextensionsv1.CustomResourceSubresourceStatus{}},
+				AdditionalPrinterColumns: columns,
+			}},
+		},
+	}
+}
+
+func objectSchema(properties map[string]apiextensionsv1.JSONSchemaProps) apiextensionsv1.JSONSchemaProps {
+	copied := make(map[string]apiextensionsv1.JSONSchemaProps, len(properties))
+	for name, property := range properties {
+		copied[name] = property
+	}
+	return apiextensionsv1.JSONSchemaProps{Type: "object", Properties: copied}
+}
+
+func stringSchema() apiextensionsv1.JSONSchemaProps {
+	return apiextensionsv1.JSONSchemaProps{Type: "string"}
+}
+
+func booleanSchema() apiextensionsv1.JSONSchemaProps {
+	return apiextensionsv1.JSONSchemaProps{Type: "boolean"}
+}
+
+func integerSchema() apiextensionsv1.JSONSchemaProps {
+	return apiextensionsv1.JSONSchemaProps{Type: "integer"}
+}
+
+func stringListSchema() apiextensionsv1.JSONSchemaProps {
+	return listSchema(stringSchema())
+}
+
+func listSchema(items apiextensionsv1.JSONSchemaProps) apiextensionsv1.JSONSchemaProps {
+	return apiextensionsv1.JSONSchemaProps{Type: "array", Items: &apiextensionsv1.JSONSchemaPropsOrArray{Schema: &items}}
+}
+
+func stringMapSchema() apiextensionsv1.JSONSchemaProps {
+	values := stringSchema()
+	return apiextensionsv1.JSONSchemaProps{Type: "object", AdditionalProperties: &apiextensionsv1.JSONSchemaPropsOrBool{Allows: true, Schema: &values}}
+}
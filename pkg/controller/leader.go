@@ -0,0 +1,95 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+)
+
+// LeaderElection configures the election of the replica that reconciles
+// resources when several run
+type LeaderElection struct {
+	// Namespace and Name of the Lease the replicas compete for
+	Namespace string
+	Name      string
+	// Identity of this replica, such as its pod name
+	Identity string
+	// LeaseDuration, RenewDeadline and RetryPeriod tune the election;
+	// client-go's recommended 15s, 10s and 2s are used when unset
+	LeaseDuration time.Duration
+	RenewDeadline time.Duration
+	RetryPeriod   time.Duration
+}
+
+// RunWithLeaderElection calls run once this replica holds the lease, with a
+// context that is cancelled when it loses it. It returns after run, once ctx
+// is cancelled or the lease is lost; losing the lease is an error, so the
+// replica can restart and compete again.
+func RunWithLeaderElection(ctx context.Context, client kubernetes.Interface, election LeaderElection, run func(ctx context.Context) error) error {
+	if election.LeaseDuration == 0 {
+		election.LeaseDuration = 15 * time.Second
+	}
+	if election.RenewDeadline == 0 {
+		election.RenewDeadline = 10 * time.Second
+	}
+	if election.RetryPeriod == 0 {
+		election.RetryPeriod = 2 * time.Second
+	}
+
+	leading := make(chan context.Context, 1)
+	elector, err := leaderelection.NewLeaderElector(leaderelection.LeaderElectionConfig{
+		Lock: &resourcelock.LeaseLock{
+			LeaseMeta:  metav1.ObjectMeta{Namespace: election.Namespace, Name: election.Name},
+			Client:     client.CoordinationV1(),
+			LockConfig: resourcelock.ResourceLockConfig{Identity: election.Identity},
+		},
+		LeaseDuration: election.LeaseDuration,
+		RenewDeadline: election.RenewDeadline,
+		RetryPeriod:   election.RetryPeriod,
+		// Another replica can take over as soon as this one stops
+		ReleaseOnCancel: true,
+		Name:            election.Name,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(ctx context.Context) {
+				leading <- ctx
+			},
+			OnStoppedLeading: func() {
+				log.Printf("Released lease %s/%s", election.Namespace, election.Name)
+			},
+			OnNewLeader: func(identity string) {
+				if identity != election.Identity {
+					log.Printf("Waiting for lease %s/%s, held by %s", election.Namespace, election.Name, identity)
+				}
+			},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to set up leader election: %w", err)
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		elector.Run(ctx)
+	}()
+
+	select {
+	case <-stopped:
+		// Stopped before acquiring the lease
+		return nil
+	case leaderCtx := <-leading:
+		log.Printf("Acquired lease %s/%s as %s", election.Namespace, election.Name, election.Identity)
+		err := run(leaderCtx)
+		<-stopped
+		if err == nil && ctx.Err() == nil {
+			err = fmt.Errorf("lost lease %s/%s", election.Namespace, election.Name)
+		}
+		return err
+	}
+}
@@ -0,0 +1,66 @@
+package controller
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	kubefake "k8s.io/client-go/kubernetes/fake"
+)
+
+func TestRunWithLeaderElection(t *testing.T) {
+	client := kubefake.NewSimpleClientset()
+
+	// start runs a replica that leads until its context is cancelled
+	start := func(identity string) (context.CancelFunc, <-chan struct{}, <-chan error) {
+		ctx, cancel := context.WithCancel(context.Background())
+		leading := make(chan struct{})
+		done := make(chan error, 1)
+		go func() {
+			done <- RunWithLeaderElection(ctx, client, LeaderElection{
+				Namespace:     "default",
+				Name:          "k8s-backup-controller",
+				Identity:      identity,
+				LeaseDuration: time.Second,
+				RenewDeadline: 500 * time.Millisecond,
+				RetryPeriod:   50 * time.Millisecond,
+			}, func(ctx context.Context) error {
+				close(leading)
+				<-ctx.Done()
+				return nil
+			})
+		}()
+		return cancel, leading, done
+	}
+
+	cancelFirst, firstLeading, firstDone := start("first")
+	select {
+	case <-firstLeading:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the first replica to acquire the lease")
+	}
+
+	cancelSecond, secondLeading, secondDone := start("second")
+	defer cancelSecond()
+	select {
+	case <-secondLeading:
+		t.Fatal("Expected the second replica to wait for the lease")
+	case <-time.After(300 * time.Millisecond):
+	}
+
+	// The first replica releases the lease when it stops
+	cancelFirst()
+	if err := <-firstDone; err != nil {
+		t.Errorf("Expected the first replica to stop cleanly, got %v", err)
+	}
+	select {
+	case <-secondLeading:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the second replica to take over the lease")
+	}
+
+	cancelSecond()
+	if err := <-secondDone; err != nil {
+		t.Errorf("Expected the second replica to stop cleanly, got %v", err)
+	}
+}
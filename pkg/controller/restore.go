@@ -0,0 +1,151 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"k8s-backup/pkg/k8s"
+	"k8s-backup/pkg/restore"
+	"k8s-backup/pkg/storage"
+	"k8s-backup/pkg/types"
+)
+
+// defaultRestoreTimeout matches the restore command's --timeout
+const defaultRestoreTimeout = 5 * time.Minute
+
+// reconcileRestore restores the backup of a new Restore resource
+func (c *Controller) reconcileRestore(ctx context.Context, namespace, name string) error {
+	var resource Restore
+	found, err := c.get(ctx, RestoresResource, namespace, name, &resource)
+	if err != nil || !found {
+		return err
+	}
+
+	status := resource.Status
+	switch {
+	case status.Phase.Finished():
+		return nil
+	case status.Phase == PhaseInProgress:
+		status.Phase = PhaseFailed
+		status.CompletionTime = c.now()
+		status.Error = "interrupted: the controller stopped during the restore"
+		log.Printf("Restore %s/%s was interrupted", namespace, name)
+		return c.updateStatus(ctx, RestoresResource, namespace, name, &status)
+	}
+
+	status = RestoreStatus{Phase: PhaseInProgress, StartTime: c.now()}
+	if err := c.updateStatus(ctx, RestoresResource, namespace, name, &status); err != nil {
+		return err
+	}
+
+	log.Printf("Restore %s/%s of backup %s started", namespace, name, resource.Spec.Backup)
+	result, err := c.runRestore(ctx, &resource, &status)
+	status.Progress = nil
+	status.CompletionTime = c.now()
+	if err != nil {
+		status.Phase = PhaseFailed
+		status.Error = err.Error()
+		if ctx.Err() != nil {
+			status.Error = "interrupted: " + status.Error
+		}
+		log.Printf("Restore %s/%s failed: %v", namespace, name, err)
+		return c.finalStatus(ctx, RestoresResource, namespace, name, &status)
+	}
+
+	errs := result.Errors
+	for _, notReady := range result.NotReady {
+		errs = append(errs, notReady)
+	}
+	status.Phase = PhaseCompleted
+	if len(errs) > 0 {
+		status.Phase = PhasePartiallyFailed
+	}
+	status.ProcessedResources = result.ProcessedResources
+	status.SkippedResources = result.SkippedResources
+	status.RestoredVolumes = result.RestoredVolumes + result.RestoredVolumeData
+	status.ErrorCount = len(errs)
+	status.Errors = statusMessages(errs)
+	log.Printf("Restore %s/%s finished: %d resources restored, %d errors", namespace, name, result.ProcessedResources, len(errs))
+	return c.finalStatus(ctx, RestoresResource, namespace, name, &status)
+}
+
+// runRestore restores the backup of a Restore resource, reporting its
+// progress in status
+func (c *Controller) runRestore(ctx context.Context, resource *Restore, status *RestoreStatus) (*restore.RestoreResult, error) {
+	spec := resource.Spec
+	if spec.Backup == "" {
+		return nil, fmt.Errorf("spec.backup is required")
+	}
+	location, err := c.storageLocation(spec.Storage)
+	if err != nil {
+		return nil, err
+	}
+	backend, err := c.openStorage(location)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open storage %s: %w", location, err)
+	}
+	// spec.backup names a Backup of the Restore's namespace. Restores in the
+	// controller's namespace may also name any backup in storage.
+	metadata, err := storage.FindBackup(backend, storageName(resource.Namespace, spec.Backup))
+	if err != nil && c.clusterWide(resource.Namespace) {
+		metadata, err = storage.FindBackup(backend, spec.Backup)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	options := &types.RestoreOptions{
+		BackupPath:              metadata.BackupPath,
+		Namespaces:              spec.Namespaces,
+		ResourceTypes:           spec.ResourceTypes,
+		ServerDryRun:            spec.ServerDryRun,
+		Wait:                    spec.Wait,
+		Timeout:                 spec.Timeout.Duration,
+		FieldManager:            k8s.DefaultFieldManager,
+		ForceConflicts:          spec.ForceConflicts,
+		LabelSelector:           spec.Selector,
+		NamespaceMapping:        spec.NamespaceMapping,
+		RemapClusterResources:   spec.RemapClusterResources,
+		ExistingPolicy:          spec.ExistingPolicy,
+		ExistingPolicyOverrides: spec.ExistingPolicyOverrides,
+		SkipVolumeSnapshots:     spec.SkipVolumeSnapshots,
+		SkipVolumeData:          spec.SkipVolumeData,
+		DataMoverImage:          spec.DataMoverImage,
+	}
+	if options.Timeout == 0 {
+		options.Timeout = defaultRestoreTimeout
+	}
+	if !c.clusterWide(resource.Namespace) {
+		if err := limitRestore(options, resource.Namespace); err != nil {
+			return nil, err
+		}
+	}
+
+	report := c.progressReporter(func(progress *Progress) {
+		status.Progress = progress
+		if err := c.updateStatus(ctx, RestoresResource, resource.Namespace, resource.Name, status); err != nil {
+			log.Printf("Warning: %v", err)
+		}
+	})
+	return restore.NewManager(c.client, backend).RestoreBackup(ctx, options, report)
+}
+
+// limitRestore limits a Restore outside the controller's namespace to the
+// objects of its own namespace. Cluster-scoped objects have no namespace, so
+// they are left out.
+func limitRestore(options *types.RestoreOptions, namespace string) error {
+	for _, ns := range options.Namespaces {
+		if ns != namespace {
+			return fmt.Errorf("spec.namespaces may only list %s, the namespace of the Restore", namespace)
+		}
+	}
+	for source, target := range options.NamespaceMapping {
+		if source != namespace || target != namespace {
+			return fmt.Errorf("spec.namespaceMapping cannot map %s into %s; a Restore in %s only restores %s into itself", source, target, namespace, namespace)
+		}
+	}
+	options.Namespaces = []string{namespace}
+	return nil
+}
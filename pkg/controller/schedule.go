@@ -0,0 +1,249 @@
+package controller
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	k8stypes "k8s.io/apimachinery/pkg/types"
+
+	"k8s-backup/pkg/retention"
+	"k8s-backup/pkg/schedule"
+)
+
+// reconcileSchedule applies the retention policy of a BackupSchedule once
+// its latest Backup has completed, creates the Backup of its latest passed
+// scheduled time when none is running, and requeues it for its next one
+func (c *Controller) reconcileSchedule(ctx context.Context, namespace, name string) error {
+	var resource BackupSchedule
+	found, err := c.get(ctx, BackupSchedulesResource, namespace, name, &resource)
+	if err != nil || !found {
+		return err
+	}
+	key := namespace + "/" + name
+	status := resource.Status
+
+	sched, err := resource.Spec.schedule(name)
+	if err == nil {
+		_, err = c.storageLocation(resource.Spec.Storage)
+	}
+	if err != nil {
+		// The schedule is reconciled again once its spec changes
+		status.Error = fmt.Sprintf("invalid schedule: %v", err)
+		status.NextScheduleTime = nil
+		return c.updateScheduleStatus(ctx, &resource, status)
+	}
+	status.Error = ""
+
+	backups, err := c.scheduleBackups(ctx, namespace, name)
+	if err != nil {
+		return err
+	}
+	status.Active = nil
+	var lastCompleted string
+	for _, b := range backups {
+		switch {
+		case !b.Status.Phase.Finished():
+			status.Active = append(status.Active, b.Name)
+		case b.Status.Phase == PhaseCompleted:
+			lastCompleted = b.Name
+		}
+	}
+	if len(backups) > 0 {
+		status.LastBackup = backups[len(backups)-1].Name
+	}
+
+	// Retention runs once for each newly completed backup; when it fails,
+	// the schedule is retried
+	if lastCompleted != "" && lastCompleted != status.LastSuccessfulBackup {
+		if err := c.applyRetention(ctx, &resource, sched); err != nil {
+			status.Error = err.Error()
+			if statusErr := c.updateScheduleStatus(ctx, &resource, status); statusErr != nil {
+				log.Printf("Warning: %v", statusErr)
+			}
+			return err
+		}
+		status.LastSuccessfulBackup = lastCompleted
+	}
+
+	now := c.clock.Now()
+	if resource.Spec.Suspend {
+		status.NextScheduleTime = nil
+		return c.updateScheduleStatus(ctx, &resource, status)
+	}
+
+	// A schedule's first run is its first scheduled time after it was created
+	last := resource.CreationTimestamp.Time
+	if last.IsZero() {
+		last = now
+	}
+	if status.LastScheduleTime != nil {
+		last = status.LastScheduleTime.Time
+	}
+	requeueAt := time.Time{}
+	if missed, skipped := sched.LatestMissed(last, now); !missed.IsZero() && len(status.Active) == 0 {
+		due := missed.Add(scheduleJitter(resource.UID, missed, sched.Jitter.Duration))
+		switch {
+		case now.Before(due):
+			requeueAt = due
+		case sched.StartingDeadline.Duration > 0 && now.Sub(missed) > sched.StartingDeadline.Duration:
+			log.Printf("Schedule %s: not creating the backup of %s, past its starting deadline", key, missed.Format(time.RFC3339))
+			status.LastScheduleTime = &metav1.Time{Time: missed}
+		default:
+			if skipped > 0 {
+				log.Printf("Schedule %s: skipping %d missed runs", key, skipped)
+			}
+			backupName, err := c.createScheduledBackup(ctx, &resource, sched, missed)
+			if err != nil {
+				return err
+			}
+			status.LastScheduleTime = &metav1.Time{Time: missed}
+			status.LastBackup = backupName
+			status.Active = append(status.Active, backupName)
+		}
+	}
+
+	next := sched.Next(now)
+	status.NextScheduleTime = nil
+	if !next.IsZero() {
+		status.NextScheduleTime = &metav1.Time{Time: next}
+		if requeueAt.IsZero() {
+			requeueAt = next.Add(scheduleJitter(resource.UID, next, sched.Jitter.Duration))
+		}
+	}
+	if err := c.updateScheduleStatus(ctx, &resource, status); err != nil {
+		return err
+	}
+	// Backups finishing requeue the schedule through their events
+	if !requeueAt.IsZero() {
+		c.schedules.AddAfter(key, requeueAt.Sub(now))
+	}
+	return nil
+}
+
+// scheduleBackups returns the Backups created by a schedule, oldest first
+func (c *Controller) scheduleBackups(ctx context.Context, namespace, name string) ([]*Backup, error) {
+	list, err := c.client.Dynamic().Resource(BackupsResource).Namespace(namespace).List(ctx, metav1.ListOptions{
+		LabelSelector: ScheduleLabel + "=" + name,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list backups of schedule %s/%s: %w", namespace, name, err)
+	}
+	var backups []*Backup
+	for i := range list.Items {
+		var b Backup
+		if err := fromUnstructured(&list.Items[i], &b); err != nil {
+			return nil, err
+		}
+		backups = append(backups, &b)
+	}
+	// Scheduled backups are named after their scheduled time
+	sort.Slice(backups, func(i, j int) bool { return backups[i].Name < backups[j].Name })
+	return backups, nil
+}
+
+// createScheduledBackup creates the Backup of a scheduled time, owned by the
+// schedule. A Backup that already exists was created by an earlier attempt.
+func (c *Controller) createScheduledBackup(ctx context.Context, resource *BackupSchedule, sched *schedule.Schedule, scheduled time.Time) (string, error) {
+	isController := true
+	backup := &Backup{
+		TypeMeta: metav1.TypeMeta{APIVersion: Group + "/" + Version, Kind: "Backup"},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      sched.BackupName(scheduled),
+			Namespace: resource.Namespace,
+			Labels:    map[string]string{ScheduleLabel: resource.Name},
+			OwnerReferences: []metav1.OwnerReference{{
+				APIVersion: Group + "/" + Version,
+				Kind:       "BackupSchedule",
+				Name:       resource.Name,
+				UID:        resource.UID,
+				Controller: &isController,
+			}},
+		},
+		Spec: BackupSpec{Storage: resource.Spec.Storage, Backup: resource.Spec.Backup},
+	}
+	content, err := runtime.DefaultUnstructuredConverter.ToUnstructured(backup)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode backup: %w", err)
+	}
+
+	_, err = c.client.Dynamic().Resource(BackupsResource).Namespace(resource.Namespace).Create(ctx, &unstructured.Unstructured{Object: content}, metav1.CreateOptions{})
+	if err != nil && !apierrors.IsAlreadyExists(err) {
+		return "", fmt.Errorf("failed to create backup %s/%s: %w", resource.Namespace, backup.Name, err)
+	}
+	log.Printf("Schedule %s/%s: created backup %s", resource.Namespace, resource.Name, backup.Name)
+	return backup.Name, nil
+}
+
+// applyRetention prunes the backups a schedule took from its storage, and
+// deletes the Backups of those that were pruned
+func (c *Controller) applyRetention(ctx context.Context, resource *BackupSchedule, sched *schedule.Schedule) error {
+	policy := sched.Policy()
+	if policy.Empty() {
+		return nil
+	}
+	location, err := c.storageLocation(resource.Spec.Storage)
+	if err != nil {
+		return err
+	}
+	backend, err := c.openStorage(location)
+	if err != nil {
+		return fmt.Errorf("failed to open storage %s: %w", location, err)
+	}
+
+	decisions, err := retention.PruneSchedule(backend, scheduleID(resource.Namespace, resource.Name), policy, c.clock.Now(), false)
+	for _, decision := range decisions {
+		if decision.Keep {
+			continue
+		}
+		name := strings.TrimPrefix(decision.Backup.Name, storageName(resource.Namespace, ""))
+		log.Printf("Schedule %s/%s: deleted backup %s", resource.Namespace, resource.Name, name)
+		deleteErr := c.client.Dynamic().Resource(BackupsResource).Namespace(resource.Namespace).Delete(ctx, name, metav1.DeleteOptions{})
+		if deleteErr != nil && !apierrors.IsNotFound(deleteErr) {
+			log.Printf("Warning: failed to delete backup %s/%s: %v", resource.Namespace, name, deleteErr)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("failed to apply retention: %w", err)
+	}
+	return nil
+}
+
+// updateScheduleStatus writes the status of a schedule when it changed, so
+// the update does not trigger another reconcile
+func (c *Controller) updateScheduleStatus(ctx context.Context, resource *BackupSchedule, status BackupScheduleStatus) error {
+	if equality.Semantic.DeepEqual(resource.Status, status) {
+		return nil
+	}
+	return c.updateStatus(ctx, BackupSchedulesResource, resource.Namespace, resource.Name, &status)
+}
+
+// scheduleID identifies a schedule in the metadata of its backups. It
+// includes the namespace, so schedules of the same name in other namespaces
+// never prune each other's backups.
+func scheduleID(namespace, name string) string {
+	return namespace + "/" + name
+}
+
+// scheduleJitter delays the run of a scheduled time by up to max. The delay
+// is derived from the schedule and the time rather than drawn at random, so
+// every reconcile agrees on it.
+func scheduleJitter(uid k8stypes.UID, scheduled time.Time, max time.Duration) time.Duration {
+	if max <= 0 {
+		return 0
+	}
+	hash := fnv.New64a()
+	hash.Write([]byte(uid))
+	binary.Write(hash, binary.BigEndian, scheduled.Unix())
+	return time.Duration(hash.Sum64() % uint64(max))
+}
@@ -0,0 +1,249 @@
+package controller
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	"k8s-backup/pkg/schedule"
+	"k8s-backup/pkg/storage"
+	"k8s-backup/pkg/types"
+)
+
+func newTestSchedule(t *testing.T, name string, spec BackupScheduleSpec, status BackupScheduleStatus) *unstructured.Unstructured {
+	return toObject(t, &BackupSchedule{
+		TypeMeta: metav1.TypeMeta{APIVersion: Group + "/" + Version, Kind: "BackupSchedule"},
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:         "ops",
+			Name:              name,
+			UID:               "3f0c8a62-5d1e-4b7a-9c2f-0e6d4b8a1c35",
+			CreationTimestamp: metav1.Time{Time: time.Date(2025, 9, 11, 12, 0, 0, 0, time.UTC)},
+		},
+		Spec:   spec,
+		Status: status,
+	})
+}
+
+func (tc *testController) getSchedule(t *testing.T, name string) *BackupSchedule {
+	t.Helper()
+	var resource BackupSchedule
+	found, err := tc.get(context.Background(), BackupSchedulesResource, "ops", name, &resource)
+	if err != nil || !found {
+		t.Fatalf("Failed to get schedule %s: found=%v, %v", name, found, err)
+	}
+	return &resource
+}
+
+func (tc *testController) scheduleBackupNames(t *testing.T, name string) []string {
+	t.Helper()
+	backups, err := tc.scheduleBackups(context.Background(), "ops", name)
+	if err != nil {
+		t.Fatalf("Failed to list backups: %v", err)
+	}
+	var names []string
+	for _, b := range backups {
+		names = append(names, b.Name)
+	}
+	return names
+}
+
+func TestReconcileSchedule(t *testing.T) {
+	tc := newTestController(t, newTestSchedule(t, "nightly", BackupScheduleSpec{
+		Schedule:  "0 2 * * *",
+		Backup:    schedule.Backup{Namespaces: []string{"shop"}},
+		Retention: schedule.Retention{KeepLast: 1},
+	}, BackupScheduleStatus{}))
+	ctx := context.Background()
+	reconcile := func() {
+		t.Helper()
+		if err := tc.reconcileSchedule(ctx, "ops", "nightly"); err != nil {
+			t.Fatalf("reconcileSchedule failed: %v", err)
+		}
+	}
+
+	// Nothing is due before the first scheduled time
+	reconcile()
+	status := tc.getSchedule(t, "nightly").Status
+	if names := tc.scheduleBackupNames(t, "nightly"); len(names) != 0 {
+		t.Fatalf("Expected no backups yet, got %v", names)
+	}
+	if status.NextScheduleTime == nil || !status.NextScheduleTime.Time.Equal(time.Date(2025, 9, 12, 2, 0, 0, 0, time.UTC)) {
+		t.Errorf("Unexpected next schedule time %v", status.NextScheduleTime)
+	}
+
+	tc.clock.Step(time.Minute)
+	reconcile()
+	first := "nightly-20250912-020000"
+	if names := tc.scheduleBackupNames(t, "nightly"); strings.Join(names, ",") != first {
+		t.Fatalf("Expected backup %s, got %v", first, names)
+	}
+	backup := tc.getBackup(t, "ops", first)
+	if len(backup.OwnerReferences) != 1 || backup.OwnerReferences[0].Name != "nightly" || backup.Spec.Namespaces[0] != "shop" {
+		t.Errorf("Unexpected backup %+v", backup)
+	}
+	status = tc.getSchedule(t, "nightly").Status
+	if strings.Join(status.Active, ",") != first || status.LastBackup != first {
+		t.Errorf("Expected %s to be active, got %+v", first, status)
+	}
+
+	// No backup is created while one is running
+	tc.clock.Step(24*time.Hour + 30*time.Minute)
+	reconcile()
+	if names := tc.scheduleBackupNames(t, "nightly"); len(names) != 1 {
+		t.Fatalf("Expected no backup while %s runs, got %v", first, names)
+	}
+
+	// Once it completes, the missed run is caught up
+	if err := tc.reconcileBackup(ctx, "ops", first); err != nil {
+		t.Fatalf("reconcileBackup failed: %v", err)
+	}
+	reconcile()
+	second := "nightly-20250913-020000"
+	if names := tc.scheduleBackupNames(t, "nightly"); strings.Join(names, ",") != first+","+second {
+		t.Fatalf("Expected backups %s and %s, got %v", first, second, names)
+	}
+	status = tc.getSchedule(t, "nightly").Status
+	if status.LastSuccessfulBackup != first {
+		t.Errorf("Expected %s as the last successful backup, got %+v", first, status)
+	}
+
+	metadata, err := storage.FindBackup(storage.NewLocalStorage(tc.storage), "ops."+first)
+	if err != nil {
+		t.Fatalf("Expected %s in storage: %v", first, err)
+	}
+	if metadata.Schedule != "ops/nightly" {
+		t.Errorf("Expected the backup to record its schedule, got %q", metadata.Schedule)
+	}
+
+	// Retention prunes the first backup, along with its resource
+	if err := tc.reconcileBackup(ctx, "ops", second); err != nil {
+		t.Fatalf("reconcileBackup failed: %v", err)
+	}
+	reconcile()
+	if names := tc.scheduleBackupNames(t, "nightly"); strings.Join(names, ",") != second {
+		t.Errorf("Expected only %s to be kept, got %v", second, names)
+	}
+	if _, err := storage.FindBackup(storage.NewLocalStorage(tc.storage), "ops."+first); err == nil {
+		t.Errorf("Expected %s to be pruned from storage", first)
+	}
+	status = tc.getSchedule(t, "nightly").Status
+	if status.LastSuccessfulBackup != second || len(status.Active) != 0 || status.Error != "" {
+		t.Errorf("Unexpected status %+v", status)
+	}
+}
+
+func TestReconcileScheduleStartingDeadline(t *testing.T) {
+	tc := newTestController(t, newTestSchedule(t, "nightly", BackupScheduleSpec{
+		Schedule:         "0 2 * * *",
+		StartingDeadline: metav1.Duration{Duration: time.Hour},
+	}, BackupScheduleStatus{
+		LastScheduleTime: &metav1.Time{Time: time.Date(2025, 9, 11, 2, 0, 0, 0, time.UTC)},
+	}))
+	tc.clock.SetTime(time.Date(2025, 9, 12, 10, 0, 0, 0, time.UTC))
+
+	if err := tc.reconcileSchedule(context.Background(), "ops", "nightly"); err != nil {
+		t.Fatalf("reconcileSchedule failed: %v", err)
+	}
+	if names := tc.scheduleBackupNames(t, "nightly"); len(names) != 0 {
+		t.Errorf("Expected no backup past the starting deadline, got %v", names)
+	}
+	status := tc.getSchedule(t, "nightly").Status
+	if !status.LastScheduleTime.Time.Equal(time.Date(2025, 9, 12, 2, 0, 0, 0, time.UTC)) {
+		t.Errorf("Expected the missed run to be recorded, got %v", status.LastScheduleTime)
+	}
+}
+
+func TestReconcileScheduleJitter(t *testing.T) {
+	resource := newTestSchedule(t, "nightly", BackupScheduleSpec{
+		Schedule: "0 2 * * *",
+		Jitter:   metav1.Duration{Duration: 10 * time.Minute},
+	}, BackupScheduleStatus{})
+	tc := newTestController(t, resource)
+	scheduled := time.Date(2025, 9, 12, 2, 0, 0, 0, time.UTC)
+	jitter := scheduleJitter(resource.GetUID(), scheduled, 10*time.Minute)
+	if jitter != scheduleJitter(resource.GetUID(), scheduled, 10*time.Minute) || jitter < 0 || jitter >= 10*time.Minute {
+		t.Fatalf("Unexpected jitter %v", jitter)
+	}
+
+	tc.clock.SetTime(scheduled.Add(jitter - time.Second))
+	if err := tc.reconcileSchedule(context.Background(), "ops", "nightly"); err != nil {
+		t.Fatalf("reconcileSchedule failed: %v", err)
+	}
+	if names := tc.scheduleBackupNames(t, "nightly"); len(names) != 0 {
+		t.Fatalf("Expected no backup before the jittered time, got %v", names)
+	}
+
+	tc.clock.Step(time.Second)
+	if err := tc.reconcileSchedule(context.Background(), "ops", "nightly"); err != nil {
+		t.Fatalf("reconcileSchedule failed: %v", err)
+	}
+	if names := tc.scheduleBackupNames(t, "nightly"); len(names) != 1 {
+		t.Errorf("Expected a backup at the jittered time, got %v", names)
+	}
+}
+
+func TestReconcileScheduleInvalidOrSuspended(t *testing.T) {
+	tc := newTestController(t,
+		newTestSchedule(t, "invalid", BackupScheduleSpec{Schedule: "0 25 * * *"}, BackupScheduleStatus{}),
+		newTestSchedule(t, "suspended", BackupScheduleSpec{Schedule: "* * * * *", Suspend: true}, BackupScheduleStatus{}),
+	)
+	tc.clock.Step(time.Hour)
+
+	for _, name := range []string{"invalid", "suspended"} {
+		if err := tc.reconcileSchedule(context.Background(), "ops", name); err != nil {
+			t.Fatalf("reconcileSchedule failed: %v", err)
+		}
+		if names := tc.scheduleBackupNames(t, name); len(names) != 0 {
+			t.Errorf("%s: expected no backups, got %v", name, names)
+		}
+	}
+
+	if status := tc.getSchedule(t, "invalid").Status; !strings.Contains(status.Error, "invalid schedule") {
+		t.Errorf("Expected an invalid schedule error, got %+v", status)
+	}
+	if status := tc.getSchedule(t, "suspended").Status; status.NextScheduleTime != nil || status.Error != "" {
+		t.Errorf("Expected a suspended schedule to have no next run, got %+v", status)
+	}
+}
+
+func TestApplyRetentionKeepsParentsOfOtherBackups(t *testing.T) {
+	resource := newTestSchedule(t, "nightly", BackupScheduleSpec{
+		Schedule:  "0 2 * * *",
+		Retention: schedule.Retention{KeepLast: 1},
+	}, BackupScheduleStatus{})
+	tc := newTestController(t, resource)
+	backend := storage.NewLocalStorage(tc.storage)
+	for i, backup := range []struct {
+		name, schedule string
+		chain          []string
+	}{
+		{"ops.nightly-20250910-020000", "ops/nightly", nil},
+		// Taken by hand, incremental to the schedule's first backup
+		{"before-upgrade", "", []string{"ops.nightly-20250910-020000"}},
+		{"ops.nightly-20250911-020000", "ops/nightly", nil},
+	} {
+		metadata := &types.BackupMetadata{Name: backup.name, Schedule: backup.schedule, Chain: backup.chain, Timestamp: time.Date(2025, 9, 10+i, 2, 0, 0, 0, time.UTC)}
+		if err := backend.SaveBackup(context.Background(), metadata, nil); err != nil {
+			t.Fatalf("SaveBackup failed: %v", err)
+		}
+	}
+
+	var spec BackupSchedule
+	if _, err := tc.get(context.Background(), BackupSchedulesResource, "ops", "nightly", &spec); err != nil {
+		t.Fatalf("Failed to get schedule: %v", err)
+	}
+	sched, err := spec.Spec.schedule("nightly")
+	if err != nil {
+		t.Fatalf("Invalid schedule: %v", err)
+	}
+	if err := tc.applyRetention(context.Background(), &spec, sched); err != nil {
+		t.Fatalf("applyRetention failed: %v", err)
+	}
+	if _, err := storage.FindBackup(backend, "ops.nightly-20250910-020000"); err != nil {
+		t.Errorf("Expected the parent of before-upgrade to be kept: %v", err)
+	}
+}
@@ -0,0 +1,229 @@
+package controller
+
+import (
+	"encoding/json"
+	"fmt"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+
+	"k8s-backup/pkg/schedule"
+	"k8s-backup/pkg/types"
+)
+
+// Group and Version of the custom resources served by the controller
+const (
+	Group   = "k8s-backup.io"
+	Version = "v1alpha1"
+)
+
+// ScheduleLabel is set on the Backups created by a BackupSchedule, to the
+// schedule's name
+const ScheduleLabel = "k8s-backup.io/schedule"
+
+// Resources of the custom resources
+var (
+	BackupsResource         = schema.GroupVersionResource{Group: Group, Version: Version, Resource: "backups"}
+	RestoresResource        = schema.GroupVersionResource{Group: Group, Version: Version, Resource: "restores"}
+	BackupSchedulesResource = schema.GroupVersionResource{Group: Group, Version: Version, Resource: "backupschedules"}
+)
+
+// Phase is the lifecycle phase of a Backup or Restore
+type Phase string
+
+const (
+	// PhaseNew is the phase of a resource the controller has not picked up
+	PhaseNew        Phase = ""
+	PhaseInProgress Phase = "InProgress"
+	PhaseCompleted  Phase = "Completed"
+	// PhasePartiallyFailed marks a restore that completed with resource errors
+	PhasePartiallyFailed Phase = "PartiallyFailed"
+	PhaseFailed          Phase = "Failed"
+)
+
+// Finished reports whether a Backup or Restore in this phase is done
+func (p Phase) Finished() bool {
+	return p == PhaseCompleted || p == PhasePartiallyFailed || p == PhaseFailed
+}
+
+// maxStatusMessages caps the warnings and errors recorded in a status
+const maxStatusMessages = 10
+
+// Backup requests a single backup. The backup is stored under the name of
+// the resource qualified with its namespace, e.g. shop.before-upgrade.
+type Backup struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   BackupSpec   `json:"spec,omitempty"`
+	Status BackupStatus `json:"status,omitempty"`
+}
+
+// BackupSpec holds the options of a backup, with the names and defaults of
+// the backup command's flags
+type BackupSpec struct {
+	// Storage is the storage location of the backup; the controller's
+	// default when empty
+	Storage         string `json:"storage,omitempty"`
+	schedule.Backup `json:",inline"`
+}
+
+// BackupStatus is the observed state of a Backup
+type BackupStatus struct {
+	Phase          Phase        `json:"phase,omitempty"`
+	StartTime      *metav1.Time `json:"startTime,omitempty"`
+	CompletionTime *metav1.Time `json:"completionTime,omitempty"`
+	Progress       *Progress    `json:"progress,omitempty"`
+	// Storage is the storage location the backup was written to
+	Storage         string `json:"storage,omitempty"`
+	BackupPath      string `json:"backupPath,omitempty"`
+	TotalResources  int    `json:"totalResources,omitempty"`
+	Size            int64  `json:"size,omitempty"`
+	VolumeSnapshots int    `json:"volumeSnapshots,omitempty"`
+	HooksRun        int    `json:"hooksRun,omitempty"`
+	// WarningCount counts the warnings of the backup, the first of which
+	// are listed in Warnings
+	WarningCount int      `json:"warningCount,omitempty"`
+	Warnings     []string `json:"warnings,omitempty"`
+	Error        string   `json:"error,omitempty"`
+}
+
+// Restore requests a restore of a backup
+type Restore struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   RestoreSpec   `json:"spec,omitempty"`
+	Status RestoreStatus `json:"status,omitempty"`
+}
+
+// RestoreSpec holds the options of a restore, with the names and defaults of
+// the restore command's flags
+type RestoreSpec struct {
+	// Storage is the storage location of the backup; the controller's
+	// default when empty
+	Storage string `json:"storage,omitempty"`
+	// Backup is the name of the backup to restore
+	Backup                  string                          `json:"backup"`
+	Namespaces              []string                        `json:"namespaces,omitempty"`
+	ResourceTypes           []string                        `json:"resourceTypes,omitempty"`
+	Selector                string                          `json:"selector,omitempty"`
+	NamespaceMapping        map[string]string               `json:"namespaceMapping,omitempty"`
+	RemapClusterResources   bool                            `json:"remapClusterResources,omitempty"`
+	ExistingPolicy          types.ExistingPolicy            `json:"existingPolicy,omitempty"`
+	ExistingPolicyOverrides map[string]types.ExistingPolicy `json:"existingPolicyOverrides,omitempty"`
+	ForceConflicts          bool                            `json:"forceConflicts,omitempty"`
+	Wait                    bool                            `json:"wait,omitempty"`
+	Timeout                 metav1.Duration                 `json:"timeout,omitempty"`
+	ServerDryRun            bool                            `json:"serverDryRun,omitempty"`
+	SkipVolumeSnapshots     bool                            `json:"skipVolumeSnapshots,omitempty"`
+	SkipVolumeData          bool                            `json:"skipVolumeData,omitempty"`
+	DataMoverImage          string                          `json:"dataMoverImage,omitempty"`
+}
+
+// RestoreStatus is the observed state of a Restore
+type RestoreStatus struct {
+	Phase              Phase        `json:"phase,omitempty"`
+	StartTime          *metav1.Time `json:"startTime,omitempty"`
+	CompletionTime     *metav1.Time `json:"completionTime,omitempty"`
+	Progress           *Progress    `json:"progress,omitempty"`
+	ProcessedResources int          `json:"processedResources,omitempty"`
+	SkippedResources   int          `json:"skippedResources,omitempty"`
+	RestoredVolumes    int          `json:"restoredVolumes,omitempty"`
+	// ErrorCount counts the resources that failed to restore or become
+	// ready, the first of which are listed in Errors
+	ErrorCount int      `json:"errorCount,omitempty"`
+	Errors     []string `json:"errors,omitempty"`
+	Error      string   `json:"error,omitempty"`
+}
+
+// Progress is the progress of a running Backup or Restore
+type Progress struct {
+	Total     int    `json:"total"`
+	Completed int    `json:"completed"`
+	Current   string `json:"current,omitempty"`
+}
+
+// BackupSchedule creates Backups on a cron schedule and applies a retention
+// policy to them
+type BackupSchedule struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   BackupScheduleSpec   `json:"spec,omitempty"`
+	Status BackupScheduleStatus `json:"status,omitempty"`
+}
+
+// BackupScheduleSpec holds the fields of a schedule file's schedule
+type BackupScheduleSpec struct {
+	Schedule         string          `json:"schedule"`
+	TimeZone         string          `json:"timeZone,omitempty"`
+	Jitter           metav1.Duration `json:"jitter,omitempty"`
+	StartingDeadline metav1.Duration `json:"startingDeadline,omitempty"`
+	// Suspend stops new Backups from being created
+	Suspend   bool               `json:"suspend,omitempty"`
+	Storage   string             `json:"storage,omitempty"`
+	Backup    schedule.Backup    `json:"backup,omitempty"`
+	Retention schedule.Retention `json:"retention,omitempty"`
+}
+
+// BackupScheduleStatus is the observed state of a BackupSchedule
+type BackupScheduleStatus struct {
+	// LastScheduleTime is the scheduled time of the last Backup created, or
+	// of the last run skipped past its starting deadline
+	LastScheduleTime     *metav1.Time `json:"lastScheduleTime,omitempty"`
+	NextScheduleTime     *metav1.Time `json:"nextScheduleTime,omitempty"`
+	LastBackup           string       `json:"lastBackup,omitempty"`
+	LastSuccessfulBackup string       `json:"lastSuccessfulBackup,omitempty"`
+	// Active lists the Backups of the schedule that have not finished
+	Active []string `json:"active,omitempty"`
+	Error  string   `json:"error,omitempty"`
+}
+
+// schedule builds the schedule of the spec
+func (s *BackupScheduleSpec) schedule(name string) (*schedule.Schedule, error) {
+	if s.Backup.HooksFile != "" {
+		return nil, fmt.Errorf("backup.hooksFile is not supported, declare hooks in backup.hooks")
+	}
+	sched := &schedule.Schedule{
+		Name:             name,
+		Schedule:         s.Schedule,
+		TimeZone:         s.TimeZone,
+		Jitter:           s.Jitter,
+		StartingDeadline: s.StartingDeadline,
+		Storage:          s.Storage,
+		Backup:           s.Backup,
+		Retention:        s.Retention,
+	}
+	if err := sched.Complete(); err != nil {
+		return nil, err
+	}
+	return sched, nil
+}
+
+// fromUnstructured converts a custom resource into its typed form. It goes
+// through JSON, since hook rules have unexported fields that the unstructured
+// converter cannot set.
+func fromUnstructured(obj *unstructured.Unstructured, into interface{}) error {
+	data, err := obj.MarshalJSON()
+	if err == nil {
+		err = json.Unmarshal(data, into)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to decode %s %s/%s: %w", obj.GetKind(), obj.GetNamespace(), obj.GetName(), err)
+	}
+	return nil
+}
+
+// statusMessages returns the messages of the first errors
+func statusMessages(errs []error) []string {
+	var messages []string
+	for i, err := range errs {
+		if i == maxStatusMessages {
+			break
+		}
+		messages = append(messages, err.Error())
+	}
+	return messages
+}
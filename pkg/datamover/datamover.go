@@ -0,0 +1,244 @@
+// Package datamover copies the files of PersistentVolumeClaims into and out
+// of backups through short-lived helper pods, for storage whose drivers do
+// not support CSI snapshots. The helper pod mounts the claim and the data is
+// streamed as a tar archive through the pod exec API.
+package datamover
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"path"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	utilrand "k8s.io/apimachinery/pkg/util/rand"
+	"k8s.io/apimachinery/pkg/util/wait"
+
+	"k8s-backup/pkg/k8s"
+	"k8s-backup/pkg/types"
+)
+
+const (
+	// HelperLabel is set on helper pods, to the name of the backup they copy
+	// data for
+	HelperLabel = "k8s-backup.io/data-mover"
+	// DefaultImage is the helper pod image, which needs sleep and tar
+	DefaultImage = "busybox:1.36"
+
+	defaultTimeout = 5 * time.Minute
+	// helperDeadline stops helper pods left behind by an interrupted run
+	helperDeadline = 24 * time.Hour
+	containerName  = "mover"
+	mountPath      = "/data"
+)
+
+// pollInterval is how often a helper pod is checked for having started
+var pollInterval = 2 * time.Second
+
+// executor runs commands in pods; *k8s.Client implements it
+type executor interface {
+	Exec(ctx context.Context, namespace, pod, container string, command []string, stdin io.Reader, stdout, stderr io.Writer) error
+}
+
+// Mover copies volume data through helper pods
+type Mover struct {
+	k8sClient *k8s.Client
+	executor  executor
+	image     string
+	timeout   time.Duration
+}
+
+// NewMover creates a data mover using the default image and timeout
+func NewMover(k8sClient *k8s.Client) *Mover {
+	return &Mover{k8sClient: k8sClient, executor: k8sClient, image: DefaultImage, timeout: defaultTimeout}
+}
+
+// SetImage sets the helper pod image
+func (m *Mover) SetImage(image string) {
+	if image != "" {
+		m.image = image
+	}
+}
+
+// SetTimeout sets how long a helper pod may take to start
+func (m *Mover) SetTimeout(timeout time.Duration) {
+	if timeout > 0 {
+		m.timeout = timeout
+	}
+}
+
+// ValidateSelection checks patterns of the form "namespace/name", where
+// either part may be a glob
+func ValidateSelection(patterns []string) error {
+	for _, pattern := range patterns {
+		if strings.Count(pattern, "/") != 1 {
+			return fmt.Errorf("invalid volume data selection %q: expected namespace/name", pattern)
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid volume data selection %q: %w", pattern, err)
+		}
+	}
+	return nil
+}
+
+// Selected reports whether the data of a claim is copied by the data mover:
+// the claim is annotated with types.VolumeDataAnnotation, or matches one of
+// the patterns
+func Selected(claim metav1.Object, patterns []string) bool {
+	if claim.GetAnnotations()[types.VolumeDataAnnotation] == "true" {
+		return true
+	}
+	name := claim.GetNamespace() + "/" + claim.GetName()
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// BackupVolume writes the files of a claim to w as a tar stream
+func (m *Mover) BackupVolume(ctx context.Context, backupName, namespace, claim string, w io.Writer) error {
+	return m.withHelperPod(ctx, backupName, namespace, claim, true, func(pod string) error {
+		return m.exec(ctx, namespace, pod, []string{"tar", "-C", mountPath, "-cf", "-", "."}, nil, w)
+	})
+}
+
+// RestoreVolume extracts a tar stream into a claim
+func (m *Mover) RestoreVolume(ctx context.Context, backupName, namespace, claim string, r io.Reader) error {
+	return m.withHelperPod(ctx, backupName, namespace, claim, false, func(pod string) error {
+		return m.exec(ctx, namespace, pod, []string{"tar", "-C", mountPath, "-xf", "-"}, r, nil)
+	})
+}
+
+// exec runs a command in a helper pod, including what it wrote to stderr in
+// the error when it fails
+func (m *Mover) exec(ctx context.Context, namespace, pod string, command []string, stdin io.Reader, stdout io.Writer) error {
+	var stderr bytes.Buffer
+	err := m.executor.Exec(ctx, namespace, pod, containerName, command, stdin, stdout, &stderr)
+	if err == nil {
+		return nil
+	}
+	if message := strings.TrimSpace(stderr.String()); message != "" {
+		return fmt.Errorf("%s failed: %w: %s", command[0], err, message)
+	}
+	return fmt.Errorf("%s failed: %w", command[0], err)
+}
+
+// withHelperPod starts a helper pod mounting a claim, calls fn with its name
+// once it is running and deletes it again
+func (m *Mover) withHelperPod(ctx context.Context, backupName, namespace, claim string, readOnly bool, fn func(pod string) error) error {
+	nodeName, err := m.claimNode(ctx, namespace, claim)
+	if err != nil {
+		return err
+	}
+
+	pod := helperPod(backupName, namespace, claim, m.image, nodeName, readOnly)
+	pods := m.k8sClient.Clientset().CoreV1().Pods(namespace)
+	if _, err := pods.Create(ctx, pod, metav1.CreateOptions{}); err != nil {
+		return fmt.Errorf("failed to create helper pod: %w", err)
+	}
+	defer func() {
+		// The pod is removed even when ctx was cancelled
+		gracePeriod := int64(0)
+		if err := pods.Delete(context.Background(), pod.Name, metav1.DeleteOptions{GracePeriodSeconds: &gracePeriod}); err != nil && !apierrors.IsNotFound(err) {
+			log.Printf("Warning: failed to delete helper pod %s/%s: %v", namespace, pod.Name, err)
+		}
+	}()
+
+	if err := m.waitForPod(ctx, namespace, pod.Name); err != nil {
+		return err
+	}
+	return fn(pod.Name)
+}
+
+// claimNode returns the node of a running pod that mounts a claim. Volumes
+// that can only be attached to one node at a time are then mounted by the
+// helper pod on the same node.
+func (m *Mover) claimNode(ctx context.Context, namespace, claim string) (string, error) {
+	pods, err := m.k8sClient.Clientset().CoreV1().Pods(namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return "", fmt.Errorf("failed to list pods: %w", err)
+	}
+	for _, pod := range pods.Items {
+		if pod.Spec.NodeName == "" || pod.Status.Phase != corev1.PodRunning {
+			continue
+		}
+		for _, volume := range pod.Spec.Volumes {
+			if volume.PersistentVolumeClaim != nil && volume.PersistentVolumeClaim.ClaimName == claim {
+				return pod.Spec.NodeName, nil
+			}
+		}
+	}
+	return "", nil
+}
+
+// waitForPod waits up to the mover's timeout for a helper pod to run
+func (m *Mover) waitForPod(ctx context.Context, namespace, name string) error {
+	var phase corev1.PodPhase
+	err := wait.PollUntilContextTimeout(ctx, pollInterval, m.timeout, true, func(ctx context.Context) (bool, error) {
+		pod, err := m.k8sClient.Clientset().CoreV1().Pods(namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return false, fmt.Errorf("failed to get helper pod: %w", err)
+		}
+		phase = pod.Status.Phase
+		switch phase {
+		case corev1.PodRunning:
+			return true, nil
+		case corev1.PodFailed, corev1.PodSucceeded:
+			return false, fmt.Errorf("helper pod %s/%s exited (%s)", namespace, name, phase)
+		}
+		return false, nil
+	})
+	if wait.Interrupted(err) {
+		return fmt.Errorf("helper pod %s/%s did not start within %s (phase %s)", namespace, name, m.timeout, phase)
+	}
+	return err
+}
+
+// helperPod builds the pod that mounts a claim while its data is copied. It
+// sleeps until it is deleted.
+func helperPod(backupName, namespace, claim, image, nodeName string, readOnly bool) *corev1.Pod {
+	deadline := int64(helperDeadline / time.Second)
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      helperPodName(backupName, namespace, claim),
+			Namespace: namespace,
+			Labels:    map[string]string{HelperLabel: backupName},
+		},
+		Spec: corev1.PodSpec{
+			NodeName:                      nodeName,
+			RestartPolicy:                 corev1.RestartPolicyNever,
+			TerminationGracePeriodSeconds: new(int64),
+			ActiveDeadlineSeconds:         &deadline,
+			Containers: []corev1.Container{{
+				Name:         containerName,
+				Image:        image,
+				Command:      []string{"sleep", fmt.Sprint(deadline)},
+				VolumeMounts: []corev1.VolumeMount{{Name: "data", MountPath: mountPath, ReadOnly: readOnly}},
+			}},
+			Volumes: []corev1.Volume{{
+				Name: "data",
+				VolumeSource: corev1.VolumeSource{PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{
+					ClaimName: claim,
+					ReadOnly:  readOnly,
+				}},
+			}},
+		},
+	}
+}
+
+// helperPodName names a helper pod of a claim for a backup. A random suffix
+// keeps it clear of pods left behind by earlier runs.
+func helperPodName(backupName, namespace, claim string) string {
+	sum := sha256.Sum256([]byte(backupName + "/" + namespace + "/" + claim))
+	return "k8s-backup-mover-" + hex.EncodeToString(sum[:6]) + "-" + utilrand.String(5)
+}
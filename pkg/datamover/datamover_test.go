@@ -0,0 +1,194 @@
+package datamover
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apiextensionsfake "k8s.io/apiextensions-apiserver/pkg/client/clientset/clientset/fake"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+
+	"k8s-backup/pkg/k8s"
+)
+
+// fakeExecutor records the commands run and answers them with output
+type fakeExecutor struct {
+	commands []string
+	stdin    []byte
+	output   string
+	err      error
+}
+
+func (e *fakeExecutor) Exec(ctx context.Context, namespace, pod, container string, command []string, stdin io.Reader, stdout, stderr io.Writer) error {
+	e.commands = append(e.commands, namespace+"/"+pod+"/"+container+": "+strings.Join(command, " "))
+	if stdin != nil {
+		e.stdin, _ = io.ReadAll(stdin)
+	}
+	if stdout != nil {
+		io.WriteString(stdout, e.output)
+	}
+	if e.err != nil {
+		io.WriteString(stderr, "tar: read error\n")
+	}
+	return e.err
+}
+
+// newTestMover returns a mover whose helper pods start running when they are
+// first read, and the clientset it uses
+func newTestMover(phase corev1.PodPhase, objects ...runtime.Object) (*Mover, *kubefake.Clientset, *fakeExecutor) {
+	clientset := kubefake.NewSimpleClientset(objects...)
+	clientset.PrependReactor("get", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		get := action.(k8stesting.GetAction)
+		obj, err := clientset.Tracker().Get(corev1.SchemeGroupVersion.WithResource("pods"), get.GetNamespace(), get.GetName())
+		if err != nil {
+			return true, nil, err
+		}
+		pod := obj.(*corev1.Pod)
+		pod.Status.Phase = phase
+		return true, pod, nil
+	})
+
+	client := k8s.NewClientFromInterfaces(clientset, apiextensionsfake.NewSimpleClientset(), dynamicfake.NewSimpleDynamicClient(runtime.NewScheme()))
+	executor := &fakeExecutor{}
+	mover := NewMover(client)
+	mover.executor = executor
+	return mover, clientset, executor
+}
+
+func TestSelected(t *testing.T) {
+	annotated := &metav1.ObjectMeta{Namespace: "db", Name: "data", Annotations: map[string]string{"k8s-backup.io/backup-volume-data": "true"}}
+	plain := &metav1.ObjectMeta{Namespace: "logs", Name: "archive"}
+
+	if !Selected(annotated, nil) {
+		t.Error("Expected an annotated claim to be selected")
+	}
+	if Selected(plain, nil) || Selected(plain, []string{"db/*", "logs/data"}) {
+		t.Error("Expected a claim matching no pattern not to be selected")
+	}
+	if !Selected(plain, []string{"logs/*"}) || !Selected(plain, []string{"*/archive"}) {
+		t.Error("Expected a claim matching a pattern to be selected")
+	}
+
+	if err := ValidateSelection([]string{"db/data", "logs/*"}); err != nil {
+		t.Errorf("ValidateSelection failed: %v", err)
+	}
+	for _, pattern := range []string{"data", "db/data/extra", "db/[data"} {
+		if err := ValidateSelection([]string{pattern}); err == nil {
+			t.Errorf("Expected %q to be rejected", pattern)
+		}
+	}
+}
+
+func TestBackupVolume(t *testing.T) {
+	pollInterval = time.Millisecond
+	defer func() { pollInterval = 2 * time.Second }()
+
+	// The claim is in use by a pod, whose node the helper pod must run on
+	workload := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "db", Name: "postgres-0"},
+		Spec: corev1.PodSpec{
+			NodeName: "node-b",
+			Volumes: []corev1.Volume{{Name: "data", VolumeSource: corev1.VolumeSource{
+				PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: "data"},
+			}}},
+		},
+		Status: corev1.PodStatus{Phase: corev1.PodRunning},
+	}
+	mover, clientset, executor := newTestMover(corev1.PodRunning, workload)
+	mover.SetImage("registry.example.com/tools:1")
+	executor.output = "tar stream"
+
+	var created *corev1.Pod
+	clientset.PrependReactor("create", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		created = action.(k8stesting.CreateAction).GetObject().(*corev1.Pod).DeepCopy()
+		return false, nil, nil
+	})
+
+	var out bytes.Buffer
+	if err := mover.BackupVolume(context.Background(), "nightly", "db", "data", &out); err != nil {
+		t.Fatalf("BackupVolume failed: %v", err)
+	}
+	if out.String() != "tar stream" {
+		t.Errorf("Expected the tar stream, got %q", out.String())
+	}
+
+	if created == nil {
+		t.Fatal("Expected a helper pod to be created")
+	}
+	if created.Spec.NodeName != "node-b" || created.Labels[HelperLabel] != "nightly" {
+		t.Errorf("Unexpected helper pod %+v", created.ObjectMeta)
+	}
+	container := created.Spec.Containers[0]
+	if container.Image != "registry.example.com/tools:1" || !container.VolumeMounts[0].ReadOnly {
+		t.Errorf("Expected a read-only mount in the configured image, got %+v", container)
+	}
+	if claim := created.Spec.Volumes[0].PersistentVolumeClaim; claim == nil || claim.ClaimName != "data" {
+		t.Errorf("Expected the helper pod to mount the claim, got %+v", created.Spec.Volumes)
+	}
+
+	expected := []string{"db/" + created.Name + "/mover: tar -C /data -cf - ."}
+	if !reflect.DeepEqual(executor.commands, expected) {
+		t.Errorf("Expected commands %v, got %v", expected, executor.commands)
+	}
+
+	// The helper pod is deleted again
+	pods, _ := clientset.CoreV1().Pods("db").List(context.Background(), metav1.ListOptions{})
+	if len(pods.Items) != 1 {
+		t.Errorf("Expected only the workload pod to remain, got %d pods", len(pods.Items))
+	}
+}
+
+func TestRestoreVolume(t *testing.T) {
+	pollInterval = time.Millisecond
+	defer func() { pollInterval = 2 * time.Second }()
+
+	mover, clientset, executor := newTestMover(corev1.PodRunning)
+	if err := mover.RestoreVolume(context.Background(), "nightly", "db-restore", "data", strings.NewReader("tar stream")); err != nil {
+		t.Fatalf("RestoreVolume failed: %v", err)
+	}
+	if string(executor.stdin) != "tar stream" || !strings.HasSuffix(executor.commands[0], "tar -C /data -xf -") {
+		t.Errorf("Expected the tar stream to be extracted, got %v with %q", executor.commands, executor.stdin)
+	}
+
+	executor.err = errors.New("command terminated with exit code 2")
+	err := mover.RestoreVolume(context.Background(), "nightly", "db-restore", "data", strings.NewReader("tar stream"))
+	if err == nil || !strings.Contains(err.Error(), "tar: read error") {
+		t.Errorf("Expected the error to include tar's output, got %v", err)
+	}
+
+	pods, _ := clientset.CoreV1().Pods("db-restore").List(context.Background(), metav1.ListOptions{})
+	if len(pods.Items) != 0 {
+		t.Errorf("Expected helper pods to be deleted, got %d pods", len(pods.Items))
+	}
+}
+
+func TestHelperPodFails(t *testing.T) {
+	pollInterval = time.Millisecond
+	defer func() { pollInterval = 2 * time.Second }()
+
+	mover, _, executor := newTestMover(corev1.PodFailed)
+	err := mover.BackupVolume(context.Background(), "nightly", "db", "data", io.Discard)
+	if err == nil || !strings.Contains(err.Error(), "exited") {
+		t.Errorf("Expected the failed helper pod to be reported, got %v", err)
+	}
+
+	mover, _, _ = newTestMover(corev1.PodPending)
+	mover.SetTimeout(20 * time.Millisecond)
+	err = mover.BackupVolume(context.Background(), "nightly", "db", "data", io.Discard)
+	if err == nil || !strings.Contains(err.Error(), "did not start") {
+		t.Errorf("Expected the helper pod to time out, got %v", err)
+	}
+	if len(executor.commands) != 0 {
+		t.Errorf("Expected no commands in a pod that did not start, got %v", executor.commands)
+	}
+}
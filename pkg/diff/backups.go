@@ -0,0 +1,197 @@
+package diff
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"sigs.k8s.io/yaml"
+
+	"k8s-backup/pkg/backup"
+	"k8s-backup/pkg/storage"
+	"k8s-backup/pkg/types"
+)
+
+// FieldChange is a field whose value differs between two backups. From or To
+// is nil when the field is only set on one side.
+type FieldChange struct {
+	Path string      `json:"path"`
+	From interface{} `json:"from,omitempty"`
+	To   interface{} `json:"to,omitempty"`
+}
+
+// plainFieldName matches map keys that can be written in a field path
+// without quoting
+var plainFieldName = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// DiffBackups compares two backups, aligning their resources by group, kind,
+// namespace and name. Resources only in the second backup are reported as
+// added, resources only in the first as removed, and resources that differ
+// as changed with the fields that differ. Both sides are normalised the way
+// backups are, without status.
+func (m *Manager) DiffBackups(ctx context.Context, options *types.BackupDiffOptions) (*DiffResult, error) {
+	log.Printf("Comparing backup %s with %s", options.From, options.To)
+
+	chain := storage.NewChainStorage(m.storage)
+	fromManifest, fromResources, err := chain.LoadBackup(ctx, options.From)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load backup %s: %w", options.From, err)
+	}
+	toManifest, toResources, err := chain.LoadBackup(ctx, options.To)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load backup %s: %w", options.To, err)
+	}
+
+	result := &DiffResult{
+		Base:      fromManifest.Metadata.Name,
+		Backup:    toManifest.Metadata.Name,
+		Resources: []ResourceDiff{},
+	}
+
+	namespaces := sets.NewString(options.Namespaces...)
+	kinds := sets.NewString()
+	for _, kind := range options.Kinds {
+		kinds.Insert(strings.ToLower(kind))
+	}
+	selected := func(info types.ResourceInfo) bool {
+		return inNamespaces(namespaces, info.Namespace) && (kinds.Len() == 0 || kinds.Has(strings.ToLower(info.Kind)))
+	}
+
+	from := make(map[string]types.ResourceWithContent, len(fromResources))
+	for _, resource := range fromResources {
+		if selected(resource.Info) {
+			from[resource.Info.Key()] = resource
+		}
+	}
+
+	for _, resource := range toResources {
+		if ctx.Err() != nil {
+			return result, ctx.Err()
+		}
+		if !selected(resource.Info) {
+			continue
+		}
+
+		key := resource.Info.Key()
+		base, ok := from[key]
+		if !ok {
+			result.add(resource.Info, Added, "")
+			continue
+		}
+		delete(from, key)
+
+		fields, err := diffResources(base, resource)
+		if err != nil {
+			result.Errors = append(result.Errors, err)
+			continue
+		}
+		if len(fields) > 0 {
+			result.add(resource.Info, Changed, "").Fields = fields
+		} else {
+			result.Unchanged++
+		}
+	}
+	for _, resource := range from {
+		result.add(resource.Info, Removed, "")
+	}
+
+	sortResources(result.Resources)
+
+	log.Printf("Diff completed: %d added, %d removed, %d changed, %d unchanged",
+		result.Added, result.Removed, result.Changed, result.Unchanged)
+
+	return result, nil
+}
+
+// diffResources returns the fields that differ between two backed up
+// versions of a resource
+func diffResources(from, to types.ResourceWithContent) ([]FieldChange, error) {
+	parse := func(resource types.ResourceWithContent) (map[string]interface{}, error) {
+		obj := &unstructured.Unstructured{}
+		if err := yaml.Unmarshal(resource.Content, &obj.Object); err != nil {
+			return nil, fmt.Errorf("failed to parse %s/%s: %w", resource.Info.Kind, resource.Info.Name, err)
+		}
+		backup.CleanObject(obj)
+		unstructured.RemoveNestedField(obj.Object, "status")
+		return obj.Object, nil
+	}
+
+	fromObj, err := parse(from)
+	if err != nil {
+		return nil, err
+	}
+	toObj, err := parse(to)
+	if err != nil {
+		return nil, err
+	}
+
+	var changes []FieldChange
+	diffFields("", fromObj, toObj, &changes)
+	return changes, nil
+}
+
+// diffFields appends the leaf fields that differ between two values. Lists
+// are compared element by element.
+func diffFields(path string, from, to interface{}, changes *[]FieldChange) {
+	switch fromValue := from.(type) {
+	case map[string]interface{}:
+		if toValue, ok := to.(map[string]interface{}); ok {
+			keys := sets.StringKeySet(fromValue).Union(sets.StringKeySet(toValue)).List()
+			for _, key := range keys {
+				diffFields(fieldPath(path, key), fromValue[key], toValue[key], changes)
+			}
+			return
+		}
+	case []interface{}:
+		if toValue, ok := to.([]interface{}); ok {
+			for i := 0; i < len(fromValue) || i < len(toValue); i++ {
+				var fromItem, toItem interface{}
+				if i < len(fromValue) {
+					fromItem = fromValue[i]
+				}
+				if i < len(toValue) {
+					toItem = toValue[i]
+				}
+				diffFields(path+"["+strconv.Itoa(i)+"]", fromItem, toItem, changes)
+			}
+			return
+		}
+	}
+
+	if !reflect.DeepEqual(from, to) {
+		*changes = append(*changes, FieldChange{Path: path, From: from, To: to})
+	}
+}
+
+// fieldPath appends a map key to a field path, quoting keys such as label
+// names that are not plain identifiers
+func fieldPath(path, key string) string {
+	if !plainFieldName.MatchString(key) {
+		return path + "[" + strconv.Quote(key) + "]"
+	}
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+// sortResources sorts differing resources by kind, namespace and name
+func sortResources(resources []ResourceDiff) {
+	sort.SliceStable(resources, func(i, j int) bool {
+		a, b := resources[i], resources[j]
+		if a.Kind != b.Kind {
+			return a.Kind < b.Kind
+		}
+		if a.Namespace != b.Namespace {
+			return a.Namespace < b.Namespace
+		}
+		return a.Name < b.Name
+	})
+}
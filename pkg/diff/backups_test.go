@@ -0,0 +1,115 @@
+package diff
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"k8s-backup/pkg/storage"
+	"k8s-backup/pkg/types"
+)
+
+func TestDiffBackups(t *testing.T) {
+	tempDir := t.TempDir()
+	local := storage.NewLocalStorage(tempDir)
+
+	save := func(name string, compress bool, resources []types.ResourceWithContent) string {
+		metadata := &types.BackupMetadata{Name: name, Timestamp: time.Now(), Version: types.BackupFormatVersion, Compress: compress}
+		if err := local.SaveBackup(context.Background(), metadata, resources); err != nil {
+			t.Fatalf("Failed to save backup %s: %v", name, err)
+		}
+		return metadata.BackupPath
+	}
+	configMap := func(namespace, name, content string) types.ResourceWithContent {
+		return types.ResourceWithContent{
+			Content: []byte("apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: " + name + "\n  namespace: " + namespace + "\n" + content),
+			Info:    types.ResourceInfo{APIVersion: "v1", Kind: "ConfigMap", Namespace: namespace, Name: name},
+		}
+	}
+	deployment := func(replicas, image string) types.ResourceWithContent {
+		return types.ResourceWithContent{
+			Content: []byte("apiVersion: apps/v1\nkind: Deployment\nmetadata:\n  name: web\n  namespace: prod\n  labels:\n    app.kubernetes.io/name: web\n" +
+				"spec:\n  replicas: " + replicas + "\n  template:\n    spec:\n      containers:\n      - name: web\n        image: " + image + "\n" +
+				"status:\n  readyReplicas: " + replicas + "\n"),
+			Info: types.ResourceInfo{APIVersion: "apps/v1", Kind: "Deployment", Namespace: "prod", Name: "web"},
+		}
+	}
+
+	from := save("nightly-1", false, []types.ResourceWithContent{
+		deployment("3", "web:1.0"),
+		configMap("prod", "same", "data:\n  mode: fast\n"),
+		configMap("prod", "dropped", ""),
+		configMap("staging", "settings", "data:\n  mode: fast\n"),
+	})
+	to := save("nightly-2", true, []types.ResourceWithContent{
+		deployment("5", "web:1.1"),
+		configMap("prod", "same", "data:\n  mode: fast\n"),
+		configMap("prod", "new", ""),
+		configMap("staging", "settings", "data:\n  mode: slow\n"),
+	})
+
+	manager := NewManager(nil, local)
+	result, err := manager.DiffBackups(context.Background(), &types.BackupDiffOptions{From: from, To: to, Namespaces: []string{"prod"}})
+	if err != nil {
+		t.Fatalf("DiffBackups failed: %v", err)
+	}
+	if result.Base != "nightly-1" || result.Backup != "nightly-2" {
+		t.Errorf("Expected nightly-1 -> nightly-2, got %s -> %s", result.Base, result.Backup)
+	}
+
+	var changes []string
+	for _, resource := range result.Resources {
+		changes = append(changes, string(resource.Change)+" "+resource.Kind+" "+resource.Namespace+"/"+resource.Name)
+	}
+	expected := []string{"removed ConfigMap prod/dropped", "added ConfigMap prod/new", "changed Deployment prod/web"}
+	if !reflect.DeepEqual(changes, expected) {
+		t.Errorf("Expected changes %v, got %v", expected, changes)
+	}
+	if result.Unchanged != 1 {
+		t.Errorf("Expected 1 unchanged resource, got %d", result.Unchanged)
+	}
+
+	// Status is ignored
+	expectedFields := []FieldChange{
+		{Path: "spec.replicas", From: float64(3), To: float64(5)},
+		{Path: "spec.template.spec.containers[0].image", From: "web:1.0", To: "web:1.1"},
+	}
+	if fields := result.Resources[2].Fields; !reflect.DeepEqual(fields, expectedFields) {
+		t.Errorf("Expected fields %+v, got %+v", expectedFields, fields)
+	}
+
+	result, err = manager.DiffBackups(context.Background(), &types.BackupDiffOptions{From: from, To: to, Kinds: []string{"configmap"}, Namespaces: []string{"staging"}})
+	if err != nil {
+		t.Fatalf("DiffBackups failed: %v", err)
+	}
+	if len(result.Resources) != 1 || result.Resources[0].Name != "settings" {
+		t.Fatalf("Expected only the staging ConfigMap to differ, got %+v", result.Resources)
+	}
+	if expected := []FieldChange{{Path: "data.mode", From: "fast", To: "slow"}}; !reflect.DeepEqual(result.Resources[0].Fields, expected) {
+		t.Errorf("Expected fields %+v, got %+v", expected, result.Resources[0].Fields)
+	}
+}
+
+func TestDiffFields(t *testing.T) {
+	from := map[string]interface{}{
+		"metadata": map[string]interface{}{"labels": map[string]interface{}{"app.kubernetes.io/name": "web", "tier": "front"}},
+		"spec":     map[string]interface{}{"ports": []interface{}{int64(80), int64(443)}},
+	}
+	to := map[string]interface{}{
+		"metadata": map[string]interface{}{"labels": map[string]interface{}{"app.kubernetes.io/name": "api"}},
+		"spec":     map[string]interface{}{"ports": []interface{}{int64(80)}, "paused": true},
+	}
+
+	var changes []FieldChange
+	diffFields("", from, to, &changes)
+	expected := []FieldChange{
+		{Path: `metadata.labels["app.kubernetes.io/name"]`, From: "web", To: "api"},
+		{Path: "metadata.labels.tier", From: "front"},
+		{Path: "spec.paused", To: true},
+		{Path: "spec.ports[1]", From: int64(443)},
+	}
+	if !reflect.DeepEqual(changes, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, changes)
+	}
+}
@@ -0,0 +1,340 @@
+// Package diff compares the resources of a backup with their live
+// counterparts in a cluster, or with the resources of another backup.
+package diff
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+
+	"github.com/pmezard/go-difflib/difflib"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"sigs.k8s.io/yaml"
+
+	"k8s-backup/pkg/backup"
+	"k8s-backup/pkg/k8s"
+	"k8s-backup/pkg/storage"
+	"k8s-backup/pkg/types"
+)
+
+// listPageSize is the number of objects requested per List call when looking
+// for objects that are not in the backup
+const listPageSize = 500
+
+// Change describes how the cluster, or a later backup, differs from a backup
+// for one object
+type Change string
+
+const (
+	// Added objects are in the backup but not in the cluster, so a restore
+	// would create them, or only in the second of two backups
+	Added Change = "added"
+	// Removed objects are in the cluster but not in the backup, so a restore
+	// leaves them alone, or only in the first of two backups
+	Removed Change = "removed"
+	// Changed objects differ between the backup and the cluster, so a restore
+	// with --overwrite would update them, or between two backups
+	Changed Change = "changed"
+)
+
+// ResourceDiff describes one object that differs
+type ResourceDiff struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	Namespace  string `json:"namespace,omitempty"`
+	Name       string `json:"name"`
+	Change     Change `json:"change"`
+	// Diff is a unified diff from the live object to the backed up one
+	Diff string `json:"diff,omitempty"`
+	// Fields lists the fields that differ between two backups
+	Fields []FieldChange `json:"fields,omitempty"`
+}
+
+// DiffResult contains the results of a diff operation
+type DiffResult struct {
+	// Base is the first backup when comparing two backups
+	Base      string         `json:"base,omitempty"`
+	Backup    string         `json:"backup"`
+	Added     int            `json:"added"`
+	Removed   int            `json:"removed"`
+	Changed   int            `json:"changed"`
+	Unchanged int            `json:"unchanged"`
+	Resources []ResourceDiff `json:"resources"`
+	Errors    []error        `json:"-"`
+}
+
+// HasChanges reports whether the cluster differs from the backup
+func (r *DiffResult) HasChanges() bool {
+	return r.Added+r.Removed+r.Changed > 0
+}
+
+// Manager handles diff operations
+type Manager struct {
+	k8sClient *k8s.Client
+	storage   storage.Storage
+}
+
+// NewManager creates a new diff manager
+func NewManager(k8sClient *k8s.Client, storage storage.Storage) *Manager {
+	return &Manager{
+		k8sClient: k8sClient,
+		storage:   storage,
+	}
+}
+
+// listScope is a collection listed for live objects missing from the backup
+type listScope struct {
+	resource  schema.GroupVersionResource
+	kind      string
+	namespace string
+}
+
+// DiffBackup compares every resource of a backup with the live object of the
+// same kind, namespace and name, and lists the live objects of the kinds and
+// namespaces in the backup that the backup does not contain. Both sides are
+// normalised the way backups are before they are compared. Status is left
+// out, as a restore does not write it.
+func (m *Manager) DiffBackup(ctx context.Context, options *types.DiffOptions) (*DiffResult, error) {
+	log.Printf("Comparing backup %s with the cluster", options.BackupPath)
+
+	// Load backup, reconstructing incremental backups from their parent chain
+	manifest, resources, err := storage.NewChainStorage(m.storage).LoadBackup(ctx, options.BackupPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load backup: %w", err)
+	}
+
+	filter := sets.NewString(options.Namespaces...)
+	result := &DiffResult{
+		Backup:    manifest.Metadata.Name,
+		Resources: []ResourceDiff{},
+	}
+
+	// The namespaces whose collections are listed for objects not in the backup
+	namespaces := sets.NewString(manifest.Metadata.Namespaces...)
+	for _, resource := range resources {
+		if resource.Info.Namespace != "" {
+			namespaces.Insert(resource.Info.Namespace)
+		}
+	}
+
+	seen := sets.NewString()
+	scopes := make(map[listScope]k8s.APIResource)
+	for _, resource := range resources {
+		if ctx.Err() != nil {
+			return result, ctx.Err()
+		}
+		if !inNamespaces(filter, resource.Info.Namespace) {
+			continue
+		}
+
+		desired := &unstructured.Unstructured{}
+		if err := yaml.Unmarshal(resource.Content, &desired.Object); err != nil {
+			result.Errors = append(result.Errors, fmt.Errorf("failed to parse %s/%s: %w", resource.Info.Kind, resource.Info.Name, err))
+			continue
+		}
+		gvk := desired.GroupVersionKind()
+		seen.Insert(objectKey(gvk.GroupKind(), resource.Info.Namespace, resource.Info.Name))
+
+		mapping, err := m.k8sClient.RESTMapping(gvk)
+		if meta.IsNoMatchError(err) {
+			// The kind is not served, e.g. because its CRD is not installed
+			result.add(resource.Info, Added, unifiedDiff(resource.Info, nil, desired))
+			continue
+		}
+		if err != nil {
+			result.Errors = append(result.Errors, err)
+			continue
+		}
+
+		namespaced := mapping.Scope.Name() == meta.RESTScopeNameNamespace
+		apiResource := k8s.APIResource{GroupVersionResource: mapping.Resource, Kind: gvk.Kind, Namespaced: namespaced}
+		if namespaced {
+			for _, namespace := range namespaces.List() {
+				if inNamespaces(filter, namespace) {
+					scopes[listScope{resource: mapping.Resource, kind: gvk.Kind, namespace: namespace}] = apiResource
+				}
+			}
+		} else {
+			scopes[listScope{resource: mapping.Resource, kind: gvk.Kind}] = apiResource
+		}
+
+		live, err := m.k8sClient.Dynamic().Resource(mapping.Resource).Namespace(resource.Info.Namespace).Get(ctx, resource.Info.Name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			result.add(resource.Info, Added, unifiedDiff(resource.Info, nil, desired))
+			continue
+		}
+		if err != nil {
+			result.Errors = append(result.Errors, fmt.Errorf("failed to get %s/%s: %w", resource.Info.Kind, resource.Info.Name, err))
+			continue
+		}
+
+		if diff := unifiedDiff(resource.Info, live, desired); diff != "" {
+			result.add(resource.Info, Changed, diff)
+		} else {
+			result.Unchanged++
+		}
+	}
+
+	// Find live objects the backup does not contain, leaving out the ones a
+	// backup would skip
+	for _, scope := range sortedScopes(scopes) {
+		if ctx.Err() != nil {
+			return result, ctx.Err()
+		}
+		apiResource := scopes[scope]
+		groupKind := schema.GroupKind{Group: scope.resource.Group, Kind: scope.kind}
+		err := m.listLive(ctx, scope, func(item *unstructured.Unstructured) {
+			if seen.Has(objectKey(groupKind, item.GetNamespace(), item.GetName())) {
+				return
+			}
+			// List items may omit their type information; fill it from the mapping
+			if item.GetKind() == "" {
+				item.SetGroupVersionKind(apiResource.GroupVersionResource.GroupVersion().WithKind(scope.kind))
+			}
+			if backup.ShouldSkip(apiResource, item) {
+				return
+			}
+			result.add(types.ResourceInfo{
+				APIVersion: item.GetAPIVersion(),
+				Kind:       item.GetKind(),
+				Namespace:  item.GetNamespace(),
+				Name:       item.GetName(),
+			}, Removed, "")
+		})
+		if err != nil {
+			result.Errors = append(result.Errors, fmt.Errorf("failed to list %s: %w", apiResource, err))
+		}
+	}
+
+	sortResources(result.Resources)
+
+	log.Printf("Diff completed: %d added, %d removed, %d changed, %d unchanged",
+		result.Added, result.Removed, result.Changed, result.Unchanged)
+
+	return result, nil
+}
+
+// add records an object that differs
+func (r *DiffResult) add(info types.ResourceInfo, change Change, diff string) *ResourceDiff {
+	switch change {
+	case Added:
+		r.Added++
+	case Removed:
+		r.Removed++
+	case Changed:
+		r.Changed++
+	}
+	r.Resources = append(r.Resources, ResourceDiff{
+		APIVersion: info.APIVersion,
+		Kind:       info.Kind,
+		Namespace:  info.Namespace,
+		Name:       info.Name,
+		Change:     change,
+		Diff:       diff,
+	})
+	return &r.Resources[len(r.Resources)-1]
+}
+
+// listLive lists the live objects of a collection a page at a time
+func (m *Manager) listLive(ctx context.Context, scope listScope, fn func(item *unstructured.Unstructured)) error {
+	client := m.k8sClient.Dynamic().Resource(scope.resource).Namespace(scope.namespace)
+	options := metav1.ListOptions{Limit: listPageSize}
+	for {
+		list, err := client.List(ctx, options)
+		if err != nil {
+			return err
+		}
+		for i := range list.Items {
+			fn(&list.Items[i])
+		}
+		options.Continue = list.GetContinue()
+		if options.Continue == "" {
+			return nil
+		}
+	}
+}
+
+// normalize returns the YAML of an object as a backup would store it,
+// without status
+func normalize(obj *unstructured.Unstructured) (string, error) {
+	if obj == nil {
+		return "", nil
+	}
+	obj = obj.DeepCopy()
+	backup.CleanObject(obj)
+	unstructured.RemoveNestedField(obj.Object, "status")
+	content, err := yaml.Marshal(obj.Object)
+	if err != nil {
+		return "", err
+	}
+	return string(content), nil
+}
+
+// unifiedDiff returns a unified diff from the live object (nil when it does
+// not exist) to the backed up one, or an empty string when they are the same
+func unifiedDiff(info types.ResourceInfo, live, desired *unstructured.Unstructured) string {
+	from, err := normalize(live)
+	if err != nil {
+		from = fmt.Sprintf("# failed to encode live object: %v\n", err)
+	}
+	to, err := normalize(desired)
+	if err != nil {
+		to = fmt.Sprintf("# failed to encode backed up object: %v\n", err)
+	}
+	if from == to {
+		return ""
+	}
+
+	name := info.Kind + "/" + info.Name
+	if info.Namespace != "" {
+		name = info.Kind + "/" + info.Namespace + "/" + info.Name
+	}
+	diff, _ := difflib.GetUnifiedDiffString(difflib.UnifiedDiff{
+		A:        difflib.SplitLines(from),
+		B:        difflib.SplitLines(to),
+		FromFile: "live/" + name,
+		ToFile:   "backup/" + name,
+		Context:  3,
+	})
+	return diff
+}
+
+// inNamespaces reports whether a namespace filter selects the namespace.
+// Like restore, cluster-scoped objects are only selected by an empty filter
+// or one containing "cluster".
+func inNamespaces(filter sets.String, namespace string) bool {
+	if filter.Len() == 0 {
+		return true
+	}
+	if namespace == "" {
+		return filter.Has("") || filter.Has("cluster")
+	}
+	return filter.Has(namespace)
+}
+
+// objectKey identifies an object independently of its API version
+func objectKey(groupKind schema.GroupKind, namespace, name string) string {
+	return groupKind.String() + "/" + namespace + "/" + name
+}
+
+// sortedScopes returns the scopes in a stable order
+func sortedScopes(scopes map[listScope]k8s.APIResource) []listScope {
+	sorted := make([]listScope, 0, len(scopes))
+	for scope := range scopes {
+		sorted = append(sorted, scope)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		a, b := sorted[i], sorted[j]
+		if a.resource.String() != b.resource.String() {
+			return a.resource.String() < b.resource.String()
+		}
+		return a.namespace < b.namespace
+	})
+	return sorted
+}
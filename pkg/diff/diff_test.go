@@ -0,0 +1,142 @@
+package diff
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	apiextensionsfake "k8s.io/apiextensions-apiserver/pkg/client/clientset/clientset/fake"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	fakediscovery "k8s.io/client-go/discovery/fake"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+
+	"k8s-backup/pkg/k8s"
+	"k8s-backup/pkg/storage"
+	"k8s-backup/pkg/types"
+)
+
+func newTestClient(objects ...runtime.Object) *k8s.Client {
+	clientset := kubefake.NewSimpleClientset()
+	clientset.Discovery().(*fakediscovery.FakeDiscovery).Resources = []*metav1.APIResourceList{
+		{
+			GroupVersion: "v1",
+			APIResources: []metav1.APIResource{
+				{Name: "configmaps", SingularName: "configmap", Kind: "ConfigMap", Namespaced: true, Verbs: metav1.Verbs{"get", "list"}},
+				{Name: "serviceaccounts", SingularName: "serviceaccount", Kind: "ServiceAccount", Namespaced: true, Verbs: metav1.Verbs{"get", "list"}},
+			},
+		},
+	}
+
+	listKinds := map[schema.GroupVersionResource]string{
+		{Version: "v1", Resource: "configmaps"}:      "ConfigMapList",
+		{Version: "v1", Resource: "serviceaccounts"}: "ServiceAccountList",
+	}
+	dynamicClient := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), listKinds, objects...)
+	return k8s.NewClientFromInterfaces(clientset, apiextensionsfake.NewSimpleClientset(), dynamicClient)
+}
+
+func newConfigMap(namespace, name string, data map[string]interface{}) *unstructured.Unstructured {
+	obj := &unstructured.Unstructured{Object: map[string]interface{}{"data": data}}
+	obj.SetAPIVersion("v1")
+	obj.SetKind("ConfigMap")
+	obj.SetNamespace(namespace)
+	obj.SetName(name)
+	return obj
+}
+
+func TestDiffBackup(t *testing.T) {
+	tempDir := t.TempDir()
+	resources := []types.ResourceWithContent{
+		{
+			Content: []byte("apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: same\n  namespace: shop\ndata:\n  mode: fast\n"),
+			Info:    types.ResourceInfo{APIVersion: "v1", Kind: "ConfigMap", Namespace: "shop", Name: "same"},
+		},
+		{
+			Content: []byte("apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: settings\n  namespace: shop\ndata:\n  mode: fast\n"),
+			Info:    types.ResourceInfo{APIVersion: "v1", Kind: "ConfigMap", Namespace: "shop", Name: "settings"},
+		},
+		{
+			Content: []byte("apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: deleted\n  namespace: shop\n"),
+			Info:    types.ResourceInfo{APIVersion: "v1", Kind: "ConfigMap", Namespace: "shop", Name: "deleted"},
+		},
+		{
+			Content: []byte("apiVersion: v1\nkind: ServiceAccount\nmetadata:\n  name: deployer\n  namespace: shop\n"),
+			Info:    types.ResourceInfo{APIVersion: "v1", Kind: "ServiceAccount", Namespace: "shop", Name: "deployer"},
+		},
+	}
+	metadata := &types.BackupMetadata{Name: "test-backup", Timestamp: time.Now(), Version: types.BackupFormatVersion}
+	if err := storage.NewLocalStorage(tempDir).SaveBackup(context.Background(), metadata, resources); err != nil {
+		t.Fatalf("Failed to save backup: %v", err)
+	}
+
+	// Cluster-set metadata and status must not show up as differences
+	same := newConfigMap("shop", "same", map[string]interface{}{"mode": "fast"})
+	same.SetResourceVersion("42")
+	same.SetUID("0b6a5c1e")
+	same.SetAnnotations(map[string]string{"kubectl.kubernetes.io/last-applied-configuration": "{}"})
+	same.Object["status"] = map[string]interface{}{"observed": true}
+
+	deployer := &unstructured.Unstructured{}
+	deployer.SetAPIVersion("v1")
+	deployer.SetKind("ServiceAccount")
+	deployer.SetNamespace("shop")
+	deployer.SetName("deployer")
+	defaultAccount := deployer.DeepCopy()
+	defaultAccount.SetName("default")
+
+	client := newTestClient(
+		same,
+		newConfigMap("shop", "settings", map[string]interface{}{"mode": "slow"}),
+		newConfigMap("shop", "extra", nil),
+		newConfigMap("other", "unrelated", nil),
+		deployer,
+		defaultAccount,
+	)
+
+	result, err := NewManager(client, storage.NewLocalStorage(tempDir)).DiffBackup(context.Background(), &types.DiffOptions{
+		BackupPath: storage.NewLocalStorage(tempDir).GetBackupPath("test-backup"),
+	})
+	if err != nil {
+		t.Fatalf("DiffBackup failed: %v", err)
+	}
+	if len(result.Errors) != 0 {
+		t.Fatalf("Expected no errors, got %v", result.Errors)
+	}
+
+	var changes []string
+	for _, resource := range result.Resources {
+		changes = append(changes, string(resource.Change)+" "+resource.Namespace+"/"+resource.Name)
+	}
+	expected := []string{"added shop/deleted", "removed shop/extra", "changed shop/settings"}
+	if !reflect.DeepEqual(changes, expected) {
+		t.Errorf("Expected changes %v, got %v", expected, changes)
+	}
+	if result.Added != 1 || result.Removed != 1 || result.Changed != 1 || result.Unchanged != 2 {
+		t.Errorf("Unexpected summary: %+v", result)
+	}
+
+	settings := result.Resources[2].Diff
+	for _, line := range []string{"--- live/ConfigMap/shop/settings", "+++ backup/ConfigMap/shop/settings", "-  mode: slow", "+  mode: fast"} {
+		if !strings.Contains(settings, line+"\n") {
+			t.Errorf("Expected the diff to contain %q:\n%s", line, settings)
+		}
+	}
+
+	// Restricting the namespaces leaves out everything else
+	result, err = NewManager(client, storage.NewLocalStorage(tempDir)).DiffBackup(context.Background(), &types.DiffOptions{
+		BackupPath: storage.NewLocalStorage(tempDir).GetBackupPath("test-backup"),
+		Namespaces: []string{"other"},
+	})
+	if err != nil {
+		t.Fatalf("DiffBackup failed: %v", err)
+	}
+	if result.HasChanges() || result.Unchanged != 0 {
+		t.Errorf("Expected nothing to compare in namespace other, got %+v", result)
+	}
+}
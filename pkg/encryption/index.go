@@ -0,0 +1,117 @@
+package encryption
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"k8s-backup/pkg/types"
+)
+
+// opaqueKind is the kind resources of an encrypted backup are stored under,
+// numbered in the order they were written
+const opaqueKind = "Encrypted"
+
+// index holds what the manifest of an encrypted backup would otherwise show
+// in plaintext about the backed up objects. Resources and volumes are stored
+// under opaque names, and their entries here are listed in the order of the
+// manifest entries they stand for.
+type index struct {
+	Namespaces      []string                   `json:"namespaces,omitempty"`
+	ResourceTypes   []string                   `json:"resourceTypes,omitempty"`
+	Deleted         []types.ResourceInfo       `json:"deleted,omitempty"`
+	VolumeSnapshots []types.VolumeSnapshotInfo `json:"volumeSnapshots,omitempty"`
+	Hooks           []types.HookResult         `json:"hooks,omitempty"`
+	Resources       []types.ResourceInfo       `json:"resources,omitempty"`
+	Volumes         []types.VolumeDataInfo     `json:"volumes,omitempty"`
+}
+
+// opaqueResource returns the manifest entry the nth resource of a backup is
+// stored under
+func opaqueResource(n int) types.ResourceInfo {
+	return types.ResourceInfo{Kind: opaqueKind, Name: strconv.Itoa(n)}
+}
+
+// opaqueVolume returns the manifest entry the nth volume of a backup is
+// stored under
+func opaqueVolume(volume types.VolumeDataInfo, n int) types.VolumeDataInfo {
+	volume.Namespace = ""
+	volume.PersistentVolumeClaim = strconv.Itoa(n)
+	return volume
+}
+
+// sealIndex moves the fields of metadata that name backed up objects into
+// the index, and seals it into the metadata's encryption info. It returns a
+// function that puts the fields back.
+func sealIndex(dataKey []byte, metadata *types.BackupMetadata, idx *index) (func(), error) {
+	idx.Namespaces = metadata.Namespaces
+	idx.ResourceTypes = metadata.ResourceTypes
+	idx.Deleted = metadata.Deleted
+	idx.VolumeSnapshots = metadata.VolumeSnapshots
+	idx.Hooks = metadata.Hooks
+
+	data, err := json.Marshal(idx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode the resource index: %w", err)
+	}
+	sealed, err := seal(dataKey, data, indexData(metadata.Name))
+	if err != nil {
+		return nil, fmt.Errorf("failed to encrypt the resource index: %w", err)
+	}
+	metadata.Encryption.Index = sealed
+	metadata.Namespaces = nil
+	metadata.ResourceTypes = nil
+	metadata.Deleted = nil
+	metadata.VolumeSnapshots = nil
+	metadata.Hooks = nil
+
+	return func() {
+		metadata.Namespaces = idx.Namespaces
+		metadata.ResourceTypes = idx.ResourceTypes
+		metadata.Deleted = idx.Deleted
+		metadata.VolumeSnapshots = idx.VolumeSnapshots
+		metadata.Hooks = idx.Hooks
+	}, nil
+}
+
+// openIndex returns the manifest of an encrypted backup as it was before its
+// index was sealed. The stored paths and checksums of resources are kept. A
+// manifest without a sealed index is returned unchanged.
+func openIndex(dataKey []byte, stored *types.BackupManifest) (*types.BackupManifest, error) {
+	info := stored.Metadata.Encryption
+	if info == nil || len(info.Index) == 0 {
+		return stored, nil
+	}
+
+	data, err := open(dataKey, info.Index, indexData(stored.Metadata.Name))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt the resource index: %w", err)
+	}
+	var idx index
+	if err := json.Unmarshal(data, &idx); err != nil {
+		return nil, fmt.Errorf("failed to decode the resource index: %w", err)
+	}
+	if len(idx.Resources) != len(stored.Resources) || len(idx.Volumes) != len(stored.Volumes) {
+		return nil, fmt.Errorf("the resource index does not match the manifest")
+	}
+
+	manifest := *stored
+	manifest.Metadata.Namespaces = idx.Namespaces
+	manifest.Metadata.ResourceTypes = idx.ResourceTypes
+	manifest.Metadata.Deleted = idx.Deleted
+	manifest.Metadata.VolumeSnapshots = idx.VolumeSnapshots
+	manifest.Metadata.Hooks = idx.Hooks
+	manifest.Resources = make([]types.ResourceInfo, len(idx.Resources))
+	for i, resource := range idx.Resources {
+		resource.RelativePath = stored.Resources[i].RelativePath
+		resource.Checksum = stored.Resources[i].Checksum
+		manifest.Resources[i] = resource
+	}
+	manifest.Volumes = idx.Volumes
+	return &manifest, nil
+}
+
+// indexData binds a sealed index to the backup it belongs to
+func indexData(backupName string) []byte {
+	return []byte("index/" + backupName)
+}
@@ -0,0 +1,252 @@
+package encryption
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"filippo.io/age"
+)
+
+// Key schemes recorded in the manifest
+const (
+	SchemePassphrase = "age-scrypt"
+	SchemeKeyFile    = "key-file"
+	SchemeAge        = "age-x25519"
+)
+
+// Key wraps and unwraps the per-backup data keys
+type Key interface {
+	// Scheme names how data keys are wrapped
+	Scheme() string
+	// ID identifies the key without revealing it, or is empty when the scheme
+	// has no stable identifier
+	ID() string
+	WrapKey(dataKey []byte) ([]byte, error)
+	UnwrapKey(wrapped []byte) ([]byte, error)
+}
+
+// NewPassphraseKey returns a key that wraps data keys with an scrypt-derived
+// key, using age's passphrase encryption
+func NewPassphraseKey(passphrase string) (Key, error) {
+	if passphrase == "" {
+		return nil, fmt.Errorf("passphrase is empty")
+	}
+	return &passphraseKey{passphrase: passphrase}, nil
+}
+
+type passphraseKey struct {
+	passphrase string
+}
+
+func (k *passphraseKey) Scheme() string { return SchemePassphrase }
+func (k *passphraseKey) ID() string     { return "" }
+
+func (k *passphraseKey) WrapKey(dataKey []byte) ([]byte, error) {
+	recipient, err := age.NewScryptRecipient(k.passphrase)
+	if err != nil {
+		return nil, err
+	}
+	return ageEncrypt(dataKey, recipient)
+}
+
+func (k *passphraseKey) UnwrapKey(wrapped []byte) ([]byte, error) {
+	identity, err := age.NewScryptIdentity(k.passphrase)
+	if err != nil {
+		return nil, err
+	}
+	return ageDecrypt(wrapped, identity)
+}
+
+// LoadKeyFile reads a 256-bit key encryption key from a file holding either
+// the hex or base64 encoding of 32 bytes, or the raw bytes. Raw keys must not
+// read as text, so a 32-character password is never used as a key.
+func LoadKeyFile(path string) (Key, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key file: %w", err)
+	}
+
+	text := strings.TrimSpace(string(data))
+	if decoded, err := hex.DecodeString(text); err == nil && len(decoded) == 32 {
+		return &fileKey{key: decoded}, nil
+	}
+	if decoded, err := base64.StdEncoding.DecodeString(text); err == nil && len(decoded) == 32 {
+		return &fileKey{key: decoded}, nil
+	}
+	if len(data) == 32 && !isText(data) {
+		return &fileKey{key: data}, nil
+	}
+	if len(data) == 32 {
+		return nil, fmt.Errorf("key file %s holds text that is neither hex nor base64; use a passphrase file for passwords", path)
+	}
+	return nil, fmt.Errorf("key file %s must contain a 32-byte key (raw, hex or base64)", path)
+}
+
+// isText reports whether data reads as text rather than random bytes, which
+// are almost never all printable
+func isText(data []byte) bool {
+	if !utf8.Valid(data) {
+		return false
+	}
+	for _, r := range string(data) {
+		if !unicode.IsPrint(r) && !unicode.IsSpace(r) {
+			return false
+		}
+	}
+	return true
+}
+
+type fileKey struct {
+	key []byte
+}
+
+func (k *fileKey) Scheme() string { return SchemeKeyFile }
+
+func (k *fileKey) ID() string {
+	sum := sha256.Sum256(k.key)
+	return hex.EncodeToString(sum[:8])
+}
+
+func (k *fileKey) WrapKey(dataKey []byte) ([]byte, error) {
+	return seal(k.key, dataKey, nil)
+}
+
+func (k *fileKey) UnwrapKey(wrapped []byte) ([]byte, error) {
+	return open(k.key, wrapped, nil)
+}
+
+// NewAgeKey returns a key that wraps data keys to age X25519 recipients
+// (age1...) and unwraps them with any of the given identities. Backups need
+// recipients; restores need identities.
+func NewAgeKey(recipients []string, identities []age.Identity) (Key, error) {
+	k := &ageKey{identities: identities}
+	for _, r := range recipients {
+		recipient, err := age.ParseX25519Recipient(r)
+		if err != nil {
+			return nil, fmt.Errorf("invalid recipient %q: %w", r, err)
+		}
+		k.recipients = append(k.recipients, recipient)
+		k.recipientNames = append(k.recipientNames, recipient.String())
+	}
+	if len(k.recipients) == 0 && len(k.identities) == 0 {
+		return nil, fmt.Errorf("at least one recipient or identity is required")
+	}
+	sort.Strings(k.recipientNames)
+	return k, nil
+}
+
+// LoadAgeIdentities reads age identities (AGE-SECRET-KEY-1...) from a file
+// as written by age-keygen
+func LoadAgeIdentities(path string) ([]age.Identity, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open identity file: %w", err)
+	}
+	defer f.Close()
+
+	identities, err := age.ParseIdentities(f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse identity file %s: %w", path, err)
+	}
+	return identities, nil
+}
+
+type ageKey struct {
+	recipients     []age.Recipient
+	recipientNames []string
+	identities     []age.Identity
+}
+
+func (k *ageKey) Scheme() string { return SchemeAge }
+
+// ID fingerprints the recipient set, so it is only known when wrapping
+func (k *ageKey) ID() string {
+	if len(k.recipientNames) == 0 {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(strings.Join(k.recipientNames, "\n")))
+	return hex.EncodeToString(sum[:8])
+}
+
+func (k *ageKey) WrapKey(dataKey []byte) ([]byte, error) {
+	if len(k.recipients) == 0 {
+		return nil, fmt.Errorf("no age recipients configured")
+	}
+	return ageEncrypt(dataKey, k.recipients...)
+}
+
+func (k *ageKey) UnwrapKey(wrapped []byte) ([]byte, error) {
+	if len(k.identities) == 0 {
+		return nil, fmt.Errorf("no age identities configured")
+	}
+	return ageDecrypt(wrapped, k.identities...)
+}
+
+func ageEncrypt(data []byte, recipients ...age.Recipient) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := age.Encrypt(&buf, recipients...)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func ageDecrypt(data []byte, identities ...age.Identity) ([]byte, error) {
+	r, err := age.Decrypt(bytes.NewReader(data), identities...)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(r)
+}
+
+// seal encrypts plaintext with AES-256-GCM, prefixing the random nonce
+func seal(key, plaintext, additionalData []byte) ([]byte, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, additionalData), nil
+}
+
+// open reverses seal
+func open(key, sealed, additionalData []byte) ([]byte, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, fmt.Errorf("ciphertext too short")
+	}
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	return aead.Open(nil, nonce, ciphertext, additionalData)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
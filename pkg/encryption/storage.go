@@ -0,0 +1,303 @@
+// Package encryption provides client-side envelope encryption of backups.
+//
+// Every backup gets a fresh 256-bit data key. Resource contents and volume
+// data are encrypted with it using AES-256-GCM, and the data key itself is
+// stored in the manifest wrapped by a user key (passphrase, key file or age
+// recipients).
+// Only the metadata backups are listed and pruned by, such as their name,
+// time, size and encryption info, stays readable without the key. What the
+// manifest records about the backed up objects is sealed into an index, and
+// resources and volumes are stored under opaque names.
+package encryption
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"io"
+
+	"k8s-backup/pkg/storage"
+	"k8s-backup/pkg/types"
+)
+
+// AlgorithmAES256GCM is the content encryption algorithm
+const AlgorithmAES256GCM = "AES-256-GCM"
+
+// Storage encrypts backups on save and decrypts them on load, delegating
+// everything else to the wrapped storage backend
+type Storage struct {
+	storage.Storage
+	key Key
+}
+
+// NewStorage wraps a storage backend. With a nil key, backups are saved in
+// plaintext and loading an encrypted backup fails with a descriptive error.
+func NewStorage(backend storage.Storage, key Key) *Storage {
+	return &Storage{Storage: backend, key: key}
+}
+
+// SaveBackup encrypts every resource's content before saving it
+func (s *Storage) SaveBackup(ctx context.Context, metadata *types.BackupMetadata, resources []types.ResourceWithContent) error {
+	return storage.WriteBackup(ctx, s, metadata, resources)
+}
+
+// LoadBackup loads a backup and decrypts its resources if it is encrypted
+func (s *Storage) LoadBackup(ctx context.Context, backupPath string) (*types.BackupManifest, []types.ResourceWithContent, error) {
+	return storage.ReadBackup(ctx, s, backupPath)
+}
+
+// OpenBackupWriter starts a backup whose resources are encrypted as they are
+// written, and whose index is sealed on Commit
+func (s *Storage) OpenBackupWriter(ctx context.Context, metadata *types.BackupMetadata) (storage.BackupWriter, error) {
+	if s.key == nil {
+		return s.Storage.OpenBackupWriter(ctx, metadata)
+	}
+
+	dataKey := make([]byte, 32)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, fmt.Errorf("failed to generate data key: %w", err)
+	}
+	wrappedKey, err := s.key.WrapKey(dataKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to wrap data key: %w", err)
+	}
+
+	metadata.Encryption = &types.EncryptionInfo{
+		Algorithm:  AlgorithmAES256GCM,
+		KeyScheme:  s.key.Scheme(),
+		KeyID:      s.key.ID(),
+		WrappedKey: wrappedKey,
+	}
+	writer, err := s.Storage.OpenBackupWriter(ctx, metadata)
+	if err != nil {
+		return nil, err
+	}
+	return &encryptingWriter{BackupWriter: writer, dataKey: dataKey, metadata: metadata}, nil
+}
+
+// OpenBackupReader opens a backup whose resources are decrypted as they are
+// read if it is encrypted
+func (s *Storage) OpenBackupReader(ctx context.Context, backupPath string) (storage.BackupReader, error) {
+	reader, err := s.Storage.OpenBackupReader(ctx, backupPath)
+	if err != nil {
+		return nil, err
+	}
+
+	dataKey, err := s.DataKey(reader.Manifest().Metadata.Encryption)
+	if err != nil {
+		reader.Close()
+		return nil, err
+	}
+	if dataKey == nil {
+		return reader, nil
+	}
+	manifest, err := openIndex(dataKey, reader.Manifest())
+	if err != nil {
+		reader.Close()
+		return nil, err
+	}
+	return &decryptingReader{BackupReader: reader, dataKey: dataKey, manifest: manifest, resources: storedResources(manifest)}, nil
+}
+
+// VerifyBackup verifies a backup and decrypts its verified resources before
+// checking them. Without a key, checksums are still verified but the
+// resources are not checked.
+func (s *Storage) VerifyBackup(ctx context.Context, backupPath string, check storage.ResourceCheck) (*types.VerificationReport, error) {
+	var dataKey []byte
+	var keyErr error
+	var decrypted *types.BackupManifest
+	var resources map[string]types.ResourceInfo
+	keyResolved := false
+	resolveKey := func(manifest *types.BackupManifest) {
+		if keyResolved || s.key == nil {
+			return
+		}
+		keyResolved = true
+		if dataKey, keyErr = s.DataKey(manifest.Metadata.Encryption); keyErr == nil {
+			decrypted, keyErr = openIndex(dataKey, manifest)
+		}
+		if keyErr != nil {
+			dataKey = nil
+			return
+		}
+		resources = storedResources(decrypted)
+	}
+
+	report, err := s.Storage.VerifyBackup(ctx, backupPath, func(manifest *types.BackupManifest, resource types.ResourceWithContent) error {
+		if manifest.Metadata.Encryption == nil {
+			return runCheck(check, manifest, resource)
+		}
+		resolveKey(manifest)
+		if dataKey == nil {
+			return nil
+		}
+
+		resource.Info = resources[resource.Info.RelativePath]
+		content, err := open(dataKey, resource.Content, additionalData(resource.Info))
+		if err != nil {
+			return fmt.Errorf("failed to decrypt: %w", err)
+		}
+		resource.Content = content
+		return runCheck(check, decrypted, resource)
+	})
+	if err != nil || report.Manifest == nil || report.Manifest.Metadata.Encryption == nil {
+		return report, err
+	}
+
+	// A backup without resources was never checked
+	resolveKey(report.Manifest)
+	if decrypted != nil {
+		report.Manifest = decrypted
+	}
+	switch {
+	case s.key == nil:
+		report.Warnings = append(report.Warnings, fmt.Sprintf("backup is encrypted (%s); resource contents were not checked", describeKey(report.Manifest.Metadata.Encryption)))
+	case keyErr != nil:
+		report.Errors = append(report.Errors, keyErr)
+	}
+	return report, nil
+}
+
+func runCheck(check storage.ResourceCheck, manifest *types.BackupManifest, resource types.ResourceWithContent) error {
+	if check == nil {
+		return nil
+	}
+	return check(manifest, resource)
+}
+
+// encryptingWriter encrypts each resource before passing it on under an
+// opaque name, recording the resources and volumes written in the index
+type encryptingWriter struct {
+	storage.BackupWriter
+	dataKey  []byte
+	metadata *types.BackupMetadata
+	index    index
+}
+
+func (w *encryptingWriter) WriteResource(ctx context.Context, resource types.ResourceWithContent) error {
+	content, err := seal(w.dataKey, resource.Content, additionalData(resource.Info))
+	if err != nil {
+		return fmt.Errorf("failed to encrypt %s/%s: %w", resource.Info.Kind, resource.Info.Name, err)
+	}
+	w.index.Resources = append(w.index.Resources, resource.Info)
+	return w.BackupWriter.WriteResource(ctx, types.ResourceWithContent{Content: content, Info: opaqueResource(len(w.index.Resources))})
+}
+
+// WriteVolume encrypts a volume's data as a stream of sealed chunks. The
+// recorded size and checksum are those of the encrypted stream.
+func (w *encryptingWriter) WriteVolume(ctx context.Context, volume types.VolumeDataInfo, data io.Reader) (types.VolumeDataInfo, error) {
+	stored, err := w.BackupWriter.WriteVolume(ctx, opaqueVolume(volume, len(w.index.Volumes)+1), newSealingReader(data, w.dataKey, volumeData(volume)))
+	stored.Namespace = volume.Namespace
+	stored.PersistentVolumeClaim = volume.PersistentVolumeClaim
+	w.index.Volumes = append(w.index.Volumes, stored)
+	return stored, err
+}
+
+// Commit seals the index into the manifest. The metadata is left as it was
+// once the backup is committed.
+func (w *encryptingWriter) Commit(ctx context.Context) error {
+	restore, err := sealIndex(w.dataKey, w.metadata, &w.index)
+	if err != nil {
+		w.BackupWriter.Abort()
+		return err
+	}
+	defer restore()
+	return w.BackupWriter.Commit(ctx)
+}
+
+// decryptingReader decrypts each resource as it is read, and returns it with
+// its entry in the opened index
+type decryptingReader struct {
+	storage.BackupReader
+	dataKey  []byte
+	manifest *types.BackupManifest
+	// resources maps the stored paths of resources to their entries
+	resources map[string]types.ResourceInfo
+}
+
+func (r *decryptingReader) Manifest() *types.BackupManifest {
+	return r.manifest
+}
+
+func (r *decryptingReader) Next(ctx context.Context) (types.ResourceWithContent, error) {
+	resource, err := r.BackupReader.Next(ctx)
+	if err != nil {
+		return resource, err
+	}
+	resource.Info = r.resources[resource.Info.RelativePath]
+	content, err := open(r.dataKey, resource.Content, additionalData(resource.Info))
+	if err != nil {
+		return types.ResourceWithContent{}, fmt.Errorf("failed to decrypt %s/%s: %w", resource.Info.Kind, resource.Info.Name, err)
+	}
+	resource.Content = content
+	return resource, nil
+}
+
+func (r *decryptingReader) OpenVolume(ctx context.Context, volume types.VolumeDataInfo) (io.ReadCloser, error) {
+	// Volumes are opened by the entries they are stored under
+	stored := volume
+	for i := range r.manifest.Volumes {
+		if r.manifest.Volumes[i].Key() == volume.Key() {
+			stored = r.BackupReader.Manifest().Volumes[i]
+		}
+	}
+	data, err := r.BackupReader.OpenVolume(ctx, stored)
+	if err != nil {
+		return nil, err
+	}
+	return newOpeningReader(data, r.dataKey, volumeData(volume)), nil
+}
+
+// storedResources maps the stored paths of a manifest's resources to their
+// entries
+func storedResources(manifest *types.BackupManifest) map[string]types.ResourceInfo {
+	resources := make(map[string]types.ResourceInfo, len(manifest.Resources))
+	for _, info := range manifest.Resources {
+		resources[info.RelativePath] = info
+	}
+	return resources
+}
+
+// DataKey unwraps the data key of an encrypted backup. It returns nil for
+// unencrypted backups.
+func (s *Storage) DataKey(info *types.EncryptionInfo) ([]byte, error) {
+	if info == nil {
+		return nil, nil
+	}
+	if info.Algorithm != AlgorithmAES256GCM {
+		return nil, fmt.Errorf("unsupported encryption algorithm %q", info.Algorithm)
+	}
+	if s.key == nil {
+		return nil, fmt.Errorf("backup is encrypted (%s); a key is required to read it", describeKey(info))
+	}
+	if s.key.Scheme() != info.KeyScheme {
+		return nil, fmt.Errorf("backup is encrypted with a %s key, not a %s key", info.KeyScheme, s.key.Scheme())
+	}
+	if info.KeyID != "" && s.key.ID() != "" && s.key.ID() != info.KeyID {
+		return nil, fmt.Errorf("backup is encrypted with key %s, not %s", info.KeyID, s.key.ID())
+	}
+
+	dataKey, err := s.key.UnwrapKey(info.WrappedKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unwrap data key: %w", err)
+	}
+	return dataKey, nil
+}
+
+func describeKey(info *types.EncryptionInfo) string {
+	if info.KeyID == "" {
+		return info.KeyScheme
+	}
+	return fmt.Sprintf("%s %s", info.KeyScheme, info.KeyID)
+}
+
+// additionalData binds each ciphertext to the resource it belongs to, so
+// encrypted contents cannot be swapped between manifest entries
+func additionalData(info types.ResourceInfo) []byte {
+	return []byte(info.APIVersion + "/" + info.Kind + "/" + info.Namespace + "/" + info.Name)
+}
+
+// volumeData binds the encrypted data of a volume to its claim
+func volumeData(volume types.VolumeDataInfo) string {
+	return "volume/" + volume.Namespace + "/" + volume.PersistentVolumeClaim
+}
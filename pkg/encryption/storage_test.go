@@ -0,0 +1,252 @@
+package encryption
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"filippo.io/age"
+
+	"k8s-backup/pkg/storage"
+	"k8s-backup/pkg/types"
+)
+
+var secretContent = []byte("apiVersion: v1\nkind: Secret\nmetadata:\n  name: db\n  namespace: shop\ndata:\n  password: aHVudGVyMg==\n")
+
+func saveTestBackup(t *testing.T, dir string, key Key) *types.BackupMetadata {
+	t.Helper()
+
+	metadata := &types.BackupMetadata{Name: "encrypted", Timestamp: time.Now(), Version: types.BackupFormatVersion, Namespaces: []string{"shop"}}
+	resources := []types.ResourceWithContent{{
+		Content: secretContent,
+		Info: types.ResourceInfo{
+			APIVersion:  "v1",
+			Kind:        "Secret",
+			Namespace:   "shop",
+			Name:        "db",
+			Labels:      map[string]string{"app": "db"},
+			Annotations: map[string]string{"note": "sensitive"},
+		},
+	}}
+	if err := NewStorage(storage.NewLocalStorage(dir), key).SaveBackup(context.Background(), metadata, resources); err != nil {
+		t.Fatalf("SaveBackup failed: %v", err)
+	}
+	return metadata
+}
+
+func writeKeyFile(t *testing.T, dir, name string, key []byte) Key {
+	t.Helper()
+
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, key, 0600); err != nil {
+		t.Fatalf("Failed to write key file: %v", err)
+	}
+	loaded, err := LoadKeyFile(path)
+	if err != nil {
+		t.Fatalf("LoadKeyFile failed: %v", err)
+	}
+	return loaded
+}
+
+func TestEncryptedRoundTrip(t *testing.T) {
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatalf("Failed to generate age identity: %v", err)
+	}
+	keyDir := t.TempDir()
+	fileKey := writeKeyFile(t, keyDir, "backup.key", bytes.Repeat([]byte{7}, 32))
+	passphraseKey, _ := NewPassphraseKey("correct horse battery staple")
+	wrappingKey, _ := NewAgeKey([]string{identity.Recipient().String()}, nil)
+	unwrappingKey, _ := NewAgeKey(nil, []age.Identity{identity})
+
+	tests := []struct {
+		name      string
+		saveKey   Key
+		loadKey   Key
+		keyScheme string
+	}{
+		{"key file", fileKey, fileKey, SchemeKeyFile},
+		{"passphrase", passphraseKey, passphraseKey, SchemePassphrase},
+		{"age", wrappingKey, unwrappingKey, SchemeAge},
+	}
+
+	for _, test := range tests {
+		dir := t.TempDir()
+		metadata := saveTestBackup(t, dir, test.saveKey)
+
+		// Resources are stored under opaque names
+		onDisk, err := os.ReadFile(filepath.Join(metadata.BackupPath, "cluster", "encrypted-1.yaml"))
+		if err != nil {
+			t.Fatalf("%s: failed to read resource file: %v", test.name, err)
+		}
+		if bytes.Contains(onDisk, []byte("password")) {
+			t.Errorf("%s: resource file contains plaintext", test.name)
+		}
+
+		manifestData, err := os.ReadFile(filepath.Join(metadata.BackupPath, types.ManifestFileName))
+		if err != nil {
+			t.Fatalf("%s: failed to read manifest: %v", test.name, err)
+		}
+		for _, plaintext := range []string{"shop", "Secret", "sensitive"} {
+			if strings.Contains(string(manifestData), plaintext) {
+				t.Errorf("%s: manifest contains %q in plaintext", test.name, plaintext)
+			}
+		}
+		if len(metadata.Namespaces) != 1 {
+			t.Errorf("%s: expected the saved metadata to keep its namespaces, got %v", test.name, metadata.Namespaces)
+		}
+
+		manifest, resources, err := NewStorage(storage.NewLocalStorage(dir), test.loadKey).LoadBackup(context.Background(), metadata.BackupPath)
+		if err != nil {
+			t.Fatalf("%s: LoadBackup failed: %v", test.name, err)
+		}
+		if manifest.Metadata.Encryption == nil || manifest.Metadata.Encryption.KeyScheme != test.keyScheme {
+			t.Errorf("%s: expected encryption info with scheme %s, got %+v", test.name, test.keyScheme, manifest.Metadata.Encryption)
+		}
+		if !bytes.Equal(resources[0].Content, secretContent) {
+			t.Errorf("%s: decrypted content mismatch:\n%s", test.name, resources[0].Content)
+		}
+		info := resources[0].Info
+		if info.Kind != "Secret" || info.Namespace != "shop" || info.Labels["app"] != "db" || info.Annotations["note"] != "sensitive" {
+			t.Errorf("%s: expected the resource's entry to be restored from the index, got %+v", test.name, info)
+		}
+		if len(manifest.Resources) != 1 || manifest.Resources[0].Name != "db" || strings.Join(manifest.Metadata.Namespaces, ",") != "shop" {
+			t.Errorf("%s: expected the manifest to be restored from the index, got %+v", test.name, manifest)
+		}
+	}
+}
+
+func TestVerifyEncryptedBackup(t *testing.T) {
+	dir := t.TempDir()
+	key := writeKeyFile(t, t.TempDir(), "backup.key", bytes.Repeat([]byte{5}, 32))
+	metadata := saveTestBackup(t, dir, key)
+	backend := storage.NewLocalStorage(dir)
+
+	var checked []types.ResourceInfo
+	report, err := NewStorage(backend, key).VerifyBackup(context.Background(), metadata.BackupPath, func(manifest *types.BackupManifest, resource types.ResourceWithContent) error {
+		if !bytes.Equal(resource.Content, secretContent) {
+			t.Errorf("Expected the decrypted content to be checked, got %q", resource.Content)
+		}
+		checked = append(checked, resource.Info)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("VerifyBackup failed: %v", err)
+	}
+	if !report.OK() || len(checked) != 1 || checked[0].Name != "db" || report.Manifest.Resources[0].Kind != "Secret" {
+		t.Errorf("Expected the resource to be checked with its entry in the index, got %+v and %v", report, checked)
+	}
+
+	// Without the key only the checksums of the opaque files are verified
+	report, err = NewStorage(backend, nil).VerifyBackup(context.Background(), metadata.BackupPath, nil)
+	if err != nil {
+		t.Fatalf("VerifyBackup failed: %v", err)
+	}
+	if !report.OK() || report.Verified != 1 || report.Manifest.Resources[0].Kind != opaqueKind || len(report.Warnings) != 1 {
+		t.Errorf("Expected the encrypted backup to verify without its index, got %+v", report)
+	}
+}
+
+func TestEncryptedIncrementalChain(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	key := writeKeyFile(t, t.TempDir(), "backup.key", bytes.Repeat([]byte{6}, 32))
+	encrypted := NewStorage(storage.NewLocalStorage(dir), key)
+
+	configMap := types.ResourceInfo{APIVersion: "v1", Kind: "ConfigMap", Namespace: "shop", Name: "settings"}
+	base := &types.BackupMetadata{Name: "base", Timestamp: time.Now(), Version: types.BackupFormatVersion}
+	if err := encrypted.SaveBackup(ctx, base, []types.ResourceWithContent{
+		{Content: []byte("kind: ConfigMap\n"), Info: configMap},
+		{Content: secretContent, Info: types.ResourceInfo{APIVersion: "v1", Kind: "Secret", Namespace: "shop", Name: "db"}},
+	}); err != nil {
+		t.Fatalf("SaveBackup failed: %v", err)
+	}
+	// The config map was deleted and the secret changed since the base
+	changed := []byte("kind: Secret\nmetadata:\n  name: db\n")
+	increment := &types.BackupMetadata{Name: "increment", Timestamp: time.Now(), Version: types.BackupFormatVersion, Parent: "base", Chain: []string{"base"}, Deleted: []types.ResourceInfo{configMap}}
+	if err := encrypted.SaveBackup(ctx, increment, []types.ResourceWithContent{
+		{Content: changed, Info: types.ResourceInfo{APIVersion: "v1", Kind: "Secret", Namespace: "shop", Name: "db"}},
+	}); err != nil {
+		t.Fatalf("SaveBackup failed: %v", err)
+	}
+
+	_, resources, err := storage.NewChainStorage(encrypted).LoadBackup(ctx, increment.BackupPath)
+	if err != nil {
+		t.Fatalf("LoadBackup failed: %v", err)
+	}
+	if len(resources) != 1 || resources[0].Info.Name != "db" || !bytes.Equal(resources[0].Content, changed) {
+		t.Errorf("Expected only the changed secret, got %+v", resources)
+	}
+}
+
+func TestLoadEncryptedBackupWithWrongKey(t *testing.T) {
+	dir := t.TempDir()
+	right := writeKeyFile(t, dir, "right.key", bytes.Repeat([]byte{1}, 32))
+	wrong := writeKeyFile(t, dir, "wrong.key", bytes.Repeat([]byte{2}, 32))
+	passphrase, _ := NewPassphraseKey("not the key file")
+
+	backupDir := t.TempDir()
+	metadata := saveTestBackup(t, backupDir, right)
+	backend := storage.NewLocalStorage(backupDir)
+
+	for name, key := range map[string]Key{"no key": nil, "wrong key": wrong, "wrong scheme": passphrase} {
+		if _, _, err := NewStorage(backend, key).LoadBackup(context.Background(), metadata.BackupPath); err == nil {
+			t.Errorf("%s: expected LoadBackup to fail", name)
+		}
+	}
+}
+
+func TestUnencryptedBackupPassesThrough(t *testing.T) {
+	dir := t.TempDir()
+	metadata := saveTestBackup(t, dir, nil)
+	if metadata.Encryption != nil {
+		t.Fatalf("Expected no encryption info without a key")
+	}
+
+	key := writeKeyFile(t, t.TempDir(), "backup.key", bytes.Repeat([]byte{3}, 32))
+	_, resources, err := NewStorage(storage.NewLocalStorage(dir), key).LoadBackup(context.Background(), metadata.BackupPath)
+	if err != nil {
+		t.Fatalf("LoadBackup failed: %v", err)
+	}
+	if !bytes.Equal(resources[0].Content, secretContent) {
+		t.Errorf("Expected plaintext content to load unchanged")
+	}
+}
+
+func TestLoadKeyFileEncodings(t *testing.T) {
+	dir := t.TempDir()
+	raw := bytes.Repeat([]byte{0xab}, 32)
+
+	rawKey := writeKeyFile(t, dir, "raw.key", raw)
+	hexKey := writeKeyFile(t, dir, "hex.key", []byte(strings.Repeat("ab", 32)+"\n"))
+	if rawKey.ID() != hexKey.ID() {
+		t.Errorf("Expected raw and hex encodings of the same key to share an ID")
+	}
+
+	base64Key := writeKeyFile(t, dir, "base64.key", []byte(base64.StdEncoding.EncodeToString(raw)))
+	if rawKey.ID() != base64Key.ID() {
+		t.Errorf("Expected raw and base64 encodings of the same key to share an ID")
+	}
+
+	// A 32-character password is not a raw key
+	password := filepath.Join(dir, "password.key")
+	if err := os.WriteFile(password, []byte("correct horse battery staple 123"), 0600); err != nil {
+		t.Fatalf("Failed to write key file: %v", err)
+	}
+	if _, err := LoadKeyFile(password); err == nil || !strings.Contains(err.Error(), "neither hex nor base64") {
+		t.Errorf("Expected a text key file to be rejected, got %v", err)
+	}
+
+	path := filepath.Join(dir, "short.key")
+	if err := os.WriteFile(path, []byte("too short"), 0600); err != nil {
+		t.Fatalf("Failed to write key file: %v", err)
+	}
+	if _, err := LoadKeyFile(path); err == nil {
+		t.Error("Expected an error for a key file without a 32-byte key")
+	}
+}
@@ -0,0 +1,153 @@
+package encryption
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// Volume data is too large to seal in one piece, so it is encrypted as a
+// sequence of frames, each holding a chunk sealed with the data key. A frame
+// starts with a flag byte, set on the last frame, and the big-endian length
+// of the sealed chunk. The chunk's index and the flag are bound into its
+// additional data, so frames cannot be reordered, dropped or truncated.
+const (
+	chunkSize         = 1 << 20
+	frameHeaderSize   = 5
+	lastFrame         = 1
+	maxSealedFrameLen = chunkSize + 64
+)
+
+// sealingReader encrypts a stream as it is read
+type sealingReader struct {
+	src     io.Reader
+	dataKey []byte
+	prefix  string
+	index   uint64
+	frame   []byte
+	done    bool
+}
+
+func newSealingReader(src io.Reader, dataKey []byte, prefix string) *sealingReader {
+	return &sealingReader{src: src, dataKey: dataKey, prefix: prefix}
+}
+
+func (r *sealingReader) Read(p []byte) (int, error) {
+	for len(r.frame) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		if err := r.sealChunk(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.frame)
+	r.frame = r.frame[n:]
+	return n, nil
+}
+
+// sealChunk reads the next chunk and seals it into a frame. A chunk shorter
+// than chunkSize ends the stream; a stream that ends on a chunk boundary
+// gets an empty last frame.
+func (r *sealingReader) sealChunk() error {
+	chunk := make([]byte, chunkSize)
+	n, err := io.ReadFull(r.src, chunk)
+	var flag byte
+	switch {
+	case err == io.EOF || err == io.ErrUnexpectedEOF:
+		flag = lastFrame
+		r.done = true
+	case err != nil:
+		return err
+	}
+
+	sealed, err := seal(r.dataKey, chunk[:n], chunkData(r.prefix, r.index, flag))
+	if err != nil {
+		return fmt.Errorf("failed to encrypt: %w", err)
+	}
+	r.index++
+
+	frame := make([]byte, frameHeaderSize, frameHeaderSize+len(sealed))
+	frame[0] = flag
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(sealed)))
+	r.frame = append(frame, sealed...)
+	return nil
+}
+
+// openingReader decrypts a stream written by sealingReader
+type openingReader struct {
+	src     io.ReadCloser
+	dataKey []byte
+	prefix  string
+	index   uint64
+	chunk   []byte
+	done    bool
+}
+
+func newOpeningReader(src io.ReadCloser, dataKey []byte, prefix string) *openingReader {
+	return &openingReader{src: src, dataKey: dataKey, prefix: prefix}
+}
+
+func (r *openingReader) Read(p []byte) (int, error) {
+	for len(r.chunk) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		if err := r.openFrame(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.chunk)
+	r.chunk = r.chunk[n:]
+	return n, nil
+}
+
+func (r *openingReader) openFrame() error {
+	header := make([]byte, frameHeaderSize)
+	if _, err := io.ReadFull(r.src, header); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return errors.New("encrypted stream is truncated")
+		}
+		return err
+	}
+	length := binary.BigEndian.Uint32(header[1:])
+	if length > maxSealedFrameLen {
+		return fmt.Errorf("encrypted frame of %d bytes is too large", length)
+	}
+	sealed := make([]byte, length)
+	if _, err := io.ReadFull(r.src, sealed); err != nil {
+		return errors.New("encrypted stream is truncated")
+	}
+
+	chunk, err := open(r.dataKey, sealed, chunkData(r.prefix, r.index, header[0]))
+	if err != nil {
+		return fmt.Errorf("failed to decrypt: %w", err)
+	}
+	r.index++
+	r.chunk = chunk
+	if header[0] != lastFrame {
+		return nil
+	}
+
+	// Read to the end of the source, so a checksum of the stored stream is
+	// checked
+	r.done = true
+	if _, err := io.ReadFull(r.src, make([]byte, 1)); err != io.EOF {
+		if err == nil {
+			return errors.New("encrypted stream has data after its last frame")
+		}
+		return err
+	}
+	return nil
+}
+
+func (r *openingReader) Close() error {
+	return r.src.Close()
+}
+
+// chunkData is the additional data of a chunk of a stream
+func chunkData(prefix string, index uint64, flag byte) []byte {
+	return []byte(prefix + "/" + strconv.FormatUint(index, 10) + "/" + strconv.Itoa(int(flag)))
+}
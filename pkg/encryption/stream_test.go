@@ -0,0 +1,86 @@
+package encryption
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"k8s-backup/pkg/storage"
+	"k8s-backup/pkg/types"
+)
+
+func TestSealedStreamRoundTrip(t *testing.T) {
+	dataKey := bytes.Repeat([]byte{3}, 32)
+	for _, size := range []int{0, 10, chunkSize, 2*chunkSize + 5} {
+		data := bytes.Repeat([]byte{'x'}, size)
+		sealed, err := io.ReadAll(newSealingReader(bytes.NewReader(data), dataKey, "volume/db/data"))
+		if err != nil {
+			t.Fatalf("size %d: failed to seal: %v", size, err)
+		}
+
+		opened, err := io.ReadAll(newOpeningReader(io.NopCloser(bytes.NewReader(sealed)), dataKey, "volume/db/data"))
+		if err != nil || !bytes.Equal(opened, data) {
+			t.Errorf("size %d: expected the data back, got %d bytes, %v", size, len(opened), err)
+		}
+
+		// Streams are bound to their volume, and cannot be cut short or
+		// extended
+		if _, err := io.ReadAll(newOpeningReader(io.NopCloser(bytes.NewReader(sealed)), dataKey, "volume/db/logs")); err == nil {
+			t.Errorf("size %d: expected a stream of another volume to be rejected", size)
+		}
+		lastFrameStart := len(sealed) - frameHeaderSize - (size%chunkSize + 28)
+		if _, err := io.ReadAll(newOpeningReader(io.NopCloser(bytes.NewReader(sealed[:lastFrameStart])), dataKey, "volume/db/data")); err == nil {
+			t.Errorf("size %d: expected a truncated stream to be rejected", size)
+		}
+		if _, err := io.ReadAll(newOpeningReader(io.NopCloser(bytes.NewReader(append(sealed, 0))), dataKey, "volume/db/data")); err == nil {
+			t.Errorf("size %d: expected trailing data to be rejected", size)
+		}
+	}
+}
+
+func TestEncryptedVolumeData(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	key := writeKeyFile(t, t.TempDir(), "backup.key", bytes.Repeat([]byte{7}, 32))
+	encrypted := NewStorage(storage.NewLocalStorage(dir), key)
+
+	metadata := &types.BackupMetadata{Name: "encrypted", Timestamp: time.Now(), Version: types.BackupFormatVersion}
+	writer, err := encrypted.OpenBackupWriter(ctx, metadata)
+	if err != nil {
+		t.Fatalf("OpenBackupWriter failed: %v", err)
+	}
+	data := []byte("password=hunter2")
+	volume, err := writer.WriteVolume(ctx, types.VolumeDataInfo{Namespace: "shop", PersistentVolumeClaim: "db"}, bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("WriteVolume failed: %v", err)
+	}
+	if err := writer.Commit(ctx); err != nil {
+		t.Fatalf("Commit failed: %v", err)
+	}
+
+	onDisk, err := os.ReadFile(filepath.Join(metadata.BackupPath, volume.RelativePath))
+	if err != nil {
+		t.Fatalf("Failed to read volume data: %v", err)
+	}
+	if bytes.Contains(onDisk, []byte("hunter2")) {
+		t.Error("Volume data is stored in plaintext")
+	}
+
+	reader, err := encrypted.OpenBackupReader(ctx, metadata.BackupPath)
+	if err != nil {
+		t.Fatalf("OpenBackupReader failed: %v", err)
+	}
+	defer reader.Close()
+	stream, err := reader.OpenVolume(ctx, volume)
+	if err != nil {
+		t.Fatalf("OpenVolume failed: %v", err)
+	}
+	defer stream.Close()
+	if read, err := io.ReadAll(stream); err != nil || !bytes.Equal(read, data) {
+		t.Errorf("Expected the decrypted volume data, got %q, %v", read, err)
+	}
+}
@@ -0,0 +1,235 @@
+package hooks
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"sigs.k8s.io/yaml"
+
+	"k8s-backup/pkg/types"
+)
+
+// annotationsHook names the hooks declared through pod annotations
+const annotationsHook = "annotations"
+
+// defaultTimeout bounds hooks that do not set a timeout
+const defaultTimeout = 30 * time.Second
+
+// Hook is a command run in a container of a pod
+type Hook struct {
+	Name      string
+	Phase     types.HookPhase
+	Container string
+	Command   []string
+	Timeout   time.Duration
+	OnError   types.HookOnError
+}
+
+// Config holds the hooks of a hooks file
+type Config struct {
+	Hooks []Rule `json:"hooks"`
+}
+
+// Rule runs commands in the pods it matches. Empty match fields match
+// every pod.
+type Rule struct {
+	Name       string   `json:"name"`
+	Namespaces []string `json:"namespaces,omitempty"`
+	// Selector is a label selector such as app=postgres
+	Selector string `json:"selector,omitempty"`
+	// Container is the default container of the rule's commands; the pod's
+	// first container is used when neither sets one
+	Container string    `json:"container,omitempty"`
+	Pre       []Command `json:"pre,omitempty"`
+	Post      []Command `json:"post,omitempty"`
+
+	namespaces sets.String
+	selector   labels.Selector
+}
+
+// Command is a hook command of a rule
+type Command struct {
+	Command   []string          `json:"command"`
+	Container string            `json:"container,omitempty"`
+	Timeout   metav1.Duration   `json:"timeout,omitempty"`
+	OnError   types.HookOnError `json:"onError,omitempty"`
+}
+
+// LoadConfig reads hooks from a YAML hooks file
+func LoadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read hooks file: %w", err)
+	}
+	config, err := ParseConfig(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid hooks file %s: %w", path, err)
+	}
+	return config, nil
+}
+
+// ParseConfig parses the YAML of a hooks file
+func ParseConfig(data []byte) (*Config, error) {
+	var config Config
+	if err := yaml.UnmarshalStrict(data, &config); err != nil {
+		return nil, err
+	}
+	return NewConfig(config.Hooks)
+}
+
+// NewConfig validates hook rules declared outside a hooks file, e.g. inline
+// in a schedule
+func NewConfig(rules []Rule) (*Config, error) {
+	config := Config{Hooks: append([]Rule(nil), rules...)}
+	names := sets.NewString()
+	for i := range config.Hooks {
+		rule := &config.Hooks[i]
+		if rule.Name == "" {
+			return nil, fmt.Errorf("hook %d: name is required", i+1)
+		}
+		if names.Has(rule.Name) {
+			return nil, fmt.Errorf("hook %d: duplicate name %q", i+1, rule.Name)
+		}
+		names.Insert(rule.Name)
+
+		selector, err := labels.Parse(rule.Selector)
+		if err != nil {
+			return nil, fmt.Errorf("hook %s: invalid selector: %w", rule.Name, err)
+		}
+		rule.selector = selector
+		rule.namespaces = sets.NewString(rule.Namespaces...)
+
+		for _, command := range append(append([]Command{}, rule.Pre...), rule.Post...) {
+			if len(command.Command) == 0 {
+				return nil, fmt.Errorf("hook %s: command is required", rule.Name)
+			}
+			if _, err := parseOnError(string(command.OnError)); err != nil {
+				return nil, fmt.Errorf("hook %s: %w", rule.Name, err)
+			}
+			if command.Timeout.Duration < 0 {
+				return nil, fmt.Errorf("hook %s: timeout must not be negative", rule.Name)
+			}
+		}
+	}
+	return &config, nil
+}
+
+// PodHooks returns the hooks of a phase to run in a pod: those declared
+// through its annotations, followed by those of the matching rules in file
+// order
+func (c *Config) PodHooks(pod *corev1.Pod, phase types.HookPhase) ([]Hook, error) {
+	var podHooks []Hook
+	hook, err := annotationHook(pod, phase)
+	if err != nil {
+		return nil, err
+	}
+	if hook != nil {
+		podHooks = append(podHooks, *hook)
+	}
+	if c == nil {
+		return podHooks, nil
+	}
+
+	for _, rule := range c.Hooks {
+		if (rule.namespaces.Len() > 0 && !rule.namespaces.Has(pod.Namespace)) ||
+			(rule.selector != nil && !rule.selector.Matches(labels.Set(pod.Labels))) {
+			continue
+		}
+		commands := rule.Pre
+		if phase == types.HookPost {
+			commands = rule.Post
+		}
+		for _, command := range commands {
+			container := command.Container
+			if container == "" {
+				container = rule.Container
+			}
+			onError, _ := parseOnError(string(command.OnError))
+			podHooks = append(podHooks, Hook{
+				Name:      rule.Name,
+				Phase:     phase,
+				Container: defaultContainer(pod, container),
+				Command:   command.Command,
+				Timeout:   timeoutOrDefault(command.Timeout.Duration),
+				OnError:   onError,
+			})
+		}
+	}
+	return podHooks, nil
+}
+
+// annotationHook reads the hook of a phase declared on a pod through the
+// k8s-backup.io/<phase>-hook-command, -container, -timeout and -on-error
+// annotations. A command that is not a JSON array is run by /bin/sh -c.
+func annotationHook(pod *corev1.Pod, phase types.HookPhase) (*Hook, error) {
+	value := func(field string) string {
+		return strings.TrimSpace(pod.Annotations[fmt.Sprintf("k8s-backup.io/%s-hook-%s", phase, field)])
+	}
+	commandValue := value("command")
+	if commandValue == "" {
+		return nil, nil
+	}
+
+	var command []string
+	if strings.HasPrefix(commandValue, "[") {
+		if err := json.Unmarshal([]byte(commandValue), &command); err != nil || len(command) == 0 {
+			return nil, fmt.Errorf("invalid %s-hook-command annotation on pod %s/%s: expected a JSON array of strings", phase, pod.Namespace, pod.Name)
+		}
+	} else {
+		command = []string{"/bin/sh", "-c", commandValue}
+	}
+
+	var timeout time.Duration
+	if timeoutValue := value("timeout"); timeoutValue != "" {
+		var err error
+		if timeout, err = time.ParseDuration(timeoutValue); err != nil || timeout < 0 {
+			return nil, fmt.Errorf("invalid %s-hook-timeout annotation on pod %s/%s: %q", phase, pod.Namespace, pod.Name, timeoutValue)
+		}
+	}
+	onError, err := parseOnError(value("on-error"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s-hook-on-error annotation on pod %s/%s: %w", phase, pod.Namespace, pod.Name, err)
+	}
+
+	return &Hook{
+		Name:      annotationsHook,
+		Phase:     phase,
+		Container: defaultContainer(pod, value("container")),
+		Command:   command,
+		Timeout:   timeoutOrDefault(timeout),
+		OnError:   onError,
+	}, nil
+}
+
+// parseOnError parses an on-error setting, which defaults to failing the
+// backup
+func parseOnError(value string) (types.HookOnError, error) {
+	switch onError := types.HookOnError(strings.ToLower(value)); onError {
+	case "":
+		return types.HookFail, nil
+	case types.HookFail, types.HookContinue:
+		return onError, nil
+	}
+	return "", fmt.Errorf("unknown on-error %q: expected fail or continue", value)
+}
+
+func defaultContainer(pod *corev1.Pod, container string) string {
+	if container == "" && len(pod.Spec.Containers) > 0 {
+		return pod.Spec.Containers[0].Name
+	}
+	return container
+}
+
+func timeoutOrDefault(timeout time.Duration) time.Duration {
+	if timeout == 0 {
+		return defaultTimeout
+	}
+	return timeout
+}
@@ -0,0 +1,139 @@
+package hooks
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"k8s-backup/pkg/types"
+)
+
+func newTestPod(namespace, name string, labels, annotations map[string]string) *corev1.Pod {
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name, Labels: labels, Annotations: annotations},
+		Spec:       corev1.PodSpec{Containers: []corev1.Container{{Name: "app"}, {Name: "sidecar"}}},
+		Status:     corev1.PodStatus{Phase: corev1.PodRunning},
+	}
+}
+
+func TestParseConfig(t *testing.T) {
+	config, err := ParseConfig([]byte(`
+hooks:
+  - name: postgres-checkpoint
+    namespaces: [db]
+    selector: app=postgres
+    container: postgres
+    pre:
+      - command: ["psql", "-c", "CHECKPOINT"]
+        timeout: 1m
+      - command: ["sync"]
+        container: sidecar
+        onError: continue
+    post:
+      - command: ["true"]
+`))
+	if err != nil {
+		t.Fatalf("ParseConfig failed: %v", err)
+	}
+	if len(config.Hooks) != 1 || len(config.Hooks[0].Pre) != 2 || config.Hooks[0].Pre[0].Timeout.Duration != time.Minute {
+		t.Errorf("Unexpected config %+v", config.Hooks)
+	}
+
+	for name, data := range map[string]string{
+		"unknown field":    "hooks:\n  - name: a\n    pre:\n      - command: [sync]\n        retries: 3\n",
+		"missing name":     "hooks:\n  - pre:\n      - command: [sync]\n",
+		"duplicate name":   "hooks:\n  - name: a\n  - name: a\n",
+		"missing command":  "hooks:\n  - name: a\n    post:\n      - container: app\n",
+		"invalid on-error": "hooks:\n  - name: a\n    pre:\n      - command: [sync]\n        onError: retry\n",
+		"invalid selector": "hooks:\n  - name: a\n    selector: 'app in ('\n",
+	} {
+		if _, err := ParseConfig([]byte(data)); err == nil {
+			t.Errorf("%s: expected the config to be rejected", name)
+		}
+	}
+}
+
+func TestPodHooks(t *testing.T) {
+	config, err := ParseConfig([]byte(`
+hooks:
+  - name: postgres
+    namespaces: [db]
+    selector: app=postgres
+    container: postgres
+    pre:
+      - command: ["psql", "-c", "CHECKPOINT"]
+      - command: ["sync"]
+        container: sidecar
+        onError: continue
+  - name: everywhere
+    post:
+      - command: ["true"]
+        timeout: 5s
+`))
+	if err != nil {
+		t.Fatalf("ParseConfig failed: %v", err)
+	}
+
+	pod := newTestPod("db", "postgres-0", map[string]string{"app": "postgres"}, map[string]string{
+		"k8s-backup.io/pre-hook-command":    "pg_dump mydb > /data/dump.sql",
+		"k8s-backup.io/pre-hook-timeout":    "2m",
+		"k8s-backup.io/pre-hook-on-error":   "Continue",
+		"k8s-backup.io/post-hook-command":   `["rm", "/data/dump.sql"]`,
+		"k8s-backup.io/post-hook-container": "sidecar",
+	})
+
+	pre, err := config.PodHooks(pod, types.HookPre)
+	if err != nil {
+		t.Fatalf("PodHooks failed: %v", err)
+	}
+	expected := []Hook{
+		{Name: "annotations", Phase: types.HookPre, Container: "app", Command: []string{"/bin/sh", "-c", "pg_dump mydb > /data/dump.sql"}, Timeout: 2 * time.Minute, OnError: types.HookContinue},
+		{Name: "postgres", Phase: types.HookPre, Container: "postgres", Command: []string{"psql", "-c", "CHECKPOINT"}, Timeout: defaultTimeout, OnError: types.HookFail},
+		{Name: "postgres", Phase: types.HookPre, Container: "sidecar", Command: []string{"sync"}, Timeout: defaultTimeout, OnError: types.HookContinue},
+	}
+	if !reflect.DeepEqual(pre, expected) {
+		t.Errorf("Expected pre hooks\n%+v\ngot\n%+v", expected, pre)
+	}
+
+	post, err := config.PodHooks(pod, types.HookPost)
+	if err != nil {
+		t.Fatalf("PodHooks failed: %v", err)
+	}
+	expected = []Hook{
+		{Name: "annotations", Phase: types.HookPost, Container: "sidecar", Command: []string{"rm", "/data/dump.sql"}, Timeout: defaultTimeout, OnError: types.HookFail},
+		{Name: "everywhere", Phase: types.HookPost, Container: "app", Command: []string{"true"}, Timeout: 5 * time.Second, OnError: types.HookFail},
+	}
+	if !reflect.DeepEqual(post, expected) {
+		t.Errorf("Expected post hooks\n%+v\ngot\n%+v", expected, post)
+	}
+
+	// Rules only apply to the pods they match
+	other := newTestPod("web", "nginx", map[string]string{"app": "postgres"}, nil)
+	if pre, _ := config.PodHooks(other, types.HookPre); len(pre) != 0 {
+		t.Errorf("Expected no pre hooks outside the rule's namespaces, got %+v", pre)
+	}
+
+	// Without a hooks file only annotations declare hooks
+	var none *Config
+	if pre, err := none.PodHooks(pod, types.HookPre); err != nil || len(pre) != 1 {
+		t.Errorf("Expected the annotation hook only, got %+v, %v", pre, err)
+	}
+}
+
+func TestInvalidHookAnnotations(t *testing.T) {
+	for field, value := range map[string]string{
+		"command":  `["unterminated"`,
+		"timeout":  "soon",
+		"on-error": "ignore",
+	} {
+		annotations := map[string]string{"k8s-backup.io/pre-hook-command": "sync", "k8s-backup.io/pre-hook-" + field: value}
+		_, err := (*Config)(nil).PodHooks(newTestPod("db", "postgres-0", nil, annotations), types.HookPre)
+		if err == nil || !strings.Contains(err.Error(), "pre-hook-"+field) {
+			t.Errorf("Expected an invalid %s annotation to be reported, got %v", field, err)
+		}
+	}
+}
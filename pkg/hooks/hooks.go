@@ -0,0 +1,206 @@
+// Package hooks runs commands in application pods around a backup, through
+// the pods/exec subresource: pre hooks before anything is captured, e.g. to
+// flush or freeze a database, and post hooks once everything has been, to
+// undo them. Hooks are declared through pod annotations or in a hooks file.
+package hooks
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/client-go/tools/pager"
+
+	"k8s-backup/pkg/k8s"
+	"k8s-backup/pkg/types"
+)
+
+// executor runs commands in pods; *k8s.Client implements it
+type executor interface {
+	Exec(ctx context.Context, namespace, pod, container string, command []string, stdin io.Reader, stdout, stderr io.Writer) error
+}
+
+// Runner runs the hooks of the pods of one backup. Post hooks run only in
+// the pods whose pre hooks were reached, in reverse order.
+type Runner struct {
+	k8sClient *k8s.Client
+	executor  executor
+	config    *Config
+
+	pods     []corev1.Pod
+	prepared int
+	postRun  bool
+	results  []types.HookResult
+	warnings []error
+}
+
+// NewRunner creates a runner for the hooks of pod annotations and, if not
+// nil, of a hooks file
+func NewRunner(k8sClient *k8s.Client, config *Config) *Runner {
+	return &Runner{k8sClient: k8sClient, executor: k8sClient, config: config}
+}
+
+// Pods lists the running pods of the namespaces, across the cluster when
+// clusterWide is set, that match the label selector
+func (r *Runner) Pods(ctx context.Context, namespaces []string, clusterWide bool, selector string) ([]corev1.Pod, error) {
+	listNamespaces := namespaces
+	if clusterWide {
+		listNamespaces = []string{metav1.NamespaceAll}
+	}
+	included := sets.NewString(namespaces...)
+
+	var pods []corev1.Pod
+	for _, namespace := range listNamespaces {
+		client := r.k8sClient.Clientset().CoreV1().Pods(namespace)
+		list := pager.New(func(ctx context.Context, options metav1.ListOptions) (runtime.Object, error) {
+			return client.List(ctx, options)
+		})
+		err := list.EachListItem(ctx, metav1.ListOptions{LabelSelector: selector}, func(obj runtime.Object) error {
+			pod, ok := obj.(*corev1.Pod)
+			if ok && pod.Status.Phase == corev1.PodRunning && included.Has(pod.Namespace) {
+				pods = append(pods, *pod)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to list pods: %w", err)
+		}
+	}
+	return pods, nil
+}
+
+// RunPre runs the pre hooks of each pod in turn. It stops at the first
+// hook that fails with on-error fail.
+func (r *Runner) RunPre(ctx context.Context, pods []corev1.Pod) error {
+	r.pods = pods
+	for i := range pods {
+		r.prepared = i + 1
+		if err := r.runPod(ctx, &pods[i], types.HookPre); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RunPost runs the post hooks of the pods whose pre hooks were reached, even
+// when ctx is cancelled, so whatever the pre hooks did is undone. A failing
+// post hook does not stop those of other pods. Only the first call runs
+// anything.
+func (r *Runner) RunPost(ctx context.Context) error {
+	if r.postRun {
+		return nil
+	}
+	r.postRun = true
+
+	ctx = context.WithoutCancel(ctx)
+	var firstErr error
+	for i := r.prepared - 1; i >= 0; i-- {
+		if err := r.runPod(ctx, &r.pods[i], types.HookPost); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// Results returns the outcome of every hook run so far
+func (r *Runner) Results() []types.HookResult {
+	return r.results
+}
+
+// Warnings returns the failures of hooks set to continue on error
+func (r *Runner) Warnings() []error {
+	return r.warnings
+}
+
+// runPod runs the hooks of a phase in a pod, stopping at the first one that
+// fails with on-error fail
+func (r *Runner) runPod(ctx context.Context, pod *corev1.Pod, phase types.HookPhase) error {
+	podHooks, err := r.config.PodHooks(pod, phase)
+	if err != nil {
+		return err
+	}
+	for _, hook := range podHooks {
+		result, err := r.run(ctx, pod, hook)
+		r.results = append(r.results, result)
+		if err == nil {
+			continue
+		}
+		if hook.OnError == types.HookContinue {
+			log.Printf("Warning: %v", err)
+			r.warnings = append(r.warnings, err)
+			continue
+		}
+		return err
+	}
+	return nil
+}
+
+// run runs a hook, logging what it writes
+func (r *Runner) run(ctx context.Context, pod *corev1.Pod, hook Hook) (types.HookResult, error) {
+	result := types.HookResult{
+		Hook:      hook.Name,
+		Phase:     hook.Phase,
+		Namespace: pod.Namespace,
+		Pod:       pod.Name,
+		Container: hook.Container,
+		OnError:   hook.OnError,
+		StartTime: time.Now(),
+	}
+	log.Printf("Running %s hook %s in %s/%s (%s)", hook.Phase, hook.Name, pod.Namespace, pod.Name, hook.Container)
+
+	ctx, cancel := context.WithTimeout(ctx, hook.Timeout)
+	defer cancel()
+	// stdout and stderr are written concurrently, so each has its own writer
+	prefix := fmt.Sprintf("[%s hook %s %s/%s] ", hook.Phase, hook.Name, pod.Namespace, pod.Name)
+	stdout, stderr := &logWriter{prefix: prefix}, &logWriter{prefix: prefix}
+	err := r.executor.Exec(ctx, pod.Namespace, pod.Name, hook.Container, hook.Command, nil, stdout, stderr)
+	stdout.flush()
+	stderr.flush()
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		err = fmt.Errorf("timed out after %s", hook.Timeout)
+	}
+
+	result.CompletionTime = time.Now()
+	if err != nil {
+		result.Error = err.Error()
+		return result, fmt.Errorf("%s hook %s failed in pod %s/%s: %w", hook.Phase, hook.Name, pod.Namespace, pod.Name, err)
+	}
+	result.Succeeded = true
+	return result, nil
+}
+
+// maxLineLength is the longest line of hook output logged as one line
+const maxLineLength = 4096
+
+// logWriter logs hook output a line at a time
+type logWriter struct {
+	prefix string
+	line   []byte
+}
+
+func (w *logWriter) Write(p []byte) (int, error) {
+	for _, b := range p {
+		if b == '\n' || len(w.line) >= maxLineLength {
+			w.flush()
+			if b == '\n' {
+				continue
+			}
+		}
+		w.line = append(w.line, b)
+	}
+	return len(p), nil
+}
+
+func (w *logWriter) flush() {
+	if line := bytes.TrimRight(w.line, "\r"); len(line) > 0 {
+		log.Printf("%s%s", w.prefix, line)
+	}
+	w.line = w.line[:0]
+}
@@ -0,0 +1,194 @@
+package hooks
+
+import (
+	"context"
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	apiextensionsfake "k8s.io/apiextensions-apiserver/pkg/client/clientset/clientset/fake"
+	"k8s.io/apimachinery/pkg/runtime"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+
+	"k8s-backup/pkg/k8s"
+	"k8s-backup/pkg/types"
+)
+
+// fakeExecutor records the commands run, failing those listed in failures
+type fakeExecutor struct {
+	commands []string
+	failures map[string]error
+	block    bool
+}
+
+func (e *fakeExecutor) Exec(ctx context.Context, namespace, pod, container string, command []string, stdin io.Reader, stdout, stderr io.Writer) error {
+	run := namespace + "/" + pod + "/" + container + ": " + strings.Join(command, " ")
+	e.commands = append(e.commands, run)
+	io.WriteString(stdout, "done\n")
+	if e.block {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	return e.failures[run]
+}
+
+func newTestRunner(config *Config, objects ...runtime.Object) (*Runner, *fakeExecutor) {
+	client := k8s.NewClientFromInterfaces(kubefake.NewSimpleClientset(objects...), apiextensionsfake.NewSimpleClientset(), dynamicfake.NewSimpleDynamicClient(runtime.NewScheme()))
+	executor := &fakeExecutor{}
+	runner := NewRunner(client, config)
+	runner.executor = executor
+	return runner, executor
+}
+
+func freezeAnnotations(onError string) map[string]string {
+	return map[string]string{
+		"k8s-backup.io/pre-hook-command":  `["fsfreeze", "--freeze", "/data"]`,
+		"k8s-backup.io/pre-hook-on-error": onError,
+		"k8s-backup.io/post-hook-command": `["fsfreeze", "--unfreeze", "/data"]`,
+	}
+}
+
+func TestPods(t *testing.T) {
+	stopped := newTestPod("db", "stopped", nil, nil)
+	stopped.Status.Phase = corev1.PodSucceeded
+	runner, _ := newTestRunner(nil,
+		newTestPod("db", "postgres-0", map[string]string{"app": "postgres"}, nil),
+		newTestPod("db", "redis-0", map[string]string{"app": "redis"}, nil),
+		newTestPod("kube-system", "coredns", map[string]string{"app": "postgres"}, nil),
+		stopped,
+	)
+
+	names := func(pods []corev1.Pod) []string {
+		var names []string
+		for _, pod := range pods {
+			names = append(names, pod.Namespace+"/"+pod.Name)
+		}
+		return names
+	}
+
+	pods, err := runner.Pods(context.Background(), []string{"db"}, true, "app=postgres")
+	if err != nil {
+		t.Fatalf("Pods failed: %v", err)
+	}
+	if expected := []string{"db/postgres-0"}; !reflect.DeepEqual(names(pods), expected) {
+		t.Errorf("Expected %v, got %v", expected, names(pods))
+	}
+
+	pods, err = runner.Pods(context.Background(), []string{"db"}, false, "")
+	if err != nil {
+		t.Fatalf("Pods failed: %v", err)
+	}
+	if expected := []string{"db/postgres-0", "db/redis-0"}; !reflect.DeepEqual(names(pods), expected) {
+		t.Errorf("Expected %v, got %v", expected, names(pods))
+	}
+}
+
+func TestRunHooks(t *testing.T) {
+	runner, executor := newTestRunner(nil)
+	pods := []corev1.Pod{
+		*newTestPod("db", "postgres-0", nil, freezeAnnotations("")),
+		*newTestPod("db", "postgres-1", nil, freezeAnnotations("")),
+	}
+
+	if err := runner.RunPre(context.Background(), pods); err != nil {
+		t.Fatalf("RunPre failed: %v", err)
+	}
+	if err := runner.RunPost(context.Background()); err != nil {
+		t.Fatalf("RunPost failed: %v", err)
+	}
+	if err := runner.RunPost(context.Background()); err != nil {
+		t.Fatalf("RunPost failed: %v", err)
+	}
+
+	// Post hooks undo the pre hooks in reverse order, once
+	expected := []string{
+		"db/postgres-0/app: fsfreeze --freeze /data",
+		"db/postgres-1/app: fsfreeze --freeze /data",
+		"db/postgres-1/app: fsfreeze --unfreeze /data",
+		"db/postgres-0/app: fsfreeze --unfreeze /data",
+	}
+	if !reflect.DeepEqual(executor.commands, expected) {
+		t.Errorf("Expected commands\n%v\ngot\n%v", expected, executor.commands)
+	}
+
+	results := runner.Results()
+	if len(results) != 4 {
+		t.Fatalf("Expected 4 hook results, got %d", len(results))
+	}
+	if results[0].Phase != types.HookPre || results[0].Pod != "postgres-0" || !results[0].Succeeded || results[0].CompletionTime.IsZero() {
+		t.Errorf("Unexpected result %+v", results[0])
+	}
+	if results[3].Phase != types.HookPost || results[3].Pod != "postgres-0" {
+		t.Errorf("Unexpected result %+v", results[3])
+	}
+}
+
+func TestFailingHooks(t *testing.T) {
+	runner, executor := newTestRunner(nil)
+	pods := []corev1.Pod{
+		*newTestPod("db", "postgres-0", nil, freezeAnnotations("continue")),
+		*newTestPod("db", "postgres-1", nil, freezeAnnotations("fail")),
+		*newTestPod("db", "postgres-2", nil, freezeAnnotations("fail")),
+	}
+	executor.failures = map[string]error{
+		"db/postgres-0/app: fsfreeze --freeze /data": errors.New("command terminated with exit code 1"),
+		"db/postgres-1/app: fsfreeze --freeze /data": errors.New("command terminated with exit code 2"),
+	}
+
+	err := runner.RunPre(context.Background(), pods)
+	if err == nil || !strings.Contains(err.Error(), "postgres-1") {
+		t.Fatalf("Expected the failing pre hook of postgres-1 to stop the backup, got %v", err)
+	}
+	if len(runner.Warnings()) != 1 || !strings.Contains(runner.Warnings()[0].Error(), "postgres-0") {
+		t.Errorf("Expected the failure set to continue as a warning, got %v", runner.Warnings())
+	}
+
+	// The third pod was never frozen, so it is not unfrozen
+	if err := runner.RunPost(context.Background()); err != nil {
+		t.Fatalf("RunPost failed: %v", err)
+	}
+	expected := []string{
+		"db/postgres-0/app: fsfreeze --freeze /data",
+		"db/postgres-1/app: fsfreeze --freeze /data",
+		"db/postgres-1/app: fsfreeze --unfreeze /data",
+		"db/postgres-0/app: fsfreeze --unfreeze /data",
+	}
+	if !reflect.DeepEqual(executor.commands, expected) {
+		t.Errorf("Expected commands\n%v\ngot\n%v", expected, executor.commands)
+	}
+
+	results := runner.Results()
+	if results[1].Succeeded || !strings.Contains(results[1].Error, "exit code 2") || results[1].OnError != types.HookFail {
+		t.Errorf("Expected the failure to be recorded, got %+v", results[1])
+	}
+}
+
+func TestHookTimeout(t *testing.T) {
+	runner, executor := newTestRunner(nil)
+	executor.block = true
+	pod := newTestPod("db", "postgres-0", nil, map[string]string{
+		"k8s-backup.io/pre-hook-command":  "sleep 60",
+		"k8s-backup.io/pre-hook-timeout":  "10ms",
+		"k8s-backup.io/post-hook-command": "true",
+	})
+
+	err := runner.RunPre(context.Background(), []corev1.Pod{*pod})
+	if err == nil || !strings.Contains(err.Error(), "timed out after 10ms") {
+		t.Errorf("Expected the hook to time out, got %v", err)
+	}
+
+	// Post hooks run even when the backup was cancelled
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	executor.block = false
+	if err := runner.RunPost(ctx); err != nil {
+		t.Errorf("Expected the post hook to run after cancellation, got %v", err)
+	}
+	if len(executor.commands) != 2 {
+		t.Errorf("Expected the post hook to run, got %v", executor.commands)
+	}
+}
@@ -3,26 +3,88 @@ package k8s
 import (
 	"context"
 	"fmt"
+	"io"
+	"log"
 	"path/filepath"
+	"sort"
 	"strings"
 
-	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
+	apiextensionsclientset "k8s.io/apiextensions-apiserver/pkg/client/clientset/clientset"
+	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	k8stypes "k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/discovery/cached/memory"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
 	"k8s.io/client-go/rest"
+	"k8s.io/client-go/restmapper"
 	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/tools/remotecommand"
 	"k8s.io/client-go/util/homedir"
-	"sigs.k8s.io/yaml"
 )
 
 type Client struct {
-	clientset *kubernetes.Clientset
+	clientset           kubernetes.Interface
+	apiextensionsClient apiextensionsclientset.Interface
+	dynamicClient       dynamic.Interface
+	discovery           discovery.DiscoveryInterface
+	mapper              meta.ResettableRESTMapper
+	// config is set on clients built from a kubeconfig, and is needed to
+	// exec into pods
+	config *rest.Config
 }
 
+// APIResource describes a listable resource discovered on the API server,
+// resolved to the version the server prefers
+type APIResource struct {
+	GroupVersionResource schema.GroupVersionResource
+	Kind                 string
+	SingularName         string
+	ShortNames           []string
+	Namespaced           bool
+}
+
+// GroupResource returns the group and resource name of the API resource
+func (r APIResource) GroupResource() schema.GroupResource {
+	return r.GroupVersionResource.GroupResource()
+}
+
+// String returns the resource in "resource.group" form ("deployments.apps"),
+// or just the resource name for the core group ("services")
+func (r APIResource) String() string {
+	return r.GroupResource().String()
+}
+
+// Client-side rate limits used when ClientOptions leaves them unset. They are
+// well above client-go's defaults so concurrent backups are not throttled to
+// a handful of requests per second.
+const (
+	DefaultQPS   = 50
+	DefaultBurst = 100
+)
+
+// ClientOptions tunes the REST client built from a kubeconfig
+type ClientOptions struct {
+	// QPS and Burst configure the client-side rate limiter shared by all
+	// requests made through the client
+	QPS   float32
+	Burst int
+}
+
+// NewClient creates a client from a kubeconfig file, or the in-cluster
+// configuration when kubeconfigPath is empty, with default options
 func NewClient(kubeconfigPath string) (*Client, error) {
+	return NewClientWithOptions(kubeconfigPath, ClientOptions{})
+}
+
+// NewClientWithOptions creates a client like NewClient with the given options
+func NewClientWithOptions(kubeconfigPath string, options ClientOptions) (*Client, error) {
 	var config *rest.Config
 	var err error
 
@@ -42,12 +104,46 @@ func NewClient(kubeconfigPath string) (*Client, error) {
 		}
 	}
 
+	config.QPS = options.QPS
+	if config.QPS <= 0 {
+		config.QPS = DefaultQPS
+	}
+	config.Burst = options.Burst
+	if config.Burst <= 0 {
+		config.Burst = DefaultBurst
+	}
+
 	clientset, err := kubernetes.NewForConfig(config)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create clientset: %w", err)
 	}
 
-	return &Client{clientset: clientset}, nil
+	apiextensionsClient, err := apiextensionsclientset.NewForConfig(config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create apiextensions client: %w", err)
+	}
+
+	dynamicClient, err := dynamic.NewForConfig(config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create dynamic client: %w", err)
+	}
+
+	client := NewClientFromInterfaces(clientset, apiextensionsClient, dynamicClient)
+	client.config = config
+	return client, nil
+}
+
+// NewClientFromInterfaces creates a client from existing typed and dynamic clients.
+// Discovery is served by the typed clientset, which makes it easy to plug in fakes.
+func NewClientFromInterfaces(clientset kubernetes.Interface, apiextensionsClient apiextensionsclientset.Interface, dynamicClient dynamic.Interface) *Client {
+	discoveryClient := clientset.Discovery()
+	return &Client{
+		clientset:           clientset,
+		apiextensionsClient: apiextensionsClient,
+		dynamicClient:       dynamicClient,
+		discovery:           discoveryClient,
+		mapper:              restmapper.NewDeferredDiscoveryRESTMapper(memory.NewMemCacheClient(discoveryClient)),
+	}
 }
 
 func (c *Client) GetServerVersion() (string, error) {
@@ -60,113 +156,267 @@ func (c *Client) GetServerVersion() (string, error) {
 
 // Clientset returns the underlying Kubernetes clientset for direct access
 // This eliminates the need for 20+ wrapper methods that add no value
-func (c *Client) Clientset() *kubernetes.Clientset {
+func (c *Client) Clientset() kubernetes.Interface {
 	return c.clientset
 }
 
-// ApplyResource applies a Kubernetes resource to the cluster
-func (c *Client) ApplyResource(ctx context.Context, obj runtime.Object, namespace string, dryRun bool) error {
-	// Convert to unstructured if needed
-	var unstruct *unstructured.Unstructured
-	if u, ok := obj.(*unstructured.Unstructured); ok {
-		unstruct = u
-	} else {
-		unstructObj, err := runtime.DefaultUnstructuredConverter.ToUnstructured(obj)
+// APIExtensions returns the client for CustomResourceDefinitions
+func (c *Client) APIExtensions() apiextensionsclientset.Interface {
+	return c.apiextensionsClient
+}
+
+// Dynamic returns the dynamic client used for working with arbitrary resources
+func (c *Client) Dynamic() dynamic.Interface {
+	return c.dynamicClient
+}
+
+// Exec runs a command in a container of a pod, streaming stdin to it and its
+// output to stdout and stderr, any of which may be nil
+func (c *Client) Exec(ctx context.Context, namespace, pod, container string, command []string, stdin io.Reader, stdout, stderr io.Writer) error {
+	if c.config == nil {
+		return fmt.Errorf("exec needs a client built from a kubeconfig")
+	}
+
+	req := c.clientset.CoreV1().RESTClient().Post().
+		Namespace(namespace).
+		Resource("pods").
+		Name(pod).
+		SubResource("exec").
+		VersionedParams(&corev1.PodExecOptions{
+			Container: container,
+			Command:   command,
+			Stdin:     stdin != nil,
+			Stdout:    stdout != nil,
+			Stderr:    stderr != nil,
+		}, scheme.ParameterCodec)
+	executor, err := remotecommand.NewSPDYExecutor(c.config, "POST", req.URL())
+	if err != nil {
+		return fmt.Errorf("failed to create executor: %w", err)
+	}
+	return executor.StreamWithContext(ctx, remotecommand.StreamOptions{Stdin: stdin, Stdout: stdout, Stderr: stderr})
+}
+
+// DiscoverResources returns every listable resource served by the cluster in
+// the server's preferred version. Subresources are omitted. Groups that fail
+// discovery (e.g. an unavailable aggregated API) are logged and skipped.
+func (c *Client) DiscoverResources() ([]APIResource, error) {
+	resourceLists, err := discovery.ServerPreferredResources(c.discovery)
+	if err != nil {
+		if !discovery.IsGroupDiscoveryFailedError(err) {
+			return nil, fmt.Errorf("failed to discover API resources: %w", err)
+		}
+		log.Printf("Warning: partial API discovery: %v", err)
+	}
+
+	var resources []APIResource
+	for _, list := range resourceLists {
+		gv, err := schema.ParseGroupVersion(list.GroupVersion)
 		if err != nil {
-			return fmt.Errorf("failed to convert object to unstructured: %w", err)
+			return nil, fmt.Errorf("invalid group version %q: %w", list.GroupVersion, err)
+		}
+
+		for _, r := range list.APIResources {
+			if strings.Contains(r.Name, "/") || !hasVerb(r.Verbs, "list") {
+				continue
+			}
+			resources = append(resources, APIResource{
+				GroupVersionResource: gv.WithResource(r.Name),
+				Kind:                 r.Kind,
+				SingularName:         r.SingularName,
+				ShortNames:           r.ShortNames,
+				Namespaced:           r.Namespaced,
+			})
 		}
-		unstruct = &unstructured.Unstructured{Object: unstructObj}
 	}
 
-	if dryRun {
-		return nil // Skip all operations in dry run
+	// Keep ordering stable regardless of discovery response order
+	sort.Slice(resources, func(i, j int) bool {
+		gi, gj := resources[i].GroupVersionResource, resources[j].GroupVersionResource
+		if gi.Group != gj.Group {
+			return gi.Group < gj.Group
+		}
+		return gi.Resource < gj.Resource
+	})
+
+	return resources, nil
+}
+
+func hasVerb(verbs metav1.Verbs, verb string) bool {
+	for _, v := range verbs {
+		if v == verb {
+			return true
+		}
 	}
+	return false
+}
 
-	// Get resource info
-	gvk := unstruct.GroupVersionKind()
-	kind := gvk.Kind
-	targetNamespace := unstruct.GetNamespace()
-	if targetNamespace == "" && namespace != "" {
-		targetNamespace = namespace
-		unstruct.SetNamespace(targetNamespace)
+// DefaultFieldManager is the field manager name used for server-side apply
+const DefaultFieldManager = "k8s-backup"
+
+// ApplyOptions controls how ApplyResource writes an object to the cluster
+type ApplyOptions struct {
+	// FieldManager identifies the owner of the applied fields (default: DefaultFieldManager)
+	FieldManager string
+	// Force takes ownership of fields currently owned by other field managers
+	Force bool
+	// Overwrite applies over an existing object. When false, an existing
+	// object is left untouched and an AlreadyExists error is returned.
+	Overwrite bool
+	// DryRun has the API server validate and admit the apply without
+	// persisting it
+	DryRun bool
+}
+
+// ApplyResource applies a Kubernetes resource of any kind to the cluster using
+// server-side apply. The object's GroupVersionKind is mapped to its resource
+// through the discovery-backed RESTMapper. Without Overwrite, the object is
+// created instead, so the API server refuses it if it already exists.
+func (c *Client) ApplyResource(ctx context.Context, obj runtime.Object, namespace string, options ApplyOptions) error {
+	unstruct, err := toUnstructured(obj)
+	if err != nil {
+		return err
 	}
 
-	// Use unified approach: marshal to YAML, unmarshal to typed object, then create/update
-	return c.applyResource(ctx, unstruct, kind, targetNamespace)
+	resourceClient, _, err := c.resourceClientFor(unstruct, namespace)
+	if err != nil {
+		return err
+	}
+
+	fieldManager := options.FieldManager
+	if fieldManager == "" {
+		fieldManager = DefaultFieldManager
+	}
+	var dryRun []string
+	if options.DryRun {
+		dryRun = []string{metav1.DryRunAll}
+	}
+
+	if !options.Overwrite {
+		_, err = resourceClient.Create(ctx, unstruct, metav1.CreateOptions{FieldManager: fieldManager, DryRun: dryRun})
+		return err
+	}
+
+	applyOptions := metav1.ApplyOptions{
+		FieldManager: fieldManager,
+		Force:        options.Force,
+		DryRun:       dryRun,
+	}
+	_, err = resourceClient.Apply(ctx, unstruct.GetName(), unstruct, applyOptions)
+	return err
 }
 
-// applyResource handles the actual resource application using a unified approach
-func (c *Client) applyResource(ctx context.Context, unstruct *unstructured.Unstructured, kind, namespace string) error {
-	// Convert unstructured to YAML
-	yamlData, err := yaml.Marshal(unstruct.Object)
+// GetResource returns the live object with the kind, namespace and name of
+// obj. The namespace defaults as it does for ApplyResource.
+func (c *Client) GetResource(ctx context.Context, obj runtime.Object, namespace string) (*unstructured.Unstructured, error) {
+	unstruct, err := toUnstructured(obj)
 	if err != nil {
-		return fmt.Errorf("failed to marshal resource to YAML: %w", err)
+		return nil, err
 	}
 
-	// Apply based on resource type using the same create/update pattern
-	switch kind {
-	case "Namespace":
-		var ns corev1.Namespace
-		if err := yaml.Unmarshal(yamlData, &ns); err != nil {
-			return err
-		}
-		_, err = c.clientset.CoreV1().Namespaces().Create(ctx, &ns, metav1.CreateOptions{})
-		if err != nil && strings.Contains(err.Error(), "already exists") {
-			_, err = c.clientset.CoreV1().Namespaces().Update(ctx, &ns, metav1.UpdateOptions{})
-		}
+	resourceClient, _, err := c.resourceClientFor(unstruct.DeepCopy(), namespace)
+	if err != nil {
+		return nil, err
+	}
+	return resourceClient.Get(ctx, unstruct.GetName(), metav1.GetOptions{})
+}
+
+// PatchResource patches the live object with the kind, namespace and name of
+// obj. FieldManager and DryRun are taken from the options.
+func (c *Client) PatchResource(ctx context.Context, obj runtime.Object, namespace string, patchType k8stypes.PatchType, patch []byte, options ApplyOptions) error {
+	unstruct, err := toUnstructured(obj)
+	if err != nil {
 		return err
+	}
 
-	case "Service":
-		var svc corev1.Service
-		if err := yaml.Unmarshal(yamlData, &svc); err != nil {
-			return err
-		}
-		svc.Namespace = namespace
-		_, err = c.clientset.CoreV1().Services(namespace).Create(ctx, &svc, metav1.CreateOptions{})
-		if err != nil && strings.Contains(err.Error(), "already exists") {
-			_, err = c.clientset.CoreV1().Services(namespace).Update(ctx, &svc, metav1.UpdateOptions{})
-		}
+	resourceClient, _, err := c.resourceClientFor(unstruct.DeepCopy(), namespace)
+	if err != nil {
 		return err
+	}
 
-	case "Deployment":
-		var dep appsv1.Deployment
-		if err := yaml.Unmarshal(yamlData, &dep); err != nil {
-			return err
-		}
-		dep.Namespace = namespace
-		_, err = c.clientset.AppsV1().Deployments(namespace).Create(ctx, &dep, metav1.CreateOptions{})
-		if err != nil && strings.Contains(err.Error(), "already exists") {
-			_, err = c.clientset.AppsV1().Deployments(namespace).Update(ctx, &dep, metav1.UpdateOptions{})
-		}
+	fieldManager := options.FieldManager
+	if fieldManager == "" {
+		fieldManager = DefaultFieldManager
+	}
+	patchOptions := metav1.PatchOptions{FieldManager: fieldManager}
+	if options.DryRun {
+		patchOptions.DryRun = []string{metav1.DryRunAll}
+	}
+	_, err = resourceClient.Patch(ctx, unstruct.GetName(), patchType, patch, patchOptions)
+	return err
+}
+
+// DeleteResource deletes the live object with the kind, namespace and name of
+// obj. When obj has a UID, only the object with that UID is deleted, so an
+// object recreated in the meantime is left alone. Dependents are garbage
+// collected in the background.
+func (c *Client) DeleteResource(ctx context.Context, obj runtime.Object, namespace string, dryRun bool) error {
+	unstruct, err := toUnstructured(obj)
+	if err != nil {
 		return err
+	}
 
-	case "ConfigMap":
-		var cm corev1.ConfigMap
-		if err := yaml.Unmarshal(yamlData, &cm); err != nil {
-			return err
-		}
-		cm.Namespace = namespace
-		_, err = c.clientset.CoreV1().ConfigMaps(namespace).Create(ctx, &cm, metav1.CreateOptions{})
-		if err != nil && strings.Contains(err.Error(), "already exists") {
-			_, err = c.clientset.CoreV1().ConfigMaps(namespace).Update(ctx, &cm, metav1.UpdateOptions{})
-		}
+	resourceClient, _, err := c.resourceClientFor(unstruct.DeepCopy(), namespace)
+	if err != nil {
 		return err
+	}
 
-	case "Secret":
-		var secret corev1.Secret
-		if err := yaml.Unmarshal(yamlData, &secret); err != nil {
-			return err
-		}
-		secret.Namespace = namespace
-		_, err = c.clientset.CoreV1().Secrets(namespace).Create(ctx, &secret, metav1.CreateOptions{})
-		if err != nil && strings.Contains(err.Error(), "already exists") {
-			_, err = c.clientset.CoreV1().Secrets(namespace).Update(ctx, &secret, metav1.UpdateOptions{})
+	propagation := metav1.DeletePropagationBackground
+	deleteOptions := metav1.DeleteOptions{PropagationPolicy: &propagation}
+	if uid := unstruct.GetUID(); uid != "" {
+		deleteOptions.Preconditions = &metav1.Preconditions{UID: &uid}
+	}
+	if dryRun {
+		deleteOptions.DryRun = []string{metav1.DryRunAll}
+	}
+	return resourceClient.Delete(ctx, unstruct.GetName(), deleteOptions)
+}
+
+// toUnstructured converts an object to unstructured if needed
+func toUnstructured(obj runtime.Object) (*unstructured.Unstructured, error) {
+	if u, ok := obj.(*unstructured.Unstructured); ok {
+		return u, nil
+	}
+	content, err := runtime.DefaultUnstructuredConverter.ToUnstructured(obj)
+	if err != nil {
+		return nil, fmt.Errorf("failed to convert object to unstructured: %w", err)
+	}
+	return &unstructured.Unstructured{Object: content}, nil
+}
+
+// resourceClientFor returns a dynamic client for the object's resource. The
+// object's namespace is defaulted for namespaced kinds and cleared for
+// cluster-scoped ones.
+func (c *Client) resourceClientFor(obj *unstructured.Unstructured, namespace string) (dynamic.ResourceInterface, *meta.RESTMapping, error) {
+	mapping, err := c.RESTMapping(obj.GroupVersionKind())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if mapping.Scope.Name() != meta.RESTScopeNameNamespace {
+		obj.SetNamespace("")
+		return c.dynamicClient.Resource(mapping.Resource), mapping, nil
+	}
+
+	if obj.GetNamespace() == "" {
+		if namespace == "" {
+			namespace = metav1.NamespaceDefault
 		}
-		return err
+		obj.SetNamespace(namespace)
+	}
+	return c.dynamicClient.Resource(mapping.Resource).Namespace(obj.GetNamespace()), mapping, nil
+}
 
-	default:
-		// Log unsupported types but don't fail
-		fmt.Printf("Info: Skipping unsupported resource type: %s\n", kind)
-		return nil
+// RESTMapping maps a GroupVersionKind to its resource. The discovery cache is
+// refreshed once when the kind is unknown, so kinds registered after the
+// client was created (e.g. by a restored CRD) can still be resolved.
+func (c *Client) RESTMapping(gvk schema.GroupVersionKind) (*meta.RESTMapping, error) {
+	mapping, err := c.mapper.RESTMapping(gvk.GroupKind(), gvk.Version)
+	if meta.IsNoMatchError(err) {
+		c.mapper.Reset()
+		mapping, err = c.mapper.RESTMapping(gvk.GroupKind(), gvk.Version)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to map %s to a resource: %w", gvk, err)
 	}
+	return mapping, nil
 }
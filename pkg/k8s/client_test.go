@@ -0,0 +1,243 @@
+package k8s
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	apiextensionsfake "k8s.io/apiextensions-apiserver/pkg/client/clientset/clientset/fake"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	k8stypes "k8s.io/apimachinery/pkg/types"
+	fakediscovery "k8s.io/client-go/discovery/fake"
+	"k8s.io/client-go/dynamic"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+var testAPIResources = []*metav1.APIResourceList{
+	{
+		GroupVersion: "v1",
+		APIResources: []metav1.APIResource{
+			{Name: "configmaps", SingularName: "configmap", Kind: "ConfigMap", Namespaced: true, Verbs: metav1.Verbs{"get", "list", "patch"}},
+		},
+	},
+	{
+		GroupVersion: "apps/v1",
+		APIResources: []metav1.APIResource{
+			{Name: "statefulsets", SingularName: "statefulset", Kind: "StatefulSet", Namespaced: true, Verbs: metav1.Verbs{"get", "list", "patch"}},
+			{Name: "statefulsets/status", Kind: "StatefulSet", Namespaced: true, Verbs: metav1.Verbs{"get", "patch"}},
+		},
+	},
+	{
+		GroupVersion: "rbac.authorization.k8s.io/v1",
+		APIResources: []metav1.APIResource{
+			{Name: "clusterroles", SingularName: "clusterrole", Kind: "ClusterRole", Verbs: metav1.Verbs{"get", "list", "patch"}},
+		},
+	},
+}
+
+func newTestClient(objects ...runtime.Object) (*Client, *dynamicfake.FakeDynamicClient) {
+	clientset := kubefake.NewSimpleClientset()
+	clientset.Discovery().(*fakediscovery.FakeDiscovery).Resources = testAPIResources
+
+	listKinds := map[schema.GroupVersionResource]string{
+		{Version: "v1", Resource: "configmaps"}:                                       "ConfigMapList",
+		{Group: "apps", Version: "v1", Resource: "statefulsets"}:                      "StatefulSetList",
+		{Group: "rbac.authorization.k8s.io", Version: "v1", Resource: "clusterroles"}: "ClusterRoleList",
+	}
+	dynamicClient := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), listKinds, objects...)
+
+	// The fake tracker only patches existing objects; treat apply as create-or-update
+	dynamicClient.PrependReactor("patch", "*", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		patch := action.(k8stesting.PatchAction)
+		if patch.GetPatchType() != k8stypes.ApplyPatchType {
+			return false, nil, nil
+		}
+		obj := &unstructured.Unstructured{}
+		if err := obj.UnmarshalJSON(patch.GetPatch()); err != nil {
+			return true, nil, err
+		}
+		return true, obj, nil
+	})
+
+	return NewClientFromInterfaces(clientset, apiextensionsfake.NewSimpleClientset(), dynamicClient), dynamicClient
+}
+
+func newObject(apiVersion, kind, namespace, name string) *unstructured.Unstructured {
+	obj := &unstructured.Unstructured{}
+	obj.SetAPIVersion(apiVersion)
+	obj.SetKind(kind)
+	obj.SetNamespace(namespace)
+	obj.SetName(name)
+	return obj
+}
+
+func TestDiscoverResources(t *testing.T) {
+	client, _ := newTestClient()
+
+	resources, err := client.DiscoverResources()
+	if err != nil {
+		t.Fatalf("DiscoverResources failed: %v", err)
+	}
+
+	expected := []string{"configmaps", "statefulsets.apps", "clusterroles.rbac.authorization.k8s.io"}
+	if len(resources) != len(expected) {
+		t.Fatalf("Expected %d resources, got %d", len(expected), len(resources))
+	}
+	for i, res := range resources {
+		if res.String() != expected[i] {
+			t.Errorf("Expected resource %s at index %d, got %s", expected[i], i, res.String())
+		}
+	}
+}
+
+func TestApplyResource(t *testing.T) {
+	tests := []struct {
+		name              string
+		obj               *unstructured.Unstructured
+		namespace         string
+		expectedResource  string
+		expectedNamespace string
+	}{
+		{"namespaced kind defaults namespace", newObject("apps/v1", "StatefulSet", "", "db"), "prod", "statefulsets", "prod"},
+		{"namespaced kind keeps own namespace", newObject("v1", "ConfigMap", "shop", "settings"), "prod", "configmaps", "shop"},
+		{"cluster-scoped kind drops namespace", newObject("rbac.authorization.k8s.io/v1", "ClusterRole", "prod", "reader"), "prod", "clusterroles", ""},
+	}
+
+	for _, test := range tests {
+		client, dynamicClient := newTestClient()
+
+		err := client.ApplyResource(context.Background(), test.obj, test.namespace, ApplyOptions{Force: true, Overwrite: true})
+		if err != nil {
+			t.Fatalf("%s: ApplyResource failed: %v", test.name, err)
+		}
+
+		var applied k8stesting.PatchAction
+		for _, action := range dynamicClient.Actions() {
+			if patch, ok := action.(k8stesting.PatchAction); ok {
+				applied = patch
+			}
+		}
+		if applied == nil {
+			t.Fatalf("%s: expected an apply patch action", test.name)
+		}
+		if applied.GetPatchType() != k8stypes.ApplyPatchType {
+			t.Errorf("%s: expected apply patch type, got %s", test.name, applied.GetPatchType())
+		}
+		if applied.GetResource().Resource != test.expectedResource {
+			t.Errorf("%s: expected resource %s, got %s", test.name, test.expectedResource, applied.GetResource().Resource)
+		}
+		if applied.GetNamespace() != test.expectedNamespace {
+			t.Errorf("%s: expected namespace %q, got %q", test.name, test.expectedNamespace, applied.GetNamespace())
+		}
+	}
+}
+
+func TestApplyResourceExisting(t *testing.T) {
+	existing := newObject("v1", "ConfigMap", "prod", "settings")
+	client, _ := newTestClient(existing)
+
+	err := client.ApplyResource(context.Background(), newObject("v1", "ConfigMap", "prod", "settings"), "prod", ApplyOptions{})
+	if !apierrors.IsAlreadyExists(err) {
+		t.Errorf("Expected AlreadyExists error, got %v", err)
+	}
+
+	err = client.ApplyResource(context.Background(), newObject("v1", "ConfigMap", "prod", "settings"), "prod", ApplyOptions{Overwrite: true})
+	if err != nil {
+		t.Errorf("Expected overwrite to succeed, got %v", err)
+	}
+}
+
+func TestApplyResourceCreates(t *testing.T) {
+	client, dynamicClient := newTestClient()
+
+	// Without overwrite, the object is created in a single call, so one
+	// created concurrently is not taken over
+	err := client.ApplyResource(context.Background(), newObject("v1", "ConfigMap", "prod", "settings"), "prod", ApplyOptions{})
+	if err != nil {
+		t.Fatalf("ApplyResource failed: %v", err)
+	}
+	var verbs []string
+	for _, action := range dynamicClient.Actions() {
+		verbs = append(verbs, action.GetVerb())
+	}
+	if !reflect.DeepEqual(verbs, []string{"create"}) {
+		t.Errorf("Expected a single create, got %v", verbs)
+	}
+}
+
+func TestApplyResourceUnknownKind(t *testing.T) {
+	client, _ := newTestClient()
+
+	err := client.ApplyResource(context.Background(), newObject("example.com/v1", "Widget", "prod", "gadget"), "prod", ApplyOptions{})
+	if err == nil {
+		t.Error("Expected an error for a kind the server does not serve")
+	}
+}
+
+// applyRecorder records the options of every Apply call made through a
+// dynamic client
+type applyRecorder struct {
+	dynamic.Interface
+	options []metav1.ApplyOptions
+}
+
+func (r *applyRecorder) Resource(resource schema.GroupVersionResource) dynamic.NamespaceableResourceInterface {
+	return &recordingResource{NamespaceableResourceInterface: r.Interface.Resource(resource), recorder: r}
+}
+
+type recordingResource struct {
+	dynamic.NamespaceableResourceInterface
+	recorder *applyRecorder
+}
+
+func (r *recordingResource) Namespace(namespace string) dynamic.ResourceInterface {
+	return &recordingNamespacedResource{ResourceInterface: r.NamespaceableResourceInterface.Namespace(namespace), recorder: r.recorder}
+}
+
+type recordingNamespacedResource struct {
+	dynamic.ResourceInterface
+	recorder *applyRecorder
+}
+
+func (r *recordingNamespacedResource) Apply(ctx context.Context, name string, obj *unstructured.Unstructured, options metav1.ApplyOptions, subresources ...string) (*unstructured.Unstructured, error) {
+	r.recorder.options = append(r.recorder.options, options)
+	return r.ResourceInterface.Apply(ctx, name, obj, options, subresources...)
+}
+
+func TestApplyResourceDryRun(t *testing.T) {
+	client, dynamicClient := newTestClient(newObject("v1", "ConfigMap", "prod", "settings"))
+	recorder := &applyRecorder{Interface: dynamicClient}
+	client = NewClientFromInterfaces(client.Clientset(), client.APIExtensions(), recorder)
+
+	for _, dryRun := range []bool{true, false} {
+		recorder.options = nil
+		err := client.ApplyResource(context.Background(), newObject("v1", "ConfigMap", "prod", "settings"), "prod", ApplyOptions{Overwrite: true, DryRun: dryRun})
+		if err != nil {
+			t.Fatalf("ApplyResource failed: %v", err)
+		}
+		if len(recorder.options) != 1 {
+			t.Fatalf("Expected one apply, got %d", len(recorder.options))
+		}
+		var expected []string
+		if dryRun {
+			expected = []string{metav1.DryRunAll}
+		}
+		if got := recorder.options[0].DryRun; !reflect.DeepEqual(got, expected) {
+			t.Errorf("DryRun %v: expected apply dryRun option %v, got %v", dryRun, expected, got)
+		}
+	}
+
+	live, err := client.GetResource(context.Background(), newObject("v1", "ConfigMap", "", "settings"), "prod")
+	if err != nil || live.GetNamespace() != "prod" {
+		t.Errorf("Expected GetResource to find prod/settings, got %v, %v", live, err)
+	}
+	if _, err := client.GetResource(context.Background(), newObject("v1", "ConfigMap", "prod", "missing"), "prod"); !apierrors.IsNotFound(err) {
+		t.Errorf("Expected NotFound for a missing object, got %v", err)
+	}
+}
@@ -0,0 +1,163 @@
+package restore
+
+import (
+	"context"
+	"fmt"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/sets"
+
+	"k8s-backup/pkg/k8s"
+	"k8s-backup/pkg/types"
+)
+
+// DryRunAction is what a server-side dry run found a restore would do with a
+// resource
+type DryRunAction string
+
+const (
+	WouldCreate  DryRunAction = "would-create"
+	WouldUpdate  DryRunAction = "would-update"
+	WouldMerge   DryRunAction = "would-merge"
+	WouldReplace DryRunAction = "would-replace"
+	// WouldSkip resources already exist and are left alone under the skip
+	// existing policy
+	WouldSkip DryRunAction = "would-skip"
+	WouldFail DryRunAction = "would-fail"
+)
+
+// ParseDryRunMode parses the value of the restore command's --dry-run flag
+// into none, client or server. The flag used to be a boolean, so true and
+// false are accepted as client and none.
+func ParseDryRunMode(value string) (string, error) {
+	switch value {
+	case "none", "false":
+		return "none", nil
+	case "client", "true":
+		return "client", nil
+	case "server":
+		return "server", nil
+	}
+	return "", fmt.Errorf("invalid dry run mode %q: expected none, client or server", value)
+}
+
+// DryRunResult is the outcome of a server-side dry run for one resource
+type DryRunResult struct {
+	Resource types.ResourceInfo
+	Action   DryRunAction
+	// Note explains why a resource was not sent to the API server
+	Note string
+	Err  error
+}
+
+// serverDryRun tracks what a server-side dry run would have created so far.
+// Nothing is persisted, so resources in namespaces, or of kinds, that the
+// restore itself creates cannot be validated by the API server.
+type serverDryRun struct {
+	namespaces sets.String
+	kinds      sets.String
+}
+
+// newServerDryRun starts a server-side dry run, treating the namespaces a
+// restore would create for its namespace mapping as created
+func (m *Manager) newServerDryRun(ctx context.Context, targets []string) (*serverDryRun, error) {
+	state := &serverDryRun{namespaces: sets.NewString(), kinds: sets.NewString()}
+	for _, target := range targets {
+		_, err := m.k8sClient.Clientset().CoreV1().Namespaces().Get(ctx, target, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			state.namespaces.Insert(target)
+		} else if err != nil {
+			return nil, fmt.Errorf("failed to get namespace %s: %w", target, err)
+		}
+	}
+	return state, nil
+}
+
+// dryRunResource sends an object through the path the existing policy takes
+// it down with dryRun=All and reports whether it would be created, updated,
+// merged, replaced, skipped or rejected
+func (m *Manager) dryRunResource(ctx context.Context, state *serverDryRun, object runtime.Object, namespace string, info types.ResourceInfo, policy types.ExistingPolicy, options *types.RestoreOptions) DryRunResult {
+	result := DryRunResult{Resource: info}
+	obj, ok := object.(*unstructured.Unstructured)
+	if !ok {
+		result.Action = WouldFail
+		result.Err = fmt.Errorf("unexpected object type %T", object)
+		return result
+	}
+
+	if obj.GetNamespace() != "" {
+		namespace = obj.GetNamespace()
+	}
+
+	live, err := m.k8sClient.GetResource(ctx, obj, namespace)
+	switch {
+	case meta.IsNoMatchError(err) && state.kinds.Has(obj.GroupVersionKind().GroupKind().String()):
+		result.Action = WouldCreate
+		result.Note = "not validated: its CustomResourceDefinition is created by this restore"
+		return result
+	case apierrors.IsNotFound(err) && state.namespaces.Has(namespace):
+		result.Action = WouldCreate
+		result.Note = fmt.Sprintf("not validated: namespace %s is created by this restore", namespace)
+		return result
+	case apierrors.IsNotFound(err):
+		result.Action = WouldCreate
+	case err != nil:
+		result.Action = WouldFail
+		result.Err = err
+		return result
+	case policy == types.ExistingUpdate:
+		result.Action = WouldUpdate
+	case policy == types.ExistingMerge:
+		result.Action = WouldMerge
+	case policy == types.ExistingReplace:
+		result.Action = WouldReplace
+	case policy == types.ExistingFail:
+		result.Action = WouldFail
+		result.Err = errExists
+		return result
+	default:
+		result.Action = WouldSkip
+		return result
+	}
+
+	applyOptions := k8s.ApplyOptions{
+		FieldManager: options.FieldManager,
+		Force:        options.ForceConflicts,
+		Overwrite:    true,
+		DryRun:       true,
+	}
+	switch result.Action {
+	case WouldMerge:
+		err = m.mergeResource(ctx, obj, live, namespace, applyOptions)
+	case WouldReplace:
+		// The live object exists until it is deleted, so only the deletion
+		// can be validated
+		err = m.k8sClient.DeleteResource(ctx, live, namespace, true)
+		result.Note = "not validated: only the deletion of the live object is checked"
+	default:
+		err = m.k8sClient.ApplyResource(ctx, obj, namespace, applyOptions)
+	}
+	if err != nil {
+		result.Action = WouldFail
+		result.Err = err
+		return result
+	}
+
+	if result.Action == WouldCreate {
+		gvk := obj.GroupVersionKind()
+		switch {
+		case gvk.Group == "" && gvk.Kind == "Namespace":
+			state.namespaces.Insert(obj.GetName())
+		case gvk.Group == "apiextensions.k8s.io" && gvk.Kind == customResourceDefinitionKind:
+			group, _, _ := unstructured.NestedString(obj.Object, "spec", "group")
+			kind, _, _ := unstructured.NestedString(obj.Object, "spec", "names", "kind")
+			state.kinds.Insert(schema.GroupKind{Group: group, Kind: kind}.String())
+		}
+	}
+	return result
+}
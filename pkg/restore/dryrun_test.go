@@ -0,0 +1,139 @@
+package restore
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	k8stesting "k8s.io/client-go/testing"
+
+	"k8s-backup/pkg/storage"
+	"k8s-backup/pkg/types"
+)
+
+func TestRestoreServerDryRun(t *testing.T) {
+	tempDir := t.TempDir()
+	configMap := func(namespace, name string) types.ResourceWithContent {
+		return types.ResourceWithContent{
+			Content: []byte("apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: " + name + "\n  namespace: " + namespace + "\n"),
+			Info:    types.ResourceInfo{APIVersion: "v1", Kind: "ConfigMap", Namespace: namespace, Name: name},
+		}
+	}
+	resources := []types.ResourceWithContent{
+		configMap("prod", "existing"),
+		configMap("prod", "new"),
+		configMap("prod", "rejected"),
+		configMap("shop", "settings"),
+		{
+			Content: []byte("apiVersion: v1\nkind: Namespace\nmetadata:\n  name: shop\n"),
+			Info:    types.ResourceInfo{APIVersion: "v1", Kind: "Namespace", Name: "shop"},
+		},
+		{
+			Content: []byte("apiVersion: apiextensions.k8s.io/v1\nkind: CustomResourceDefinition\nmetadata:\n  name: gizmos.example.com\nspec:\n  group: example.com\n  names:\n    kind: Gizmo\n"),
+			Info:    types.ResourceInfo{APIVersion: "apiextensions.k8s.io/v1", Kind: "CustomResourceDefinition", Name: "gizmos.example.com"},
+		},
+		{
+			Content: []byte("apiVersion: example.com/v1\nkind: Gizmo\nmetadata:\n  name: thing\n  namespace: prod\n"),
+			Info:    types.ResourceInfo{APIVersion: "example.com/v1", Kind: "Gizmo", Namespace: "prod", Name: "thing"},
+		},
+	}
+	backupPath := saveTestBackup(t, tempDir, resources)
+
+	client := newTestClient(&eventRecorder{}, newTestObject("v1", "ConfigMap", "prod", "existing"))
+	client.Dynamic().(*dynamicfake.FakeDynamicClient).PrependReactor("patch", "configmaps", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if action.(k8stesting.PatchAction).GetName() == "rejected" {
+			return true, nil, apierrors.NewBadRequest("admission webhook denied the request")
+		}
+		return false, nil, nil
+	})
+	// The fake client drops dryRun, so deletes must not reach its tracker
+	client.Dynamic().(*dynamicfake.FakeDynamicClient).PrependReactor("delete", "configmaps", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, nil
+	})
+	manager := NewManager(client, storage.NewLocalStorage(tempDir))
+
+	options := &types.RestoreOptions{BackupPath: backupPath, ServerDryRun: true, OverwriteExisting: true}
+	result, err := manager.RestoreBackup(context.Background(), options, nil)
+	if err != nil {
+		t.Fatalf("RestoreBackup failed: %v", err)
+	}
+
+	actions := make(map[string]DryRunAction)
+	notes := make(map[string]bool)
+	for _, dryRun := range result.DryRun {
+		actions[dryRun.Resource.Kind+"/"+dryRun.Resource.Name] = dryRun.Action
+		notes[dryRun.Resource.Kind+"/"+dryRun.Resource.Name] = dryRun.Note != ""
+	}
+	expected := map[string]DryRunAction{
+		"Namespace/shop": WouldCreate,
+		"CustomResourceDefinition/gizmos.example.com": WouldCreate,
+		"ConfigMap/existing":                          WouldUpdate,
+		"ConfigMap/new":                               WouldCreate,
+		"ConfigMap/rejected":                          WouldFail,
+		"ConfigMap/settings":                          WouldCreate,
+		"Gizmo/thing":                                 WouldCreate,
+	}
+	if !reflect.DeepEqual(actions, expected) {
+		t.Errorf("Expected dry run actions %v, got %v", expected, actions)
+	}
+	// Resources depending on objects created by the restore are not validated
+	if !notes["ConfigMap/settings"] || !notes["Gizmo/thing"] || notes["ConfigMap/new"] {
+		t.Errorf("Unexpected notes: %v", notes)
+	}
+	if len(result.Errors) != 1 || result.ProcessedResources != 6 {
+		t.Errorf("Expected 6 processed resources and 1 error, got %d and %v", result.ProcessedResources, result.Errors)
+	}
+	if _, err := client.Clientset().CoreV1().Namespaces().Get(context.Background(), "shop", metav1.GetOptions{}); !apierrors.IsNotFound(err) {
+		t.Errorf("Expected nothing to be created, got %v", err)
+	}
+
+	// Without --overwrite, existing resources are skipped
+	options.OverwriteExisting = false
+	result, err = manager.RestoreBackup(context.Background(), options, nil)
+	if err != nil {
+		t.Fatalf("RestoreBackup failed: %v", err)
+	}
+	for _, dryRun := range result.DryRun {
+		if dryRun.Resource.Name == "existing" && dryRun.Action != WouldSkip {
+			t.Errorf("Expected the existing ConfigMap to be skipped, got %s", dryRun.Action)
+		}
+	}
+
+	// Other existing policies are validated along their own path
+	for policy, action := range map[types.ExistingPolicy]DryRunAction{types.ExistingMerge: WouldMerge, types.ExistingReplace: WouldReplace, types.ExistingFail: WouldFail} {
+		options.ExistingPolicy = policy
+		result, err = manager.RestoreBackup(context.Background(), options, nil)
+		if err != nil {
+			t.Fatalf("RestoreBackup failed: %v", err)
+		}
+		for _, dryRun := range result.DryRun {
+			if dryRun.Resource.Name == "existing" && dryRun.Action != action {
+				t.Errorf("Expected %s for the existing ConfigMap under %s, got %s", action, policy, dryRun.Action)
+			}
+		}
+	}
+}
+
+func TestParseDryRunMode(t *testing.T) {
+	tests := map[string]string{
+		"none":   "none",
+		"client": "client",
+		"server": "server",
+		// The values of the former boolean flag
+		"true":  "client",
+		"false": "none",
+	}
+	for value, expected := range tests {
+		mode, err := ParseDryRunMode(value)
+		if err != nil || mode != expected {
+			t.Errorf("%s: expected %s, got %q, %v", value, expected, mode, err)
+		}
+	}
+	if _, err := ParseDryRunMode("all"); err == nil {
+		t.Error("Expected an invalid mode to fail")
+	}
+}
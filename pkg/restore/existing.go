@@ -0,0 +1,243 @@
+package restore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	k8stypes "k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/jsonmergepatch"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"sigs.k8s.io/yaml"
+
+	"k8s-backup/pkg/k8s"
+	"k8s-backup/pkg/types"
+)
+
+// Action is what a restore did with a resource
+type Action string
+
+const (
+	Created  Action = "created"
+	Updated  Action = "updated"
+	Merged   Action = "merged"
+	Replaced Action = "replaced"
+	// Skipped resources already existed and were left untouched
+	Skipped Action = "skipped"
+	Failed  Action = "failed"
+)
+
+// ResourceAction records what a restore did with a resource, and the existing
+// policy in effect for its kind
+type ResourceAction struct {
+	Resource types.ResourceInfo
+	Action   Action
+	Policy   types.ExistingPolicy
+}
+
+// errExists is returned for resources that already exist under ExistingFail
+var errExists = errors.New("already exists and the existing policy is fail")
+
+// deletionPollInterval is how often a replaced object is checked for having
+// been deleted
+var deletionPollInterval = time.Second
+
+// PolicyConfig is the format of an existing policy file: a default policy
+// and overrides keyed by the lowercase kind, its plural or kind.group
+type PolicyConfig struct {
+	Default types.ExistingPolicy            `json:"default,omitempty"`
+	Kinds   map[string]types.ExistingPolicy `json:"kinds,omitempty"`
+}
+
+// LoadPolicyConfig reads an existing policy file
+func LoadPolicyConfig(path string) (*PolicyConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read existing policy file: %w", err)
+	}
+	config, err := ParsePolicyConfig(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid existing policy file %s: %w", path, err)
+	}
+	return config, nil
+}
+
+// ParsePolicyConfig parses the YAML of an existing policy file
+func ParsePolicyConfig(data []byte) (*PolicyConfig, error) {
+	config := &PolicyConfig{}
+	if err := yaml.UnmarshalStrict(data, config); err != nil {
+		return nil, err
+	}
+	if config.Default != "" {
+		if _, err := types.ParseExistingPolicy(string(config.Default)); err != nil {
+			return nil, err
+		}
+	}
+	kinds := make(map[string]types.ExistingPolicy, len(config.Kinds))
+	for kind, policy := range config.Kinds {
+		if _, err := types.ParseExistingPolicy(string(policy)); err != nil {
+			return nil, fmt.Errorf("kind %s: %w", kind, err)
+		}
+		kinds[strings.ToLower(kind)] = policy
+	}
+	config.Kinds = kinds
+	return config, nil
+}
+
+// existingPolicies resolves the existing policy of each kind
+type existingPolicies struct {
+	defaultPolicy types.ExistingPolicy
+	overrides     map[string]types.ExistingPolicy
+	// plurals caches the resource name of each kind overrides are matched
+	// against
+	plurals map[schema.GroupKind]string
+}
+
+func newExistingPolicies(options *types.RestoreOptions) (*existingPolicies, error) {
+	policies := &existingPolicies{
+		defaultPolicy: options.ExistingPolicy,
+		overrides:     make(map[string]types.ExistingPolicy),
+		plurals:       make(map[schema.GroupKind]string),
+	}
+	if policies.defaultPolicy == "" {
+		policies.defaultPolicy = types.ExistingSkip
+		if options.OverwriteExisting {
+			policies.defaultPolicy = types.ExistingUpdate
+		}
+	}
+	if _, err := types.ParseExistingPolicy(string(policies.defaultPolicy)); err != nil {
+		return nil, err
+	}
+	for kind, policy := range options.ExistingPolicyOverrides {
+		if _, err := types.ParseExistingPolicy(string(policy)); err != nil {
+			return nil, fmt.Errorf("kind %s: %w", kind, err)
+		}
+		policies.overrides[strings.ToLower(kind)] = policy
+	}
+	return policies, nil
+}
+
+// policyFor returns the policy for a kind, preferring an override for
+// kind.group over one for the kind or its plural. The plural is only
+// resolved when there are overrides, once per kind.
+func (p *existingPolicies) policyFor(gvk schema.GroupVersionKind, resourcePlural func(schema.GroupVersionKind) string) types.ExistingPolicy {
+	if len(p.overrides) == 0 {
+		return p.defaultPolicy
+	}
+	plural, ok := p.plurals[gvk.GroupKind()]
+	if !ok {
+		plural = resourcePlural(gvk)
+		p.plurals[gvk.GroupKind()] = plural
+	}
+
+	kind := strings.ToLower(gvk.Kind)
+	keys := []string{kind, plural}
+	if gvk.Group != "" {
+		keys = append([]string{kind + "." + gvk.Group, plural + "." + gvk.Group}, keys...)
+	}
+	for _, key := range keys {
+		if policy, ok := p.overrides[key]; ok {
+			return policy
+		}
+	}
+	return p.defaultPolicy
+}
+
+// restoreResource writes an object to the cluster. Objects that do not exist
+// are created; for objects that do, the policy decides what happens.
+func (m *Manager) restoreResource(ctx context.Context, obj runtime.Object, namespace string, policy types.ExistingPolicy, options *types.RestoreOptions) (Action, error) {
+	applyOptions := k8s.ApplyOptions{
+		FieldManager: options.FieldManager,
+		Force:        options.ForceConflicts,
+		Overwrite:    true,
+	}
+
+	live, err := m.k8sClient.GetResource(ctx, obj, namespace)
+	if apierrors.IsNotFound(err) {
+		return Created, m.k8sClient.ApplyResource(ctx, obj, namespace, applyOptions)
+	}
+	if err != nil {
+		return Failed, err
+	}
+
+	switch policy {
+	case types.ExistingUpdate:
+		return Updated, m.k8sClient.ApplyResource(ctx, obj, namespace, applyOptions)
+	case types.ExistingMerge:
+		return Merged, m.mergeResource(ctx, obj, live, namespace, applyOptions)
+	case types.ExistingReplace:
+		return Replaced, m.replaceResource(ctx, obj, live, namespace, applyOptions, options.Timeout)
+	case types.ExistingFail:
+		return Failed, errExists
+	default:
+		return Skipped, nil
+	}
+}
+
+// mergeResource patches the live object towards the backed up one with a
+// three-way JSON merge patch. The live object's last-applied configuration,
+// when kubectl recorded one, is the common ancestor, so fields applied with
+// kubectl that are not in the backup are removed. Fields only set in the
+// cluster are kept, and lists are replaced as a whole.
+func (m *Manager) mergeResource(ctx context.Context, obj runtime.Object, live *unstructured.Unstructured, namespace string, options k8s.ApplyOptions) error {
+	unstruct, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return fmt.Errorf("unexpected object type %T", obj)
+	}
+	modified, err := unstruct.MarshalJSON()
+	if err != nil {
+		return fmt.Errorf("failed to encode object: %w", err)
+	}
+	current, err := live.MarshalJSON()
+	if err != nil {
+		return fmt.Errorf("failed to encode live object: %w", err)
+	}
+	original := modified
+	if lastApplied := live.GetAnnotations()[corev1.LastAppliedConfigAnnotation]; lastApplied != "" {
+		original = []byte(lastApplied)
+	}
+
+	patch, err := jsonmergepatch.CreateThreeWayJSONMergePatch(original, modified, current)
+	if err != nil {
+		return fmt.Errorf("failed to create merge patch: %w", err)
+	}
+	if string(patch) == "{}" {
+		return nil
+	}
+	return m.k8sClient.PatchResource(ctx, obj, namespace, k8stypes.MergePatchType, patch, options)
+}
+
+// replaceResource deletes the live object, waits until it is gone and
+// creates the backed up object in its place
+func (m *Manager) replaceResource(ctx context.Context, obj runtime.Object, live *unstructured.Unstructured, namespace string, options k8s.ApplyOptions, timeout time.Duration) error {
+	if err := m.k8sClient.DeleteResource(ctx, live, namespace, false); err != nil && !apierrors.IsNotFound(err) {
+		return fmt.Errorf("failed to delete live object: %w", err)
+	}
+
+	if timeout <= 0 {
+		timeout = defaultWaitTimeout
+	}
+	err := wait.PollUntilContextTimeout(ctx, deletionPollInterval, timeout, true, func(ctx context.Context) (bool, error) {
+		_, err := m.k8sClient.GetResource(ctx, obj, namespace)
+		if apierrors.IsNotFound(err) {
+			return true, nil
+		}
+		return false, err
+	})
+	if wait.Interrupted(err) {
+		return fmt.Errorf("live object was not deleted after %s", timeout)
+	}
+	if err != nil {
+		return err
+	}
+
+	return m.k8sClient.ApplyResource(ctx, obj, namespace, options)
+}
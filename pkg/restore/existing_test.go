@@ -0,0 +1,212 @@
+package restore
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	k8stesting "k8s.io/client-go/testing"
+
+	"k8s-backup/pkg/storage"
+	"k8s-backup/pkg/types"
+)
+
+func TestParsePolicyConfig(t *testing.T) {
+	config, err := ParsePolicyConfig([]byte("default: update\nkinds:\n  PersistentVolumeClaim: skip\n  job.batch: replace\n"))
+	if err != nil {
+		t.Fatalf("ParsePolicyConfig failed: %v", err)
+	}
+	expected := &PolicyConfig{
+		Default: types.ExistingUpdate,
+		Kinds:   map[string]types.ExistingPolicy{"persistentvolumeclaim": types.ExistingSkip, "job.batch": types.ExistingReplace},
+	}
+	if !reflect.DeepEqual(config, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, config)
+	}
+
+	for _, data := range []string{"default: overwrite\n", "kinds:\n  secret: ignore\n", "policy: skip\n"} {
+		if _, err := ParsePolicyConfig([]byte(data)); err == nil {
+			t.Errorf("Expected %q to be rejected", data)
+		}
+	}
+}
+
+func TestExistingPolicyFor(t *testing.T) {
+	policies, err := newExistingPolicies(&types.RestoreOptions{
+		OverwriteExisting:       true,
+		ExistingPolicyOverrides: map[string]types.ExistingPolicy{"Jobs": types.ExistingReplace, "job.batch": types.ExistingFail, "secret": types.ExistingSkip},
+	})
+	if err != nil {
+		t.Fatalf("newExistingPolicies failed: %v", err)
+	}
+
+	cases := []struct {
+		gvk      schema.GroupVersionKind
+		plural   string
+		expected types.ExistingPolicy
+	}{
+		{schema.GroupVersionKind{Group: "batch", Version: "v1", Kind: "Job"}, "jobs", types.ExistingFail},
+		{schema.GroupVersionKind{Group: "example.com", Version: "v1", Kind: "Job"}, "jobs", types.ExistingReplace},
+		{schema.GroupVersionKind{Version: "v1", Kind: "Secret"}, "secrets", types.ExistingSkip},
+		// --overwrite is the default for everything else
+		{schema.GroupVersionKind{Version: "v1", Kind: "ConfigMap"}, "configmaps", types.ExistingUpdate},
+	}
+	for _, c := range cases {
+		plural := func(schema.GroupVersionKind) string { return c.plural }
+		if policy := policies.policyFor(c.gvk, plural); policy != c.expected {
+			t.Errorf("Expected %s for %s, got %s", c.expected, c.gvk, policy)
+		}
+	}
+
+	// Plurals are resolved once per kind, and only when there are overrides
+	lookups := 0
+	countLookups := func(gvk schema.GroupVersionKind) string {
+		lookups++
+		return strings.ToLower(gvk.Kind) + "s"
+	}
+	cronJob := schema.GroupVersionKind{Group: "batch", Version: "v1", Kind: "CronJob"}
+	for i := 0; i < 3; i++ {
+		policies.policyFor(cronJob, countLookups)
+	}
+	if lookups != 1 {
+		t.Errorf("Expected one plural lookup, got %d", lookups)
+	}
+	defaults, err := newExistingPolicies(&types.RestoreOptions{})
+	if err != nil {
+		t.Fatalf("newExistingPolicies failed: %v", err)
+	}
+	if policy := defaults.policyFor(cronJob, countLookups); policy != types.ExistingSkip || lookups != 1 {
+		t.Errorf("Expected skip without a plural lookup, got %s after %d lookups", policy, lookups)
+	}
+
+	if _, err := newExistingPolicies(&types.RestoreOptions{ExistingPolicy: "overwrite"}); err == nil {
+		t.Error("Expected an unknown policy to be rejected")
+	}
+}
+
+func TestRestoreExistingPolicies(t *testing.T) {
+	tempDir := t.TempDir()
+	resources := []types.ResourceWithContent{
+		{
+			Content: []byte("apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: settings\n  namespace: prod\ndata:\n  mode: fast\n"),
+			Info:    types.ResourceInfo{APIVersion: "v1", Kind: "ConfigMap", Namespace: "prod", Name: "settings"},
+		},
+		{
+			Content: []byte("apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: new\n  namespace: prod\n"),
+			Info:    types.ResourceInfo{APIVersion: "v1", Kind: "ConfigMap", Namespace: "prod", Name: "new"},
+		},
+	}
+	backupPath := saveTestBackup(t, tempDir, resources)
+
+	newLive := func() *unstructured.Unstructured {
+		live := newTestObject("v1", "ConfigMap", "prod", "settings")
+		live.SetUID("5e1f2c3a")
+		live.Object["data"] = map[string]interface{}{"mode": "slow", "extra": "kept", "legacy": "removed"}
+		live.SetAnnotations(map[string]string{"kubectl.kubernetes.io/last-applied-configuration": `{"data":{"mode":"slow","legacy":"removed"}}`})
+		return live
+	}
+
+	cases := []struct {
+		policy    types.ExistingPolicy
+		overrides map[string]types.ExistingPolicy
+		effective types.ExistingPolicy
+		action    Action
+		events    []string
+	}{
+		{policy: types.ExistingSkip, effective: types.ExistingSkip, action: Skipped, events: []string{"apply configmaps/new"}},
+		{policy: types.ExistingUpdate, effective: types.ExistingUpdate, action: Updated, events: []string{"apply configmaps/settings", "apply configmaps/new"}},
+		{policy: types.ExistingMerge, effective: types.ExistingMerge, action: Merged, events: []string{"merge configmaps/settings", "apply configmaps/new"}},
+		{policy: types.ExistingReplace, effective: types.ExistingReplace, action: Replaced, events: []string{"delete configmaps/settings", "apply configmaps/settings", "apply configmaps/new"}},
+		{policy: types.ExistingFail, effective: types.ExistingFail, action: Failed, events: []string{"apply configmaps/new"}},
+		{policy: types.ExistingSkip, overrides: map[string]types.ExistingPolicy{"configmap": types.ExistingUpdate}, effective: types.ExistingUpdate, action: Updated, events: []string{"apply configmaps/settings", "apply configmaps/new"}},
+	}
+	for _, c := range cases {
+		recorder := &eventRecorder{}
+		client := newTestClient(recorder, newLive())
+		dynamicClient := client.Dynamic().(*dynamicfake.FakeDynamicClient)
+		dynamicClient.PrependReactor("delete", "*", func(action k8stesting.Action) (bool, runtime.Object, error) {
+			recorder.record("delete " + action.GetResource().Resource + "/" + action.(k8stesting.DeleteAction).GetName())
+			return false, nil, nil
+		})
+		dynamicClient.PrependReactor("patch", "*", func(action k8stesting.Action) (bool, runtime.Object, error) {
+			if patch := action.(k8stesting.PatchAction); patch.GetPatchType() == "application/merge-patch+json" {
+				recorder.record("merge " + patch.GetResource().Resource + "/" + patch.GetName())
+			}
+			return false, nil, nil
+		})
+
+		result, err := NewManager(client, storage.NewLocalStorage(tempDir)).RestoreBackup(context.Background(), &types.RestoreOptions{
+			BackupPath:              backupPath,
+			ExistingPolicy:          c.policy,
+			ExistingPolicyOverrides: c.overrides,
+		}, nil)
+		if err != nil {
+			t.Fatalf("%s: RestoreBackup failed: %v", c.policy, err)
+		}
+
+		var actions []string
+		for _, action := range result.Actions {
+			actions = append(actions, action.Resource.Name+" "+string(action.Action)+" "+string(action.Policy))
+		}
+		expected := []string{"settings " + string(c.action) + " " + string(c.effective), "new created " + string(c.effective)}
+		if !reflect.DeepEqual(actions, expected) {
+			t.Errorf("%s: expected actions %v, got %v", c.policy, expected, actions)
+		}
+		if !reflect.DeepEqual(recorder.events, c.events) {
+			t.Errorf("%s: expected API calls %v, got %v", c.policy, c.events, recorder.events)
+		}
+		if (c.action == Failed) != (len(result.Errors) == 1) {
+			t.Errorf("%s: unexpected errors %v", c.policy, result.Errors)
+		}
+		if (c.action == Skipped) != (result.SkippedResources == 1) {
+			t.Errorf("%s: expected the existing resource to be skipped only under skip, got %d skipped", c.policy, result.SkippedResources)
+		}
+
+		if c.action == Merged {
+			live, err := client.GetResource(context.Background(), newLive(), "prod")
+			if err != nil {
+				t.Fatalf("Failed to get merged object: %v", err)
+			}
+			// Fields kubectl applied that are not in the backup are removed,
+			// fields only set in the cluster are kept
+			data := map[string]interface{}{"mode": "fast", "extra": "kept"}
+			if !reflect.DeepEqual(live.Object["data"], data) {
+				t.Errorf("Expected merged data %v, got %v", data, live.Object["data"])
+			}
+		}
+	}
+}
+
+func TestRestoreExistingPolicyOverrideByPlural(t *testing.T) {
+	tempDir := t.TempDir()
+	backupPath := saveTestBackup(t, tempDir, []types.ResourceWithContent{
+		{
+			Content: []byte("apiVersion: networking.k8s.io/v1\nkind: IngressClass\nmetadata:\n  name: nginx\n"),
+			Info:    types.ResourceInfo{APIVersion: "networking.k8s.io/v1", Kind: "IngressClass", Name: "nginx"},
+		},
+	})
+
+	// Overrides keyed by plural use the resource name from discovery, not
+	// one guessed from the kind
+	recorder := &eventRecorder{}
+	client := newTestClient(recorder, newTestObject("networking.k8s.io/v1", "IngressClass", "", "nginx"))
+	result, err := NewManager(client, storage.NewLocalStorage(tempDir)).RestoreBackup(context.Background(), &types.RestoreOptions{
+		BackupPath:              backupPath,
+		ExistingPolicy:          types.ExistingUpdate,
+		ExistingPolicyOverrides: map[string]types.ExistingPolicy{"ingressclasses": types.ExistingSkip},
+	}, nil)
+	if err != nil {
+		t.Fatalf("RestoreBackup failed: %v", err)
+	}
+	if len(result.Actions) != 1 || result.Actions[0].Action != Skipped || result.Actions[0].Policy != types.ExistingSkip {
+		t.Errorf("Expected the override to skip the ingress class, got %+v", result.Actions)
+	}
+	if len(recorder.events) != 0 {
+		t.Errorf("Expected no API calls, got %v", recorder.events)
+	}
+}
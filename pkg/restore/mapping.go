@@ -0,0 +1,145 @@
+package restore
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/util/validation"
+
+	"k8s-backup/pkg/k8s"
+)
+
+// serviceAccountUserPrefix starts the user name a service account
+// authenticates as: system:serviceaccount:<namespace>:<name>
+const serviceAccountUserPrefix = "system:serviceaccount:"
+
+// ParseNamespaceMapping parses source:target pairs such as prod:prod-restore
+// into a namespace mapping
+func ParseNamespaceMapping(pairs []string) (map[string]string, error) {
+	mapping := make(map[string]string, len(pairs))
+	targets := make(map[string]string, len(pairs))
+	for _, pair := range pairs {
+		source, target, ok := strings.Cut(pair, ":")
+		if !ok || source == "" || target == "" {
+			return nil, fmt.Errorf("invalid namespace mapping %q: expected source:target", pair)
+		}
+		if errs := validation.IsDNS1123Label(target); len(errs) > 0 {
+			return nil, fmt.Errorf("invalid namespace mapping %q: %s", pair, strings.Join(errs, ", "))
+		}
+		if _, ok := mapping[source]; ok {
+			return nil, fmt.Errorf("namespace %s is mapped more than once", source)
+		}
+		if other, ok := targets[target]; ok {
+			return nil, fmt.Errorf("namespaces %s and %s are both mapped to %s", other, source, target)
+		}
+		mapping[source] = target
+		targets[target] = source
+	}
+	return mapping, nil
+}
+
+// mapNamespace returns the namespace a resource from the given namespace is
+// restored into
+func mapNamespace(mapping map[string]string, namespace string) string {
+	if target, ok := mapping[namespace]; ok {
+		return target
+	}
+	return namespace
+}
+
+// remapNamespaces rewrites an object restored under a namespace mapping: its
+// own namespace, the name of a mapped Namespace, and the namespaces of
+// well-known references to objects in other namespaces. Other cluster-scoped
+// objects keep their name, so rewriting them would take them over from the
+// source namespaces; they are only rewritten with remapClusterScoped.
+func remapNamespaces(obj *unstructured.Unstructured, mapping map[string]string, remapClusterScoped bool) {
+	if len(mapping) == 0 {
+		return
+	}
+
+	if namespace := obj.GetNamespace(); namespace != "" {
+		obj.SetNamespace(mapNamespace(mapping, namespace))
+	}
+
+	gvk := obj.GroupVersionKind()
+	if gvk.Group == "" && gvk.Kind == "Namespace" {
+		obj.SetName(mapNamespace(mapping, obj.GetName()))
+		return
+	}
+	if obj.GetNamespace() == "" && !remapClusterScoped {
+		return
+	}
+	switch {
+	case gvk.Group == "rbac.authorization.k8s.io" && (gvk.Kind == "RoleBinding" || gvk.Kind == "ClusterRoleBinding"):
+		remapSubjects(obj, mapping)
+	case gvk.Group == "" && gvk.Kind == "PersistentVolume":
+		remapNestedNamespace(obj.Object, mapping, "spec", "claimRef", "namespace")
+	case gvk.Group == "admissionregistration.k8s.io" && (gvk.Kind == "ValidatingWebhookConfiguration" || gvk.Kind == "MutatingWebhookConfiguration"):
+		webhooks, _, _ := unstructured.NestedSlice(obj.Object, "webhooks")
+		for _, webhook := range webhooks {
+			if webhook, ok := webhook.(map[string]interface{}); ok {
+				remapNestedNamespace(webhook, mapping, "clientConfig", "service", "namespace")
+			}
+		}
+		unstructured.SetNestedSlice(obj.Object, webhooks, "webhooks")
+	case gvk.Group == "apiregistration.k8s.io" && gvk.Kind == "APIService":
+		remapNestedNamespace(obj.Object, mapping, "spec", "service", "namespace")
+	case gvk.Group == "apiextensions.k8s.io" && gvk.Kind == "CustomResourceDefinition":
+		remapNestedNamespace(obj.Object, mapping, "spec", "conversion", "webhook", "clientConfig", "service", "namespace")
+	}
+}
+
+// remapSubjects rewrites the namespaces of ServiceAccount subjects, and the
+// service account user names of User subjects, in a role binding
+func remapSubjects(obj *unstructured.Unstructured, mapping map[string]string) {
+	subjects, found, _ := unstructured.NestedSlice(obj.Object, "subjects")
+	if !found {
+		return
+	}
+	for _, subject := range subjects {
+		subject, ok := subject.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		switch subject["kind"] {
+		case "ServiceAccount":
+			remapNestedNamespace(subject, mapping, "namespace")
+		case "User":
+			name, _ := subject["name"].(string)
+			if rest, ok := strings.CutPrefix(name, serviceAccountUserPrefix); ok {
+				if namespace, account, ok := strings.Cut(rest, ":"); ok {
+					subject["name"] = serviceAccountUserPrefix + mapNamespace(mapping, namespace) + ":" + account
+				}
+			}
+		}
+	}
+	unstructured.SetNestedSlice(obj.Object, subjects, "subjects")
+}
+
+// remapNestedNamespace rewrites the namespace at the given path, if it is set
+func remapNestedNamespace(obj map[string]interface{}, mapping map[string]string, fields ...string) {
+	namespace, found, err := unstructured.NestedString(obj, fields...)
+	if !found || err != nil {
+		return
+	}
+	unstructured.SetNestedField(obj, mapNamespace(mapping, namespace), fields...)
+}
+
+// ensureNamespace creates a namespace that resources are restored into under
+// a namespace mapping, unless it already exists
+func (m *Manager) ensureNamespace(ctx context.Context, name, fieldManager string) error {
+	if fieldManager == "" {
+		fieldManager = k8s.DefaultFieldManager
+	}
+	namespace := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: name}}
+	_, err := m.k8sClient.Clientset().CoreV1().Namespaces().Create(ctx, namespace, metav1.CreateOptions{FieldManager: fieldManager})
+	if err != nil && !apierrors.IsAlreadyExists(err) {
+		return fmt.Errorf("failed to create namespace %s: %w", name, err)
+	}
+	return nil
+}
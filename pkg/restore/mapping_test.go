@@ -0,0 +1,160 @@
+package restore
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	k8stesting "k8s.io/client-go/testing"
+
+	"k8s-backup/pkg/storage"
+	"k8s-backup/pkg/types"
+)
+
+func TestParseNamespaceMapping(t *testing.T) {
+	tests := []struct {
+		pairs    []string
+		expected map[string]string
+		valid    bool
+	}{
+		{[]string{"prod:prod-restore", "shop:shop-copy"}, map[string]string{"prod": "prod-restore", "shop": "shop-copy"}, true},
+		{[]string{}, map[string]string{}, true},
+		{[]string{"prod"}, nil, false},
+		{[]string{"prod:"}, nil, false},
+		{[]string{"prod:Prod_Restore"}, nil, false},
+		{[]string{"prod:a", "prod:b"}, nil, false},
+		{[]string{"prod:copy", "shop:copy"}, nil, false},
+	}
+
+	for _, test := range tests {
+		mapping, err := ParseNamespaceMapping(test.pairs)
+		if (err == nil) != test.valid {
+			t.Errorf("%v: expected valid=%v, got %v", test.pairs, test.valid, err)
+			continue
+		}
+		if test.valid && !reflect.DeepEqual(mapping, test.expected) {
+			t.Errorf("%v: expected %v, got %v", test.pairs, test.expected, mapping)
+		}
+	}
+}
+
+func TestRemapNamespaces(t *testing.T) {
+	mapping := map[string]string{"prod": "prod-restore"}
+
+	binding := newTestObject("rbac.authorization.k8s.io/v1", "ClusterRoleBinding", "", "deployers")
+	binding.Object["subjects"] = []interface{}{
+		map[string]interface{}{"kind": "ServiceAccount", "name": "deployer", "namespace": "prod"},
+		map[string]interface{}{"kind": "ServiceAccount", "name": "deployer", "namespace": "other"},
+		map[string]interface{}{"kind": "User", "name": "system:serviceaccount:prod:ci"},
+		map[string]interface{}{"kind": "Group", "name": "prod"},
+	}
+	remapNamespaces(binding, mapping, true)
+	expected := []interface{}{
+		map[string]interface{}{"kind": "ServiceAccount", "name": "deployer", "namespace": "prod-restore"},
+		map[string]interface{}{"kind": "ServiceAccount", "name": "deployer", "namespace": "other"},
+		map[string]interface{}{"kind": "User", "name": "system:serviceaccount:prod-restore:ci"},
+		map[string]interface{}{"kind": "Group", "name": "prod"},
+	}
+	if !reflect.DeepEqual(binding.Object["subjects"], expected) {
+		t.Errorf("Unexpected subjects: %v", binding.Object["subjects"])
+	}
+
+	namespace := newTestObject("v1", "Namespace", "", "prod")
+	remapNamespaces(namespace, mapping, false)
+	if namespace.GetName() != "prod-restore" {
+		t.Errorf("Expected the Namespace to be renamed, got %s", namespace.GetName())
+	}
+
+	volume := newTestObject("v1", "PersistentVolume", "", "pv-1")
+	volume.Object["spec"] = map[string]interface{}{"claimRef": map[string]interface{}{"namespace": "prod", "name": "data"}}
+	remapNamespaces(volume, mapping, true)
+	if claimNamespace, _, _ := unstructured.NestedString(volume.Object, "spec", "claimRef", "namespace"); claimNamespace != "prod-restore" {
+		t.Errorf("Expected the claimRef namespace to be rewritten, got %s", claimNamespace)
+	}
+
+	webhook := newTestObject("admissionregistration.k8s.io/v1", "ValidatingWebhookConfiguration", "", "policy")
+	webhook.Object["webhooks"] = []interface{}{
+		map[string]interface{}{"name": "check", "clientConfig": map[string]interface{}{"service": map[string]interface{}{"namespace": "prod", "name": "policy"}}},
+	}
+	remapNamespaces(webhook, mapping, true)
+	webhooks, _, _ := unstructured.NestedSlice(webhook.Object, "webhooks")
+	if serviceNamespace, _, _ := unstructured.NestedString(webhooks[0].(map[string]interface{}), "clientConfig", "service", "namespace"); serviceNamespace != "prod-restore" {
+		t.Errorf("Expected the webhook service namespace to be rewritten, got %s", serviceNamespace)
+	}
+
+	// Without opting in, cluster-scoped objects are left as backed up
+	unchanged := newTestObject("rbac.authorization.k8s.io/v1", "ClusterRoleBinding", "", "deployers")
+	unchanged.Object["subjects"] = []interface{}{
+		map[string]interface{}{"kind": "ServiceAccount", "name": "deployer", "namespace": "prod"},
+	}
+	remapNamespaces(unchanged, mapping, false)
+	if subjects, _, _ := unstructured.NestedSlice(unchanged.Object, "subjects"); subjects[0].(map[string]interface{})["namespace"] != "prod" {
+		t.Errorf("Expected the ClusterRoleBinding to be left unchanged, got %v", subjects)
+	}
+	roleBinding := newTestObject("rbac.authorization.k8s.io/v1", "RoleBinding", "prod", "deployers")
+	roleBinding.Object["subjects"] = []interface{}{
+		map[string]interface{}{"kind": "ServiceAccount", "name": "deployer", "namespace": "prod"},
+	}
+	remapNamespaces(roleBinding, mapping, false)
+	if subjects, _, _ := unstructured.NestedSlice(roleBinding.Object, "subjects"); roleBinding.GetNamespace() != "prod-restore" || subjects[0].(map[string]interface{})["namespace"] != "prod-restore" {
+		t.Errorf("Expected a RoleBinding to be rewritten, got %s with %v", roleBinding.GetNamespace(), subjects)
+	}
+
+	configMap := newTestObject("v1", "ConfigMap", "shop", "settings")
+	remapNamespaces(configMap, mapping, true)
+	if configMap.GetNamespace() != "shop" {
+		t.Errorf("Expected an unmapped namespace to be kept, got %s", configMap.GetNamespace())
+	}
+}
+
+func TestRestoreWithNamespaceMapping(t *testing.T) {
+	tempDir := t.TempDir()
+	resources := []types.ResourceWithContent{
+		{
+			Content: []byte("apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: settings\n  namespace: prod\n"),
+			Info:    types.ResourceInfo{APIVersion: "v1", Kind: "ConfigMap", Namespace: "prod", Name: "settings"},
+		},
+		{
+			Content: []byte("apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: settings\n  namespace: shop\n"),
+			Info:    types.ResourceInfo{APIVersion: "v1", Kind: "ConfigMap", Namespace: "shop", Name: "settings"},
+		},
+	}
+	backupPath := saveTestBackup(t, tempDir, resources)
+
+	client := newTestClient(&eventRecorder{})
+	var applied []string
+	client.Dynamic().(*dynamicfake.FakeDynamicClient).PrependReactor("patch", "*", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		applied = append(applied, action.GetNamespace()+"/"+action.(k8stesting.PatchAction).GetName())
+		return false, nil, nil
+	})
+	manager := NewManager(client, storage.NewLocalStorage(tempDir))
+
+	result, err := manager.RestoreBackup(context.Background(), &types.RestoreOptions{
+		BackupPath:        backupPath,
+		OverwriteExisting: true,
+		NamespaceMapping:  map[string]string{"prod": "prod-restore", "unused": "unused-copy"},
+	}, nil)
+	if err != nil {
+		t.Fatalf("RestoreBackup failed: %v", err)
+	}
+	if len(result.Errors) != 0 {
+		t.Fatalf("Expected no errors, got %v", result.Errors)
+	}
+
+	if expected := []string{"prod-restore/settings", "shop/settings"}; !reflect.DeepEqual(applied, expected) {
+		t.Errorf("Expected applies %v, got %v", expected, applied)
+	}
+	if expected := []string{"prod-restore", "shop"}; !reflect.DeepEqual(result.Namespaces, expected) {
+		t.Errorf("Expected namespaces %v, got %v", expected, result.Namespaces)
+	}
+	if expected := map[string]string{"prod": "prod-restore"}; !reflect.DeepEqual(result.NamespaceMapping, expected) {
+		t.Errorf("Expected the applied mapping %v, got %v", expected, result.NamespaceMapping)
+	}
+	if _, err := client.Clientset().CoreV1().Namespaces().Get(context.Background(), "prod-restore", metav1.GetOptions{}); err != nil {
+		t.Errorf("Expected the target namespace to be created: %v", err)
+	}
+}
@@ -0,0 +1,332 @@
+package restore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/tools/cache"
+	watchtools "k8s.io/client-go/tools/watch"
+
+	"k8s-backup/pkg/types"
+)
+
+// defaultWaitTimeout bounds readiness waits when RestoreOptions.Timeout is unset
+const defaultWaitTimeout = 5 * time.Minute
+
+// maxConcurrentWaits bounds the number of objects watched at once while
+// waiting for restored resources
+const maxConcurrentWaits = 16
+
+// readinessCheck inspects a live object and reports whether it is ready. The
+// message describes what is still outstanding and is surfaced on timeout. A
+// non-nil error means the object has failed and will not become ready.
+type readinessCheck func(obj *unstructured.Unstructured) (ready bool, message string, err error)
+
+var (
+	serviceKind  = schema.GroupKind{Kind: "Service"}
+	endpointsGVR = schema.GroupVersionResource{Version: "v1", Resource: "endpoints"}
+)
+
+// readinessChecks maps kinds that have a meaningful ready state to their check.
+// Kinds not listed here are considered ready as soon as they are applied.
+// CustomResourceDefinitions are waited for separately, before any custom
+// resources are applied.
+var readinessChecks = map[schema.GroupKind]readinessCheck{
+	{Group: "apps", Kind: "Deployment"}:  deploymentReady,
+	{Group: "apps", Kind: "StatefulSet"}: statefulSetReady,
+	{Group: "apps", Kind: "DaemonSet"}:   daemonSetReady,
+	{Group: "batch", Kind: "Job"}:        jobReady,
+	{Kind: "PersistentVolumeClaim"}:      persistentVolumeClaimReady,
+	{Kind: "Namespace"}:                  namespaceReady,
+}
+
+// readinessWait is an applied object to wait for
+type readinessWait struct {
+	resource  types.ResourceInfo
+	obj       runtime.Object
+	namespace string
+}
+
+// waitForResourcesReady waits for applied objects concurrently, sharing one
+// timeout. It runs once every resource is applied, because objects such as a
+// WaitForFirstConsumer claim or a Service only become ready through the
+// workloads restored after them. It returns the objects that are not ready,
+// in the order they were applied.
+func (m *Manager) waitForResourcesReady(ctx context.Context, waits []readinessWait, timeout time.Duration) []ResourceError {
+	if timeout <= 0 {
+		timeout = defaultWaitTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	errs := make([]error, len(waits))
+	semaphore := make(chan struct{}, maxConcurrentWaits)
+	var wg sync.WaitGroup
+	for i, w := range waits {
+		wg.Add(1)
+		go func(i int, w readinessWait) {
+			defer wg.Done()
+			semaphore <- struct{}{}
+			defer func() { <-semaphore }()
+			errs[i] = m.waitForResourceReady(ctx, w.obj, w.namespace, timeout)
+		}(i, w)
+	}
+	wg.Wait()
+
+	var notReady []ResourceError
+	for i, err := range errs {
+		if err != nil {
+			notReady = append(notReady, ResourceError{Resource: waits[i].resource, Err: err})
+		}
+	}
+	return notReady
+}
+
+// waitForResourceReady blocks until the restored object reaches its kind's
+// ready state or the timeout expires
+func (m *Manager) waitForResourceReady(ctx context.Context, obj runtime.Object, namespace string, timeout time.Duration) error {
+	u, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return fmt.Errorf("unexpected object type %T", obj)
+	}
+	if u.GetNamespace() != "" {
+		namespace = u.GetNamespace()
+	}
+
+	gvk := u.GroupVersionKind()
+	if gvk.GroupKind() == serviceKind {
+		if !serviceNeedsEndpoints(u) {
+			return nil
+		}
+		client := m.k8sClient.Dynamic().Resource(endpointsGVR).Namespace(namespace)
+		return waitUntilReady(ctx, client, u.GetName(), timeout, endpointsReady)
+	}
+
+	check, ok := readinessChecks[gvk.GroupKind()]
+	if !ok {
+		return nil
+	}
+
+	mapping, err := m.k8sClient.RESTMapping(gvk)
+	if err != nil {
+		return err
+	}
+	var client dynamic.ResourceInterface = m.k8sClient.Dynamic().Resource(mapping.Resource)
+	if mapping.Scope.Name() == "namespace" {
+		client = m.k8sClient.Dynamic().Resource(mapping.Resource).Namespace(namespace)
+	}
+
+	return waitUntilReady(ctx, client, u.GetName(), timeout, check)
+}
+
+// waitUntilReady watches the named object and returns once check reports it
+// ready. The watch is resynced on disconnects, so no polling interval is needed.
+func waitUntilReady(ctx context.Context, client dynamic.ResourceInterface, name string, timeout time.Duration, check readinessCheck) error {
+	if timeout <= 0 {
+		timeout = defaultWaitTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	fieldSelector := fields.OneTermEqualSelector("metadata.name", name).String()
+	lw := &cache.ListWatch{
+		ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+			options.FieldSelector = fieldSelector
+			return client.List(ctx, options)
+		},
+		WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+			options.FieldSelector = fieldSelector
+			return client.Watch(ctx, options)
+		},
+	}
+
+	message := "not found"
+	_, err := watchtools.UntilWithSync(ctx, lw, &unstructured.Unstructured{}, nil, func(event watch.Event) (bool, error) {
+		obj, ok := event.Object.(*unstructured.Unstructured)
+		if !ok || obj.GetName() != name {
+			return false, nil
+		}
+		if event.Type == watch.Deleted {
+			message = "deleted"
+			return false, nil
+		}
+
+		ready, msg, err := check(obj)
+		message = msg
+		return ready, err
+	})
+	if wait.Interrupted(err) || errors.Is(err, watchtools.ErrWatchClosed) {
+		return fmt.Errorf("not ready after %s: %s", timeout, message)
+	}
+	return err
+}
+
+// serviceNeedsEndpoints reports whether a Service is expected to get endpoints
+// from a selector. ExternalName and selectorless Services are ready as applied.
+func serviceNeedsEndpoints(obj *unstructured.Unstructured) bool {
+	serviceType, _, _ := unstructured.NestedString(obj.Object, "spec", "type")
+	if serviceType == "ExternalName" {
+		return false
+	}
+	selector, _, _ := unstructured.NestedStringMap(obj.Object, "spec", "selector")
+	return len(selector) > 0
+}
+
+func endpointsReady(obj *unstructured.Unstructured) (bool, string, error) {
+	subsets, _, _ := unstructured.NestedSlice(obj.Object, "subsets")
+	for _, subset := range subsets {
+		subset, ok := subset.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		addresses, _, _ := unstructured.NestedSlice(subset, "addresses")
+		if len(addresses) > 0 {
+			return true, "", nil
+		}
+	}
+	return false, "no ready endpoints", nil
+}
+
+func deploymentReady(obj *unstructured.Unstructured) (bool, string, error) {
+	if ready, msg := generationObserved(obj); !ready {
+		return false, msg, nil
+	}
+
+	if cond := findCondition(obj, "Progressing"); cond != nil && cond["reason"] == "ProgressDeadlineExceeded" {
+		return false, "", fmt.Errorf("rollout failed: %v", cond["message"])
+	}
+
+	replicas := desiredReplicas(obj)
+	updated, _, _ := unstructured.NestedInt64(obj.Object, "status", "updatedReplicas")
+	ready, _, _ := unstructured.NestedInt64(obj.Object, "status", "readyReplicas")
+	if updated < replicas {
+		return false, fmt.Sprintf("%d of %d replicas updated", updated, replicas), nil
+	}
+	if ready < replicas {
+		return false, fmt.Sprintf("%d of %d replicas ready", ready, replicas), nil
+	}
+	return true, "", nil
+}
+
+func statefulSetReady(obj *unstructured.Unstructured) (bool, string, error) {
+	if ready, msg := generationObserved(obj); !ready {
+		return false, msg, nil
+	}
+
+	replicas := desiredReplicas(obj)
+	ready, _, _ := unstructured.NestedInt64(obj.Object, "status", "readyReplicas")
+	if ready < replicas {
+		return false, fmt.Sprintf("%d of %d replicas ready", ready, replicas), nil
+	}
+
+	// OnDelete statefulsets never roll pods on their own, so only readiness counts
+	strategy, _, _ := unstructured.NestedString(obj.Object, "spec", "updateStrategy", "type")
+	if strategy != "OnDelete" {
+		current, _, _ := unstructured.NestedString(obj.Object, "status", "currentRevision")
+		update, _, _ := unstructured.NestedString(obj.Object, "status", "updateRevision")
+		if current != update {
+			return false, fmt.Sprintf("rolling out revision %s", update), nil
+		}
+	}
+	return true, "", nil
+}
+
+func daemonSetReady(obj *unstructured.Unstructured) (bool, string, error) {
+	if ready, msg := generationObserved(obj); !ready {
+		return false, msg, nil
+	}
+
+	desired, _, _ := unstructured.NestedInt64(obj.Object, "status", "desiredNumberScheduled")
+	updated, _, _ := unstructured.NestedInt64(obj.Object, "status", "updatedNumberScheduled")
+	ready, _, _ := unstructured.NestedInt64(obj.Object, "status", "numberReady")
+	if updated < desired {
+		return false, fmt.Sprintf("%d of %d pods updated", updated, desired), nil
+	}
+	if ready < desired {
+		return false, fmt.Sprintf("%d of %d pods ready", ready, desired), nil
+	}
+	return true, "", nil
+}
+
+func jobReady(obj *unstructured.Unstructured) (bool, string, error) {
+	if cond := findCondition(obj, "Failed"); cond != nil && cond["status"] == "True" {
+		return false, "", fmt.Errorf("job failed: %v", cond["message"])
+	}
+	if cond := findCondition(obj, "Complete"); cond != nil && cond["status"] == "True" {
+		return true, "", nil
+	}
+	return false, "job has not completed", nil
+}
+
+func persistentVolumeClaimReady(obj *unstructured.Unstructured) (bool, string, error) {
+	phase, _, _ := unstructured.NestedString(obj.Object, "status", "phase")
+	switch phase {
+	case "Bound":
+		return true, "", nil
+	case "Lost":
+		return false, "", fmt.Errorf("claim lost its volume")
+	}
+	return false, "claim is not bound", nil
+}
+
+func namespaceReady(obj *unstructured.Unstructured) (bool, string, error) {
+	phase, _, _ := unstructured.NestedString(obj.Object, "status", "phase")
+	switch phase {
+	case "Active":
+		return true, "", nil
+	case "Terminating":
+		return false, "", fmt.Errorf("namespace is terminating")
+	}
+	return false, "namespace is not active", nil
+}
+
+func customResourceDefinitionReady(obj *unstructured.Unstructured) (bool, string, error) {
+	if cond := findCondition(obj, "NamesAccepted"); cond != nil && cond["status"] == "False" {
+		return false, "", fmt.Errorf("names not accepted: %v", cond["message"])
+	}
+	if cond := findCondition(obj, "Established"); cond != nil && cond["status"] == "True" {
+		return true, "", nil
+	}
+	return false, "not established", nil
+}
+
+// generationObserved reports whether the controller has seen the latest spec
+func generationObserved(obj *unstructured.Unstructured) (bool, string) {
+	observed, _, _ := unstructured.NestedInt64(obj.Object, "status", "observedGeneration")
+	if observed < obj.GetGeneration() {
+		return false, "waiting for the controller to observe the latest generation"
+	}
+	return true, ""
+}
+
+// desiredReplicas returns spec.replicas, which defaults to 1 when unset
+func desiredReplicas(obj *unstructured.Unstructured) int64 {
+	replicas, found, _ := unstructured.NestedInt64(obj.Object, "spec", "replicas")
+	if !found {
+		return 1
+	}
+	return replicas
+}
+
+// findCondition returns the status condition of the given type, or nil
+func findCondition(obj *unstructured.Unstructured, conditionType string) map[string]interface{} {
+	conditions, _, _ := unstructured.NestedSlice(obj.Object, "status", "conditions")
+	for _, c := range conditions {
+		cond, ok := c.(map[string]interface{})
+		if ok && cond["type"] == conditionType {
+			return cond
+		}
+	}
+	return nil
+}
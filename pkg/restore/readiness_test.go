@@ -0,0 +1,188 @@
+package restore
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	"k8s-backup/pkg/storage"
+	"k8s-backup/pkg/types"
+)
+
+func withFields(obj *unstructured.Unstructured, fields map[string]interface{}) *unstructured.Unstructured {
+	for k, v := range fields {
+		obj.Object[k] = v
+	}
+	return obj
+}
+
+func TestReadinessChecks(t *testing.T) {
+	deployment := func(generation int64, status map[string]interface{}) *unstructured.Unstructured {
+		obj := withFields(newTestObject("apps/v1", "Deployment", "shop", "web"), map[string]interface{}{
+			"spec":   map[string]interface{}{"replicas": int64(2)},
+			"status": status,
+		})
+		obj.SetGeneration(generation)
+		return obj
+	}
+	withPhase := func(kind, phase string) *unstructured.Unstructured {
+		return withFields(newTestObject("v1", kind, "", "x"), map[string]interface{}{
+			"status": map[string]interface{}{"phase": phase},
+		})
+	}
+	withCondition := func(apiVersion, kind, conditionType, status string) *unstructured.Unstructured {
+		return withFields(newTestObject(apiVersion, kind, "", "x"), map[string]interface{}{
+			"status": map[string]interface{}{
+				"conditions": []interface{}{
+					map[string]interface{}{"type": conditionType, "status": status, "message": "boom"},
+				},
+			},
+		})
+	}
+
+	tests := []struct {
+		name      string
+		check     readinessCheck
+		obj       *unstructured.Unstructured
+		ready     bool
+		expectErr bool
+	}{
+		{"deployment rolled out", deploymentReady, deployment(2, map[string]interface{}{"observedGeneration": int64(2), "updatedReplicas": int64(2), "readyReplicas": int64(2)}), true, false},
+		{"deployment stale generation", deploymentReady, deployment(3, map[string]interface{}{"observedGeneration": int64(2), "updatedReplicas": int64(2), "readyReplicas": int64(2)}), false, false},
+		{"deployment partially ready", deploymentReady, deployment(1, map[string]interface{}{"observedGeneration": int64(1), "updatedReplicas": int64(2), "readyReplicas": int64(1)}), false, false},
+		{"deployment past deadline", deploymentReady, deployment(1, map[string]interface{}{
+			"observedGeneration": int64(1),
+			"conditions":         []interface{}{map[string]interface{}{"type": "Progressing", "status": "False", "reason": "ProgressDeadlineExceeded"}},
+		}), false, true},
+		{"pvc bound", persistentVolumeClaimReady, withPhase("PersistentVolumeClaim", "Bound"), true, false},
+		{"pvc pending", persistentVolumeClaimReady, withPhase("PersistentVolumeClaim", "Pending"), false, false},
+		{"pvc lost", persistentVolumeClaimReady, withPhase("PersistentVolumeClaim", "Lost"), false, true},
+		{"namespace active", namespaceReady, withPhase("Namespace", "Active"), true, false},
+		{"namespace terminating", namespaceReady, withPhase("Namespace", "Terminating"), false, true},
+		{"job complete", jobReady, withCondition("batch/v1", "Job", "Complete", "True"), true, false},
+		{"job failed", jobReady, withCondition("batch/v1", "Job", "Failed", "True"), false, true},
+		{"job running", jobReady, newTestObject("batch/v1", "Job", "", "x"), false, false},
+		{"crd established", customResourceDefinitionReady, withCondition("apiextensions.k8s.io/v1", "CustomResourceDefinition", "Established", "True"), true, false},
+		{"crd names rejected", customResourceDefinitionReady, withCondition("apiextensions.k8s.io/v1", "CustomResourceDefinition", "NamesAccepted", "False"), false, true},
+		{"endpoints with addresses", endpointsReady, withFields(newTestObject("v1", "Endpoints", "", "x"), map[string]interface{}{
+			"subsets": []interface{}{map[string]interface{}{"addresses": []interface{}{map[string]interface{}{"ip": "10.0.0.1"}}}},
+		}), true, false},
+		{"endpoints without addresses", endpointsReady, withFields(newTestObject("v1", "Endpoints", "", "x"), map[string]interface{}{
+			"subsets": []interface{}{map[string]interface{}{"notReadyAddresses": []interface{}{map[string]interface{}{"ip": "10.0.0.1"}}}},
+		}), false, false},
+	}
+
+	for _, test := range tests {
+		ready, _, err := test.check(test.obj)
+		if ready != test.ready {
+			t.Errorf("%s: expected ready=%t, got %t", test.name, test.ready, ready)
+		}
+		if (err != nil) != test.expectErr {
+			t.Errorf("%s: expected error=%t, got %v", test.name, test.expectErr, err)
+		}
+	}
+}
+
+func TestRestoreWaitsForReadiness(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "k8s-backup-test-*")
+	if err != nil {
+		t.Fatalf("Failed to create temp directory: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	backupPath := saveTestBackup(t, tempDir, []types.ResourceWithContent{
+		{
+			Content: []byte("apiVersion: apps/v1\nkind: Deployment\nmetadata:\n  name: web\n  namespace: shop\nspec:\n  replicas: 2\n"),
+			Info:    types.ResourceInfo{APIVersion: "apps/v1", Kind: "Deployment", Namespace: "shop", Name: "web"},
+		},
+		{
+			Content: []byte("apiVersion: v1\nkind: Service\nmetadata:\n  name: web\n  namespace: shop\nspec:\n  selector:\n    app: web\n"),
+			Info:    types.ResourceInfo{APIVersion: "v1", Kind: "Service", Namespace: "shop", Name: "web"},
+		},
+		{
+			Content: []byte("apiVersion: v1\nkind: Service\nmetadata:\n  name: upstream\n  namespace: shop\nspec:\n  type: ExternalName\n  externalName: example.com\n"),
+			Info:    types.ResourceInfo{APIVersion: "v1", Kind: "Service", Namespace: "shop", Name: "upstream"},
+		},
+	})
+
+	// The live deployment has rolled out, but the service never gets endpoints
+	liveDeployment := withFields(newTestObject("apps/v1", "Deployment", "shop", "web"), map[string]interface{}{
+		"spec":   map[string]interface{}{"replicas": int64(2)},
+		"status": map[string]interface{}{"observedGeneration": int64(1), "updatedReplicas": int64(2), "readyReplicas": int64(2)},
+	})
+	liveDeployment.SetGeneration(1)
+	emptyEndpoints := newTestObject("v1", "Endpoints", "shop", "web")
+
+	manager := NewManager(newTestClient(&eventRecorder{}, liveDeployment, emptyEndpoints), storage.NewLocalStorage(tempDir))
+	result, err := manager.RestoreBackup(context.Background(), &types.RestoreOptions{
+		BackupPath:        backupPath,
+		Wait:              true,
+		Timeout:           200 * time.Millisecond,
+		OverwriteExisting: true,
+	}, nil)
+	if err != nil {
+		t.Fatalf("RestoreBackup failed: %v", err)
+	}
+
+	if len(result.Errors) != 0 {
+		t.Errorf("Expected no errors, got %v", result.Errors)
+	}
+	if result.ProcessedResources != 3 {
+		t.Errorf("Expected 3 processed resources, got %d", result.ProcessedResources)
+	}
+	if len(result.NotReady) != 1 {
+		t.Fatalf("Expected 1 resource not ready, got %v", result.NotReady)
+	}
+	notReady := result.NotReady[0]
+	if notReady.Resource.Kind != "Service" || notReady.Resource.Name != "web" {
+		t.Errorf("Expected Service web to be not ready, got %s", notReady.Error())
+	}
+	if !strings.Contains(notReady.Error(), "no ready endpoints") {
+		t.Errorf("Expected the outstanding condition in the error, got %q", notReady.Error())
+	}
+}
+
+func TestRestoreWaitsOnceAllResourcesAreApplied(t *testing.T) {
+	tempDir := t.TempDir()
+	backupPath := saveTestBackup(t, tempDir, []types.ResourceWithContent{
+		{
+			Content: []byte("apiVersion: v1\nkind: Service\nmetadata:\n  name: web\n  namespace: shop\nspec:\n  selector:\n    app: web\n"),
+			Info:    types.ResourceInfo{APIVersion: "v1", Kind: "Service", Namespace: "shop", Name: "web"},
+		},
+		{
+			Content: []byte("apiVersion: apps/v1\nkind: Deployment\nmetadata:\n  name: web\n  namespace: shop\nspec:\n  replicas: 2\n"),
+			Info:    types.ResourceInfo{APIVersion: "apps/v1", Kind: "Deployment", Namespace: "shop", Name: "web"},
+		},
+	})
+
+	// Neither becomes ready, so both waits run until the shared timeout
+	recorder := &eventRecorder{}
+	manager := NewManager(newTestClient(recorder), storage.NewLocalStorage(tempDir))
+	start := time.Now()
+	result, err := manager.RestoreBackup(context.Background(), &types.RestoreOptions{
+		BackupPath: backupPath,
+		Wait:       true,
+		Timeout:    300 * time.Millisecond,
+	}, nil)
+	if err != nil {
+		t.Fatalf("RestoreBackup failed: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Expected the waits to share the timeout, took %s", elapsed)
+	}
+
+	// The service is not waited for before the deployment backing it exists
+	lastApply := recorder.indexOf("apply deployments/web")
+	for _, wait := range []string{"wait endpoints", "wait deployments"} {
+		if i := recorder.indexOf(wait); i < lastApply {
+			t.Errorf("Expected %q after every resource was applied, got events %v", wait, recorder.events)
+		}
+	}
+	if len(result.NotReady) != 2 || result.NotReady[0].Resource.Kind != "Service" || result.NotReady[1].Resource.Kind != "Deployment" {
+		t.Errorf("Expected the service and deployment in apply order, got %v", result.NotReady)
+	}
+}
@@ -3,21 +3,31 @@ package restore
 import (
 	"context"
 	"fmt"
+	"io"
 	"log"
 	"sort"
 	"strings"
 	"time"
 
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/apimachinery/pkg/util/sets"
 	"sigs.k8s.io/yaml"
 
+	"k8s-backup/pkg/datamover"
 	"k8s-backup/pkg/k8s"
+	"k8s-backup/pkg/snapshot"
 	"k8s-backup/pkg/storage"
+	"k8s-backup/pkg/transform"
 	"k8s-backup/pkg/types"
 )
 
+const customResourceDefinitionKind = "CustomResourceDefinition"
+
 // RestoreResult contains the results of a restore operation
 type RestoreResult struct {
 	ProcessedResources int
@@ -25,13 +35,44 @@ type RestoreResult struct {
 	Namespaces         []string
 	ResourceTypes      []string
 	Errors             []error
-	Duration           time.Duration
+	NotReady           []ResourceError
+	// NamespaceMapping holds the entries of the requested namespace mapping
+	// that applied to restored resources
+	NamespaceMapping map[string]string
+	// RestoredVolumes counts the claims provisioned from the backup's volume
+	// snapshots
+	RestoredVolumes int
+	// RestoredVolumeData counts the claims the data mover copied backed up
+	// files into
+	RestoredVolumeData int
+	// Actions records what was done with every resource written to the
+	// cluster: created, or skipped, updated, merged or replaced under the
+	// existing policy
+	Actions []ResourceAction
+	// DryRun holds the outcome for every resource of a server-side dry run
+	DryRun   []DryRunResult
+	Duration time.Duration
+}
+
+// ResourceError associates an error with the backed up resource it concerns
+type ResourceError struct {
+	Resource types.ResourceInfo
+	Err      error
+}
+
+func (e ResourceError) Error() string {
+	name := e.Resource.Name
+	if e.Resource.Namespace != "" {
+		name = e.Resource.Namespace + "/" + name
+	}
+	return fmt.Sprintf("%s %s: %v", e.Resource.Kind, name, e.Err)
 }
 
 // Manager handles restore operations
 type Manager struct {
-	k8sClient *k8s.Client
-	storage   storage.Storage
+	k8sClient   *k8s.Client
+	storage     storage.Storage
+	transformer transform.Transformer
 }
 
 // NewManager creates a new restore manager
@@ -42,37 +83,79 @@ func NewManager(k8sClient *k8s.Client, storage storage.Storage) *Manager {
 	}
 }
 
+// SetTransformer sets the transformer every object is run through before it
+// is restored, such as a pipeline loaded from a rules file
+func (m *Manager) SetTransformer(transformer transform.Transformer) {
+	m.transformer = transformer
+}
+
 // RestoreBackup performs a restore operation with the given options
 func (m *Manager) RestoreBackup(ctx context.Context, options *types.RestoreOptions, progressCallback types.ProgressCallback) (*RestoreResult, error) {
 	startTime := time.Now()
 	log.Printf("Starting restore from: %s", options.BackupPath)
 
-	// Load backup
-	manifest, resources, err := m.storage.LoadBackup(ctx, options.BackupPath)
+	// Open backup, reconstructing incremental backups from their parent chain
+	reader, err := storage.NewChainStorage(m.storage).OpenBackupReader(ctx, options.BackupPath)
 	if err != nil {
 		return nil, fmt.Errorf("failed to load backup: %w", err)
 	}
+	defer reader.Close()
+
+	manifest := reader.Manifest()
+	log.Printf("Loaded backup: %s (%d resources)", manifest.Metadata.Name, len(manifest.Resources))
+
+	if options.ServerDryRun && m.k8sClient == nil {
+		return nil, fmt.Errorf("a server-side dry run needs a Kubernetes client")
+	}
+	// applying is set when resources are written to the cluster
+	applying := !options.DryRun && !options.ServerDryRun && m.k8sClient != nil
 
-	log.Printf("Loaded backup: %s (%d resources)", manifest.Metadata.Name, len(resources))
+	policies, err := newExistingPolicies(options)
+	if err != nil {
+		return nil, err
+	}
 
 	// Filter resources based on options
-	filteredResources := m.filterResources(resources, options)
-	log.Printf("Filtered to %d resources for restore", len(filteredResources))
+	filter, err := newResourceFilter(options)
+	if err != nil {
+		return nil, err
+	}
+	selected := 0
+	mapped := make(map[string]string)
+	restoredNamespaces := sets.NewString()
+	for _, info := range manifest.Resources {
+		if !m.includeResource(info, filter) {
+			continue
+		}
+		selected++
+		if name := namespaceName(info); name != "" {
+			restoredNamespaces.Insert(name)
+		}
+		for _, namespace := range []string{info.Namespace, namespaceName(info)} {
+			if target, ok := options.NamespaceMapping[namespace]; ok {
+				mapped[namespace] = target
+			}
+		}
+	}
+	log.Printf("Filtered to %d resources for restore", selected)
 
-	if len(filteredResources) == 0 {
+	if selected == 0 {
 		return &RestoreResult{
 			ProcessedResources: 0,
-			SkippedResources:   len(resources),
+			SkippedResources:   len(manifest.Resources),
 			Duration:           time.Since(startTime),
 		}, nil
 	}
 
-	// Sort resources by dependency order
-	sortedResources := m.sortResourcesByDependency(filteredResources)
+	// Read resources in dependency order
+	next, err := m.resourcesInDependencyOrder(ctx, reader, filter)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load backup: %w", err)
+	}
 
 	// Initialize progress tracking
 	progress := types.Progress{
-		Total:     len(sortedResources),
+		Total:     selected,
 		Completed: 0,
 		Current:   "Starting restore...",
 		Errors:    []error{},
@@ -80,23 +163,102 @@ func (m *Manager) RestoreBackup(ctx context.Context, options *types.RestoreOptio
 
 	result := &RestoreResult{
 		ProcessedResources: 0,
-		SkippedResources:   len(resources) - len(filteredResources),
+		SkippedResources:   len(manifest.Resources) - selected,
 		Namespaces:         []string{},
 		ResourceTypes:      []string{},
 		Errors:             []error{},
 		Duration:           0,
 	}
 
+	// Create the namespaces resources are mapped into, unless their Namespace
+	// objects are restored from the backup
+	var createdTargets []string
+	if len(mapped) > 0 {
+		result.NamespaceMapping = mapped
+		for source, target := range mapped {
+			log.Printf("Restoring namespace %s into %s", source, target)
+			if restoredNamespaces.Has(source) {
+				continue
+			}
+			createdTargets = append(createdTargets, target)
+			if applying {
+				if err := m.ensureNamespace(ctx, target, options.FieldManager); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+
+	var dryRunState *serverDryRun
+	if options.ServerDryRun {
+		if dryRunState, err = m.newServerDryRun(ctx, createdTargets); err != nil {
+			return nil, err
+		}
+	}
+
+	// Claims snapshotted by the backup are provisioned from their snapshots
+	snapshots := make(map[string]types.VolumeSnapshotInfo)
+	if !options.SkipVolumeSnapshots {
+		for _, info := range manifest.Metadata.VolumeSnapshots {
+			snapshots[info.Namespace+"/"+info.PersistentVolumeClaim] = info
+		}
+	}
+	volumes := snapshot.NewManager(m.k8sClient)
+
+	// Claims whose files were copied by the data mover get a new volume,
+	// which the files are copied into before any workload is restored
+	volumeData := make(map[string]types.VolumeDataInfo)
+	if !options.SkipVolumeData {
+		for _, info := range manifest.Volumes {
+			if info.Phase == types.VolumeDataCompleted {
+				volumeData[info.Key()] = info
+			}
+		}
+	}
+	mover := datamover.NewMover(m.k8sClient)
+	mover.SetImage(options.DataMoverImage)
+	mover.SetTimeout(options.Timeout)
+
 	// Track namespaces and resource types
 	namespacesSet := sets.NewString()
 	resourceTypesSet := sets.NewString()
 
+	// CRDs sort first; custom resources are held back until they are
+	// established, and so is the end of the restore, so CRs applied after it
+	// do not race them
+	var pendingCRDs []string
+	waitForPendingCRDs := func() {
+		progress.Current = fmt.Sprintf("Waiting for %d CustomResourceDefinitions to be established", len(pendingCRDs))
+		if progressCallback != nil {
+			progressCallback(progress)
+		}
+		for _, err := range m.waitForCRDsEstablished(ctx, pendingCRDs, options.Timeout) {
+			result.Errors = append(result.Errors, err)
+			progress.Errors = append(progress.Errors, err)
+		}
+		pendingCRDs = nil
+	}
+	// Applied resources to wait for
+	var waits []readinessWait
+
 	// Apply resources in dependency order
-	for i, resource := range sortedResources {
+	for i := 0; ; i++ {
 		if ctx.Err() != nil {
 			return result, ctx.Err()
 		}
 
+		resource, err := next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return result, fmt.Errorf("failed to read backup: %w", err)
+		}
+
+		if len(pendingCRDs) > 0 && resource.Info.Kind != customResourceDefinitionKind {
+			waitForPendingCRDs()
+		}
+
 		progress.Current = fmt.Sprintf("Restoring %s/%s", resource.Info.Kind, resource.Info.Name)
 		progress.Completed = i
 		if progressCallback != nil {
@@ -112,38 +274,179 @@ func (m *Manager) RestoreBackup(ctx context.Context, options *types.RestoreOptio
 			continue
 		}
 
-		// Apply the resource
-		if !options.DryRun && m.k8sClient != nil {
-			err = m.k8sClient.ApplyResource(ctx, obj, resource.Info.Namespace, options.DryRun)
-			if err != nil {
-				if !options.OverwriteExisting && strings.Contains(err.Error(), "already exists") {
-					log.Printf("Skipping existing resource: %s/%s", resource.Info.Kind, resource.Info.Name)
-					result.SkippedResources++
+		// Volumes of snapshotted claims are replaced by ones provisioned from
+		// the snapshots
+		if volume, ok := obj.(*unstructured.Unstructured); ok && resource.Info.Kind == "PersistentVolume" {
+			claimNamespace, _, _ := unstructured.NestedString(volume.Object, "spec", "claimRef", "namespace")
+			claimName, _, _ := unstructured.NestedString(volume.Object, "spec", "claimRef", "name")
+			if _, ok := snapshots[claimNamespace+"/"+claimName]; ok {
+				log.Printf("Skipping PersistentVolume %s: claim %s/%s is restored from a volume snapshot", resource.Info.Name, claimNamespace, claimName)
+				result.SkippedResources++
+				continue
+			}
+			if _, ok := volumeData[claimNamespace+"/"+claimName]; ok {
+				log.Printf("Skipping PersistentVolume %s: claim %s/%s is restored from volume data", resource.Info.Name, claimNamespace, claimName)
+				result.SkippedResources++
+				continue
+			}
+		}
+
+		// Transform the object as it was backed up, then rewrite namespaces
+		// under the namespace mapping
+		namespace := mapNamespace(options.NamespaceMapping, resource.Info.Namespace)
+		if unstruct, ok := obj.(*unstructured.Unstructured); ok {
+			if m.transformer != nil {
+				if err := m.transformer.Transform(unstruct); err != nil {
+					err = fmt.Errorf("failed to transform %s/%s: %w", resource.Info.Kind, resource.Info.Name, err)
+					result.Errors = append(result.Errors, err)
+					progress.Errors = append(progress.Errors, err)
+					continue
+				}
+			}
+			remapNamespaces(unstruct, options.NamespaceMapping, options.RemapClusterResources)
+			if len(options.NamespaceMapping) > 0 && resource.Info.Namespace == "" && resource.Info.Kind != "Namespace" {
+				if options.RemapClusterResources {
+					log.Printf("Warning: rewriting the namespace references of cluster-scoped %s %s, which keeps its name and may be shared with the source namespaces", resource.Info.Kind, resource.Info.Name)
+				} else {
+					log.Printf("Warning: restoring cluster-scoped %s %s unchanged under the namespace mapping; it still refers to the source namespaces", resource.Info.Kind, resource.Info.Name)
+				}
+			}
+			if unstruct.GetNamespace() != "" {
+				namespace = unstruct.GetNamespace()
+			}
+		}
+
+		gvk := obj.GetObjectKind().GroupVersionKind()
+		policy := policies.policyFor(gvk, m.resourcePlural)
+
+		if unstruct, ok := obj.(*unstructured.Unstructured); ok && resource.Info.Kind == "PersistentVolumeClaim" {
+			if info, ok := snapshots[resource.Info.Namespace+"/"+resource.Info.Name]; ok {
+				unstruct.SetNamespace(namespace)
+				// The snapshot objects are only created for a claim that is
+				// provisioned from them, not for one the existing policy
+				// leaves in place, where they would never be cleaned up
+				kept := false
+				if applying && policy != types.ExistingReplace {
+					_, err := m.k8sClient.GetResource(ctx, unstruct, namespace)
+					kept = err == nil
+				}
+				if err := volumes.RestoreClaim(ctx, unstruct, info, applying && !kept); err != nil {
+					err = fmt.Errorf("failed to restore %s/%s from its volume snapshot: %w", resource.Info.Kind, resource.Info.Name, err)
+					result.Errors = append(result.Errors, err)
+					progress.Errors = append(progress.Errors, err)
 					continue
 				}
+				if !kept {
+					result.RestoredVolumes++
+				}
+			}
+			if _, ok := volumeData[resource.Info.Namespace+"/"+resource.Info.Name]; ok {
+				snapshot.UnbindClaim(unstruct)
+			}
+		}
+
+		// Show what would be applied
+		if (options.DryRun || options.ServerDryRun) && options.DryRunOutput != nil {
+			if err := writeObject(options.DryRunOutput, obj); err != nil {
+				return result, err
+			}
+		}
+
+		// Have the API server validate the resource without persisting it
+		if options.ServerDryRun {
+			dryRun := m.dryRunResource(ctx, dryRunState, obj, namespace, resource.Info, policy, options)
+			result.DryRun = append(result.DryRun, dryRun)
+			switch dryRun.Action {
+			case WouldSkip:
+				result.SkippedResources++
+				continue
+			case WouldFail:
+				err := fmt.Errorf("%s/%s would fail: %w", resource.Info.Kind, resource.Info.Name, dryRun.Err)
+				result.Errors = append(result.Errors, err)
+				progress.Errors = append(progress.Errors, err)
+				continue
+			}
+		}
 
-				err = fmt.Errorf("failed to apply %s/%s: %w", resource.Info.Kind, resource.Info.Name, err)
+		// Apply the resource, leaving the existing policy to decide what
+		// happens to resources that already exist
+		if applying {
+			action, err := m.restoreResource(ctx, obj, namespace, policy, options)
+			if err != nil {
+				action = Failed
+			}
+			result.Actions = append(result.Actions, ResourceAction{Resource: resource.Info, Action: action, Policy: policy})
+			if action == Skipped {
+				log.Printf("Skipping existing resource: %s/%s", resource.Info.Kind, resource.Info.Name)
+				result.SkippedResources++
+				continue
+			}
+			if err != nil {
+				if apierrors.IsConflict(err) {
+					err = fmt.Errorf("failed to apply %s/%s: fields are owned by another field manager (use --force-conflicts to take ownership): %w", resource.Info.Kind, resource.Info.Name, err)
+				} else {
+					err = fmt.Errorf("failed to apply %s/%s: %w", resource.Info.Kind, resource.Info.Name, err)
+				}
 				result.Errors = append(result.Errors, err)
 				progress.Errors = append(progress.Errors, err)
 				continue
 			}
+
+			// Copy the backed up files into new claims before the workloads
+			// that use them are restored
+			if info, ok := volumeData[resource.Info.Namespace+"/"+resource.Info.Name]; ok && resource.Info.Kind == "PersistentVolumeClaim" {
+				if action != Created {
+					log.Printf("Not restoring volume data into existing claim %s/%s", namespace, resource.Info.Name)
+				} else {
+					progress.Current = fmt.Sprintf("Restoring volume data of %s/%s", namespace, resource.Info.Name)
+					if progressCallback != nil {
+						progressCallback(progress)
+					}
+					if err := m.restoreVolumeData(ctx, reader, mover, manifest.Metadata.Name, namespace, info); err != nil {
+						err = fmt.Errorf("failed to restore volume data of %s/%s: %w", namespace, resource.Info.Name, err)
+						result.Errors = append(result.Errors, err)
+						progress.Errors = append(progress.Errors, err)
+					} else {
+						result.RestoredVolumeData++
+					}
+				}
+			}
 		}
 
 		// Track success
 		result.ProcessedResources++
-		namespacesSet.Insert(resource.Info.Namespace)
+		namespacesSet.Insert(namespace)
 		resourceTypesSet.Insert(strings.ToLower(resource.Info.Kind))
 
-		// Wait for resource to be ready if requested
-		if options.Wait && !options.DryRun && m.k8sClient != nil {
-			if err := m.waitForResourceReady(ctx, obj, resource.Info, options.Timeout); err != nil {
-				log.Printf("Warning: Resource %s/%s may not be fully ready: %v", resource.Info.Kind, resource.Info.Name, err)
-			}
+		if resource.Info.Kind == customResourceDefinitionKind && applying {
+			pendingCRDs = append(pendingCRDs, resource.Info.Name)
+		}
+
+		// Wait for resource to be ready if requested, once every resource
+		// is applied
+		if options.Wait && applying && resource.Info.Kind != customResourceDefinitionKind {
+			waits = append(waits, readinessWait{resource: resource.Info, obj: obj, namespace: namespace})
+		}
+	}
+	if len(pendingCRDs) > 0 {
+		progress.Completed = selected
+		waitForPendingCRDs()
+	}
+
+	if len(waits) > 0 {
+		progress.Completed = selected
+		progress.Current = fmt.Sprintf("Waiting for %d resources to be ready", len(waits))
+		if progressCallback != nil {
+			progressCallback(progress)
+		}
+		for _, notReady := range m.waitForResourcesReady(ctx, waits, options.Timeout) {
+			result.NotReady = append(result.NotReady, notReady)
+			progress.Errors = append(progress.Errors, notReady)
 		}
 	}
 
 	// Final progress update
-	progress.Completed = len(sortedResources)
+	progress.Completed = selected
 	progress.Current = "Restore completed"
 	if progressCallback != nil {
 		progressCallback(progress)
@@ -163,46 +466,141 @@ func (m *Manager) RestoreBackup(ctx context.Context, options *types.RestoreOptio
 	return result, nil
 }
 
-// filterResources filters resources based on restore options
-func (m *Manager) filterResources(resources []types.ResourceWithContent, options *types.RestoreOptions) []types.ResourceWithContent {
-	// Create filter sets
-	namespacesFilter := sets.NewString(options.Namespaces...)
-	resourceTypesFilter := sets.NewString(options.ResourceTypes...)
+// restoreVolumeData copies the backed up files of a claim into the claim of
+// the same name in namespace
+func (m *Manager) restoreVolumeData(ctx context.Context, reader storage.BackupReader, mover *datamover.Mover, backupName, namespace string, info types.VolumeDataInfo) error {
+	data, err := reader.OpenVolume(ctx, info)
+	if err != nil {
+		return err
+	}
+	defer data.Close()
 
-	var filtered []types.ResourceWithContent
+	if err := mover.RestoreVolume(ctx, backupName, namespace, info.PersistentVolumeClaim, data); err != nil {
+		return err
+	}
+	log.Printf("Restored volume data %s/%s: %d bytes", namespace, info.PersistentVolumeClaim, info.Size)
+	return nil
+}
 
-	for _, resource := range resources {
-		// Filter by namespace if specified
-		if namespacesFilter.Len() > 0 {
-			if resource.Info.Namespace == "" {
-				// Cluster-scoped resource - include if no namespace filter or if "cluster" is specified
-				if !namespacesFilter.Has("") && !namespacesFilter.Has("cluster") {
-					continue
-				}
-			} else {
-				// Namespaced resource - include only if namespace matches
-				if !namespacesFilter.Has(resource.Info.Namespace) {
-					continue
+// resourcesInDependencyOrder returns an iterator over the resources of a
+// backup that the options select, in dependency order. Backups are written in
+// that order and are streamed; older backups are read into memory and sorted.
+func (m *Manager) resourcesInDependencyOrder(ctx context.Context, reader storage.BackupReader, filter *resourceFilter) (func() (types.ResourceWithContent, error), error) {
+	if inDependencyOrder(reader.Manifest().Resources) {
+		return func() (types.ResourceWithContent, error) {
+			for {
+				resource, err := reader.Next(ctx)
+				if err != nil || m.includeResource(resource.Info, filter) {
+					return resource, err
 				}
 			}
+		}, nil
+	}
+
+	var resources []types.ResourceWithContent
+	for {
+		resource, err := reader.Next(ctx)
+		if err == io.EOF {
+			break
 		}
+		if err != nil {
+			return nil, err
+		}
+		resources = append(resources, resource)
+	}
+	sorted := m.sortResourcesByDependency(m.filterResources(resources, filter))
 
-		// Filter by resource type if specified
-		if resourceTypesFilter.Len() > 0 {
-			resourceType := strings.ToLower(resource.Info.Kind)
-			// Also check plural forms
-			resourceTypePlural := m.getResourceTypePlural(resourceType)
-			if !resourceTypesFilter.Has(resourceType) && !resourceTypesFilter.Has(resourceTypePlural) {
-				continue
-			}
+	return func() (types.ResourceWithContent, error) {
+		if len(sorted) == 0 {
+			return types.ResourceWithContent{}, io.EOF
+		}
+		resource := sorted[0]
+		sorted = sorted[1:]
+		return resource, nil
+	}, nil
+}
+
+// inDependencyOrder reports whether resources are already listed in the
+// order they must be restored in
+func inDependencyOrder(resources []types.ResourceInfo) bool {
+	for i := 1; i < len(resources); i++ {
+		if types.GetResourceOrder(resources[i].Kind) < types.GetResourceOrder(resources[i-1].Kind) {
+			return false
 		}
+	}
+	return true
+}
+
+// namespaceName returns the name of a Namespace resource, and an empty string
+// for any other resource
+func namespaceName(info types.ResourceInfo) string {
+	if info.Kind == "Namespace" && info.Namespace == "" {
+		return info.Name
+	}
+	return ""
+}
 
-		filtered = append(filtered, resource)
+// resourceFilter holds the restore options that select resources
+type resourceFilter struct {
+	namespaces    sets.String
+	resourceTypes sets.String
+	selector      labels.Selector
+}
+
+func newResourceFilter(options *types.RestoreOptions) (*resourceFilter, error) {
+	selector, err := labels.Parse(options.LabelSelector)
+	if err != nil {
+		return nil, fmt.Errorf("invalid selector: %w", err)
 	}
+	return &resourceFilter{
+		namespaces:    sets.NewString(options.Namespaces...),
+		resourceTypes: sets.NewString(options.ResourceTypes...),
+		selector:      selector,
+	}, nil
+}
 
+// filterResources filters resources based on restore options
+func (m *Manager) filterResources(resources []types.ResourceWithContent, filter *resourceFilter) []types.ResourceWithContent {
+	var filtered []types.ResourceWithContent
+	for _, resource := range resources {
+		if m.includeResource(resource.Info, filter) {
+			filtered = append(filtered, resource)
+		}
+	}
 	return filtered
 }
 
+// includeResource reports whether the restore options select a resource
+func (m *Manager) includeResource(info types.ResourceInfo, filter *resourceFilter) bool {
+	// Filter by namespace if specified
+	if filter.namespaces.Len() > 0 {
+		if info.Namespace == "" {
+			// Cluster-scoped resource - include if no namespace filter or if "cluster" is specified
+			if !filter.namespaces.Has("") && !filter.namespaces.Has("cluster") {
+				return false
+			}
+		} else {
+			// Namespaced resource - include only if namespace matches
+			if !filter.namespaces.Has(info.Namespace) {
+				return false
+			}
+		}
+	}
+
+	// Filter by resource type if specified
+	if filter.resourceTypes.Len() > 0 {
+		resourceType := strings.ToLower(info.Kind)
+		// Also check plural forms
+		resourceTypePlural := m.getResourceTypePlural(resourceType)
+		if !filter.resourceTypes.Has(resourceType) && !filter.resourceTypes.Has(resourceTypePlural) {
+			return false
+		}
+	}
+
+	// Filter by the labels recorded at backup time
+	return filter.selector.Matches(labels.Set(info.Labels))
+}
+
 // sortResourcesByDependency sorts resources by their dependency order
 func (m *Manager) sortResourcesByDependency(resources []types.ResourceWithContent) []types.ResourceWithContent {
 	// Create a copy to avoid modifying the original slice
@@ -261,6 +659,18 @@ func (m *Manager) parseResourceObject(content []byte) (runtime.Object, error) {
 	return runtimeObj, nil
 }
 
+// writeObject writes an object as a YAML document
+func writeObject(w io.Writer, obj runtime.Object) error {
+	content, err := yaml.Marshal(obj)
+	if err != nil {
+		return fmt.Errorf("failed to encode %s: %w", obj.GetObjectKind().GroupVersionKind().Kind, err)
+	}
+	if _, err := fmt.Fprintf(w, "---\n%s", content); err != nil {
+		return fmt.Errorf("failed to write dry run output: %w", err)
+	}
+	return nil
+}
+
 // createRuntimeObject creates an appropriate runtime.Object based on apiVersion and kind
 func (m *Manager) createRuntimeObject(apiVersion, kind string) (runtime.Object, error) {
 	// Use unstructured.Unstructured for all resource types
@@ -271,23 +681,30 @@ func (m *Manager) createRuntimeObject(apiVersion, kind string) (runtime.Object,
 	return obj, nil
 }
 
-// waitForResourceReady waits for a resource to become ready (simplified implementation)
-func (m *Manager) waitForResourceReady(ctx context.Context, obj runtime.Object, info types.ResourceInfo, timeout time.Duration) error {
-	// This is a simplified implementation - in practice, you would implement
-	// specific readiness checks for different resource types
-
-	// For now, just wait a short time for basic resources to be created
-	shortTimeout := 30 * time.Second
-	if timeout < shortTimeout {
-		shortTimeout = timeout
+// waitForCRDsEstablished waits until every named CRD reports the Established
+// condition, so custom resources applied afterwards can be mapped and served.
+// It returns one error per CRD that did not become established in time.
+func (m *Manager) waitForCRDsEstablished(ctx context.Context, names []string, timeout time.Duration) []error {
+	var errors []error
+	crdClient := m.k8sClient.Dynamic().Resource(apiextensionsv1.SchemeGroupVersion.WithResource("customresourcedefinitions"))
+	for _, name := range names {
+		if err := waitUntilReady(ctx, crdClient, name, timeout, customResourceDefinitionReady); err != nil {
+			errors = append(errors, fmt.Errorf("CustomResourceDefinition %s was not established: %w", name, err))
+		}
 	}
 
-	select {
-	case <-time.After(shortTimeout):
-		return nil
-	case <-ctx.Done():
-		return ctx.Err()
+	return errors
+}
+
+// resourcePlural returns the resource name the API server serves a kind
+// under, falling back to a guess when the kind cannot be mapped
+func (m *Manager) resourcePlural(gvk schema.GroupVersionKind) string {
+	if m.k8sClient != nil {
+		if mapping, err := m.k8sClient.RESTMapping(gvk); err == nil {
+			return mapping.Resource.Resource
+		}
 	}
+	return m.getResourceTypePlural(strings.ToLower(gvk.Kind))
 }
 
 // getResourceTypePlural returns the plural form of a resource type
@@ -0,0 +1,438 @@
+package restore
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	apiextensionsfake "k8s.io/apiextensions-apiserver/pkg/client/clientset/clientset/fake"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	k8stypes "k8s.io/apimachinery/pkg/types"
+	fakediscovery "k8s.io/client-go/discovery/fake"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+
+	"k8s-backup/pkg/k8s"
+	"k8s-backup/pkg/snapshot"
+	"k8s-backup/pkg/storage"
+	"k8s-backup/pkg/transform"
+	"k8s-backup/pkg/types"
+)
+
+var testAPIResources = []*metav1.APIResourceList{
+	{
+		GroupVersion: "v1",
+		APIResources: []metav1.APIResource{
+			{Name: "namespaces", SingularName: "namespace", Kind: "Namespace", Verbs: metav1.Verbs{"get", "list", "patch"}},
+			{Name: "configmaps", SingularName: "configmap", Kind: "ConfigMap", Namespaced: true, Verbs: metav1.Verbs{"get", "list", "patch"}},
+			{Name: "services", SingularName: "service", Kind: "Service", Namespaced: true, Verbs: metav1.Verbs{"get", "list", "watch", "patch"}},
+			{Name: "endpoints", SingularName: "endpoints", Kind: "Endpoints", Namespaced: true, Verbs: metav1.Verbs{"get", "list", "watch"}},
+			{Name: "persistentvolumeclaims", SingularName: "persistentvolumeclaim", Kind: "PersistentVolumeClaim", Namespaced: true, Verbs: metav1.Verbs{"get", "list", "create", "patch"}},
+		},
+	},
+	{
+		GroupVersion: "apps/v1",
+		APIResources: []metav1.APIResource{
+			{Name: "deployments", SingularName: "deployment", Kind: "Deployment", Namespaced: true, Verbs: metav1.Verbs{"get", "list", "watch", "patch"}},
+		},
+	},
+	{
+		GroupVersion: "networking.k8s.io/v1",
+		APIResources: []metav1.APIResource{
+			{Name: "ingressclasses", SingularName: "ingressclass", Kind: "IngressClass", Verbs: metav1.Verbs{"get", "list", "patch"}},
+		},
+	},
+	{
+		GroupVersion: "apiextensions.k8s.io/v1",
+		APIResources: []metav1.APIResource{
+			{Name: "customresourcedefinitions", SingularName: "customresourcedefinition", Kind: "CustomResourceDefinition", Verbs: metav1.Verbs{"get", "list", "patch"}},
+		},
+	},
+	{
+		GroupVersion: "example.com/v1",
+		APIResources: []metav1.APIResource{
+			{Name: "widgets", SingularName: "widget", Kind: "Widget", Namespaced: true, Verbs: metav1.Verbs{"get", "list", "patch"}},
+		},
+	},
+}
+
+// eventRecorder collects API calls across fake clients in the order they happen
+type eventRecorder struct {
+	mu     sync.Mutex
+	events []string
+}
+
+func (r *eventRecorder) record(event string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, event)
+}
+
+func (r *eventRecorder) indexOf(event string) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i, e := range r.events {
+		if e == event {
+			return i
+		}
+	}
+	return -1
+}
+
+func newTestClient(recorder *eventRecorder, objects ...runtime.Object) *k8s.Client {
+	clientset := kubefake.NewSimpleClientset()
+	clientset.Discovery().(*fakediscovery.FakeDiscovery).Resources = testAPIResources
+
+	listKinds := map[schema.GroupVersionResource]string{
+		{Version: "v1", Resource: "namespaces"}:                                               "NamespaceList",
+		{Version: "v1", Resource: "configmaps"}:                                               "ConfigMapList",
+		{Version: "v1", Resource: "services"}:                                                 "ServiceList",
+		{Version: "v1", Resource: "endpoints"}:                                                "EndpointsList",
+		{Version: "v1", Resource: "persistentvolumeclaims"}:                                   "PersistentVolumeClaimList",
+		snapshot.VolumeSnapshotGVR:                                                            "VolumeSnapshotList",
+		snapshot.VolumeSnapshotContentGVR:                                                     "VolumeSnapshotContentList",
+		{Group: "apps", Version: "v1", Resource: "deployments"}:                               "DeploymentList",
+		{Group: "networking.k8s.io", Version: "v1", Resource: "ingressclasses"}:               "IngressClassList",
+		{Group: "apiextensions.k8s.io", Version: "v1", Resource: "customresourcedefinitions"}: "CustomResourceDefinitionList",
+		{Group: "example.com", Version: "v1", Resource: "widgets"}:                            "WidgetList",
+	}
+	dynamicClient := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), listKinds, objects...)
+	dynamicClient.PrependReactor("patch", "*", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		patch := action.(k8stesting.PatchAction)
+		if patch.GetPatchType() != k8stypes.ApplyPatchType {
+			return false, nil, nil
+		}
+		recorder.record("apply " + patch.GetResource().Resource + "/" + patch.GetName())
+		obj := &unstructured.Unstructured{}
+		if err := obj.UnmarshalJSON(patch.GetPatch()); err != nil {
+			return true, nil, err
+		}
+		return true, obj, nil
+	})
+	dynamicClient.PrependReactor("create", "*", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		create := action.(k8stesting.CreateAction)
+		if obj, ok := create.GetObject().(*unstructured.Unstructured); ok {
+			recorder.record("create " + create.GetResource().Resource + "/" + obj.GetName())
+		}
+		return false, nil, nil
+	})
+	dynamicClient.PrependReactor("list", "*", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		recorder.record("wait " + action.GetResource().Resource)
+		return false, nil, nil
+	})
+
+	return k8s.NewClientFromInterfaces(clientset, apiextensionsfake.NewSimpleClientset(), dynamicClient)
+}
+
+func newTestCRD(established bool) *unstructured.Unstructured {
+	crd := newTestObject("apiextensions.k8s.io/v1", "CustomResourceDefinition", "", "widgets.example.com")
+	if established {
+		crd.Object["status"] = map[string]interface{}{
+			"conditions": []interface{}{
+				map[string]interface{}{"type": "Established", "status": "True"},
+			},
+		}
+	}
+	return crd
+}
+
+func newTestObject(apiVersion, kind, namespace, name string) *unstructured.Unstructured {
+	obj := &unstructured.Unstructured{}
+	obj.SetAPIVersion(apiVersion)
+	obj.SetKind(kind)
+	obj.SetNamespace(namespace)
+	obj.SetName(name)
+	return obj
+}
+
+var crdTestResources = []types.ResourceWithContent{
+	{
+		Content: []byte("apiVersion: example.com/v1\nkind: Widget\nmetadata:\n  name: gadget\n  namespace: shop\n"),
+		Info:    types.ResourceInfo{APIVersion: "example.com/v1", Kind: "Widget", Namespace: "shop", Name: "gadget"},
+	},
+	{
+		Content: []byte("apiVersion: v1\nkind: Namespace\nmetadata:\n  name: shop\n"),
+		Info:    types.ResourceInfo{APIVersion: "v1", Kind: "Namespace", Name: "shop"},
+	},
+	{
+		Content: []byte("apiVersion: apiextensions.k8s.io/v1\nkind: CustomResourceDefinition\nmetadata:\n  name: widgets.example.com\nspec:\n  group: example.com\n"),
+		Info:    types.ResourceInfo{APIVersion: "apiextensions.k8s.io/v1", Kind: "CustomResourceDefinition", Name: "widgets.example.com"},
+	},
+}
+
+func saveTestBackup(t *testing.T, dir string, resources []types.ResourceWithContent) string {
+	t.Helper()
+
+	metadata := &types.BackupMetadata{
+		Name:      "test-backup",
+		Timestamp: time.Now(),
+		Version:   types.BackupFormatVersion,
+	}
+	if err := storage.NewLocalStorage(dir).SaveBackup(context.Background(), metadata, resources); err != nil {
+		t.Fatalf("Failed to save backup: %v", err)
+	}
+	return metadata.BackupPath
+}
+
+func TestRestoreAppliesCRDsBeforeCustomResources(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "k8s-backup-test-*")
+	if err != nil {
+		t.Fatalf("Failed to create temp directory: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	backupPath := saveTestBackup(t, tempDir, crdTestResources)
+	recorder := &eventRecorder{}
+	manager := NewManager(newTestClient(recorder, newTestCRD(true)), storage.NewLocalStorage(tempDir))
+
+	result, err := manager.RestoreBackup(context.Background(), &types.RestoreOptions{
+		BackupPath:        backupPath,
+		Timeout:           5 * time.Second,
+		OverwriteExisting: true,
+	}, nil)
+	if err != nil {
+		t.Fatalf("RestoreBackup failed: %v", err)
+	}
+
+	if len(result.Errors) != 0 {
+		t.Fatalf("Expected no errors, got %v", result.Errors)
+	}
+	if result.ProcessedResources != 3 {
+		t.Errorf("Expected 3 processed resources, got %d", result.ProcessedResources)
+	}
+
+	applyCRD := recorder.indexOf("apply customresourcedefinitions/widgets.example.com")
+	waitCRD := recorder.indexOf("wait customresourcedefinitions")
+	applyWidget := recorder.indexOf("apply widgets/gadget")
+	if applyCRD < 0 || waitCRD < 0 || applyWidget < 0 {
+		t.Fatalf("Missing expected API calls, got %v", recorder.events)
+	}
+	if !(applyCRD < waitCRD && waitCRD < applyWidget) {
+		t.Errorf("Expected CRD apply, then establishment wait, then custom resource apply; got %v", recorder.events)
+	}
+}
+
+func TestRestoreReportsUnestablishedCRDs(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "k8s-backup-test-*")
+	if err != nil {
+		t.Fatalf("Failed to create temp directory: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	backupPath := saveTestBackup(t, tempDir, crdTestResources)
+	manager := NewManager(newTestClient(&eventRecorder{}, newTestCRD(false)), storage.NewLocalStorage(tempDir))
+
+	result, err := manager.RestoreBackup(context.Background(), &types.RestoreOptions{
+		BackupPath:        backupPath,
+		Timeout:           10 * time.Millisecond,
+		OverwriteExisting: true,
+	}, nil)
+	if err != nil {
+		t.Fatalf("RestoreBackup failed: %v", err)
+	}
+
+	if len(result.Errors) != 1 {
+		t.Errorf("Expected 1 error for the unestablished CRD, got %v", result.Errors)
+	}
+}
+
+func TestRestoreWaitsForTrailingCRDs(t *testing.T) {
+	tempDir := t.TempDir()
+	backupPath := saveTestBackup(t, tempDir, crdTestResources)
+	manager := NewManager(newTestClient(&eventRecorder{}, newTestCRD(false)), storage.NewLocalStorage(tempDir))
+
+	// No resource is read after the CRD, which is still waited for
+	result, err := manager.RestoreBackup(context.Background(), &types.RestoreOptions{
+		BackupPath:        backupPath,
+		ResourceTypes:     []string{"customresourcedefinitions"},
+		Timeout:           10 * time.Millisecond,
+		OverwriteExisting: true,
+	}, nil)
+	if err != nil {
+		t.Fatalf("RestoreBackup failed: %v", err)
+	}
+	if result.ProcessedResources != 1 || len(result.Errors) != 1 {
+		t.Errorf("Expected the CRD to be applied and reported as not established, got %d processed and errors %v", result.ProcessedResources, result.Errors)
+	}
+}
+
+func TestRestoreFiltersBySelector(t *testing.T) {
+	tempDir := t.TempDir()
+	resources := []types.ResourceWithContent{
+		{
+			Content: []byte("apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: payments\n  namespace: shop\n"),
+			Info:    types.ResourceInfo{APIVersion: "v1", Kind: "ConfigMap", Namespace: "shop", Name: "payments", Labels: map[string]string{"app": "payments", "tier": "web"}},
+		},
+		{
+			Content: []byte("apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: cache\n  namespace: shop\n"),
+			Info:    types.ResourceInfo{APIVersion: "v1", Kind: "ConfigMap", Namespace: "shop", Name: "cache", Labels: map[string]string{"app": "payments", "tier": "cache"}},
+		},
+		{
+			Content: []byte("apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: unlabeled\n  namespace: shop\n"),
+			Info:    types.ResourceInfo{APIVersion: "v1", Kind: "ConfigMap", Namespace: "shop", Name: "unlabeled"},
+		},
+	}
+	backupPath := saveTestBackup(t, tempDir, resources)
+	manager := NewManager(nil, storage.NewLocalStorage(tempDir))
+
+	result, err := manager.RestoreBackup(context.Background(), &types.RestoreOptions{
+		BackupPath:    backupPath,
+		DryRun:        true,
+		LabelSelector: "app=payments,tier!=cache",
+	}, nil)
+	if err != nil {
+		t.Fatalf("RestoreBackup failed: %v", err)
+	}
+	if result.ProcessedResources != 1 || result.SkippedResources != 2 {
+		t.Errorf("Expected 1 processed and 2 skipped resources, got %d and %d", result.ProcessedResources, result.SkippedResources)
+	}
+
+	if _, err := manager.RestoreBackup(context.Background(), &types.RestoreOptions{BackupPath: backupPath, DryRun: true, LabelSelector: "app in (payments"}, nil); err == nil {
+		t.Error("Expected an invalid selector to fail the restore")
+	}
+}
+
+func TestRestoreDryRunShowsTransformedObjects(t *testing.T) {
+	tempDir := t.TempDir()
+	resources := []types.ResourceWithContent{
+		{
+			Content: []byte("apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: settings\n  namespace: prod\n  labels:\n    team: shop\n"),
+			Info:    types.ResourceInfo{APIVersion: "v1", Kind: "ConfigMap", Namespace: "prod", Name: "settings"},
+		},
+	}
+	backupPath := saveTestBackup(t, tempDir, resources)
+
+	pipeline, err := transform.ParseRules([]byte("transforms:\n- type: labels\n  match: {namespaces: [prod]}\n  add: {restored: \"true\"}\n  remove: [team]\n"))
+	if err != nil {
+		t.Fatalf("ParseRules failed: %v", err)
+	}
+	manager := NewManager(nil, storage.NewLocalStorage(tempDir))
+	manager.SetTransformer(pipeline)
+
+	var output bytes.Buffer
+	result, err := manager.RestoreBackup(context.Background(), &types.RestoreOptions{
+		BackupPath:       backupPath,
+		DryRun:           true,
+		NamespaceMapping: map[string]string{"prod": "prod-restore"},
+		DryRunOutput:     &output,
+	}, nil)
+	if err != nil {
+		t.Fatalf("RestoreBackup failed: %v", err)
+	}
+	if len(result.Errors) != 0 {
+		t.Fatalf("Expected no errors, got %v", result.Errors)
+	}
+
+	// Rules match the namespace the resource was backed up from
+	expected := "---\napiVersion: v1\nkind: ConfigMap\nmetadata:\n  labels:\n    restored: \"true\"\n  name: settings\n  namespace: prod-restore\n"
+	if output.String() != expected {
+		t.Errorf("Expected dry run output:\n%s\ngot:\n%s", expected, output.String())
+	}
+}
+
+func TestRestoreProvisionsClaimsFromSnapshots(t *testing.T) {
+	tempDir := t.TempDir()
+	resources := []types.ResourceWithContent{
+		{
+			Content: []byte("apiVersion: v1\nkind: PersistentVolume\nmetadata:\n  name: pv-data\nspec:\n  claimRef:\n    name: data\n    namespace: db\n"),
+			Info:    types.ResourceInfo{APIVersion: "v1", Kind: "PersistentVolume", Name: "pv-data"},
+		},
+		{
+			Content: []byte("apiVersion: v1\nkind: PersistentVolumeClaim\nmetadata:\n  name: data\n  namespace: db\nspec:\n  volumeName: pv-data\n"),
+			Info:    types.ResourceInfo{APIVersion: "v1", Kind: "PersistentVolumeClaim", Namespace: "db", Name: "data"},
+		},
+	}
+	metadata := &types.BackupMetadata{
+		Name:      "test-backup",
+		Timestamp: time.Now(),
+		Version:   types.BackupFormatVersion,
+		VolumeSnapshots: []types.VolumeSnapshotInfo{{
+			Namespace: "db", PersistentVolumeClaim: "data", VolumeSnapshot: "test-backup-data",
+			VolumeSnapshotClass: "ebs", Driver: "ebs.csi.aws.com", SnapshotHandle: "snap-0123",
+		}},
+	}
+	if err := storage.NewLocalStorage(tempDir).SaveBackup(context.Background(), metadata, resources); err != nil {
+		t.Fatalf("Failed to save backup: %v", err)
+	}
+	manager := NewManager(nil, storage.NewLocalStorage(tempDir))
+
+	var output bytes.Buffer
+	result, err := manager.RestoreBackup(context.Background(), &types.RestoreOptions{
+		BackupPath:       metadata.BackupPath,
+		DryRun:           true,
+		NamespaceMapping: map[string]string{"db": "db-restore"},
+		DryRunOutput:     &output,
+	}, nil)
+	if err != nil {
+		t.Fatalf("RestoreBackup failed: %v", err)
+	}
+	if result.RestoredVolumes != 1 || result.SkippedResources != 1 {
+		t.Errorf("Expected 1 restored volume and the PersistentVolume skipped, got %d and %d", result.RestoredVolumes, result.SkippedResources)
+	}
+	expected := "---\napiVersion: v1\nkind: PersistentVolumeClaim\nmetadata:\n  name: data\n  namespace: db-restore\nspec:\n" +
+		"  dataSource:\n    apiGroup: snapshot.storage.k8s.io\n    kind: VolumeSnapshot\n    name: test-backup-data\n"
+	if output.String() != expected {
+		t.Errorf("Expected dry run output:\n%s\ngot:\n%s", expected, output.String())
+	}
+
+	// Claims can still be restored as backed up
+	output.Reset()
+	result, err = manager.RestoreBackup(context.Background(), &types.RestoreOptions{
+		BackupPath:          metadata.BackupPath,
+		DryRun:              true,
+		SkipVolumeSnapshots: true,
+		DryRunOutput:        &output,
+	}, nil)
+	if err != nil {
+		t.Fatalf("RestoreBackup failed: %v", err)
+	}
+	if result.RestoredVolumes != 0 || result.ProcessedResources != 2 {
+		t.Errorf("Expected both resources to be restored as backed up, got %+v", result)
+	}
+}
+
+func TestRestoreSkipsSnapshotsOfExistingClaims(t *testing.T) {
+	tempDir := t.TempDir()
+	resources := []types.ResourceWithContent{
+		{
+			Content: []byte("apiVersion: v1\nkind: PersistentVolumeClaim\nmetadata:\n  name: data\n  namespace: db\nspec:\n  volumeName: pv-data\n"),
+			Info:    types.ResourceInfo{APIVersion: "v1", Kind: "PersistentVolumeClaim", Namespace: "db", Name: "data"},
+		},
+	}
+	metadata := &types.BackupMetadata{
+		Name:      "test-backup",
+		Timestamp: time.Now(),
+		Version:   types.BackupFormatVersion,
+		VolumeSnapshots: []types.VolumeSnapshotInfo{{
+			Namespace: "db", PersistentVolumeClaim: "data", VolumeSnapshot: "test-backup-data",
+			VolumeSnapshotClass: "ebs", Driver: "ebs.csi.aws.com", SnapshotHandle: "snap-0123",
+		}},
+	}
+	if err := storage.NewLocalStorage(tempDir).SaveBackup(context.Background(), metadata, resources); err != nil {
+		t.Fatalf("Failed to save backup: %v", err)
+	}
+	recorder := &eventRecorder{}
+	manager := NewManager(newTestClient(recorder, newTestObject("v1", "PersistentVolumeClaim", "db", "data")), storage.NewLocalStorage(tempDir))
+
+	// The existing claim is skipped, so nothing would use the snapshot
+	result, err := manager.RestoreBackup(context.Background(), &types.RestoreOptions{BackupPath: metadata.BackupPath, Timeout: 5 * time.Second}, nil)
+	if err != nil {
+		t.Fatalf("RestoreBackup failed: %v", err)
+	}
+	if len(result.Errors) != 0 {
+		t.Fatalf("Expected no errors, got %v", result.Errors)
+	}
+	if result.RestoredVolumes != 0 || result.SkippedResources != 1 {
+		t.Errorf("Expected no restored volumes and the claim skipped, got %d and %d", result.RestoredVolumes, result.SkippedResources)
+	}
+	if len(recorder.events) != 0 {
+		t.Errorf("Expected no objects to be created, got %v", recorder.events)
+	}
+}
@@ -0,0 +1,250 @@
+// Package retention decides which backups to keep under a retention policy
+// and deletes the rest from any storage backend.
+package retention
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/resource"
+
+	"k8s-backup/pkg/storage"
+	"k8s-backup/pkg/types"
+)
+
+// Policy describes which backups to keep. Keep rules select backups to keep;
+// when none are set, every backup is selected. MaxAge and MaxTotalSize then
+// remove selected backups, oldest first. The newest backup and every backup
+// an incremental backup being kept depends on are always kept.
+type Policy struct {
+	// KeepLast keeps the n most recent backups
+	KeepLast int
+	// KeepDaily, KeepWeekly and KeepMonthly keep the most recent backup of
+	// each of the last n days, ISO weeks and months that have backups
+	KeepDaily   int
+	KeepWeekly  int
+	KeepMonthly int
+	// MaxAge deletes backups older than this when non-zero
+	MaxAge time.Duration
+	// MaxTotalSize deletes the oldest backups once the total size exceeds
+	// this many bytes when non-zero
+	MaxTotalSize int64
+}
+
+// Empty reports whether the policy has no rules at all
+func (p Policy) Empty() bool {
+	return p == Policy{}
+}
+
+func (p Policy) hasKeepRules() bool {
+	return p.KeepLast > 0 || p.KeepDaily > 0 || p.KeepWeekly > 0 || p.KeepMonthly > 0
+}
+
+// Decision records whether a backup is kept and why
+type Decision struct {
+	Backup  *types.BackupMetadata
+	Keep    bool
+	Reasons []string
+}
+
+// Plan applies a policy to a set of backups, returning one decision per
+// backup, newest first
+func Plan(backups []*types.BackupMetadata, policy Policy, now time.Time) []*Decision {
+	decisions := make([]*Decision, len(backups))
+	for i, backup := range backups {
+		decisions[i] = &Decision{Backup: backup}
+	}
+	sort.SliceStable(decisions, func(i, j int) bool {
+		return decisions[i].Backup.Timestamp.After(decisions[j].Backup.Timestamp)
+	})
+
+	// Keep rules
+	if policy.hasKeepRules() {
+		for i, decision := range decisions {
+			if i < policy.KeepLast {
+				decision.keep(fmt.Sprintf("last %d", policy.KeepLast))
+			}
+		}
+		keepPeriods(decisions, policy.KeepDaily, "daily", func(t time.Time) string {
+			return t.Format("2006-01-02")
+		})
+		keepPeriods(decisions, policy.KeepWeekly, "weekly", func(t time.Time) string {
+			year, week := t.ISOWeek()
+			return fmt.Sprintf("%d-W%02d", year, week)
+		})
+		keepPeriods(decisions, policy.KeepMonthly, "monthly", func(t time.Time) string {
+			return t.Format("2006-01")
+		})
+		for _, decision := range decisions {
+			if !decision.Keep {
+				decision.Reasons = append(decision.Reasons, "not selected by any keep rule")
+			}
+		}
+	} else {
+		for _, decision := range decisions {
+			decision.keep("within limits")
+		}
+	}
+
+	// Limits
+	if policy.MaxAge > 0 {
+		for _, decision := range decisions {
+			if decision.Keep && now.Sub(decision.Backup.Timestamp) > policy.MaxAge {
+				decision.drop(fmt.Sprintf("older than %s", policy.MaxAge))
+			}
+		}
+	}
+	if policy.MaxTotalSize > 0 {
+		total := int64(0)
+		for _, decision := range decisions {
+			if !decision.Keep {
+				continue
+			}
+			total += decision.Backup.Size
+			if total > policy.MaxTotalSize {
+				decision.drop(fmt.Sprintf("total size exceeds %s", resource.NewQuantity(policy.MaxTotalSize, resource.BinarySI)))
+			}
+		}
+	}
+
+	// Safety nets
+	if len(decisions) > 0 && !decisions[0].Keep {
+		decisions[0].keep("newest backup")
+	}
+	byName := make(map[string]*Decision, len(decisions))
+	for _, decision := range decisions {
+		byName[decision.Backup.Name] = decision
+	}
+	for _, decision := range decisions {
+		if !decision.Keep {
+			continue
+		}
+		for _, ancestor := range decision.Backup.Chain {
+			if parent, ok := byName[ancestor]; ok && !parent.Keep {
+				parent.keep(fmt.Sprintf("required by incremental backup %s", decision.Backup.Name))
+			}
+		}
+	}
+
+	return decisions
+}
+
+// keepPeriods keeps the newest backup in each of the n most recent periods
+func keepPeriods(decisions []*Decision, n int, rule string, period func(time.Time) string) {
+	seen := make(map[string]bool)
+	for _, decision := range decisions {
+		if len(seen) >= n {
+			return
+		}
+		key := period(decision.Backup.Timestamp)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		decision.keep(fmt.Sprintf("%s %s", rule, key))
+	}
+}
+
+func (d *Decision) keep(reason string) {
+	if !d.Keep {
+		d.Keep = true
+		d.Reasons = nil
+	}
+	d.Reasons = append(d.Reasons, reason)
+}
+
+func (d *Decision) drop(reason string) {
+	d.Keep = false
+	d.Reasons = []string{reason}
+}
+
+// Prune applies a policy to every backup in the storage and deletes those not
+// kept, newest first. Deletion stops short of any backup a backup that failed
+// to delete depends on. With dryRun, nothing is deleted.
+func Prune(s storage.Storage, policy Policy, now time.Time, dryRun bool) ([]*Decision, error) {
+	backups, err := s.ListBackups()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list backups: %w", err)
+	}
+	return prune(s, Plan(backups, policy, now), dryRun)
+}
+
+// PruneSchedule is like Prune, but only deletes the backups taken by the
+// named schedule, so schedules sharing a storage location each apply their
+// own policy. Backups of the schedule that any other backup is incremental
+// to are kept, since the other backup is never deleted.
+func PruneSchedule(s storage.Storage, schedule string, policy Policy, now time.Time, dryRun bool) ([]*Decision, error) {
+	backups, err := s.ListBackups()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list backups: %w", err)
+	}
+	var scheduled, others []*types.BackupMetadata
+	for _, backup := range backups {
+		if backup.Schedule == schedule {
+			scheduled = append(scheduled, backup)
+		} else {
+			others = append(others, backup)
+		}
+	}
+
+	decisions := Plan(scheduled, policy, now)
+	byName := make(map[string]*Decision, len(decisions))
+	for _, decision := range decisions {
+		byName[decision.Backup.Name] = decision
+	}
+	for _, other := range others {
+		for _, ancestor := range other.Chain {
+			if parent, ok := byName[ancestor]; ok && !parent.Keep {
+				parent.keep(fmt.Sprintf("required by incremental backup %s", other.Name))
+			}
+		}
+	}
+	return prune(s, decisions, dryRun)
+}
+
+// prune deletes the backups not kept, newest first
+func prune(s storage.Storage, decisions []*Decision, dryRun bool) ([]*Decision, error) {
+	if dryRun {
+		return decisions, nil
+	}
+
+	var errs []error
+	required := make(map[string]string)
+	for _, decision := range decisions {
+		if decision.Keep {
+			continue
+		}
+		name := decision.Backup.Name
+		if child, ok := required[name]; ok {
+			errs = append(errs, fmt.Errorf("not deleting %s: backup %s depends on it and could not be deleted", name, child))
+			continue
+		}
+		if err := s.DeleteBackup(decision.Backup.BackupPath); err != nil {
+			errs = append(errs, fmt.Errorf("failed to delete %s: %w", name, err))
+			for _, ancestor := range decision.Backup.Chain {
+				required[ancestor] = name
+			}
+		}
+	}
+
+	if len(errs) > 0 {
+		return decisions, fmt.Errorf("failed to prune backups: %w", errors.Join(errs...))
+	}
+	return decisions, nil
+}
+
+// ParseAge parses a Go duration, also accepting a whole number of days ("30d")
+func ParseAge(value string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(value, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("invalid number of days %q", value)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(value)
+}
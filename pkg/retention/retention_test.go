@@ -0,0 +1,206 @@
+package retention
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"k8s-backup/pkg/storage"
+	"k8s-backup/pkg/types"
+)
+
+var now = time.Date(2025, 9, 30, 12, 0, 0, 0, time.UTC)
+
+func backupAt(name string, age time.Duration, size int64, chain ...string) *types.BackupMetadata {
+	metadata := &types.BackupMetadata{Name: name, Timestamp: now.Add(-age), Size: size, Chain: chain}
+	if len(chain) > 0 {
+		metadata.Parent = chain[len(chain)-1]
+	}
+	return metadata
+}
+
+func keptNames(decisions []*Decision) []string {
+	var names []string
+	for _, decision := range decisions {
+		if decision.Keep {
+			names = append(names, decision.Backup.Name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestPlan(t *testing.T) {
+	day := 24 * time.Hour
+	backups := []*types.BackupMetadata{
+		backupAt("today-late", 1*time.Hour, 10),
+		backupAt("today-early", 6*time.Hour, 10),
+		backupAt("yesterday", 1*day, 10),
+		backupAt("last-week", 8*day, 10),
+		backupAt("last-month", 35*day, 10),
+		backupAt("last-year", 400*day, 10),
+	}
+
+	tests := []struct {
+		name   string
+		policy Policy
+		kept   []string
+	}{
+		{"no rules", Policy{}, []string{"last-month", "last-week", "last-year", "today-early", "today-late", "yesterday"}},
+		{"keep last", Policy{KeepLast: 2}, []string{"today-early", "today-late"}},
+		{"keep daily", Policy{KeepDaily: 2}, []string{"today-late", "yesterday"}},
+		{"keep weekly", Policy{KeepWeekly: 2}, []string{"last-week", "today-late"}},
+		{"keep monthly", Policy{KeepMonthly: 3}, []string{"last-month", "last-year", "today-late"}},
+		{"combined", Policy{KeepLast: 1, KeepMonthly: 2}, []string{"last-month", "today-late"}},
+		{"max age", Policy{MaxAge: 7 * day}, []string{"today-early", "today-late", "yesterday"}},
+		{"max age keeps newest", Policy{MaxAge: time.Minute}, []string{"today-late"}},
+		{"max total size", Policy{MaxTotalSize: 35}, []string{"today-early", "today-late", "yesterday"}},
+	}
+
+	for _, test := range tests {
+		decisions := Plan(backups, test.policy, now)
+		if got := keptNames(decisions); !reflect.DeepEqual(got, test.kept) {
+			t.Errorf("%s: expected to keep %v, got %v", test.name, test.kept, got)
+		}
+		for _, decision := range decisions {
+			if len(decision.Reasons) == 0 {
+				t.Errorf("%s: no reason given for %s", test.name, decision.Backup.Name)
+			}
+		}
+	}
+}
+
+func TestPlanKeepsIncrementalParents(t *testing.T) {
+	backups := []*types.BackupMetadata{
+		backupAt("full", 72*time.Hour, 10),
+		backupAt("incr-1", 48*time.Hour, 10, "full"),
+		backupAt("incr-2", 24*time.Hour, 10, "full", "incr-1"),
+		backupAt("other", 100*time.Hour, 10),
+	}
+
+	decisions := Plan(backups, Policy{KeepLast: 1}, now)
+	if got := keptNames(decisions); !reflect.DeepEqual(got, []string{"full", "incr-1", "incr-2"}) {
+		t.Errorf("Expected the chain of the kept backup to be kept, got %v", got)
+	}
+	for _, decision := range decisions {
+		if decision.Backup.Name == "full" && decision.Reasons[0] != "required by incremental backup incr-2" {
+			t.Errorf("Unexpected reason for keeping full: %v", decision.Reasons)
+		}
+	}
+}
+
+func TestPrune(t *testing.T) {
+	dir := t.TempDir()
+	backend := storage.NewLocalStorage(dir)
+	for i, name := range []string{"oldest", "middle", "newest"} {
+		metadata := &types.BackupMetadata{Name: name, Timestamp: now.Add(time.Duration(i) * time.Hour)}
+		if err := backend.SaveBackup(context.Background(), metadata, nil); err != nil {
+			t.Fatalf("SaveBackup failed: %v", err)
+		}
+	}
+
+	if _, err := Prune(backend, Policy{KeepLast: 1}, now, true); err != nil {
+		t.Fatalf("Dry run failed: %v", err)
+	}
+	if backups, _ := backend.ListBackups(); len(backups) != 3 {
+		t.Fatalf("Expected dry run to delete nothing, %d backups left", len(backups))
+	}
+
+	if _, err := Prune(backend, Policy{KeepLast: 1}, now, false); err != nil {
+		t.Fatalf("Prune failed: %v", err)
+	}
+	backups, _ := backend.ListBackups()
+	if len(backups) != 1 || backups[0].Name != "newest" {
+		t.Errorf("Expected only the newest backup to remain, got %v", backups)
+	}
+}
+
+func TestPruneSchedule(t *testing.T) {
+	dir := t.TempDir()
+	backend := storage.NewLocalStorage(dir)
+	for i, backup := range []struct{ name, schedule string }{
+		{"nightly-1", "nightly"},
+		{"manual", ""},
+		{"hourly-1", "hourly"},
+		{"nightly-2", "nightly"},
+	} {
+		metadata := &types.BackupMetadata{Name: backup.name, Schedule: backup.schedule, Timestamp: now.Add(time.Duration(i) * time.Hour)}
+		if err := backend.SaveBackup(context.Background(), metadata, nil); err != nil {
+			t.Fatalf("SaveBackup failed: %v", err)
+		}
+	}
+
+	decisions, err := PruneSchedule(backend, "nightly", Policy{KeepLast: 1}, now, false)
+	if err != nil {
+		t.Fatalf("PruneSchedule failed: %v", err)
+	}
+	if len(decisions) != 2 {
+		t.Errorf("Expected decisions for the schedule's backups only, got %d", len(decisions))
+	}
+
+	backups, _ := backend.ListBackups()
+	var names []string
+	for _, backup := range backups {
+		names = append(names, backup.Name)
+	}
+	sort.Strings(names)
+	if expected := []string{"hourly-1", "manual", "nightly-2"}; !reflect.DeepEqual(names, expected) {
+		t.Errorf("Expected %v to remain, got %v", expected, names)
+	}
+}
+
+func TestPruneScheduleKeepsParentsOfOtherBackups(t *testing.T) {
+	dir := t.TempDir()
+	backend := storage.NewLocalStorage(dir)
+	for i, backup := range []struct {
+		name, schedule string
+		chain          []string
+	}{
+		{"nightly-1", "nightly", nil},
+		{"nightly-2", "nightly", []string{"nightly-1"}},
+		// Taken by hand on top of the schedule's chain
+		{"manual", "", []string{"nightly-1", "nightly-2"}},
+		{"nightly-3", "nightly", nil},
+		{"nightly-4", "nightly", nil},
+	} {
+		metadata := &types.BackupMetadata{Name: backup.name, Schedule: backup.schedule, Chain: backup.chain, Timestamp: now.Add(time.Duration(i) * time.Hour)}
+		if err := backend.SaveBackup(context.Background(), metadata, nil); err != nil {
+			t.Fatalf("SaveBackup failed: %v", err)
+		}
+	}
+
+	decisions, err := PruneSchedule(backend, "nightly", Policy{KeepLast: 1}, now, false)
+	if err != nil {
+		t.Fatalf("PruneSchedule failed: %v", err)
+	}
+	for _, decision := range decisions {
+		if decision.Backup.Name == "nightly-1" && (!decision.Keep || decision.Reasons[0] != "required by incremental backup manual") {
+			t.Errorf("Expected nightly-1 to be kept for manual, got %+v", decision)
+		}
+	}
+
+	backups, _ := backend.ListBackups()
+	var names []string
+	for _, backup := range backups {
+		names = append(names, backup.Name)
+	}
+	sort.Strings(names)
+	if expected := []string{"manual", "nightly-1", "nightly-2", "nightly-4"}; !reflect.DeepEqual(names, expected) {
+		t.Errorf("Expected %v to remain, got %v", expected, names)
+	}
+}
+
+func TestParseAge(t *testing.T) {
+	for value, expected := range map[string]time.Duration{"30d": 30 * 24 * time.Hour, "36h": 36 * time.Hour, "0d": 0} {
+		if age, err := ParseAge(value); err != nil || age != expected {
+			t.Errorf("%s: expected %s, got %s, %v", value, expected, age, err)
+		}
+	}
+	for _, value := range []string{"d", "-1d", "1.5d", "soon"} {
+		if _, err := ParseAge(value); err == nil {
+			t.Errorf("Expected %q to be rejected", value)
+		}
+	}
+}
@@ -0,0 +1,278 @@
+package schedule
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"sigs.k8s.io/yaml"
+
+	"k8s-backup/pkg/hooks"
+	"k8s-backup/pkg/retention"
+	"k8s-backup/pkg/types"
+)
+
+// Defaults shared with the backup command's flags
+var (
+	defaultExcludeNamespaces = []string{"kube-system", "kube-public", "kube-node-lease"}
+	defaultConcurrency       = 4
+	defaultSnapshotTimeout   = 10 * time.Minute
+	defaultVolumeDataTimeout = 5 * time.Minute
+)
+
+// File is the format of a schedule file
+type File struct {
+	Schedules []*Schedule `json:"schedules"`
+}
+
+// Schedule takes backups on a cron schedule
+type Schedule struct {
+	Name string `json:"name"`
+	// Schedule is a cron expression, evaluated in TimeZone (default UTC)
+	Schedule string `json:"schedule"`
+	TimeZone string `json:"timeZone,omitempty"`
+	// Jitter delays each run by a random duration up to this long, so
+	// schedules firing at the same time do not all start at once
+	Jitter metav1.Duration `json:"jitter,omitempty"`
+	// StartingDeadline is how late a run missed while the daemon was down
+	// may still be caught up; zero catches up any missed run
+	StartingDeadline metav1.Duration `json:"startingDeadline,omitempty"`
+	// Storage is the storage location backups are written to; the schedule
+	// command's default is used when empty
+	Storage   string    `json:"storage,omitempty"`
+	Backup    Backup    `json:"backup,omitempty"`
+	Retention Retention `json:"retention,omitempty"`
+
+	cron     *Cron
+	location *time.Location
+	policy   retention.Policy
+}
+
+// Backup holds the backup options of a schedule, with the names and
+// defaults of the backup command's flags
+type Backup struct {
+	Namespaces           []string        `json:"namespaces,omitempty"`
+	ExcludeNamespaces    []string        `json:"excludeNamespaces,omitempty"`
+	ResourceTypes        []string        `json:"resourceTypes,omitempty"`
+	ExcludeResourceTypes []string        `json:"excludeResourceTypes,omitempty"`
+	Selector             string          `json:"selector,omitempty"`
+	FieldSelector        string          `json:"fieldSelector,omitempty"`
+	NamespaceSelector    string          `json:"namespaceSelector,omitempty"`
+	Compress             *bool           `json:"compress,omitempty"`
+	Concurrency          int             `json:"concurrency,omitempty"`
+	SnapshotVolumes      bool            `json:"snapshotVolumes,omitempty"`
+	SnapshotTimeout      metav1.Duration `json:"snapshotTimeout,omitempty"`
+	VolumeData           []string        `json:"volumeData,omitempty"`
+	DataMoverImage       string          `json:"dataMoverImage,omitempty"`
+	VolumeDataTimeout    metav1.Duration `json:"volumeDataTimeout,omitempty"`
+	// HooksFile is a hooks file to read hook rules from; Hooks declares
+	// them inline instead, in the format of a hooks file's hooks
+	HooksFile string       `json:"hooksFile,omitempty"`
+	Hooks     []hooks.Rule `json:"hooks,omitempty"`
+	SkipHooks bool         `json:"skipHooks,omitempty"`
+}
+
+// Retention is the retention policy applied to a schedule's backups after
+// each successful run
+type Retention struct {
+	KeepLast    int `json:"keepLast,omitempty"`
+	KeepDaily   int `json:"keepDaily,omitempty"`
+	KeepWeekly  int `json:"keepWeekly,omitempty"`
+	KeepMonthly int `json:"keepMonthly,omitempty"`
+	// MaxAge is a duration such as 720h or 30d
+	MaxAge string `json:"maxAge,omitempty"`
+	// MaxTotalSize is a quantity such as 50Gi
+	MaxTotalSize string `json:"maxTotalSize,omitempty"`
+}
+
+// LoadFile reads the schedules of a YAML schedule file
+func LoadFile(path string) ([]*Schedule, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read schedule file: %w", err)
+	}
+	schedules, err := ParseFile(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid schedule file %s: %w", path, err)
+	}
+	return schedules, nil
+}
+
+// ParseFile parses and validates the schedules of a schedule file
+func ParseFile(data []byte) ([]*Schedule, error) {
+	var file File
+	if err := yaml.UnmarshalStrict(data, &file); err != nil {
+		return nil, err
+	}
+	if len(file.Schedules) == 0 {
+		return nil, fmt.Errorf("no schedules defined")
+	}
+
+	names := sets.NewString()
+	for i, schedule := range file.Schedules {
+		if schedule == nil {
+			return nil, fmt.Errorf("schedule %d is empty", i+1)
+		}
+		// Backup names are prefixed with the schedule name
+		if errs := validation.IsDNS1123Label(schedule.Name); len(errs) > 0 {
+			return nil, fmt.Errorf("schedule %d: invalid name %q: %s", i+1, schedule.Name, errs[0])
+		}
+		if names.Has(schedule.Name) {
+			return nil, fmt.Errorf("schedule %d: duplicate name %q", i+1, schedule.Name)
+		}
+		names.Insert(schedule.Name)
+
+		if err := schedule.Complete(); err != nil {
+			return nil, fmt.Errorf("schedule %s: %w", schedule.Name, err)
+		}
+	}
+	return file.Schedules, nil
+}
+
+// Complete validates a schedule and parses its expression, time zone and
+// retention policy. Schedules not read by ParseFile must be completed before
+// they are used.
+func (s *Schedule) Complete() error {
+	var err error
+	if s.cron, err = ParseCron(s.Schedule); err != nil {
+		return err
+	}
+	if s.location, err = time.LoadLocation(s.TimeZone); err != nil {
+		return fmt.Errorf("invalid time zone: %w", err)
+	}
+	if s.Jitter.Duration < 0 || s.StartingDeadline.Duration < 0 {
+		return fmt.Errorf("jitter and startingDeadline must not be negative")
+	}
+	if s.policy, err = s.Retention.policy(); err != nil {
+		return err
+	}
+	if len(s.Backup.Hooks) > 0 {
+		if _, err := s.Backup.HookConfig(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Next returns the first scheduled time after t
+func (s *Schedule) Next(t time.Time) time.Time {
+	return s.cron.Next(t.In(s.location))
+}
+
+// Policy returns the schedule's retention policy
+func (s *Schedule) Policy() retention.Policy {
+	return s.policy
+}
+
+// BackupName names the backup of a scheduled time, e.g.
+// nightly-20250912-020000
+func (s *Schedule) BackupName(scheduled time.Time) string {
+	return s.Name + "-" + scheduled.UTC().Format("20060102-150405")
+}
+
+// LatestMissed returns the latest scheduled time after last that is not
+// after now, and how many earlier scheduled times it supersedes. It returns
+// the zero time when no scheduled time has passed since last.
+func (s *Schedule) LatestMissed(last, now time.Time) (time.Time, int) {
+	missed := s.Next(last)
+	if missed.IsZero() || missed.After(now) {
+		return time.Time{}, 0
+	}
+	skipped := 0
+	for next := s.Next(missed); !next.IsZero() && !next.After(now); next = s.Next(next) {
+		missed = next
+		skipped++
+	}
+	return missed, skipped
+}
+
+// Options returns the backup options of a run
+func (s *Schedule) Options(backupName string) *types.BackupOptions {
+	options := s.Backup.Options(backupName)
+	options.Schedule = s.Name
+	return options
+}
+
+// Options returns the backup options these settings select, with the
+// backup command's defaults for those left unset
+func (b Backup) Options(backupName string) *types.BackupOptions {
+	options := &types.BackupOptions{
+		Namespaces:           b.Namespaces,
+		ExcludeNamespaces:    b.ExcludeNamespaces,
+		ResourceTypes:        b.ResourceTypes,
+		ExcludeResourceTypes: b.ExcludeResourceTypes,
+		BackupName:           backupName,
+		Compress:             b.Compress == nil || *b.Compress,
+		Concurrency:          b.Concurrency,
+		LabelSelector:        b.Selector,
+		FieldSelector:        b.FieldSelector,
+		NamespaceSelector:    b.NamespaceSelector,
+		SnapshotVolumes:      b.SnapshotVolumes,
+		SnapshotTimeout:      b.SnapshotTimeout.Duration,
+		VolumeData:           b.VolumeData,
+		DataMoverImage:       b.DataMoverImage,
+		VolumeDataTimeout:    b.VolumeDataTimeout.Duration,
+		SkipHooks:            b.SkipHooks,
+	}
+	if options.ExcludeNamespaces == nil {
+		options.ExcludeNamespaces = defaultExcludeNamespaces
+	}
+	if options.Concurrency == 0 {
+		options.Concurrency = defaultConcurrency
+	}
+	if options.SnapshotTimeout == 0 {
+		options.SnapshotTimeout = defaultSnapshotTimeout
+	}
+	if options.VolumeDataTimeout == 0 {
+		options.VolumeDataTimeout = defaultVolumeDataTimeout
+	}
+	return options
+}
+
+// HookConfig returns the hook rules of a backup, from its hooks file or
+// declared inline. It returns nil when hooks are skipped or none are set.
+func (b Backup) HookConfig() (*hooks.Config, error) {
+	switch {
+	case b.SkipHooks:
+		return nil, nil
+	case b.HooksFile != "" && len(b.Hooks) > 0:
+		return nil, fmt.Errorf("hooksFile and hooks are mutually exclusive")
+	case b.HooksFile != "":
+		return hooks.LoadConfig(b.HooksFile)
+	case len(b.Hooks) > 0:
+		config, err := hooks.NewConfig(b.Hooks)
+		if err != nil {
+			return nil, fmt.Errorf("invalid hooks: %w", err)
+		}
+		return config, nil
+	}
+	return nil, nil
+}
+
+func (r Retention) policy() (retention.Policy, error) {
+	policy := retention.Policy{
+		KeepLast:    r.KeepLast,
+		KeepDaily:   r.KeepDaily,
+		KeepWeekly:  r.KeepWeekly,
+		KeepMonthly: r.KeepMonthly,
+	}
+	if r.MaxAge != "" {
+		age, err := retention.ParseAge(r.MaxAge)
+		if err != nil {
+			return policy, fmt.Errorf("invalid retention maxAge: %w", err)
+		}
+		policy.MaxAge = age
+	}
+	if r.MaxTotalSize != "" {
+		size, err := resource.ParseQuantity(r.MaxTotalSize)
+		if err != nil {
+			return policy, fmt.Errorf("invalid retention maxTotalSize: %w", err)
+		}
+		policy.MaxTotalSize = size.Value()
+	}
+	return policy, nil
+}
@@ -0,0 +1,236 @@
+package schedule
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Cron is a parsed five-field cron expression: minute, hour, day of month,
+// month and day of week
+type Cron struct {
+	minute, hour, dayOfMonth, month, dayOfWeek uint64
+	// When both day fields are restricted, a day matching either matches
+	dayOfMonthAny, dayOfWeekAny bool
+}
+
+// cronField describes the values of a field of a cron expression
+type cronField struct {
+	name     string
+	min, max int
+	names    map[string]int
+}
+
+var (
+	minuteField     = cronField{name: "minute", min: 0, max: 59}
+	hourField       = cronField{name: "hour", min: 0, max: 23}
+	dayOfMonthField = cronField{name: "day of month", min: 1, max: 31}
+	monthField      = cronField{name: "month", min: 1, max: 12, names: map[string]int{
+		"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6,
+		"jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12,
+	}}
+	// Sunday is both 0 and 7
+	dayOfWeekField = cronField{name: "day of week", min: 0, max: 7, names: map[string]int{
+		"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6,
+	}}
+)
+
+// cronMacros are the named schedules accepted in place of an expression
+var cronMacros = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// ParseCron parses a standard five-field cron expression, such as
+// "30 2 * * 1-5", or one of @yearly, @monthly, @weekly, @daily and @hourly.
+// Fields take lists, ranges, steps and, for months and days of the week,
+// three-letter names.
+func ParseCron(expr string) (*Cron, error) {
+	expr = strings.TrimSpace(expr)
+	if macro, ok := cronMacros[strings.ToLower(expr)]; ok {
+		expr = macro
+	}
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("invalid cron expression %q: expected 5 fields, got %d", expr, len(fields))
+	}
+
+	var cron Cron
+	var err error
+	for i, target := range []struct {
+		bits  *uint64
+		field cronField
+	}{
+		{&cron.minute, minuteField},
+		{&cron.hour, hourField},
+		{&cron.dayOfMonth, dayOfMonthField},
+		{&cron.month, monthField},
+		{&cron.dayOfWeek, dayOfWeekField},
+	} {
+		if *target.bits, err = target.field.parse(fields[i]); err != nil {
+			return nil, fmt.Errorf("invalid cron expression %q: %w", expr, err)
+		}
+	}
+	if cron.dayOfWeek&(1<<7) != 0 {
+		cron.dayOfWeek |= 1
+	}
+	cron.dayOfMonthAny = fields[2] == "*" || fields[2] == "?"
+	cron.dayOfWeekAny = fields[4] == "*" || fields[4] == "?"
+	return &cron, nil
+}
+
+// parse parses a field into a bit set of its values
+func (f cronField) parse(field string) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		rangeExpr, stepExpr, hasStep := strings.Cut(part, "/")
+
+		var low, high int
+		var err error
+		switch {
+		case rangeExpr == "*" || rangeExpr == "?":
+			low, high = f.min, f.max
+		case strings.Contains(rangeExpr, "-"):
+			lowExpr, highExpr, _ := strings.Cut(rangeExpr, "-")
+			if low, err = f.value(lowExpr); err != nil {
+				return 0, err
+			}
+			if high, err = f.value(highExpr); err != nil {
+				return 0, err
+			}
+		default:
+			if low, err = f.value(rangeExpr); err != nil {
+				return 0, err
+			}
+			// "5/15" starts at 5 and runs to the end of the range
+			high = low
+			if hasStep {
+				high = f.max
+			}
+		}
+		if low > high {
+			return 0, fmt.Errorf("invalid %s range %q", f.name, rangeExpr)
+		}
+
+		step := 1
+		if hasStep {
+			if step, err = strconv.Atoi(stepExpr); err != nil || step <= 0 {
+				return 0, fmt.Errorf("invalid %s step %q", f.name, stepExpr)
+			}
+		}
+		for value := low; value <= high; value += step {
+			bits |= 1 << value
+		}
+	}
+	return bits, nil
+}
+
+// value parses a single value of a field
+func (f cronField) value(expr string) (int, error) {
+	if value, ok := f.names[strings.ToLower(expr)]; ok {
+		return value, nil
+	}
+	value, err := strconv.Atoi(expr)
+	if err != nil || value < f.min || value > f.max {
+		return 0, fmt.Errorf("invalid %s %q: expected %d-%d", f.name, expr, f.min, f.max)
+	}
+	return value, nil
+}
+
+// Next returns the first time after t that matches the expression, in t's
+// location. It returns the zero time if nothing matches within five years,
+// e.g. for February 30th. Times that do not exist when daylight saving time
+// starts are skipped, and times that happen twice when it ends match once.
+func (c *Cron) Next(t time.Time) time.Time {
+	next := c.next(t)
+	if !next.IsZero() && wallClock(next) == wallClock(t.Truncate(time.Minute)) {
+		next = c.next(next)
+	}
+	return next
+}
+
+// wallClock formats the local date and time of t to the minute
+func wallClock(t time.Time) string {
+	return t.Format("2006-01-02 15:04")
+}
+
+func (c *Cron) next(t time.Time) time.Time {
+	loc := t.Location()
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	yearLimit := t.Year() + 5
+
+	// Each field is advanced in turn, resetting the smaller fields the first
+	// time it moves; when a field wraps around, the larger fields are
+	// checked again
+	reset := false
+wrap:
+	for t.Year() <= yearLimit {
+		for c.month&(1<<uint(t.Month())) == 0 {
+			if !reset {
+				reset = true
+				t = time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, loc)
+			}
+			t = t.AddDate(0, 1, 0)
+			if t.Month() == time.January {
+				continue wrap
+			}
+		}
+
+		for !c.dayMatches(t) {
+			if !reset {
+				reset = true
+				t = time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, loc)
+			}
+			t = t.AddDate(0, 0, 1)
+			// Midnight may not exist on days daylight saving time starts
+			if t.Hour() != 0 {
+				if t.Hour() > 12 {
+					t = t.Add(time.Duration(24-t.Hour()) * time.Hour)
+				} else {
+					t = t.Add(-time.Duration(t.Hour()) * time.Hour)
+				}
+			}
+			if t.Day() == 1 {
+				continue wrap
+			}
+		}
+
+		for c.hour&(1<<uint(t.Hour())) == 0 {
+			if !reset {
+				reset = true
+				t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), 0, 0, 0, loc)
+			}
+			t = t.Add(time.Hour)
+			if t.Hour() == 0 {
+				continue wrap
+			}
+		}
+
+		for c.minute&(1<<uint(t.Minute())) == 0 {
+			reset = true
+			t = t.Add(time.Minute)
+			if t.Minute() == 0 {
+				continue wrap
+			}
+		}
+		return t
+	}
+	return time.Time{}
+}
+
+// dayMatches applies the day of month and day of week fields. As in cron,
+// when both are restricted a day matching either of them matches.
+func (c *Cron) dayMatches(t time.Time) bool {
+	dayOfMonth := c.dayOfMonth&(1<<uint(t.Day())) != 0
+	dayOfWeek := c.dayOfWeek&(1<<uint(t.Weekday())) != 0
+	if c.dayOfMonthAny || c.dayOfWeekAny {
+		return dayOfMonth && dayOfWeek
+	}
+	return dayOfMonth || dayOfWeek
+}
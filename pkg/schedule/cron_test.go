@@ -0,0 +1,92 @@
+package schedule
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCronNext(t *testing.T) {
+	base := time.Date(2025, 9, 12, 15, 4, 30, 0, time.UTC) // a Friday
+
+	tests := []struct {
+		expr     string
+		from     time.Time
+		expected time.Time
+	}{
+		{"* * * * *", base, time.Date(2025, 9, 12, 15, 5, 0, 0, time.UTC)},
+		{"30 2 * * *", base, time.Date(2025, 9, 13, 2, 30, 0, 0, time.UTC)},
+		{"*/15 * * * *", base, time.Date(2025, 9, 12, 15, 15, 0, 0, time.UTC)},
+		{"5/20 * * * *", base, time.Date(2025, 9, 12, 15, 5, 0, 0, time.UTC)},
+		{"0 9-17/4 * * *", base, time.Date(2025, 9, 12, 17, 0, 0, 0, time.UTC)},
+		{"0 0 * * mon-wed", base, time.Date(2025, 9, 15, 0, 0, 0, 0, time.UTC)},
+		{"0 0 * * 7", base, time.Date(2025, 9, 14, 0, 0, 0, 0, time.UTC)},
+		{"0 0 1,15 * *", base, time.Date(2025, 9, 15, 0, 0, 0, 0, time.UTC)},
+		{"0 0 1 jan *", base, time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 0 31 * *", base, time.Date(2025, 10, 31, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", base, time.Date(2028, 2, 29, 0, 0, 0, 0, time.UTC)},
+		// Either day field matches when both are restricted
+		{"0 0 20 * fri", base, time.Date(2025, 9, 19, 0, 0, 0, 0, time.UTC)},
+		{"@hourly", base, time.Date(2025, 9, 12, 16, 0, 0, 0, time.UTC)},
+		{"@weekly", base, time.Date(2025, 9, 14, 0, 0, 0, 0, time.UTC)},
+		{"@monthly", base, time.Date(2025, 10, 1, 0, 0, 0, 0, time.UTC)},
+		// A time on the schedule is not its own next time
+		{"0 15 * * *", time.Date(2025, 9, 12, 15, 0, 0, 0, time.UTC), time.Date(2025, 9, 13, 15, 0, 0, 0, time.UTC)},
+		{"0 0 30 2 *", base, time.Time{}},
+	}
+	for _, test := range tests {
+		cron, err := ParseCron(test.expr)
+		if err != nil {
+			t.Errorf("%s: %v", test.expr, err)
+			continue
+		}
+		if next := cron.Next(test.from); !next.Equal(test.expected) {
+			t.Errorf("%s: expected %s, got %s", test.expr, test.expected, next)
+		}
+	}
+}
+
+func TestCronNextDaylightSaving(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Skipf("time zone data unavailable: %v", err)
+	}
+	cron, err := ParseCron("30 2 * * *")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 02:30 does not exist on 2025-03-30 in Berlin, so that day is skipped
+	next := cron.Next(time.Date(2025, 3, 29, 12, 0, 0, 0, berlin))
+	if expected := time.Date(2025, 3, 31, 2, 30, 0, 0, berlin); !next.Equal(expected) {
+		t.Errorf("Expected %s, got %s", expected, next)
+	}
+	// and 02:30 on 2025-10-26 happens twice, but only the first matches
+	next = cron.Next(time.Date(2025, 10, 25, 12, 0, 0, 0, berlin))
+	if expected := time.Date(2025, 10, 26, 0, 30, 0, 0, time.UTC); !next.Equal(expected) {
+		t.Errorf("Expected %s, got %s", expected, next)
+	}
+	if after := cron.Next(next); after.Day() != 27 {
+		t.Errorf("Expected the next run on the following day, got %s", after)
+	}
+}
+
+func TestParseCronErrors(t *testing.T) {
+	for _, expr := range []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"5-1 * * * *",
+		"*/0 * * * *",
+		"* * * foo *",
+		"@every 5m",
+	} {
+		if _, err := ParseCron(expr); err == nil {
+			t.Errorf("Expected %q to be rejected", expr)
+		}
+	}
+}
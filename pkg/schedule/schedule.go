@@ -0,0 +1,198 @@
+// Package schedule takes backups on cron schedules from a long-running
+// daemon. The status of every schedule is persisted in a state file, so runs
+// missed or interrupted while the daemon was down are caught up when it
+// restarts, and runs of the same schedule never overlap.
+package schedule
+
+import (
+	"context"
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+
+	"k8s.io/utils/clock"
+)
+
+// Runner takes the backup of a scheduled run
+type Runner interface {
+	RunBackup(ctx context.Context, schedule *Schedule, backupName string) error
+}
+
+// RunnerFunc adapts a function to a Runner
+type RunnerFunc func(ctx context.Context, schedule *Schedule, backupName string) error
+
+// RunBackup calls f
+func (f RunnerFunc) RunBackup(ctx context.Context, schedule *Schedule, backupName string) error {
+	return f(ctx, schedule, backupName)
+}
+
+// Scheduler runs the backups of a set of schedules on time
+type Scheduler struct {
+	schedules []*Schedule
+	runner    Runner
+	state     *State
+	clock     clock.Clock
+	// jitter returns a random delay up to max
+	jitter func(max time.Duration) time.Duration
+}
+
+// NewScheduler creates a scheduler running schedules with runner and
+// recording their status in state
+func NewScheduler(schedules []*Schedule, runner Runner, state *State) *Scheduler {
+	return &Scheduler{
+		schedules: schedules,
+		runner:    runner,
+		state:     state,
+		clock:     clock.RealClock{},
+		jitter:    randomJitter,
+	}
+}
+
+// SetClock sets the clock schedules are evaluated against
+func (s *Scheduler) SetClock(clock clock.Clock) {
+	s.clock = clock
+}
+
+// Run runs every schedule until ctx is cancelled. Cancelling ctx also
+// cancels running backups, which are recorded as interrupted; Run returns
+// once they have stopped.
+func (s *Scheduler) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, schedule := range s.schedules {
+		wg.Add(1)
+		go func(schedule *Schedule) {
+			defer wg.Done()
+			s.runSchedule(ctx, schedule)
+		}(schedule)
+	}
+	wg.Wait()
+}
+
+// runSchedule runs the backups of a schedule one at a time
+func (s *Scheduler) runSchedule(ctx context.Context, schedule *Schedule) {
+	scheduled := s.firstRun(schedule)
+	for !scheduled.IsZero() {
+		delay := scheduled.Sub(s.clock.Now()) + s.jitter(schedule.Jitter.Duration)
+		if delay > 0 {
+			log.Printf("Schedule %s: next backup at %s", schedule.Name, s.clock.Now().Add(delay).Format(time.RFC3339))
+			timer := s.clock.NewTimer(delay)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return
+			case <-timer.C():
+			}
+		}
+
+		s.run(ctx, schedule, scheduled)
+		if ctx.Err() != nil {
+			return
+		}
+		scheduled = s.nextRun(schedule, scheduled)
+	}
+	log.Printf("Schedule %s: no further runs", schedule.Name)
+}
+
+// firstRun returns the first time to run a schedule when the daemon starts.
+// A schedule that never ran starts with its next scheduled time. Otherwise,
+// a run that was interrupted, or the latest one missed since, is caught up.
+func (s *Scheduler) firstRun(schedule *Schedule) time.Time {
+	status, ok := s.state.Get(schedule.Name)
+	if !ok {
+		return schedule.Next(s.clock.Now())
+	}
+
+	next := s.nextRun(schedule, status.LastScheduleTime)
+	if status.Phase != RunRunning && status.Phase != RunInterrupted {
+		return next
+	}
+	if status.Phase == RunRunning {
+		status.Phase = RunInterrupted
+		status.Error = "the scheduler stopped during the run"
+		s.setStatus(schedule, status)
+	}
+	if next.After(s.clock.Now()) && s.withinDeadline(schedule, status.LastScheduleTime) {
+		log.Printf("Schedule %s: retrying the interrupted backup %s", schedule.Name, status.LastBackup)
+		return status.LastScheduleTime
+	}
+	return next
+}
+
+// nextRun returns the time to run a schedule after the run scheduled at
+// last. When scheduled times have passed since, e.g. while the daemon was
+// down or the last run took longer than the interval, only the latest is
+// caught up, and only within the schedule's starting deadline.
+func (s *Scheduler) nextRun(schedule *Schedule, last time.Time) time.Time {
+	now := s.clock.Now()
+	missed, skipped := schedule.LatestMissed(last, now)
+	if missed.IsZero() {
+		return schedule.Next(last)
+	}
+
+	if skipped > 0 {
+		log.Printf("Schedule %s: skipping %d missed runs", schedule.Name, skipped)
+	}
+	if s.withinDeadline(schedule, missed) {
+		log.Printf("Schedule %s: catching up the run missed at %s", schedule.Name, missed.Format(time.RFC3339))
+		return missed
+	}
+	log.Printf("Schedule %s: not catching up the run missed at %s, past its starting deadline", schedule.Name, missed.Format(time.RFC3339))
+	return schedule.Next(now)
+}
+
+// withinDeadline reports whether a run scheduled at a passed time may still
+// start
+func (s *Scheduler) withinDeadline(schedule *Schedule, scheduled time.Time) bool {
+	deadline := schedule.StartingDeadline.Duration
+	return deadline == 0 || s.clock.Since(scheduled) <= deadline
+}
+
+// run takes the backup of a scheduled time, recording its status before
+// and after
+func (s *Scheduler) run(ctx context.Context, schedule *Schedule, scheduled time.Time) {
+	status, _ := s.state.Get(schedule.Name)
+	status.LastScheduleTime = scheduled
+	status.LastStartTime = s.clock.Now()
+	status.LastCompletionTime = time.Time{}
+	status.LastBackup = schedule.BackupName(scheduled)
+	status.Phase = RunRunning
+	status.Error = ""
+	s.setStatus(schedule, status)
+
+	log.Printf("Schedule %s: starting backup %s", schedule.Name, status.LastBackup)
+	err := s.runner.RunBackup(ctx, schedule, status.LastBackup)
+
+	status.LastCompletionTime = s.clock.Now()
+	switch {
+	case ctx.Err() != nil:
+		status.Phase = RunInterrupted
+		status.Error = ctx.Err().Error()
+		log.Printf("Schedule %s: backup %s interrupted", schedule.Name, status.LastBackup)
+	case err != nil:
+		status.Phase = RunFailed
+		status.Error = err.Error()
+		log.Printf("Schedule %s: backup %s failed: %v", schedule.Name, status.LastBackup, err)
+	default:
+		status.Phase = RunSucceeded
+		status.LastSuccessfulBackup = status.LastBackup
+		status.LastSuccessTime = status.LastCompletionTime
+		log.Printf("Schedule %s: backup %s completed in %s", schedule.Name, status.LastBackup, status.LastCompletionTime.Sub(status.LastStartTime).Round(time.Second))
+	}
+	s.setStatus(schedule, status)
+}
+
+// setStatus saves the status of a schedule. Failing to save it does not stop
+// the schedule.
+func (s *Scheduler) setStatus(schedule *Schedule, status Status) {
+	if err := s.state.Set(schedule.Name, status); err != nil {
+		log.Printf("Warning: schedule %s: %v", schedule.Name, err)
+	}
+}
+
+func randomJitter(max time.Duration) time.Duration {
+	if max <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(max)))
+}
@@ -0,0 +1,349 @@
+package schedule
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	testclock "k8s.io/utils/clock/testing"
+)
+
+func TestParseFile(t *testing.T) {
+	schedules, err := ParseFile([]byte(`
+schedules:
+  - name: nightly
+    schedule: "30 2 * * *"
+    timeZone: Europe/Berlin
+    jitter: 5m
+    storage: s3://backups/cluster-a
+    backup:
+      namespaces: [shop]
+      selector: app=payments
+      compress: false
+      snapshotVolumes: true
+    retention:
+      keepDaily: 7
+      maxAge: 30d
+      maxTotalSize: 10Gi
+  - name: hourly
+    schedule: "@hourly"
+    backup:
+      hooks:
+        - name: flush
+          selector: app=redis
+          pre:
+            - command: [redis-cli, save]
+`))
+	if err != nil {
+		t.Fatalf("ParseFile failed: %v", err)
+	}
+	if len(schedules) != 2 {
+		t.Fatalf("Expected 2 schedules, got %d", len(schedules))
+	}
+
+	nightly := schedules[0]
+	options := nightly.Options("nightly-20250912-003000")
+	if options.Compress || !options.SnapshotVolumes || options.LabelSelector != "app=payments" || options.Schedule != "nightly" {
+		t.Errorf("Unexpected options %+v", options)
+	}
+	if options.Concurrency != 4 || options.SnapshotTimeout != 10*time.Minute || !reflect.DeepEqual(options.ExcludeNamespaces, []string{"kube-system", "kube-public", "kube-node-lease"}) {
+		t.Errorf("Expected the backup command's defaults, got %+v", options)
+	}
+	if policy := nightly.Policy(); policy.KeepDaily != 7 || policy.MaxAge != 30*24*time.Hour || policy.MaxTotalSize != 10<<30 {
+		t.Errorf("Unexpected retention policy %+v", policy)
+	}
+	if !schedules[1].Options("hourly").Compress || !schedules[1].Policy().Empty() {
+		t.Error("Expected compressed backups and no retention by default")
+	}
+	if config, err := schedules[1].Backup.HookConfig(); err != nil || len(config.Hooks) != 1 || config.Hooks[0].Name != "flush" {
+		t.Errorf("Expected the inline hooks, got %+v, %v", config, err)
+	}
+	if config, err := nightly.Backup.HookConfig(); err != nil || config != nil {
+		t.Errorf("Expected no hooks, got %+v, %v", config, err)
+	}
+
+	// Schedules are evaluated in their time zone; backup names use UTC
+	next := nightly.Next(time.Date(2025, 9, 12, 0, 0, 0, 0, time.UTC))
+	if expected := time.Date(2025, 9, 12, 0, 30, 0, 0, time.UTC); !next.Equal(expected) {
+		t.Errorf("Expected %s, got %s", expected, next)
+	}
+	if name := nightly.BackupName(next); name != "nightly-20250912-003000" {
+		t.Errorf("Unexpected backup name %s", name)
+	}
+
+	for name, data := range map[string]string{
+		"no schedules":     "schedules: []\n",
+		"unknown field":    "schedules:\n  - name: a\n    schedule: '@daily'\n    every: 1h\n",
+		"invalid name":     "schedules:\n  - name: Nightly_Backup\n    schedule: '@daily'\n",
+		"duplicate name":   "schedules:\n  - name: a\n    schedule: '@daily'\n  - name: a\n    schedule: '@hourly'\n",
+		"invalid cron":     "schedules:\n  - name: a\n    schedule: '61 * * * *'\n",
+		"invalid zone":     "schedules:\n  - name: a\n    schedule: '@daily'\n    timeZone: Mars/Olympus\n",
+		"invalid max age":  "schedules:\n  - name: a\n    schedule: '@daily'\n    retention:\n      maxAge: forever\n",
+		"negative jitter":  "schedules:\n  - name: a\n    schedule: '@daily'\n    jitter: -1m\n",
+		"unknown backup":   "schedules:\n  - name: a\n    schedule: '@daily'\n    backup:\n      incremental: true\n",
+		"invalid max size": "schedules:\n  - name: a\n    schedule: '@daily'\n    retention:\n      maxTotalSize: lots\n",
+		"invalid hooks":    "schedules:\n  - name: a\n    schedule: '@daily'\n    backup:\n      hooks:\n        - name: flush\n          pre:\n            - command: []\n",
+		"hooks and file":   "schedules:\n  - name: a\n    schedule: '@daily'\n    backup:\n      hooksFile: ./hooks.yaml\n      hooks:\n        - name: flush\n",
+	} {
+		if _, err := ParseFile([]byte(data)); err == nil {
+			t.Errorf("%s: expected the schedule file to be rejected", name)
+		}
+	}
+}
+
+// testScheduler runs a scheduler against a fake clock. Every backup is sent
+// to runs and returns what is sent to results.
+type testScheduler struct {
+	*Scheduler
+	clock     *testclock.FakeClock
+	statePath string
+	runs      chan string
+	results   chan error
+	cancel    context.CancelFunc
+	done      chan struct{}
+
+	mu        sync.Mutex
+	active    int
+	maxActive int
+}
+
+func newTestScheduler(t *testing.T, file string, now time.Time, statuses map[string]Status) *testScheduler {
+	t.Helper()
+	schedules, err := ParseFile([]byte(file))
+	if err != nil {
+		t.Fatalf("ParseFile failed: %v", err)
+	}
+	statePath := filepath.Join(t.TempDir(), "state.json")
+	state, err := LoadState(statePath)
+	if err != nil {
+		t.Fatalf("LoadState failed: %v", err)
+	}
+	for name, status := range statuses {
+		if err := state.Set(name, status); err != nil {
+			t.Fatalf("Failed to save state: %v", err)
+		}
+	}
+
+	ts := &testScheduler{
+		clock:     testclock.NewFakeClock(now),
+		statePath: statePath,
+		runs:      make(chan string),
+		results:   make(chan error),
+		done:      make(chan struct{}),
+	}
+	ts.Scheduler = NewScheduler(schedules, RunnerFunc(ts.runBackup), state)
+	ts.SetClock(ts.clock)
+	ts.jitter = func(time.Duration) time.Duration { return 0 }
+	return ts
+}
+
+func (ts *testScheduler) runBackup(ctx context.Context, schedule *Schedule, backupName string) error {
+	ts.mu.Lock()
+	ts.active++
+	if ts.active > ts.maxActive {
+		ts.maxActive = ts.active
+	}
+	ts.mu.Unlock()
+	defer func() {
+		ts.mu.Lock()
+		ts.active--
+		ts.mu.Unlock()
+	}()
+
+	ts.runs <- backupName
+	select {
+	case err := <-ts.results:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (ts *testScheduler) start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	ts.cancel = cancel
+	go func() {
+		defer close(ts.done)
+		ts.Run(ctx)
+	}()
+}
+
+func (ts *testScheduler) stop() {
+	ts.cancel()
+	<-ts.done
+}
+
+// waitForTimer waits until the scheduler waits for its next run
+func (ts *testScheduler) waitForTimer(t *testing.T) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !ts.clock.HasWaiters() {
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for the scheduler to wait for its next run")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func (ts *testScheduler) expectRun(t *testing.T, expected string) {
+	t.Helper()
+	select {
+	case name := <-ts.runs:
+		if name != expected {
+			t.Fatalf("Expected backup %s, got %s", expected, name)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for backup %s", expected)
+	}
+}
+
+func (ts *testScheduler) expectNoRun(t *testing.T) {
+	t.Helper()
+	select {
+	case name := <-ts.runs:
+		t.Fatalf("Unexpected backup %s", name)
+	case <-time.After(20 * time.Millisecond):
+	}
+}
+
+func (ts *testScheduler) savedStatus(t *testing.T, name string) Status {
+	t.Helper()
+	state, err := LoadState(ts.statePath)
+	if err != nil {
+		t.Fatalf("LoadState failed: %v", err)
+	}
+	status, _ := state.Get(name)
+	return status
+}
+
+const nightlyFile = `
+schedules:
+  - name: nightly
+    schedule: "0 2 * * *"
+`
+
+func TestSchedulerRunsOnTime(t *testing.T) {
+	ts := newTestScheduler(t, nightlyFile, time.Date(2025, 9, 12, 1, 59, 30, 0, time.UTC), nil)
+	ts.start()
+	defer ts.stop()
+
+	ts.waitForTimer(t)
+	ts.clock.Step(29 * time.Second)
+	ts.expectNoRun(t)
+	ts.clock.Step(time.Second)
+	ts.expectRun(t, "nightly-20250912-020000")
+	if status := ts.savedStatus(t, "nightly"); status.Phase != RunRunning {
+		t.Errorf("Expected the running backup to be recorded, got %+v", status)
+	}
+	ts.clock.Step(5 * time.Minute)
+	ts.results <- nil
+
+	ts.waitForTimer(t)
+	status := ts.savedStatus(t, "nightly")
+	if status.Phase != RunSucceeded || status.LastSuccessfulBackup != "nightly-20250912-020000" || status.LastCompletionTime.Sub(status.LastStartTime) != 5*time.Minute {
+		t.Errorf("Unexpected status %+v", status)
+	}
+
+	// A failed run keeps the last successful backup
+	ts.clock.Step(24 * time.Hour)
+	ts.expectRun(t, "nightly-20250913-020000")
+	ts.results <- errors.New("failed to list pods")
+	ts.waitForTimer(t)
+	status = ts.savedStatus(t, "nightly")
+	if status.Phase != RunFailed || status.Error != "failed to list pods" || status.LastSuccessfulBackup != "nightly-20250912-020000" {
+		t.Errorf("Unexpected status %+v", status)
+	}
+}
+
+func TestSchedulerJitter(t *testing.T) {
+	ts := newTestScheduler(t, nightlyFile, time.Date(2025, 9, 12, 1, 59, 30, 0, time.UTC), nil)
+	ts.jitter = func(max time.Duration) time.Duration { return 10 * time.Second }
+	ts.start()
+	defer ts.stop()
+
+	ts.waitForTimer(t)
+	ts.clock.Step(30 * time.Second)
+	ts.expectNoRun(t)
+	ts.clock.Step(10 * time.Second)
+	// The backup is named after its scheduled time
+	ts.expectRun(t, "nightly-20250912-020000")
+	ts.results <- nil
+}
+
+func TestSchedulerDoesNotOverlap(t *testing.T) {
+	ts := newTestScheduler(t, "schedules:\n  - name: often\n    schedule: '* * * * *'\n", time.Date(2025, 9, 12, 12, 0, 30, 0, time.UTC), nil)
+	ts.start()
+	defer ts.stop()
+
+	ts.waitForTimer(t)
+	ts.clock.Step(30 * time.Second)
+	ts.expectRun(t, "often-20250912-120100")
+
+	// The run takes past three more scheduled times; only the latest runs,
+	// once the first has finished
+	ts.clock.Step(3 * time.Minute)
+	ts.expectNoRun(t)
+	ts.results <- nil
+	ts.expectRun(t, "often-20250912-120400")
+	ts.results <- nil
+
+	ts.waitForTimer(t)
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if ts.maxActive != 1 {
+		t.Errorf("Expected runs not to overlap, got %d at once", ts.maxActive)
+	}
+}
+
+func TestSchedulerCatchesUp(t *testing.T) {
+	lastRun := map[string]Status{"nightly": {
+		LastScheduleTime: time.Date(2025, 9, 10, 2, 0, 0, 0, time.UTC),
+		LastBackup:       "nightly-20250910-020000",
+		Phase:            RunSucceeded,
+	}}
+	now := time.Date(2025, 9, 12, 10, 0, 0, 0, time.UTC)
+
+	// The latest of the runs missed while the daemon was down runs at once
+	ts := newTestScheduler(t, nightlyFile, now, lastRun)
+	ts.start()
+	ts.expectRun(t, "nightly-20250912-020000")
+	ts.results <- nil
+	ts.waitForTimer(t)
+	ts.stop()
+
+	// unless it is past its starting deadline
+	ts = newTestScheduler(t, nightlyFile+"    startingDeadline: 1h\n", now, lastRun)
+	ts.start()
+	defer ts.stop()
+	ts.waitForTimer(t)
+	ts.expectNoRun(t)
+	ts.clock.Step(16 * time.Hour)
+	ts.expectRun(t, "nightly-20250913-020000")
+	ts.results <- nil
+}
+
+func TestSchedulerRetriesInterruptedRuns(t *testing.T) {
+	now := time.Date(2025, 9, 12, 2, 30, 0, 0, time.UTC)
+	running := map[string]Status{"nightly": {
+		LastScheduleTime: time.Date(2025, 9, 12, 2, 0, 0, 0, time.UTC),
+		LastBackup:       "nightly-20250912-020000",
+		Phase:            RunRunning,
+	}}
+
+	ts := newTestScheduler(t, nightlyFile, now, running)
+	ts.start()
+	ts.expectRun(t, "nightly-20250912-020000")
+
+	// Stopping the scheduler interrupts the run, which is recorded so the
+	// next start retries it
+	ts.stop()
+	status := ts.savedStatus(t, "nightly")
+	if status.Phase != RunInterrupted || !strings.Contains(status.Error, "canceled") {
+		t.Errorf("Expected the run to be recorded as interrupted, got %+v", status)
+	}
+}
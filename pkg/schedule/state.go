@@ -0,0 +1,125 @@
+package schedule
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// RunPhase is the outcome of a scheduled run
+type RunPhase string
+
+const (
+	RunRunning   RunPhase = "Running"
+	RunSucceeded RunPhase = "Succeeded"
+	RunFailed    RunPhase = "Failed"
+	// RunInterrupted marks a run that was still going when the daemon
+	// stopped; it is caught up like a missed run
+	RunInterrupted RunPhase = "Interrupted"
+)
+
+// Status is the persisted state of a schedule
+type Status struct {
+	// LastScheduleTime is the scheduled time of the last run, before jitter
+	LastScheduleTime   time.Time `json:"lastScheduleTime"`
+	LastStartTime      time.Time `json:"lastStartTime"`
+	LastCompletionTime time.Time `json:"lastCompletionTime"`
+	LastBackup         string    `json:"lastBackup"`
+	Phase              RunPhase  `json:"phase"`
+	Error              string    `json:"error,omitempty"`
+	// LastSuccessfulBackup and LastSuccessTime survive failed runs
+	LastSuccessfulBackup string    `json:"lastSuccessfulBackup,omitempty"`
+	LastSuccessTime      time.Time `json:"lastSuccessTime"`
+}
+
+// State persists the status of every schedule to a JSON file. It is safe
+// for concurrent use.
+type State struct {
+	path      string
+	mu        sync.Mutex
+	schedules map[string]Status
+}
+
+// stateFile is the format of a state file
+type stateFile struct {
+	Schedules map[string]Status `json:"schedules"`
+}
+
+// LoadState reads a state file; a missing file is an empty state
+func LoadState(path string) (*State, error) {
+	state := &State{path: path, schedules: make(map[string]Status)}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read state file: %w", err)
+	}
+
+	var file stateFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("invalid state file %s: %w", path, err)
+	}
+	for name, status := range file.Schedules {
+		state.schedules[name] = status
+	}
+	return state, nil
+}
+
+// Get returns the status of a schedule, and whether it has ever run
+func (s *State) Get(name string) (Status, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	status, ok := s.schedules[name]
+	return status, ok
+}
+
+// Statuses returns the status of every schedule that has run
+func (s *State) Statuses() map[string]Status {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	statuses := make(map[string]Status, len(s.schedules))
+	for name, status := range s.schedules {
+		statuses[name] = status
+	}
+	return statuses
+}
+
+// Set records the status of a schedule and saves the state
+func (s *State) Set(name string, status Status) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.schedules[name] = status
+	return s.save()
+}
+
+// save writes the state file through a temporary file, so a crash never
+// leaves it half written
+func (s *State) save() error {
+	data, err := json.MarshalIndent(stateFile{Schedules: s.schedules}, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode state: %w", err)
+	}
+
+	temp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to save state: %w", err)
+	}
+	defer os.Remove(temp.Name())
+	if _, err := temp.Write(append(data, '\n')); err != nil {
+		temp.Close()
+		return fmt.Errorf("failed to save state: %w", err)
+	}
+	if err := temp.Close(); err != nil {
+		return fmt.Errorf("failed to save state: %w", err)
+	}
+	if err := os.Rename(temp.Name(), s.path); err != nil {
+		return fmt.Errorf("failed to save state: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,295 @@
+// Package snapshot takes CSI VolumeSnapshots of backed up
+// PersistentVolumeClaims and provisions restored claims from them.
+package snapshot
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	k8stypes "k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+
+	"k8s-backup/pkg/k8s"
+	"k8s-backup/pkg/types"
+)
+
+const (
+	// Group is the API group of CSI snapshot objects
+	Group = "snapshot.storage.k8s.io"
+	// BackupLabel is set on the VolumeSnapshots taken for a backup, to the
+	// backup's name
+	BackupLabel = "k8s-backup.io/backup"
+
+	defaultClassAnnotation = "snapshot.storage.kubernetes.io/is-default-class"
+	defaultTimeout         = 10 * time.Minute
+)
+
+var (
+	VolumeSnapshotGVR        = schema.GroupVersionResource{Group: Group, Version: "v1", Resource: "volumesnapshots"}
+	VolumeSnapshotContentGVR = schema.GroupVersionResource{Group: Group, Version: "v1", Resource: "volumesnapshotcontents"}
+	VolumeSnapshotClassGVR   = schema.GroupVersionResource{Group: Group, Version: "v1", Resource: "volumesnapshotclasses"}
+)
+
+// pollInterval is how often a VolumeSnapshot is checked for readiness
+var pollInterval = 2 * time.Second
+
+// bindingAnnotations are set on claims and volumes when they are bound and
+// provisioned; a claim restored from a snapshot or volume data must be
+// provisioned afresh
+var bindingAnnotations = []string{
+	"pv.kubernetes.io/bind-completed",
+	"pv.kubernetes.io/bound-by-controller",
+	"volume.beta.kubernetes.io/storage-provisioner",
+	"volume.kubernetes.io/storage-provisioner",
+	"volume.kubernetes.io/selected-node",
+}
+
+// Manager creates and restores CSI volume snapshots
+type Manager struct {
+	k8sClient *k8s.Client
+}
+
+// NewManager creates a new snapshot manager
+func NewManager(k8sClient *k8s.Client) *Manager {
+	return &Manager{k8sClient: k8sClient}
+}
+
+// SnapshotClaims takes a VolumeSnapshot of each claim, using the
+// VolumeSnapshotClass of the CSI driver that provisioned its volume, and
+// waits up to timeout for each to become ready to use. The snapshot contents
+// are switched to the Retain deletion policy, so the snapshots outlive the
+// claims and namespaces they were taken of. Claims that cannot be
+// snapshotted are reported as warnings.
+func (m *Manager) SnapshotClaims(ctx context.Context, backupName string, claims []*unstructured.Unstructured, timeout time.Duration) ([]types.VolumeSnapshotInfo, []error, error) {
+	if len(claims) == 0 {
+		return nil, nil, nil
+	}
+	if timeout <= 0 {
+		timeout = defaultTimeout
+	}
+
+	classes, err := m.snapshotClasses(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var warnings []error
+	var pending []types.VolumeSnapshotInfo
+	for _, claim := range claims {
+		info, err := m.createSnapshot(ctx, backupName, claim, classes)
+		if err != nil {
+			warnings = append(warnings, fmt.Errorf("failed to snapshot PersistentVolumeClaim %s/%s: %w", claim.GetNamespace(), claim.GetName(), err))
+			continue
+		}
+		pending = append(pending, info)
+	}
+
+	var snapshots []types.VolumeSnapshotInfo
+	for _, info := range pending {
+		if err := m.waitForSnapshot(ctx, &info, timeout); err != nil {
+			warnings = append(warnings, fmt.Errorf("failed to snapshot PersistentVolumeClaim %s/%s: %w", info.Namespace, info.PersistentVolumeClaim, err))
+			continue
+		}
+		log.Printf("Snapshotted PersistentVolumeClaim %s/%s as %s", info.Namespace, info.PersistentVolumeClaim, info.VolumeSnapshot)
+		snapshots = append(snapshots, info)
+	}
+	return snapshots, warnings, nil
+}
+
+// snapshotClasses maps each CSI driver to its VolumeSnapshotClass, preferring
+// the class marked as default when a driver has several
+func (m *Manager) snapshotClasses(ctx context.Context) (map[string]string, error) {
+	list, err := m.k8sClient.Dynamic().Resource(VolumeSnapshotClassGVR).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list VolumeSnapshotClasses: %w", err)
+	}
+
+	classes := make(map[string]string)
+	for _, class := range list.Items {
+		driver, _, _ := unstructured.NestedString(class.Object, "driver")
+		if _, ok := classes[driver]; !ok || class.GetAnnotations()[defaultClassAnnotation] == "true" {
+			classes[driver] = class.GetName()
+		}
+	}
+	return classes, nil
+}
+
+// createSnapshot creates a VolumeSnapshot of a bound claim
+func (m *Manager) createSnapshot(ctx context.Context, backupName string, claim *unstructured.Unstructured, classes map[string]string) (types.VolumeSnapshotInfo, error) {
+	info := types.VolumeSnapshotInfo{Namespace: claim.GetNamespace(), PersistentVolumeClaim: claim.GetName()}
+
+	phase, _, _ := unstructured.NestedString(claim.Object, "status", "phase")
+	volumeName, _, _ := unstructured.NestedString(claim.Object, "spec", "volumeName")
+	if phase != "Bound" || volumeName == "" {
+		return info, fmt.Errorf("claim is not bound")
+	}
+	volume, err := m.k8sClient.Clientset().CoreV1().PersistentVolumes().Get(ctx, volumeName, metav1.GetOptions{})
+	if err != nil {
+		return info, fmt.Errorf("failed to get PersistentVolume %s: %w", volumeName, err)
+	}
+	if volume.Spec.CSI == nil {
+		return info, fmt.Errorf("PersistentVolume %s is not provisioned by a CSI driver", volumeName)
+	}
+	info.Driver = volume.Spec.CSI.Driver
+	info.VolumeSnapshotClass = classes[info.Driver]
+	if info.VolumeSnapshotClass == "" {
+		return info, fmt.Errorf("no VolumeSnapshotClass for CSI driver %s", info.Driver)
+	}
+
+	info.VolumeSnapshot = snapshotName(backupName, claim.GetName())
+	snapshot := &unstructured.Unstructured{Object: map[string]interface{}{
+		"spec": map[string]interface{}{
+			"volumeSnapshotClassName": info.VolumeSnapshotClass,
+			"source":                  map[string]interface{}{"persistentVolumeClaimName": claim.GetName()},
+		},
+	}}
+	snapshot.SetGroupVersionKind(VolumeSnapshotGVR.GroupVersion().WithKind("VolumeSnapshot"))
+	snapshot.SetNamespace(info.Namespace)
+	snapshot.SetName(info.VolumeSnapshot)
+	snapshot.SetLabels(map[string]string{BackupLabel: backupName})
+
+	_, err = m.k8sClient.Dynamic().Resource(VolumeSnapshotGVR).Namespace(info.Namespace).Create(ctx, snapshot, metav1.CreateOptions{})
+	if err != nil {
+		return info, fmt.Errorf("failed to create VolumeSnapshot: %w", err)
+	}
+	return info, nil
+}
+
+// waitForSnapshot waits for a VolumeSnapshot to become ready to use, then
+// records its content's snapshot handle and retains the content
+func (m *Manager) waitForSnapshot(ctx context.Context, info *types.VolumeSnapshotInfo, timeout time.Duration) error {
+	client := m.k8sClient.Dynamic().Resource(VolumeSnapshotGVR).Namespace(info.Namespace)
+	var snapshot *unstructured.Unstructured
+	err := wait.PollUntilContextTimeout(ctx, pollInterval, timeout, true, func(ctx context.Context) (bool, error) {
+		var err error
+		snapshot, err = client.Get(ctx, info.VolumeSnapshot, metav1.GetOptions{})
+		if err != nil {
+			return false, err
+		}
+		if message, found, _ := unstructured.NestedString(snapshot.Object, "status", "error", "message"); found {
+			return false, fmt.Errorf("VolumeSnapshot %s failed: %s", info.VolumeSnapshot, message)
+		}
+		ready, _, _ := unstructured.NestedBool(snapshot.Object, "status", "readyToUse")
+		return ready, nil
+	})
+	if wait.Interrupted(err) {
+		return fmt.Errorf("VolumeSnapshot %s was not ready after %s", info.VolumeSnapshot, timeout)
+	}
+	if err != nil {
+		return err
+	}
+
+	info.RestoreSize, _, _ = unstructured.NestedString(snapshot.Object, "status", "restoreSize")
+	info.VolumeSnapshotContent, _, _ = unstructured.NestedString(snapshot.Object, "status", "boundVolumeSnapshotContentName")
+	if info.VolumeSnapshotContent == "" {
+		return fmt.Errorf("VolumeSnapshot %s is not bound to a VolumeSnapshotContent", info.VolumeSnapshot)
+	}
+
+	contents := m.k8sClient.Dynamic().Resource(VolumeSnapshotContentGVR)
+	content, err := contents.Patch(ctx, info.VolumeSnapshotContent, k8stypes.MergePatchType,
+		[]byte(`{"spec":{"deletionPolicy":"Retain"}}`), metav1.PatchOptions{FieldManager: k8s.DefaultFieldManager})
+	if err != nil {
+		return fmt.Errorf("failed to retain VolumeSnapshotContent %s: %w", info.VolumeSnapshotContent, err)
+	}
+	info.SnapshotHandle, _, _ = unstructured.NestedString(content.Object, "status", "snapshotHandle")
+	if info.SnapshotHandle == "" {
+		return fmt.Errorf("VolumeSnapshotContent %s has no snapshot handle", info.VolumeSnapshotContent)
+	}
+	return nil
+}
+
+// RestoreClaim rewrites a claim being restored to be provisioned from a
+// snapshot recorded in its backup. When create is set, a pre-provisioned
+// VolumeSnapshotContent for the snapshot handle and a VolumeSnapshot bound
+// to it are created in the claim's namespace first; existing ones are kept.
+func (m *Manager) RestoreClaim(ctx context.Context, claim *unstructured.Unstructured, info types.VolumeSnapshotInfo, create bool) error {
+	namespace := claim.GetNamespace()
+	if create {
+		contentName := contentName(namespace, info)
+
+		content := &unstructured.Unstructured{Object: map[string]interface{}{
+			"spec": map[string]interface{}{
+				"deletionPolicy":          "Retain",
+				"driver":                  info.Driver,
+				"volumeSnapshotClassName": info.VolumeSnapshotClass,
+				"source":                  map[string]interface{}{"snapshotHandle": info.SnapshotHandle},
+				"volumeSnapshotRef":       map[string]interface{}{"namespace": namespace, "name": info.VolumeSnapshot},
+			},
+		}}
+		content.SetGroupVersionKind(VolumeSnapshotContentGVR.GroupVersion().WithKind("VolumeSnapshotContent"))
+		content.SetName(contentName)
+		_, err := m.k8sClient.Dynamic().Resource(VolumeSnapshotContentGVR).Create(ctx, content, metav1.CreateOptions{FieldManager: k8s.DefaultFieldManager})
+		if err != nil && !apierrors.IsAlreadyExists(err) {
+			return fmt.Errorf("failed to create VolumeSnapshotContent %s: %w", contentName, err)
+		}
+
+		snapshot := &unstructured.Unstructured{Object: map[string]interface{}{
+			"spec": map[string]interface{}{
+				"volumeSnapshotClassName": info.VolumeSnapshotClass,
+				"source":                  map[string]interface{}{"volumeSnapshotContentName": contentName},
+			},
+		}}
+		snapshot.SetGroupVersionKind(VolumeSnapshotGVR.GroupVersion().WithKind("VolumeSnapshot"))
+		snapshot.SetNamespace(namespace)
+		snapshot.SetName(info.VolumeSnapshot)
+		_, err = m.k8sClient.Dynamic().Resource(VolumeSnapshotGVR).Namespace(namespace).Create(ctx, snapshot, metav1.CreateOptions{FieldManager: k8s.DefaultFieldManager})
+		if err != nil && !apierrors.IsAlreadyExists(err) {
+			return fmt.Errorf("failed to create VolumeSnapshot %s: %w", info.VolumeSnapshot, err)
+		}
+	}
+
+	// A new volume is provisioned from the snapshot instead of binding to
+	// the backed up one
+	UnbindClaim(claim)
+	unstructured.RemoveNestedField(claim.Object, "spec", "dataSourceRef")
+	if err := unstructured.SetNestedMap(claim.Object, map[string]interface{}{
+		"apiGroup": Group,
+		"kind":     "VolumeSnapshot",
+		"name":     info.VolumeSnapshot,
+	}, "spec", "dataSource"); err != nil {
+		return fmt.Errorf("failed to set data source: %w", err)
+	}
+	return nil
+}
+
+// UnbindClaim removes a claim's binding to the volume it was backed up with,
+// so a new volume is provisioned for it
+func UnbindClaim(claim *unstructured.Unstructured) {
+	unstructured.RemoveNestedField(claim.Object, "spec", "volumeName")
+	if annotations := claim.GetAnnotations(); annotations != nil {
+		for _, key := range bindingAnnotations {
+			delete(annotations, key)
+		}
+		if len(annotations) == 0 {
+			annotations = nil
+		}
+		claim.SetAnnotations(annotations)
+	}
+}
+
+// snapshotName names the VolumeSnapshot of a claim for a backup, hashing
+// names that would be too long
+func snapshotName(backupName, claim string) string {
+	name := backupName + "-" + claim
+	if len(name) <= 253 {
+		return name
+	}
+	sum := sha256.Sum256([]byte(name))
+	return name[:236] + "-" + hex.EncodeToString(sum[:8])
+}
+
+// contentName names the pre-provisioned VolumeSnapshotContent a snapshot is
+// restored into a namespace with. Contents are cluster-scoped, so the name
+// is derived from the target namespace as well as the snapshot.
+func contentName(namespace string, info types.VolumeSnapshotInfo) string {
+	sum := sha256.Sum256([]byte(namespace + "/" + info.VolumeSnapshot + "/" + info.SnapshotHandle))
+	return "k8s-backup-" + hex.EncodeToString(sum[:16])
+}
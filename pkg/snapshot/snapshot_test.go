@@ -0,0 +1,242 @@
+package snapshot
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apiextensionsfake "k8s.io/apiextensions-apiserver/pkg/client/clientset/clientset/fake"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+
+	"k8s-backup/pkg/k8s"
+	"k8s-backup/pkg/types"
+)
+
+func newObject(gvr schema.GroupVersionResource, kind, namespace, name string, content map[string]interface{}) *unstructured.Unstructured {
+	obj := &unstructured.Unstructured{Object: content}
+	if obj.Object == nil {
+		obj.Object = map[string]interface{}{}
+	}
+	obj.SetGroupVersionKind(gvr.GroupVersion().WithKind(kind))
+	obj.SetNamespace(namespace)
+	obj.SetName(name)
+	return obj
+}
+
+func newClaim(name, volumeName string) *unstructured.Unstructured {
+	claim := newObject(schema.GroupVersionResource{Version: "v1"}, "PersistentVolumeClaim", "db", name, map[string]interface{}{
+		"spec":   map[string]interface{}{"volumeName": volumeName},
+		"status": map[string]interface{}{"phase": "Bound"},
+	})
+	if volumeName == "" {
+		claim.Object["status"] = map[string]interface{}{"phase": "Pending"}
+	}
+	return claim
+}
+
+// newTestClient returns a client whose snapshot controller binds each
+// VolumeSnapshot to a content and marks it ready on the second time it is read
+func newTestClient(objects ...runtime.Object) (*k8s.Client, *dynamicfake.FakeDynamicClient) {
+	clientset := kubefake.NewSimpleClientset(
+		&corev1.PersistentVolume{
+			ObjectMeta: metav1.ObjectMeta{Name: "pv-data"},
+			Spec: corev1.PersistentVolumeSpec{PersistentVolumeSource: corev1.PersistentVolumeSource{
+				CSI: &corev1.CSIPersistentVolumeSource{Driver: "ebs.csi.aws.com", VolumeHandle: "vol-0123"},
+			}},
+		},
+		&corev1.PersistentVolume{
+			ObjectMeta: metav1.ObjectMeta{Name: "pv-local"},
+			Spec: corev1.PersistentVolumeSpec{PersistentVolumeSource: corev1.PersistentVolumeSource{
+				HostPath: &corev1.HostPathVolumeSource{Path: "/data"},
+			}},
+		},
+	)
+
+	listKinds := map[schema.GroupVersionResource]string{
+		VolumeSnapshotGVR:        "VolumeSnapshotList",
+		VolumeSnapshotContentGVR: "VolumeSnapshotContentList",
+		VolumeSnapshotClassGVR:   "VolumeSnapshotClassList",
+	}
+	dynamicClient := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), listKinds, objects...)
+
+	reads := make(map[string]int)
+	dynamicClient.PrependReactor("get", "volumesnapshots", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		get := action.(k8stesting.GetAction)
+		reads[get.GetName()]++
+		if reads[get.GetName()] != 2 {
+			return false, nil, nil
+		}
+
+		tracker := dynamicClient.Tracker()
+		obj, err := tracker.Get(VolumeSnapshotGVR, get.GetNamespace(), get.GetName())
+		if err != nil {
+			return true, nil, err
+		}
+		snapshot := obj.(*unstructured.Unstructured)
+		contentName := "snapcontent-" + get.GetName()
+		content := newObject(VolumeSnapshotContentGVR, "VolumeSnapshotContent", "", contentName, map[string]interface{}{
+			"spec":   map[string]interface{}{"deletionPolicy": "Delete"},
+			"status": map[string]interface{}{"snapshotHandle": "snap-" + get.GetName()},
+		})
+		if err := tracker.Create(VolumeSnapshotContentGVR, content, ""); err != nil {
+			return true, nil, err
+		}
+		snapshot.Object["status"] = map[string]interface{}{
+			"readyToUse":                     true,
+			"restoreSize":                    "10Gi",
+			"boundVolumeSnapshotContentName": contentName,
+		}
+		if err := tracker.Update(VolumeSnapshotGVR, snapshot, get.GetNamespace()); err != nil {
+			return true, nil, err
+		}
+		return false, nil, nil
+	})
+
+	return k8s.NewClientFromInterfaces(clientset, apiextensionsfake.NewSimpleClientset(), dynamicClient), dynamicClient
+}
+
+func TestSnapshotClaims(t *testing.T) {
+	pollInterval = time.Millisecond
+	defer func() { pollInterval = 2 * time.Second }()
+
+	client, dynamicClient := newTestClient(
+		newObject(VolumeSnapshotClassGVR, "VolumeSnapshotClass", "", "ebs-slow", map[string]interface{}{"driver": "ebs.csi.aws.com"}),
+		newObject(VolumeSnapshotClassGVR, "VolumeSnapshotClass", "", "ebs", map[string]interface{}{
+			"driver":   "ebs.csi.aws.com",
+			"metadata": map[string]interface{}{"annotations": map[string]interface{}{defaultClassAnnotation: "true"}},
+		}),
+		newObject(VolumeSnapshotClassGVR, "VolumeSnapshotClass", "", "other", map[string]interface{}{"driver": "pd.csi.storage.gke.io"}),
+	)
+
+	claims := []*unstructured.Unstructured{newClaim("data", "pv-data"), newClaim("pending", ""), newClaim("local", "pv-local")}
+	snapshots, warnings, err := NewManager(client).SnapshotClaims(context.Background(), "nightly", claims, time.Second)
+	if err != nil {
+		t.Fatalf("SnapshotClaims failed: %v", err)
+	}
+
+	expected := []types.VolumeSnapshotInfo{{
+		Namespace:             "db",
+		PersistentVolumeClaim: "data",
+		VolumeSnapshot:        "nightly-data",
+		VolumeSnapshotContent: "snapcontent-nightly-data",
+		VolumeSnapshotClass:   "ebs",
+		Driver:                "ebs.csi.aws.com",
+		SnapshotHandle:        "snap-nightly-data",
+		RestoreSize:           "10Gi",
+	}}
+	if !reflect.DeepEqual(snapshots, expected) {
+		t.Errorf("Expected snapshots %+v, got %+v", expected, snapshots)
+	}
+	// The unbound claim and the claim on a non-CSI volume cannot be snapshotted
+	if len(warnings) != 2 {
+		t.Errorf("Expected 2 warnings, got %v", warnings)
+	}
+
+	snapshot, err := dynamicClient.Resource(VolumeSnapshotGVR).Namespace("db").Get(context.Background(), "nightly-data", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Failed to get VolumeSnapshot: %v", err)
+	}
+	if snapshot.GetLabels()[BackupLabel] != "nightly" {
+		t.Errorf("Expected the backup label, got %v", snapshot.GetLabels())
+	}
+	if source, _, _ := unstructured.NestedString(snapshot.Object, "spec", "source", "persistentVolumeClaimName"); source != "data" {
+		t.Errorf("Expected a snapshot of claim data, got %q", source)
+	}
+
+	content, err := dynamicClient.Resource(VolumeSnapshotContentGVR).Get(context.Background(), "snapcontent-nightly-data", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Failed to get VolumeSnapshotContent: %v", err)
+	}
+	if policy, _, _ := unstructured.NestedString(content.Object, "spec", "deletionPolicy"); policy != "Retain" {
+		t.Errorf("Expected the content to be retained, got deletion policy %q", policy)
+	}
+}
+
+func TestSnapshotClaimsTimeout(t *testing.T) {
+	pollInterval = time.Millisecond
+	defer func() { pollInterval = 2 * time.Second }()
+
+	client, dynamicClient := newTestClient(newObject(VolumeSnapshotClassGVR, "VolumeSnapshotClass", "", "ebs", map[string]interface{}{"driver": "ebs.csi.aws.com"}))
+	// The snapshot never becomes ready
+	dynamicClient.PrependReactor("get", "volumesnapshots", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		get := action.(k8stesting.GetAction)
+		obj, err := dynamicClient.Tracker().Get(VolumeSnapshotGVR, get.GetNamespace(), get.GetName())
+		return true, obj, err
+	})
+
+	snapshots, warnings, err := NewManager(client).SnapshotClaims(context.Background(), "nightly", []*unstructured.Unstructured{newClaim("data", "pv-data")}, 20*time.Millisecond)
+	if err != nil {
+		t.Fatalf("SnapshotClaims failed: %v", err)
+	}
+	if len(snapshots) != 0 || len(warnings) != 1 {
+		t.Errorf("Expected the snapshot to time out, got %+v and %v", snapshots, warnings)
+	}
+}
+
+func TestRestoreClaim(t *testing.T) {
+	client, dynamicClient := newTestClient()
+	info := types.VolumeSnapshotInfo{
+		Namespace:             "db",
+		PersistentVolumeClaim: "data",
+		VolumeSnapshot:        "nightly-data",
+		VolumeSnapshotClass:   "ebs",
+		Driver:                "ebs.csi.aws.com",
+		SnapshotHandle:        "snap-0123",
+	}
+
+	claim := newClaim("data", "pv-data")
+	claim.SetNamespace("db-restore")
+	claim.SetAnnotations(map[string]string{"pv.kubernetes.io/bind-completed": "yes", "team": "storage"})
+	if err := NewManager(client).RestoreClaim(context.Background(), claim, info, true); err != nil {
+		t.Fatalf("RestoreClaim failed: %v", err)
+	}
+
+	contentName := contentName("db-restore", info)
+	content, err := dynamicClient.Resource(VolumeSnapshotContentGVR).Get(context.Background(), contentName, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Failed to get VolumeSnapshotContent: %v", err)
+	}
+	expectedSpec := map[string]interface{}{
+		"deletionPolicy":          "Retain",
+		"driver":                  "ebs.csi.aws.com",
+		"volumeSnapshotClassName": "ebs",
+		"source":                  map[string]interface{}{"snapshotHandle": "snap-0123"},
+		"volumeSnapshotRef":       map[string]interface{}{"namespace": "db-restore", "name": "nightly-data"},
+	}
+	if !reflect.DeepEqual(content.Object["spec"], expectedSpec) {
+		t.Errorf("Expected content spec %v, got %v", expectedSpec, content.Object["spec"])
+	}
+
+	snapshot, err := dynamicClient.Resource(VolumeSnapshotGVR).Namespace("db-restore").Get(context.Background(), "nightly-data", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Failed to get VolumeSnapshot: %v", err)
+	}
+	if source, _, _ := unstructured.NestedString(snapshot.Object, "spec", "source", "volumeSnapshotContentName"); source != contentName {
+		t.Errorf("Expected the snapshot to use content %s, got %q", contentName, source)
+	}
+
+	expectedClaimSpec := map[string]interface{}{
+		"dataSource": map[string]interface{}{"apiGroup": Group, "kind": "VolumeSnapshot", "name": "nightly-data"},
+	}
+	if !reflect.DeepEqual(claim.Object["spec"], expectedClaimSpec) {
+		t.Errorf("Expected claim spec %v, got %v", expectedClaimSpec, claim.Object["spec"])
+	}
+	if annotations := claim.GetAnnotations(); !reflect.DeepEqual(annotations, map[string]string{"team": "storage"}) {
+		t.Errorf("Expected binding annotations to be removed, got %v", annotations)
+	}
+
+	// Restoring again keeps the existing objects
+	claim = newClaim("data", "pv-data")
+	claim.SetNamespace("db-restore")
+	if err := NewManager(client).RestoreClaim(context.Background(), claim, info, true); err != nil {
+		t.Errorf("RestoreClaim failed on existing snapshot objects: %v", err)
+	}
+}
@@ -0,0 +1,293 @@
+package storage
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"sigs.k8s.io/yaml"
+
+	"k8s-backup/pkg/types"
+)
+
+// resourceRelativePath returns where a resource is stored within a backup.
+// Kinds outside the core group are qualified by their group, so that kinds
+// of the same name in different groups are stored apart.
+func resourceRelativePath(info types.ResourceInfo) string {
+	dir := info.Namespace
+	if dir == "" {
+		dir = "cluster"
+	}
+	kind := strings.ToLower(info.Kind)
+	if i := strings.LastIndex(info.APIVersion, "/"); i >= 0 {
+		kind += "." + info.APIVersion[:i]
+	}
+	return filepath.Join(dir, fmt.Sprintf("%s-%s.yaml", kind, info.Name))
+}
+
+// manifestSidecarSuffix names the small archive stored next to each backup
+// archive that holds a copy of its manifest files. Archives are written in a
+// single pass, so their own manifest comes last; the sidecar lets backups be
+// listed and checked before their resources are read.
+const manifestSidecarSuffix = ".manifest"
+
+// archiveWriter writes a backup as a gzipped tar archive: resources and
+// volume data in the order they are written, followed by the manifest files
+type archiveWriter struct {
+	gzip    *gzip.Writer
+	tar     *tar.Writer
+	modTime time.Time
+	manifestBuilder
+}
+
+func newArchiveWriter(w io.Writer, modTime time.Time) *archiveWriter {
+	if modTime.IsZero() {
+		modTime = time.Now()
+	}
+	gzipWriter := gzip.NewWriter(w)
+	return &archiveWriter{gzip: gzipWriter, tar: tar.NewWriter(gzipWriter), modTime: modTime}
+}
+
+func (a *archiveWriter) writeResource(resource types.ResourceWithContent) error {
+	info := a.add(resource)
+	return a.writeFile(info.RelativePath, resource.Content)
+}
+
+// writeVolume stores a volume's tar stream. Tar headers carry the size of a
+// file, so the stream is spooled to a temporary file first; a copy that
+// fails leaves nothing in the archive.
+func (a *archiveWriter) writeVolume(volume types.VolumeDataInfo, data io.Reader) (types.VolumeDataInfo, error) {
+	spool, err := os.CreateTemp("", "k8s-backup-volume-*")
+	if err != nil {
+		return volume, fmt.Errorf("failed to create spool file: %w", err)
+	}
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+
+	volume, err = copyVolume(spool, volume, data)
+	if err != nil {
+		volume = failVolume(volume, err)
+		a.addVolume(volume)
+		return volume, fmt.Errorf("failed to copy volume %s: %w", volume.Key(), err)
+	}
+	if _, err := spool.Seek(0, io.SeekStart); err != nil {
+		return volume, fmt.Errorf("failed to read spool file: %w", err)
+	}
+
+	header := &tar.Header{
+		Name:     filepath.ToSlash(volume.RelativePath),
+		Mode:     0600,
+		Size:     volume.Size,
+		ModTime:  a.modTime,
+		Typeflag: tar.TypeReg,
+	}
+	if err := a.tar.WriteHeader(header); err != nil {
+		return volume, fmt.Errorf("failed to write header for %s: %w", volume.RelativePath, err)
+	}
+	if _, err := io.Copy(a.tar, spool); err != nil {
+		return volume, fmt.Errorf("failed to write %s: %w", volume.RelativePath, err)
+	}
+	a.addVolume(volume)
+	return volume, nil
+}
+
+func (a *archiveWriter) writeFile(name string, content []byte) error {
+	header := &tar.Header{
+		Name:     filepath.ToSlash(name),
+		Mode:     0600,
+		Size:     int64(len(content)),
+		ModTime:  a.modTime,
+		Typeflag: tar.TypeReg,
+	}
+	if err := a.tar.WriteHeader(header); err != nil {
+		return fmt.Errorf("failed to write header for %s: %w", name, err)
+	}
+	if _, err := a.tar.Write(content); err != nil {
+		return fmt.Errorf("failed to write %s: %w", name, err)
+	}
+	return nil
+}
+
+// close writes the manifest files and finishes the archive
+func (a *archiveWriter) close(files map[string][]byte) error {
+	for _, name := range manifestFileNames {
+		if content, ok := files[name]; ok {
+			if err := a.writeFile(name, content); err != nil {
+				return err
+			}
+		}
+	}
+	if err := a.tar.Close(); err != nil {
+		return fmt.Errorf("failed to close tar writer: %w", err)
+	}
+	return a.gzip.Close()
+}
+
+// writeManifestSidecar writes the manifest files as a sidecar archive
+func writeManifestSidecar(w io.Writer, files map[string][]byte, modTime time.Time) error {
+	return newArchiveWriter(w, modTime).close(files)
+}
+
+// readArchiveManifestFiles reads the manifest files from a gzipped tar
+// archive or sidecar. Older archives store them first, so reading stops at
+// the first resource after the manifest.
+func readArchiveManifestFiles(r io.Reader) (map[string][]byte, error) {
+	files := make(map[string][]byte)
+	err := walkArchive(r, func(name string, content io.Reader) (bool, error) {
+		if !isManifestFile(name) {
+			_, found := files[types.ManifestFileName]
+			return !found, nil
+		}
+		data, err := io.ReadAll(content)
+		if err != nil {
+			return false, fmt.Errorf("failed to read %s: %w", name, err)
+		}
+		files[name] = data
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := files[types.ManifestFileName]; !ok {
+		return nil, fmt.Errorf("archive does not contain %s", types.ManifestFileName)
+	}
+	return files, nil
+}
+
+// readArchiveManifest reads the manifest of a backup archive, from its
+// sidecar when there is one
+func readArchiveManifest(open, openSidecar func() (io.ReadCloser, error)) (*types.BackupManifest, error) {
+	files, err := readManifestFiles(open, openSidecar)
+	if err != nil {
+		return nil, err
+	}
+	manifest := &types.BackupManifest{}
+	if err := yaml.Unmarshal(files[types.ManifestFileName], manifest); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal manifest: %w", err)
+	}
+	return manifest, nil
+}
+
+// readManifestFiles reads the manifest files of a backup archive from its
+// sidecar, falling back to the archive itself when there is no sidecar
+func readManifestFiles(open, openSidecar func() (io.ReadCloser, error)) (map[string][]byte, error) {
+	r, err := openSidecar()
+	if errors.Is(err, fs.ErrNotExist) {
+		r, err = open()
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	return readArchiveManifestFiles(r)
+}
+
+// openArchiveSource reads a backup archive's manifest files and then opens
+// the archive again to stream its files
+func openArchiveSource(open, openSidecar func() (io.ReadCloser, error)) (backupSource, error) {
+	files, err := readManifestFiles(open, openSidecar)
+	if err != nil {
+		return backupSource{}, err
+	}
+
+	r, err := open()
+	if err != nil {
+		return backupSource{}, err
+	}
+	gzipReader, err := gzip.NewReader(r)
+	if err != nil {
+		r.Close()
+		return backupSource{}, fmt.Errorf("failed to create gzip reader: %w", err)
+	}
+	tarReader := tar.NewReader(gzipReader)
+
+	next := func() (string, io.Reader, error) {
+		for {
+			header, err := tarReader.Next()
+			if err == io.EOF {
+				return "", nil, io.EOF
+			}
+			if err != nil {
+				return "", nil, fmt.Errorf("failed to read tar header: %w", err)
+			}
+			if header.Typeflag == tar.TypeReg {
+				return filepath.ToSlash(header.Name), tarReader, nil
+			}
+		}
+	}
+	return backupSource{manifestFiles: files, next: next, open: openArchiveFile(open), close: r.Close}, nil
+}
+
+// openArchiveFile returns a function that opens a single file of a backup
+// archive, reading the archive up to that file
+func openArchiveFile(open func() (io.ReadCloser, error)) func(path string) (io.ReadCloser, error) {
+	return func(path string) (io.ReadCloser, error) {
+		r, err := open()
+		if err != nil {
+			return nil, err
+		}
+		gzipReader, err := gzip.NewReader(r)
+		if err != nil {
+			r.Close()
+			return nil, fmt.Errorf("failed to create gzip reader: %w", err)
+		}
+		tarReader := tar.NewReader(gzipReader)
+		for {
+			header, err := tarReader.Next()
+			if err == io.EOF {
+				r.Close()
+				return nil, fmt.Errorf("%s: %w", path, fs.ErrNotExist)
+			}
+			if err != nil {
+				r.Close()
+				return nil, fmt.Errorf("failed to read tar header: %w", err)
+			}
+			if header.Typeflag == tar.TypeReg && filepath.ToSlash(header.Name) == path {
+				return archiveFile{Reader: tarReader, Closer: r}, nil
+			}
+		}
+	}
+}
+
+// archiveFile reads a file from an archive and closes the whole archive
+type archiveFile struct {
+	io.Reader
+	io.Closer
+}
+
+// walkArchive calls fn for each regular file in a gzipped tar archive until fn
+// returns false or an error
+func walkArchive(r io.Reader, fn func(name string, content io.Reader) (bool, error)) error {
+	gzipReader, err := gzip.NewReader(r)
+	if err != nil {
+		return fmt.Errorf("failed to create gzip reader: %w", err)
+	}
+	defer gzipReader.Close()
+
+	tarReader := tar.NewReader(gzipReader)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read tar header: %w", err)
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		more, err := fn(filepath.ToSlash(header.Name), tarReader)
+		if err != nil || !more {
+			return err
+		}
+	}
+}
@@ -0,0 +1,206 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"k8s-backup/pkg/types"
+)
+
+// ChainStorage reconstructs incremental backups on load by walking their
+// parent chain, delegating everything else to the wrapped storage backend
+type ChainStorage struct {
+	Storage
+}
+
+// NewChainStorage wraps a storage backend. Wrapping a ChainStorage returns it
+// unchanged.
+func NewChainStorage(backend Storage) *ChainStorage {
+	if chain, ok := backend.(*ChainStorage); ok {
+		return chain
+	}
+	return &ChainStorage{Storage: backend}
+}
+
+// LoadBackup loads a backup and, if it is incremental, the backups it was
+// taken against, returning the full point-in-time state. The returned
+// manifest lists every resource in that state.
+func (s *ChainStorage) LoadBackup(ctx context.Context, backupPath string) (*types.BackupManifest, []types.ResourceWithContent, error) {
+	return ReadBackup(ctx, s, backupPath)
+}
+
+// OpenBackupReader opens a backup and, if it is incremental, the backups it
+// was taken against, streaming the full point-in-time state. Every backup in
+// the chain is read once, side by side. Resources are merged by restore
+// order, so a state made of backups written in dependency order is returned
+// in dependency order too.
+func (s *ChainStorage) OpenBackupReader(ctx context.Context, backupPath string) (BackupReader, error) {
+	reader, err := s.Storage.OpenBackupReader(ctx, backupPath)
+	if err != nil || reader.Manifest().Metadata.Parent == "" {
+		return reader, err
+	}
+	manifest := reader.Manifest()
+
+	backups, err := s.Storage.ListBackups()
+	if err != nil {
+		reader.Close()
+		return nil, fmt.Errorf("failed to list backups: %w", err)
+	}
+	paths := make(map[string]string, len(backups))
+	for _, backup := range backups {
+		paths[backup.Name] = backup.BackupPath
+	}
+
+	// Open the chain from the requested backup up to its full base backup
+	layers := []BackupReader{reader}
+	closeLayers := func() {
+		for _, layer := range layers {
+			layer.Close()
+		}
+	}
+	visited := map[string]bool{manifest.Metadata.Name: true}
+	for parent := manifest.Metadata.Parent; parent != ""; {
+		if visited[parent] {
+			closeLayers()
+			return nil, fmt.Errorf("backup chain of %s contains a cycle at %s", manifest.Metadata.Name, parent)
+		}
+		visited[parent] = true
+
+		path, ok := paths[parent]
+		if !ok {
+			closeLayers()
+			return nil, fmt.Errorf("parent backup %s of %s not found", parent, manifest.Metadata.Name)
+		}
+		parentReader, err := s.Storage.OpenBackupReader(ctx, path)
+		if err != nil {
+			closeLayers()
+			return nil, fmt.Errorf("failed to open parent backup %s: %w", parent, err)
+		}
+		layers = append(layers, parentReader)
+		parent = parentReader.Manifest().Metadata.Parent
+	}
+
+	return newChainReader(manifest, layers), nil
+}
+
+// chainReader merges the layers of an incremental backup chain
+type chainReader struct {
+	manifest *types.BackupManifest
+	// layers are ordered newest first
+	layers []BackupReader
+	// plan holds the layer each resource of the merged manifest is read from
+	plan []int
+	next int
+}
+
+// newChainReader works out from the layers' manifests which of their
+// resources make up the final state and in which order they are read
+func newChainReader(manifest *types.BackupManifest, layers []BackupReader) *chainReader {
+	// A resource is live unless a newer layer replaced or deleted it
+	live := make([][]types.ResourceInfo, len(layers))
+	removed := make(map[string]bool)
+	for i, layer := range layers {
+		layerManifest := layer.Manifest()
+		for _, info := range layerManifest.Resources {
+			if !removed[info.Key()] {
+				live[i] = append(live[i], info)
+			}
+		}
+		for _, info := range layerManifest.Resources {
+			removed[info.Key()] = true
+		}
+		for _, info := range layerManifest.Metadata.Deleted {
+			removed[info.Key()] = true
+		}
+	}
+
+	// Merge the layers by restore order, oldest layer first on ties
+	merged := *manifest
+	merged.Resources = nil
+	var plan []int
+	positions := make([]int, len(layers))
+	for {
+		pick := -1
+		for i := len(layers) - 1; i >= 0; i-- {
+			if positions[i] == len(live[i]) {
+				continue
+			}
+			if pick < 0 || types.GetResourceOrder(live[i][positions[i]].Kind) < types.GetResourceOrder(live[pick][positions[pick]].Kind) {
+				pick = i
+			}
+		}
+		if pick < 0 {
+			break
+		}
+		merged.Resources = append(merged.Resources, live[pick][positions[pick]])
+		plan = append(plan, pick)
+		positions[pick]++
+	}
+
+	return &chainReader{manifest: &merged, layers: layers, plan: plan}
+}
+
+func (r *chainReader) Manifest() *types.BackupManifest {
+	return r.manifest
+}
+
+func (r *chainReader) Next(ctx context.Context) (types.ResourceWithContent, error) {
+	if r.next == len(r.plan) {
+		return types.ResourceWithContent{}, io.EOF
+	}
+
+	// Skip the layer's resources that newer layers replaced
+	want := r.manifest.Resources[r.next]
+	layer := r.layers[r.plan[r.next]]
+	for {
+		resource, err := layer.Next(ctx)
+		if err == io.EOF {
+			return types.ResourceWithContent{}, fmt.Errorf("backup %s ended before %s", layer.Manifest().Metadata.Name, want.RelativePath)
+		}
+		if err != nil {
+			return types.ResourceWithContent{}, err
+		}
+		if resource.Info.Key() == want.Key() {
+			r.next++
+			return resource, nil
+		}
+	}
+}
+
+// OpenVolume opens volume data from the requested backup. Volume data is
+// copied in full by every backup, so older layers are never read.
+func (r *chainReader) OpenVolume(ctx context.Context, volume types.VolumeDataInfo) (io.ReadCloser, error) {
+	return r.layers[0].OpenVolume(ctx, volume)
+}
+
+func (r *chainReader) Close() error {
+	var errs []error
+	for _, layer := range r.layers {
+		if err := layer.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// ApplyIncrement returns the state that results from removing the deleted
+// resources from a base state and adding or replacing the changed ones
+func ApplyIncrement(base []types.ResourceWithContent, deleted []types.ResourceInfo, changed []types.ResourceWithContent) []types.ResourceWithContent {
+	removed := make(map[string]bool, len(deleted)+len(changed))
+	for _, info := range deleted {
+		removed[info.Key()] = true
+	}
+	for _, resource := range changed {
+		removed[resource.Info.Key()] = true
+	}
+
+	state := make([]types.ResourceWithContent, 0, len(base)+len(changed))
+	for _, resource := range base {
+		if !removed[resource.Info.Key()] {
+			state = append(state, resource)
+		}
+	}
+	return append(state, changed...)
+}
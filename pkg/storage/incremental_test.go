@@ -0,0 +1,89 @@
+package storage
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"k8s-backup/pkg/types"
+)
+
+func TestApplyIncrement(t *testing.T) {
+	base := []types.ResourceWithContent{
+		{Content: []byte("v1"), Info: types.ResourceInfo{APIVersion: "apps/v1", Kind: "Deployment", Namespace: "default", Name: "web"}},
+		{Content: []byte("v1"), Info: types.ResourceInfo{APIVersion: "v1", Kind: "ConfigMap", Namespace: "default", Name: "gone"}},
+	}
+	deleted := []types.ResourceInfo{{APIVersion: "v1", Kind: "ConfigMap", Namespace: "default", Name: "gone"}}
+	changed := []types.ResourceWithContent{
+		// A new API version of the same object replaces it
+		{Content: []byte("v2"), Info: types.ResourceInfo{APIVersion: "apps/v1beta2", Kind: "Deployment", Namespace: "default", Name: "web"}},
+	}
+
+	state := ApplyIncrement(base, deleted, changed)
+	if len(state) != 1 || string(state[0].Content) != "v2" {
+		t.Errorf("Expected only the updated Deployment, got %+v", state)
+	}
+}
+
+func TestChainStorageMissingParent(t *testing.T) {
+	backend := NewLocalStorage(t.TempDir())
+	metadata := &types.BackupMetadata{Name: "orphan", Timestamp: time.Now(), Parent: "deleted-parent", Chain: []string{"deleted-parent"}}
+	if err := backend.SaveBackup(context.Background(), metadata, nil); err != nil {
+		t.Fatalf("SaveBackup failed: %v", err)
+	}
+
+	_, _, err := NewChainStorage(backend).LoadBackup(context.Background(), metadata.BackupPath)
+	if err == nil || !strings.Contains(err.Error(), "deleted-parent") {
+		t.Errorf("Expected an error naming the missing parent, got %v", err)
+	}
+}
+
+func TestChainStorageMergesInRestoreOrder(t *testing.T) {
+	ctx := context.Background()
+	backend := NewLocalStorage(t.TempDir())
+	resource := func(kind, namespace, name, content string) types.ResourceWithContent {
+		return types.ResourceWithContent{Content: []byte(content), Info: types.ResourceInfo{APIVersion: "v1", Kind: kind, Namespace: namespace, Name: name}}
+	}
+
+	full := &types.BackupMetadata{Name: "full", Timestamp: time.Now()}
+	if err := backend.SaveBackup(ctx, full, []types.ResourceWithContent{
+		resource("Namespace", "", "default", "v1"),
+		resource("ConfigMap", "default", "gone", "v1"),
+		resource("Deployment", "default", "web", "v1"),
+	}); err != nil {
+		t.Fatalf("SaveBackup failed: %v", err)
+	}
+	increment := &types.BackupMetadata{
+		Name:      "increment",
+		Timestamp: time.Now(),
+		Parent:    "full",
+		Chain:     []string{"full"},
+		Deleted:   []types.ResourceInfo{{APIVersion: "v1", Kind: "ConfigMap", Namespace: "default", Name: "gone"}},
+	}
+	if err := backend.SaveBackup(ctx, increment, []types.ResourceWithContent{
+		resource("Namespace", "", "other", "v1"),
+		resource("Deployment", "default", "web", "v2"),
+	}); err != nil {
+		t.Fatalf("SaveBackup failed: %v", err)
+	}
+
+	manifest, resources, err := NewChainStorage(backend).LoadBackup(ctx, increment.BackupPath)
+	if err != nil {
+		t.Fatalf("LoadBackup failed: %v", err)
+	}
+
+	var got []string
+	for _, r := range resources {
+		got = append(got, r.Info.Kind+"/"+r.Info.Name+"="+string(r.Content))
+	}
+	expected := []string{"Namespace/default=v1", "Namespace/other=v1", "Deployment/web=v2"}
+	if strings.Join(got, " ") != strings.Join(expected, " ") {
+		t.Errorf("Expected %v, got %v", expected, got)
+	}
+	for i, info := range manifest.Resources {
+		if info.Key() != resources[i].Info.Key() {
+			t.Errorf("Manifest entry %d is %s, but %s was read", i, info.Key(), resources[i].Info.Key())
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package storage
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"strings"
+
+	"sigs.k8s.io/yaml"
+
+	"k8s-backup/pkg/types"
+)
+
+// Signing holds the optional ed25519 keys used to sign manifests when saving
+// and to require a valid signature when loading
+type Signing struct {
+	PrivateKey ed25519.PrivateKey
+	PublicKey  ed25519.PublicKey
+}
+
+// checksum returns the digest recorded for a resource file
+func checksum(content []byte) string {
+	sum := sha256.Sum256(content)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// manifestFiles marshals the manifest and returns the files written alongside
+// every backup: the manifest, its digest and, when a private key is set, its
+// signature
+func manifestFiles(manifest *types.BackupManifest, signing Signing) (map[string][]byte, error) {
+	manifestData, err := yaml.Marshal(manifest)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal manifest: %w", err)
+	}
+
+	sum := sha256.Sum256(manifestData)
+	files := map[string][]byte{
+		types.ManifestFileName:       manifestData,
+		types.ManifestDigestFileName: []byte(hex.EncodeToString(sum[:]) + "  " + types.ManifestFileName + "\n"),
+	}
+	if signing.PrivateKey != nil {
+		signature := ed25519.Sign(signing.PrivateKey, manifestData)
+		files[types.ManifestSignatureFileName] = []byte(base64.StdEncoding.EncodeToString(signature) + "\n")
+	}
+	return files, nil
+}
+
+// verifyManifest checks a backup's manifest against its digest and, when a
+// public key is given, its signature, recording the outcome in the report.
+// It returns the parsed manifest, or nil if there is none.
+func verifyManifest(files map[string][]byte, publicKey ed25519.PublicKey, report *types.VerificationReport) *types.BackupManifest {
+	manifestData, ok := files[types.ManifestFileName]
+	if !ok {
+		report.Errors = append(report.Errors, fmt.Errorf("%s is missing", types.ManifestFileName))
+		return nil
+	}
+
+	if digest, ok := files[types.ManifestDigestFileName]; ok {
+		sum := sha256.Sum256(manifestData)
+		fields := strings.Fields(string(digest))
+		if len(fields) == 0 || fields[0] != hex.EncodeToString(sum[:]) {
+			report.Errors = append(report.Errors, fmt.Errorf("%s does not match %s", types.ManifestFileName, types.ManifestDigestFileName))
+		} else {
+			report.ManifestVerified = true
+		}
+	} else {
+		report.Warnings = append(report.Warnings, fmt.Sprintf("%s is missing; the manifest cannot be checked", types.ManifestDigestFileName))
+	}
+
+	signature, signed := files[types.ManifestSignatureFileName]
+	report.Signed = signed
+	switch {
+	case publicKey != nil && !signed:
+		report.Errors = append(report.Errors, fmt.Errorf("backup is not signed"))
+	case publicKey != nil:
+		decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(signature)))
+		if err != nil || !ed25519.Verify(publicKey, manifestData, decoded) {
+			report.Errors = append(report.Errors, fmt.Errorf("manifest signature is not valid for the given key"))
+		} else {
+			report.SignatureVerified = true
+		}
+	case signed:
+		report.Warnings = append(report.Warnings, "backup is signed but no public key was given to verify it")
+	}
+
+	var manifest types.BackupManifest
+	if err := yaml.Unmarshal(manifestData, &manifest); err != nil {
+		report.Errors = append(report.Errors, fmt.Errorf("failed to unmarshal manifest: %w", err))
+		return nil
+	}
+	report.Manifest = &manifest
+	return &manifest
+}
+
+// ValidateResource parses a verified resource and checks that it is a valid
+// object matching its manifest entry
+func ValidateResource(_ *types.BackupManifest, resource types.ResourceWithContent) error {
+	var obj struct {
+		APIVersion string `json:"apiVersion"`
+		Kind       string `json:"kind"`
+		Metadata   struct {
+			Name string `json:"name"`
+		} `json:"metadata"`
+	}
+
+	if err := yaml.Unmarshal(resource.Content, &obj); err != nil {
+		return err
+	}
+	if obj.APIVersion != resource.Info.APIVersion || obj.Kind != resource.Info.Kind || obj.Metadata.Name != resource.Info.Name {
+		return fmt.Errorf("content is %s %s/%s, manifest expects %s %s/%s",
+			obj.APIVersion, obj.Kind, obj.Metadata.Name, resource.Info.APIVersion, resource.Info.Kind, resource.Info.Name)
+	}
+	return nil
+}
+
+// LoadSigningKey reads a PEM-encoded PKCS#8 ed25519 private key, as written by
+// `openssl genpkey -algorithm ed25519`
+func LoadSigningKey(path string) (ed25519.PrivateKey, error) {
+	block, err := readPEM(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse private key %s: %w", path, err)
+	}
+	privateKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s is not an ed25519 private key", path)
+	}
+	return privateKey, nil
+}
+
+// LoadVerificationKey reads a PEM-encoded PKIX ed25519 public key, as written
+// by `openssl pkey -pubout`
+func LoadVerificationKey(path string) (ed25519.PublicKey, error) {
+	block, err := readPEM(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse public key %s: %w", path, err)
+	}
+	publicKey, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("%s is not an ed25519 public key", path)
+	}
+	return publicKey, nil
+}
+
+func readPEM(path string) (*pem.Block, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key file: %w", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s does not contain a PEM block", path)
+	}
+	return block, nil
+}
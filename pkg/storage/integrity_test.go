@@ -0,0 +1,261 @@
+package storage
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"k8s-backup/pkg/types"
+)
+
+func saveIntegrityTestBackup(t *testing.T, storage *LocalStorage, compress bool) string {
+	t.Helper()
+
+	metadata := &types.BackupMetadata{Name: "integrity", Timestamp: time.Now(), Version: types.BackupFormatVersion, Compress: compress}
+	resources := []types.ResourceWithContent{
+		{
+			Content: []byte("apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: app\n  namespace: default\n"),
+			Info:    types.ResourceInfo{APIVersion: "v1", Kind: "ConfigMap", Namespace: "default", Name: "app"},
+		},
+		{
+			Content: []byte("apiVersion: v1\nkind: Namespace\nmetadata:\n  name: default\n"),
+			Info:    types.ResourceInfo{APIVersion: "v1", Kind: "Namespace", Name: "default"},
+		},
+	}
+	if err := storage.SaveBackup(context.Background(), metadata, resources); err != nil {
+		t.Fatalf("SaveBackup failed: %v", err)
+	}
+	return metadata.BackupPath
+}
+
+func TestVerifyBackup(t *testing.T) {
+	configMapPath := filepath.Join("default", "configmap-app.yaml")
+
+	tests := []struct {
+		name     string
+		tamper   func(backupDir string) error
+		missing  []string
+		corrupt  []string
+		extra    []string
+		manifest bool
+	}{
+		{
+			name:     "intact",
+			tamper:   func(string) error { return nil },
+			manifest: true,
+		},
+		{
+			name: "edited resource",
+			tamper: func(dir string) error {
+				return os.WriteFile(filepath.Join(dir, configMapPath), []byte("apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: evil\n"), 0600)
+			},
+			corrupt:  []string{"default/configmap-app.yaml"},
+			manifest: true,
+		},
+		{
+			name:     "missing resource",
+			tamper:   func(dir string) error { return os.Remove(filepath.Join(dir, configMapPath)) },
+			missing:  []string{"default/configmap-app.yaml"},
+			manifest: true,
+		},
+		{
+			name: "extra file",
+			tamper: func(dir string) error {
+				return os.WriteFile(filepath.Join(dir, "default", "secret-x.yaml"), []byte("x"), 0600)
+			},
+			extra:    []string{"default/secret-x.yaml"},
+			manifest: true,
+		},
+		{
+			name: "edited manifest",
+			tamper: func(dir string) error {
+				path := filepath.Join(dir, types.ManifestFileName)
+				data, err := os.ReadFile(path)
+				if err != nil {
+					return err
+				}
+				return os.WriteFile(path, append(data, '\n'), 0600)
+			},
+		},
+	}
+
+	for _, test := range tests {
+		storage := NewLocalStorage(t.TempDir())
+		backupDir := saveIntegrityTestBackup(t, storage, false)
+		if err := test.tamper(backupDir); err != nil {
+			t.Fatalf("%s: failed to tamper with backup: %v", test.name, err)
+		}
+
+		report, err := storage.VerifyBackup(context.Background(), backupDir, nil)
+		if err != nil {
+			t.Fatalf("%s: VerifyBackup failed: %v", test.name, err)
+		}
+		if !reflect.DeepEqual(report.Missing, test.missing) || !reflect.DeepEqual(report.Corrupt, test.corrupt) || !reflect.DeepEqual(report.Extra, test.extra) {
+			t.Errorf("%s: got missing=%v corrupt=%v extra=%v", test.name, report.Missing, report.Corrupt, report.Extra)
+		}
+		if report.ManifestVerified != test.manifest {
+			t.Errorf("%s: expected ManifestVerified=%v", test.name, test.manifest)
+		}
+		if test.name == "intact" && !report.OK() {
+			t.Errorf("%s: expected report to be OK, got errors %v", test.name, report.Errors)
+		}
+		if test.name != "intact" && report.OK() {
+			t.Errorf("%s: expected report to fail", test.name)
+		}
+
+		_, _, loadErr := storage.LoadBackup(context.Background(), backupDir)
+		if shouldLoad := test.name == "intact" || test.name == "extra file"; shouldLoad != (loadErr == nil) {
+			t.Errorf("%s: unexpected LoadBackup result: %v", test.name, loadErr)
+		}
+	}
+}
+
+func TestValidateResource(t *testing.T) {
+	tests := []struct {
+		resource types.ResourceWithContent
+		valid    bool
+	}{
+		{
+			resource: types.ResourceWithContent{
+				Content: []byte("apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: app\n"),
+				Info:    types.ResourceInfo{APIVersion: "v1", Kind: "ConfigMap", Name: "app"},
+			},
+			valid: true,
+		},
+		{
+			resource: types.ResourceWithContent{
+				Content: []byte("apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: other\n"),
+				Info:    types.ResourceInfo{APIVersion: "v1", Kind: "ConfigMap", Name: "app"},
+			},
+		},
+		{
+			resource: types.ResourceWithContent{
+				Content: []byte("not: [valid"),
+				Info:    types.ResourceInfo{APIVersion: "v1", Kind: "Secret", Name: "db"},
+			},
+		},
+	}
+
+	for i, test := range tests {
+		if err := ValidateResource(nil, test.resource); (err == nil) != test.valid {
+			t.Errorf("Resource %d: expected valid=%v, got %v", i, test.valid, err)
+		}
+	}
+}
+
+func TestVerifyBackupRunsCheck(t *testing.T) {
+	storage := NewLocalStorage(t.TempDir())
+	archivePath := saveIntegrityTestBackup(t, storage, true)
+
+	report, err := storage.VerifyBackup(context.Background(), archivePath, func(_ *types.BackupManifest, resource types.ResourceWithContent) error {
+		if resource.Info.Kind == "Namespace" {
+			return fmt.Errorf("rejected")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("VerifyBackup failed: %v", err)
+	}
+	if report.Verified != 2 || !reflect.DeepEqual(report.Invalid, []string{"cluster/namespace-default.yaml: rejected"}) {
+		t.Errorf("Expected 2 verified resources and the Namespace invalid, got %d %v", report.Verified, report.Invalid)
+	}
+}
+
+func TestLoadCompressedBackupVerifiesChecksums(t *testing.T) {
+	storage := NewLocalStorage(t.TempDir())
+	archivePath := saveIntegrityTestBackup(t, storage, true)
+	if !strings.HasSuffix(archivePath, ".tar.gz") {
+		t.Fatalf("Expected BackupPath to point at the archive, got %s", archivePath)
+	}
+
+	manifest, resources, err := storage.LoadBackup(context.Background(), archivePath)
+	if err != nil {
+		t.Fatalf("LoadBackup failed: %v", err)
+	}
+	if len(resources) != 2 || !strings.HasPrefix(manifest.Resources[0].Checksum, "sha256:") {
+		t.Errorf("Expected 2 resources with checksums, got %d: %+v", len(resources), manifest.Resources)
+	}
+}
+
+func TestSignedBackup(t *testing.T) {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	otherPublicKey, _, _ := ed25519.GenerateKey(rand.Reader)
+
+	storage := NewLocalStorage(t.TempDir())
+	storage.SetSigning(Signing{PrivateKey: privateKey})
+	signedPath := saveIntegrityTestBackup(t, storage, false)
+
+	unsigned := NewLocalStorage(t.TempDir())
+	unsignedPath := saveIntegrityTestBackup(t, unsigned, false)
+
+	tests := []struct {
+		name      string
+		path      string
+		publicKey ed25519.PublicKey
+		ok        bool
+	}{
+		{"right key", signedPath, publicKey, true},
+		{"wrong key", signedPath, otherPublicKey, false},
+		{"no key", signedPath, nil, true},
+		{"unsigned", unsignedPath, publicKey, false},
+	}
+
+	for _, test := range tests {
+		verifier := NewLocalStorage(filepath.Dir(test.path))
+		verifier.SetSigning(Signing{PublicKey: test.publicKey})
+
+		report, err := verifier.VerifyBackup(context.Background(), test.path, nil)
+		if err != nil {
+			t.Fatalf("%s: VerifyBackup failed: %v", test.name, err)
+		}
+		if report.OK() != test.ok {
+			t.Errorf("%s: expected OK=%v, got errors %v", test.name, test.ok, report.Errors)
+		}
+		if _, _, err := verifier.LoadBackup(context.Background(), test.path); (err == nil) != test.ok {
+			t.Errorf("%s: unexpected LoadBackup result: %v", test.name, err)
+		}
+	}
+}
+
+func TestLoadSigningKeys(t *testing.T) {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	dir := t.TempDir()
+
+	privateDER, _ := x509.MarshalPKCS8PrivateKey(privateKey)
+	publicDER, _ := x509.MarshalPKIXPublicKey(publicKey)
+	privatePath := filepath.Join(dir, "signing.pem")
+	publicPath := filepath.Join(dir, "signing.pub")
+	if err := os.WriteFile(privatePath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privateDER}), 0600); err != nil {
+		t.Fatalf("Failed to write private key: %v", err)
+	}
+	if err := os.WriteFile(publicPath, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicDER}), 0600); err != nil {
+		t.Fatalf("Failed to write public key: %v", err)
+	}
+
+	loadedPrivate, err := LoadSigningKey(privatePath)
+	if err != nil || !loadedPrivate.Equal(privateKey) {
+		t.Errorf("LoadSigningKey returned %v, %v", loadedPrivate, err)
+	}
+	loadedPublic, err := LoadVerificationKey(publicPath)
+	if err != nil || !loadedPublic.Equal(publicKey) {
+		t.Errorf("LoadVerificationKey returned %v, %v", loadedPublic, err)
+	}
+	if _, err := LoadSigningKey(publicPath); err == nil {
+		t.Error("Expected an error loading a public key as a signing key")
+	}
+}
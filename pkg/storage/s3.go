@@ -0,0 +1,915 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"k8s-backup/pkg/types"
+)
+
+const (
+	// DefaultS3PartSize is the initial multipart upload part size. S3
+	// requires every part except the last to be at least 5 MiB.
+	DefaultS3PartSize = 8 * 1024 * 1024
+
+	// S3 allows at most 10,000 parts of up to 5 GiB each. Streamed archives
+	// have no known size, so the part size doubles every s3PartGrowthInterval
+	// parts, allowing uploads of over 5 TB from the default part size.
+	s3MaxParts           = 10000
+	s3MaxPartSize        = 5 * 1024 * 1024 * 1024
+	s3PartGrowthInterval = 1000
+
+	s3ArchiveSuffix = ".tar.gz"
+	emptySHA256     = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+)
+
+// S3Options configures an S3-compatible storage backend
+type S3Options struct {
+	// Endpoint is the base URL of the service, e.g. http://localhost:9000.
+	// It defaults to the AWS endpoint for Region.
+	Endpoint string
+	Bucket   string
+	Prefix   string
+	Region   string
+	// PathStyle addresses the bucket in the URL path instead of the host name,
+	// as most S3-compatible services require
+	PathStyle bool
+
+	// Credentials are read from the environment or the shared credentials
+	// file when AccessKeyID is empty
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+
+	PartSize   int64
+	HTTPClient *http.Client
+}
+
+// S3Storage stores each backup as a single compressed archive object
+type S3Storage struct {
+	options  S3Options
+	endpoint *url.URL
+	client   *http.Client
+	signing  Signing
+	now      func() time.Time
+}
+
+// NewS3Storage creates an S3 storage backend, filling in defaults and
+// credentials that were not set explicitly
+func NewS3Storage(options S3Options) (*S3Storage, error) {
+	if options.Bucket == "" {
+		return nil, fmt.Errorf("bucket is required")
+	}
+	options.Prefix = strings.Trim(options.Prefix, "/")
+
+	if options.Region == "" {
+		options.Region = firstNonEmpty(os.Getenv("AWS_REGION"), os.Getenv("AWS_DEFAULT_REGION"), "us-east-1")
+	}
+	if options.Endpoint == "" {
+		options.Endpoint = fmt.Sprintf("https://s3.%s.amazonaws.com", options.Region)
+	}
+	endpoint, err := url.Parse(options.Endpoint)
+	if err != nil || endpoint.Scheme == "" || endpoint.Host == "" {
+		return nil, fmt.Errorf("invalid endpoint %q", options.Endpoint)
+	}
+
+	if options.AccessKeyID == "" {
+		creds, err := loadS3Credentials()
+		if err != nil {
+			return nil, err
+		}
+		options.AccessKeyID = creds.AccessKeyID
+		options.SecretAccessKey = creds.SecretAccessKey
+		options.SessionToken = creds.SessionToken
+	}
+
+	if options.PartSize <= 0 {
+		options.PartSize = DefaultS3PartSize
+	}
+	client := options.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	return &S3Storage{
+		options:  options,
+		endpoint: endpoint,
+		client:   client,
+		now:      time.Now,
+	}, nil
+}
+
+// SetSigning sets the keys used to sign saved manifests and to verify loaded ones
+func (s *S3Storage) SetSigning(signing Signing) {
+	s.signing = signing
+}
+
+// SaveBackup streams the backup archive to the bucket. The archive is always
+// compressed, whatever metadata.Compress says.
+func (s *S3Storage) SaveBackup(ctx context.Context, metadata *types.BackupMetadata, resources []types.ResourceWithContent) error {
+	return WriteBackup(ctx, s, metadata, resources)
+}
+
+// LoadBackup downloads and reads a backup archive. backupPath may be an
+// s3:// URL, an object key or a backup name.
+func (s *S3Storage) LoadBackup(ctx context.Context, backupPath string) (*types.BackupManifest, []types.ResourceWithContent, error) {
+	return ReadBackup(ctx, s, backupPath)
+}
+
+// OpenBackupWriter starts uploading a backup archive. Resources are
+// compressed and uploaded as they are written, one part at a time.
+func (s *S3Storage) OpenBackupWriter(ctx context.Context, metadata *types.BackupMetadata) (BackupWriter, error) {
+	key := s.objectKey(metadata.Name + s3ArchiveSuffix)
+
+	// Existing backups are never written over, as with local storage. The
+	// sidecar is checked as well, since it is what lists a backup.
+	for _, existing := range []string{key, key + manifestSidecarSuffix} {
+		found, err := s.headObject(ctx, existing)
+		if err != nil {
+			return nil, fmt.Errorf("failed to check for backup %s: %w", metadata.Name, err)
+		}
+		if found {
+			return nil, fmt.Errorf("backup %s already exists in %s", metadata.Name, s.objectURL(s.objectKey("")))
+		}
+	}
+
+	metadata.BackupPath = s.objectURL(key)
+	metadata.Compress = true
+
+	pr, pw := io.Pipe()
+	w := &s3BackupWriter{
+		storage:  s,
+		key:      key,
+		metadata: metadata,
+		pipe:     pw,
+		archive:  newArchiveWriter(pw, metadata.Timestamp),
+		uploaded: make(chan struct{}),
+	}
+	go func() {
+		w.size, w.uploadErr = s.upload(ctx, key, pr)
+		pr.CloseWithError(w.uploadErr)
+		close(w.uploaded)
+	}()
+	return w, nil
+}
+
+// OpenBackupReader downloads a backup's manifest, from its sidecar when
+// there is one, and then streams the archive
+func (s *S3Storage) OpenBackupReader(ctx context.Context, backupPath string) (BackupReader, error) {
+	key, source, err := s.openSource(ctx, backupPath)
+	if err != nil {
+		return nil, err
+	}
+	reader, err := newBackupReader(source, s.signing.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	reader.Manifest().Metadata.BackupPath = s.objectURL(key)
+	return reader, nil
+}
+
+// VerifyBackup streams a backup archive and checks every file against its
+// manifest
+func (s *S3Storage) VerifyBackup(ctx context.Context, backupPath string, check ResourceCheck) (*types.VerificationReport, error) {
+	_, source, err := s.openSource(ctx, backupPath)
+	if err != nil {
+		return nil, err
+	}
+	return verifyBackup(ctx, source, s.signing.PublicKey, check)
+}
+
+// openSource resolves backupPath and opens its archive for reading
+func (s *S3Storage) openSource(ctx context.Context, backupPath string) (string, backupSource, error) {
+	key, err := s.resolveKey(backupPath)
+	if err != nil {
+		return "", backupSource{}, err
+	}
+	source, err := openArchiveSource(s.openObject(ctx, key), s.openObject(ctx, key+manifestSidecarSuffix))
+	if err != nil {
+		return "", backupSource{}, err
+	}
+	return key, source, nil
+}
+
+// openObject returns a function that downloads an object, failing with
+// fs.ErrNotExist if there is no such object
+func (s *S3Storage) openObject(ctx context.Context, key string) func() (io.ReadCloser, error) {
+	return func() (io.ReadCloser, error) {
+		body, _, err := s.getObject(ctx, key)
+		var respErr *s3Error
+		if errors.As(err, &respErr) && respErr.StatusCode == http.StatusNotFound {
+			return nil, fmt.Errorf("failed to download %s: %w", key, fs.ErrNotExist)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to download %s: %w", key, err)
+		}
+		return body, nil
+	}
+}
+
+// ListBackups returns the metadata of every backup archive under the prefix.
+// Only manifests are downloaded: the sidecar of each archive, or for archives
+// without one, the start of the archive.
+func (s *S3Storage) ListBackups() ([]*types.BackupMetadata, error) {
+	ctx := context.Background()
+
+	objects, err := s.listObjects(ctx, s.objectKey(""))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list backups: %w", err)
+	}
+
+	keys := make(map[string]bool, len(objects))
+	for _, object := range objects {
+		keys[object.Key] = true
+	}
+
+	var backups []*types.BackupMetadata
+	for _, object := range objects {
+		if !strings.HasSuffix(object.Key, s3ArchiveSuffix) {
+			continue
+		}
+
+		openSidecar := func() (io.ReadCloser, error) { return nil, fs.ErrNotExist }
+		if keys[object.Key+manifestSidecarSuffix] {
+			openSidecar = s.openObject(ctx, object.Key+manifestSidecarSuffix)
+		}
+		manifest, err := readArchiveManifest(s.openObject(ctx, object.Key), openSidecar)
+		var respErr *s3Error
+		if errors.As(err, &respErr) {
+			return nil, err
+		}
+		if err != nil {
+			continue
+		}
+
+		metadata := manifest.Metadata
+		metadata.BackupPath = s.objectURL(object.Key)
+		metadata.Size = object.Size
+		backups = append(backups, &metadata)
+	}
+
+	return backups, nil
+}
+
+// DeleteBackup removes a backup archive and its manifest sidecar from the
+// bucket
+func (s *S3Storage) DeleteBackup(backupPath string) error {
+	key, err := s.resolveKey(backupPath)
+	if err != nil {
+		return err
+	}
+
+	for _, objectKey := range []string{key, key + manifestSidecarSuffix} {
+		resp, err := s.do(context.Background(), http.MethodDelete, objectKey, nil, nil)
+		if err != nil {
+			return fmt.Errorf("failed to delete backup: %w", err)
+		}
+		resp.Body.Close()
+	}
+	return nil
+}
+
+// s3BackupWriter compresses resources into a pipe that is uploaded as they
+// are written
+type s3BackupWriter struct {
+	storage  *S3Storage
+	key      string
+	metadata *types.BackupMetadata
+	pipe     *io.PipeWriter
+	archive  *archiveWriter
+	done     bool
+
+	// uploaded is closed once the upload has finished and set size and
+	// uploadErr
+	uploaded  chan struct{}
+	size      int64
+	uploadErr error
+}
+
+var errBackupAborted = errors.New("backup aborted")
+
+func (w *s3BackupWriter) WriteResource(ctx context.Context, resource types.ResourceWithContent) error {
+	if err := w.archive.writeResource(resource); err != nil {
+		return fmt.Errorf("failed to upload backup: %w", err)
+	}
+	return nil
+}
+
+func (w *s3BackupWriter) WriteVolume(ctx context.Context, volume types.VolumeDataInfo, data io.Reader) (types.VolumeDataInfo, error) {
+	volume, err := w.archive.writeVolume(volume, data)
+	if err != nil && volume.Phase != types.VolumeDataFailed {
+		return volume, fmt.Errorf("failed to upload backup: %w", err)
+	}
+	return volume, err
+}
+
+func (w *s3BackupWriter) Commit(ctx context.Context) error {
+	files, err := manifestFiles(w.archive.manifest(w.metadata), w.storage.signing)
+	if err == nil {
+		err = w.archive.close(files)
+	}
+	w.pipe.CloseWithError(err)
+	<-w.uploaded
+	w.done = true
+	if err == nil {
+		err = w.uploadErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to upload backup: %w", err)
+	}
+
+	// An archive left without its sidecar would be read with a stale
+	// sidecar from an earlier backup of the same name
+	var sidecar bytes.Buffer
+	err = writeManifestSidecar(&sidecar, files, w.metadata.Timestamp)
+	if err == nil {
+		var resp *http.Response
+		resp, err = w.storage.do(ctx, http.MethodPut, w.key+manifestSidecarSuffix, nil, sidecar.Bytes())
+		if err == nil {
+			resp.Body.Close()
+		}
+	}
+	if err != nil {
+		w.storage.DeleteBackup(w.key)
+		return fmt.Errorf("failed to upload manifest: %w", err)
+	}
+
+	w.metadata.Size = w.size
+	return nil
+}
+
+func (w *s3BackupWriter) Abort() error {
+	if w.done {
+		return nil
+	}
+	w.done = true
+	w.pipe.CloseWithError(errBackupAborted)
+	<-w.uploaded
+	return nil
+}
+
+// GetBackupPath returns the s3:// URL a backup with the given name is stored at
+func (s *S3Storage) GetBackupPath(backupName string) string {
+	return s.objectURL(s.objectKey(backupName + s3ArchiveSuffix))
+}
+
+// objectKey joins a name onto the configured prefix
+func (s *S3Storage) objectKey(name string) string {
+	if s.options.Prefix == "" {
+		return name
+	}
+	return s.options.Prefix + "/" + name
+}
+
+func (s *S3Storage) objectURL(key string) string {
+	return fmt.Sprintf("s3://%s/%s", s.options.Bucket, key)
+}
+
+// resolveKey maps a backup path as returned by this backend, an object key or
+// a bare backup name to an object key
+func (s *S3Storage) resolveKey(backupPath string) (string, error) {
+	if strings.HasPrefix(backupPath, "s3://") {
+		u, err := url.Parse(backupPath)
+		if err != nil {
+			return "", fmt.Errorf("invalid backup path %q: %w", backupPath, err)
+		}
+		if u.Host != s.options.Bucket {
+			return "", fmt.Errorf("backup %s is not in bucket %s", backupPath, s.options.Bucket)
+		}
+		return strings.TrimPrefix(u.Path, "/"), nil
+	}
+
+	key := strings.TrimPrefix(backupPath, "/")
+	if s.options.Prefix != "" && !strings.HasPrefix(key, s.options.Prefix+"/") {
+		key = s.objectKey(key)
+	}
+	if !strings.HasSuffix(key, s3ArchiveSuffix) {
+		key += s3ArchiveSuffix
+	}
+	return key, nil
+}
+
+// s3PartSize returns the size of a multipart upload part, growing from the
+// initial size as the upload goes on
+func s3PartSize(initial int64, partNumber int) int64 {
+	size := initial
+	for i := s3PartGrowthInterval; i < partNumber && size < s3MaxPartSize; i += s3PartGrowthInterval {
+		size *= 2
+	}
+	if size > s3MaxPartSize {
+		size = s3MaxPartSize
+	}
+	return size
+}
+
+// upload streams r to key. Content that fits in a single part is sent with a
+// plain PUT; anything larger uses a multipart upload, buffering one part at a
+// time. It returns the number of bytes uploaded.
+func (s *S3Storage) upload(ctx context.Context, key string, r io.Reader) (int64, error) {
+	buf := make([]byte, s3PartSize(s.options.PartSize, 1))
+
+	n, err := io.ReadFull(r, buf)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		resp, err := s.do(ctx, http.MethodPut, key, nil, buf[:n])
+		if err != nil {
+			return 0, err
+		}
+		resp.Body.Close()
+		return int64(n), nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	uploadID, err := s.createMultipartUpload(ctx, key)
+	if err != nil {
+		return 0, err
+	}
+
+	var parts []completedPart
+	total := int64(0)
+	for {
+		etag, err := s.uploadPart(ctx, key, uploadID, len(parts)+1, buf[:n])
+		if err != nil {
+			s.abortMultipartUpload(key, uploadID)
+			return 0, err
+		}
+		parts = append(parts, completedPart{PartNumber: len(parts) + 1, ETag: etag})
+		total += int64(n)
+
+		if size := s3PartSize(s.options.PartSize, len(parts)+1); size != int64(len(buf)) {
+			buf = make([]byte, size)
+		}
+		n, err = io.ReadFull(r, buf)
+		if err == io.EOF {
+			break
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
+			s.abortMultipartUpload(key, uploadID)
+			return 0, err
+		}
+		if len(parts) == s3MaxParts {
+			s.abortMultipartUpload(key, uploadID)
+			return 0, fmt.Errorf("failed to upload %s: larger than %d parts", key, s3MaxParts)
+		}
+	}
+
+	if err := s.completeMultipartUpload(ctx, key, uploadID, parts); err != nil {
+		s.abortMultipartUpload(key, uploadID)
+		return 0, err
+	}
+	return total, nil
+}
+
+type initiateMultipartUploadResult struct {
+	UploadID string `xml:"UploadId"`
+}
+
+type completedPart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+type completeMultipartUpload struct {
+	XMLName xml.Name        `xml:"CompleteMultipartUpload"`
+	Parts   []completedPart `xml:"Part"`
+}
+
+func (s *S3Storage) createMultipartUpload(ctx context.Context, key string) (string, error) {
+	resp, err := s.do(ctx, http.MethodPost, key, url.Values{"uploads": {""}}, nil)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var result initiateMultipartUploadResult
+	if err := xml.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", fmt.Errorf("failed to decode multipart upload response: %w", err)
+	}
+	return result.UploadID, nil
+}
+
+func (s *S3Storage) uploadPart(ctx context.Context, key, uploadID string, partNumber int, data []byte) (string, error) {
+	query := url.Values{"partNumber": {strconv.Itoa(partNumber)}, "uploadId": {uploadID}}
+	resp, err := s.do(ctx, http.MethodPut, key, query, data)
+	if err != nil {
+		return "", fmt.Errorf("failed to upload part %d: %w", partNumber, err)
+	}
+	resp.Body.Close()
+	return resp.Header.Get("ETag"), nil
+}
+
+func (s *S3Storage) completeMultipartUpload(ctx context.Context, key, uploadID string, parts []completedPart) error {
+	body, err := xml.Marshal(completeMultipartUpload{Parts: parts})
+	if err != nil {
+		return err
+	}
+
+	resp, err := s.do(ctx, http.MethodPost, key, url.Values{"uploadId": {uploadID}}, body)
+	if err != nil {
+		return fmt.Errorf("failed to complete multipart upload: %w", err)
+	}
+	defer resp.Body.Close()
+
+	// S3 can report a failure in the body of a 200 response
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if respErr := parseS3Error(data); respErr != nil {
+		return fmt.Errorf("failed to complete multipart upload: %w", respErr)
+	}
+	return nil
+}
+
+// abortMultipartUpload releases the parts of a failed upload. It is best
+// effort and runs even if the upload's context was cancelled.
+func (s *S3Storage) abortMultipartUpload(key, uploadID string) {
+	resp, err := s.do(context.Background(), http.MethodDelete, key, url.Values{"uploadId": {uploadID}}, nil)
+	if err == nil {
+		resp.Body.Close()
+	}
+}
+
+func (s *S3Storage) getObject(ctx context.Context, key string) (io.ReadCloser, int64, error) {
+	resp, err := s.do(ctx, http.MethodGet, key, nil, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	return resp.Body, resp.ContentLength, nil
+}
+
+// headObject reports whether an object exists
+func (s *S3Storage) headObject(ctx context.Context, key string) (bool, error) {
+	resp, err := s.do(ctx, http.MethodHead, key, nil, nil)
+	var respErr *s3Error
+	if errors.As(err, &respErr) && respErr.StatusCode == http.StatusNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+	return true, nil
+}
+
+type s3Object struct {
+	Key  string `xml:"Key"`
+	Size int64  `xml:"Size"`
+}
+
+type listBucketResult struct {
+	Contents              []s3Object `xml:"Contents"`
+	IsTruncated           bool       `xml:"IsTruncated"`
+	NextContinuationToken string     `xml:"NextContinuationToken"`
+}
+
+// listObjects returns every object whose key starts with prefix
+func (s *S3Storage) listObjects(ctx context.Context, prefix string) ([]s3Object, error) {
+	var objects []s3Object
+	token := ""
+
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+
+		resp, err := s.do(ctx, http.MethodGet, "", query, nil)
+		if err != nil {
+			return nil, err
+		}
+		var result listBucketResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode list response: %w", err)
+		}
+
+		objects = append(objects, result.Contents...)
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return objects, nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+// s3Error is the error document returned by S3 for failed requests
+type s3Error struct {
+	XMLName    xml.Name `xml:"Error"`
+	Code       string   `xml:"Code"`
+	Message    string   `xml:"Message"`
+	StatusCode int      `xml:"-"`
+}
+
+func (e *s3Error) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("%s (status %d)", e.Code, e.StatusCode)
+	}
+	return fmt.Sprintf("%s: %s (status %d)", e.Code, e.Message, e.StatusCode)
+}
+
+func parseS3Error(data []byte) *s3Error {
+	var respErr s3Error
+	if err := xml.Unmarshal(data, &respErr); err != nil || respErr.Code == "" {
+		return nil
+	}
+	return &respErr
+}
+
+// do sends a signed request for key (or the bucket itself when key is empty)
+// and turns non-2xx responses into errors
+func (s *S3Storage) do(ctx context.Context, method, key string, query url.Values, body []byte) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, s.requestURL(key, query).String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = int64(len(body))
+
+	payloadHash := emptySHA256
+	if len(body) > 0 {
+		sum := sha256.Sum256(body)
+		payloadHash = hex.EncodeToString(sum[:])
+	}
+	signV4(req, payloadHash, s.options.AccessKeyID, s.options.SecretAccessKey, s.options.SessionToken, s.options.Region, s.now())
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		defer resp.Body.Close()
+		data, _ := io.ReadAll(resp.Body)
+		respErr := parseS3Error(data)
+		if respErr == nil {
+			respErr = &s3Error{Code: http.StatusText(resp.StatusCode)}
+		}
+		respErr.StatusCode = resp.StatusCode
+		return nil, fmt.Errorf("%s %s: %w", method, key, respErr)
+	}
+	return resp, nil
+}
+
+// requestURL builds a virtual-hosted or path-style URL whose path and query
+// are already in the canonical form used for signing
+func (s *S3Storage) requestURL(key string, query url.Values) *url.URL {
+	u := *s.endpoint
+	basePath := strings.TrimSuffix(u.Path, "/")
+
+	objectPath := "/" + key
+	if s.options.PathStyle {
+		objectPath = "/" + s.options.Bucket
+		if key != "" {
+			objectPath += "/" + key
+		}
+	} else {
+		u.Host = s.options.Bucket + "." + u.Host
+	}
+
+	u.Path = basePath + objectPath
+	u.RawPath = awsURIEncode(u.Path, false)
+	u.RawQuery = canonicalQuery(query)
+	return &u
+}
+
+// signV4 signs a request with AWS Signature Version 4. The host and every
+// header already set on the request are signed.
+func signV4(req *http.Request, payloadHash, accessKeyID, secretAccessKey, sessionToken, region string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", sessionToken)
+	}
+
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	headers := map[string]string{"host": host}
+	for name, values := range req.Header {
+		trimmed := make([]string, len(values))
+		for i, v := range values {
+			trimmed[i] = strings.Join(strings.Fields(v), " ")
+		}
+		headers[strings.ToLower(name)] = strings.Join(trimmed, ",")
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalPath := req.URL.EscapedPath()
+	if canonicalPath == "" {
+		canonicalPath = "/"
+	}
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		canonicalPath,
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + region + "/s3/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+secretAccessKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		accessKeyID, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// canonicalQuery encodes query parameters sorted by key, as SigV4 requires
+func canonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var parts []string
+	for _, key := range keys {
+		values := append([]string(nil), query[key]...)
+		sort.Strings(values)
+		for _, value := range values {
+			parts = append(parts, awsURIEncode(key, true)+"="+awsURIEncode(value, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// awsURIEncode percent-encodes everything except unreserved characters, and
+// slashes unless encodeSlash is set
+func awsURIEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+type s3Credentials struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+}
+
+// loadS3Credentials reads credentials from the standard AWS environment
+// variables, falling back to the shared credentials file
+func loadS3Credentials() (s3Credentials, error) {
+	if id := os.Getenv("AWS_ACCESS_KEY_ID"); id != "" {
+		return s3Credentials{
+			AccessKeyID:     id,
+			SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+		}, nil
+	}
+
+	credentialsFile := os.Getenv("AWS_SHARED_CREDENTIALS_FILE")
+	if credentialsFile == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return s3Credentials{}, fmt.Errorf("no S3 credentials in environment and no home directory: %w", err)
+		}
+		credentialsFile = filepath.Join(home, ".aws", "credentials")
+	}
+	profile := firstNonEmpty(os.Getenv("AWS_PROFILE"), "default")
+
+	creds, err := readCredentialsFile(credentialsFile, profile)
+	if err != nil {
+		return s3Credentials{}, fmt.Errorf("no S3 credentials found: %w", err)
+	}
+	return creds, nil
+}
+
+// readCredentialsFile reads a profile from an AWS shared credentials file
+func readCredentialsFile(credentialsFile, profile string) (s3Credentials, error) {
+	f, err := os.Open(credentialsFile)
+	if err != nil {
+		return s3Credentials{}, err
+	}
+	defer f.Close()
+
+	var creds s3Credentials
+	section := ""
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = strings.TrimSpace(line[1 : len(line)-1])
+			continue
+		}
+		if section != profile {
+			continue
+		}
+
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			continue
+		}
+		switch strings.TrimSpace(key) {
+		case "aws_access_key_id":
+			creds.AccessKeyID = strings.TrimSpace(value)
+		case "aws_secret_access_key":
+			creds.SecretAccessKey = strings.TrimSpace(value)
+		case "aws_session_token":
+			creds.SessionToken = strings.TrimSpace(value)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return s3Credentials{}, err
+	}
+	if creds.AccessKeyID == "" {
+		return s3Credentials{}, fmt.Errorf("profile %q not found in %s", profile, credentialsFile)
+	}
+	return creds, nil
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// parseS3Location parses s3://bucket/prefix?endpoint=...&region=...&pathStyle=...
+func parseS3Location(location string) (S3Options, error) {
+	u, err := url.Parse(location)
+	if err != nil {
+		return S3Options{}, fmt.Errorf("invalid storage location %q: %w", location, err)
+	}
+	if u.Host == "" {
+		return S3Options{}, fmt.Errorf("storage location %q has no bucket", location)
+	}
+
+	query := u.Query()
+	options := S3Options{
+		Bucket:   u.Host,
+		Prefix:   path.Clean("/" + u.Path)[1:],
+		Endpoint: query.Get("endpoint"),
+		Region:   query.Get("region"),
+		// Custom endpoints are almost always MinIO-style services
+		PathStyle: query.Get("endpoint") != "",
+	}
+	if v := query.Get("pathStyle"); v != "" {
+		options.PathStyle, err = strconv.ParseBool(v)
+		if err != nil {
+			return S3Options{}, fmt.Errorf("invalid pathStyle %q: %w", v, err)
+		}
+	}
+	return options, nil
+}
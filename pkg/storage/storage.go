@@ -1,11 +1,10 @@
 package storage
 
 import (
-	"archive/tar"
-	"compress/gzip"
 	"context"
 	"fmt"
 	"io"
+	"io/fs"
 	"os"
 	"path/filepath"
 	"strings"
@@ -18,155 +17,137 @@ import (
 type Storage interface {
 	SaveBackup(ctx context.Context, metadata *types.BackupMetadata, resources []types.ResourceWithContent) error
 	LoadBackup(ctx context.Context, backupPath string) (*types.BackupManifest, []types.ResourceWithContent, error)
+	// OpenBackupWriter and OpenBackupReader stream a backup's resources
+	// instead of holding them all in memory
+	OpenBackupWriter(ctx context.Context, metadata *types.BackupMetadata) (BackupWriter, error)
+	OpenBackupReader(ctx context.Context, backupPath string) (BackupReader, error)
 	ListBackups() ([]*types.BackupMetadata, error)
 	DeleteBackup(backupPath string) error
 	GetBackupPath(backupName string) string
+	// VerifyBackup checks every file of a backup against its manifest, calling
+	// check, when set, for each resource whose content matched its checksum
+	VerifyBackup(ctx context.Context, backupPath string, check ResourceCheck) (*types.VerificationReport, error)
 }
 
+// Open returns the storage backend for a location, which is either a local
+// directory or an s3://bucket/prefix URL. S3 URLs accept endpoint, region and
+// pathStyle query parameters for S3-compatible services.
+func Open(location string) (Storage, error) {
+	if strings.HasPrefix(location, "s3://") {
+		options, err := parseS3Location(location)
+		if err != nil {
+			return nil, err
+		}
+		return NewS3Storage(options)
+	}
+	return NewLocalStorage(location), nil
+}
+
+// FindBackup returns the metadata of the backup with the given name
+func FindBackup(s Storage, name string) (*types.BackupMetadata, error) {
+	backups, err := s.ListBackups()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list backups: %w", err)
+	}
+	for _, backup := range backups {
+		if backup.Name == name {
+			return backup, nil
+		}
+	}
+	return nil, fmt.Errorf("backup %s not found", name)
+}
+
+// LocalStorage keeps backups on the local filesystem. Backups can contain
+// Secrets, so files and directories are only accessible to the owner.
 type LocalStorage struct {
 	basePath string
+	signing  Signing
 }
 
 func NewLocalStorage(basePath string) *LocalStorage {
 	return &LocalStorage{basePath: basePath}
 }
 
+// SetSigning sets the keys used to sign saved manifests and to verify loaded ones
+func (s *LocalStorage) SetSigning(signing Signing) {
+	s.signing = signing
+}
+
 // SaveBackup saves a backup to the local filesystem
 func (s *LocalStorage) SaveBackup(ctx context.Context, metadata *types.BackupMetadata, resources []types.ResourceWithContent) error {
-	// Create backup directory
-	backupDir := filepath.Join(s.basePath, metadata.Name)
-	if err := os.MkdirAll(backupDir, 0755); err != nil {
-		return fmt.Errorf("failed to create backup directory: %w", err)
-	}
+	return WriteBackup(ctx, s, metadata, resources)
+}
 
-	// Update metadata with final path
-	metadata.BackupPath = backupDir
+// LoadBackup loads a backup from the local filesystem, failing if any
+// resource file is missing or does not match its recorded checksum
+func (s *LocalStorage) LoadBackup(ctx context.Context, backupPath string) (*types.BackupManifest, []types.ResourceWithContent, error) {
+	return ReadBackup(ctx, s, backupPath)
+}
 
-	// Create manifest
-	manifest := &types.BackupManifest{
-		Metadata:  *metadata,
-		Resources: make([]types.ResourceInfo, len(resources)),
+// OpenBackupWriter starts a new backup. Compressed backups are written
+// straight into a gzipped tar archive, others into a directory with one file
+// per resource.
+func (s *LocalStorage) OpenBackupWriter(ctx context.Context, metadata *types.BackupMetadata) (BackupWriter, error) {
+	if err := os.MkdirAll(s.basePath, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create backup directory: %w", err)
 	}
 
-	// Batch directory creation and file operations for efficiency
-	dirMap := make(map[string]bool)
-	totalSize := int64(0)
-
-	for i, resource := range resources {
-		// Determine file path within backup
-		var relativePath string
-		if resource.Info.Namespace != "" {
-			relativePath = filepath.Join(resource.Info.Namespace,
-				fmt.Sprintf("%s-%s.yaml", strings.ToLower(resource.Info.Kind), resource.Info.Name))
-		} else {
-			relativePath = filepath.Join("cluster",
-				fmt.Sprintf("%s-%s.yaml", strings.ToLower(resource.Info.Kind), resource.Info.Name))
-		}
-
-		// Batch directory creation
-		dir := filepath.Dir(filepath.Join(backupDir, relativePath))
-		if !dirMap[dir] {
-			if err := os.MkdirAll(dir, 0755); err != nil {
-				return fmt.Errorf("failed to create directory %s: %w", dir, err)
-			}
-			dirMap[dir] = true
-		}
-
-		// Update resource info and manifest first
-		resourceInfo := resource.Info
-		resourceInfo.RelativePath = relativePath
-		manifest.Resources[i] = resourceInfo
-		totalSize += int64(len(resource.Content))
-
-		// Check context cancellation before I/O
-		if ctx.Err() != nil {
-			return ctx.Err()
+	// Existing backups are never written over: a failed backup would delete
+	// the one it replaced, and a successful one would mix with its files
+	backupDir := filepath.Join(s.basePath, metadata.Name)
+	for _, existing := range []string{backupDir, backupDir + ".tar.gz"} {
+		if _, err := os.Stat(existing); err == nil {
+			return nil, fmt.Errorf("backup %s already exists in %s", metadata.Name, s.basePath)
+		} else if !os.IsNotExist(err) {
+			return nil, fmt.Errorf("failed to check for backup %s: %w", metadata.Name, err)
 		}
 	}
 
-	// Write all files in a second pass for better I/O efficiency
-	for i, resource := range resources {
-		relativePath := manifest.Resources[i].RelativePath
-		fullPath := filepath.Join(backupDir, relativePath)
-		if err := os.WriteFile(fullPath, resource.Content, 0644); err != nil {
-			return fmt.Errorf("failed to write resource file %s: %w", relativePath, err)
+	if !metadata.Compress {
+		// The directory only gets its final name once it is complete
+		partialDir := backupDir + ".partial"
+		if err := os.RemoveAll(partialDir); err != nil {
+			return nil, fmt.Errorf("failed to remove partial backup directory: %w", err)
+		}
+		if err := os.Mkdir(partialDir, 0700); err != nil {
+			return nil, fmt.Errorf("failed to create backup directory: %w", err)
 		}
+		metadata.BackupPath = backupDir
+		return &directoryWriter{dir: partialDir, path: backupDir, metadata: metadata, signing: s.signing, dirs: make(map[string]bool)}, nil
 	}
 
-	// Update metadata with final size
-	manifest.Metadata.Size = totalSize
-
-	// Save manifest
-	manifestPath := filepath.Join(backupDir, types.ManifestFileName)
-	manifestData, err := yaml.Marshal(manifest)
+	// The archive only gets its final name once it is complete
+	archivePath := backupDir + ".tar.gz"
+	file, err := os.OpenFile(archivePath+".partial", os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
 	if err != nil {
-		return fmt.Errorf("failed to marshal manifest: %w", err)
-	}
-
-	if err := os.WriteFile(manifestPath, manifestData, 0644); err != nil {
-		return fmt.Errorf("failed to write manifest: %w", err)
+		return nil, fmt.Errorf("failed to create archive file: %w", err)
 	}
-
-	// Optionally compress backup
-	if metadata.Compress {
-		if err := s.compressBackup(backupDir); err != nil {
-			return fmt.Errorf("failed to compress backup: %w", err)
-		}
-	}
-
-	return nil
+	metadata.BackupPath = archivePath
+	return &localArchiveWriter{
+		path:     archivePath,
+		file:     file,
+		archive:  newArchiveWriter(file, metadata.Timestamp),
+		metadata: metadata,
+		signing:  s.signing,
+	}, nil
 }
 
-// LoadBackup loads a backup from the local filesystem
-func (s *LocalStorage) LoadBackup(ctx context.Context, backupPath string) (*types.BackupManifest, []types.ResourceWithContent, error) {
-	// Handle compressed backups
-	isCompressed := strings.HasSuffix(backupPath, ".tar.gz")
-	actualPath := backupPath
-
-	if isCompressed {
-		// Extract compressed backup to temporary directory
-		tempDir, err := s.extractBackup(backupPath)
-		if err != nil {
-			return nil, nil, fmt.Errorf("failed to extract backup: %w", err)
-		}
-		defer os.RemoveAll(tempDir) // Cleanup temp directory
-		actualPath = tempDir
-	}
-
-	// Load manifest
-	manifestPath := filepath.Join(actualPath, types.ManifestFileName)
-	manifestData, err := os.ReadFile(manifestPath)
+// OpenBackupReader opens a directory or compressed backup for streaming
+func (s *LocalStorage) OpenBackupReader(ctx context.Context, backupPath string) (BackupReader, error) {
+	source, err := s.openSource(backupPath)
 	if err != nil {
-		return nil, nil, fmt.Errorf("failed to read manifest: %w", err)
-	}
-
-	var manifest types.BackupManifest
-	if err := yaml.Unmarshal(manifestData, &manifest); err != nil {
-		return nil, nil, fmt.Errorf("failed to unmarshal manifest: %w", err)
+		return nil, err
 	}
+	return newBackupReader(source, s.signing.PublicKey)
+}
 
-	// Load resource files
-	resources := make([]types.ResourceWithContent, 0, len(manifest.Resources))
-	for _, resourceInfo := range manifest.Resources {
-		resourcePath := filepath.Join(actualPath, resourceInfo.RelativePath)
-		content, err := os.ReadFile(resourcePath)
-		if err != nil {
-			return nil, nil, fmt.Errorf("failed to read resource file %s: %w", resourceInfo.RelativePath, err)
-		}
-
-		resource := types.ResourceWithContent{
-			Content: content,
-			Info:    resourceInfo,
-		}
-		resources = append(resources, resource)
-
-		// Check context cancellation
-		if ctx.Err() != nil {
-			return nil, nil, ctx.Err()
-		}
+// VerifyBackup checks every file of a backup against its manifest
+func (s *LocalStorage) VerifyBackup(ctx context.Context, backupPath string, check ResourceCheck) (*types.VerificationReport, error) {
+	source, err := s.openSource(backupPath)
+	if err != nil {
+		return nil, err
 	}
-
-	return &manifest, resources, nil
+	return verifyBackup(ctx, source, s.signing.PublicKey, check)
 }
 
 // ListBackups returns all available backups in the local storage
@@ -201,9 +182,18 @@ func (s *LocalStorage) ListBackups() ([]*types.BackupMetadata, error) {
 	return backups, nil
 }
 
-// DeleteBackup removes a backup from local storage
+// DeleteBackup removes a backup, and the manifest sidecar of a compressed
+// backup, from local storage
 func (s *LocalStorage) DeleteBackup(backupPath string) error {
-	return os.RemoveAll(backupPath)
+	if err := os.RemoveAll(backupPath); err != nil {
+		return err
+	}
+	if strings.HasSuffix(backupPath, ".tar.gz") {
+		if err := os.Remove(backupPath + manifestSidecarSuffix); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
 }
 
 // GetBackupPath returns the full path for a backup
@@ -211,142 +201,262 @@ func (s *LocalStorage) GetBackupPath(backupName string) string {
 	return filepath.Join(s.basePath, backupName)
 }
 
-// compressBackup creates a gzipped tar archive of the backup directory
-func (s *LocalStorage) compressBackup(backupDir string) error {
-	archiveName := backupDir + ".tar.gz"
-
-	// Create archive file
-	archiveFile, err := os.Create(archiveName)
-	if err != nil {
-		return fmt.Errorf("failed to create archive file: %w", err)
+// openSource opens a directory or compressed backup for reading
+func (s *LocalStorage) openSource(backupPath string) (backupSource, error) {
+	if strings.HasSuffix(backupPath, ".tar.gz") {
+		return openArchiveSource(openLocalFile(backupPath), openLocalFile(backupPath+manifestSidecarSuffix))
 	}
-	defer archiveFile.Close()
-
-	// Create gzip writer
-	gzipWriter := gzip.NewWriter(archiveFile)
-	defer gzipWriter.Close()
-
-	// Create tar writer
-	tarWriter := tar.NewWriter(gzipWriter)
-	defer tarWriter.Close()
+	return openDirectorySource(backupPath)
+}
 
-	// Walk through backup directory and add files to archive
-	err = filepath.Walk(backupDir, func(path string, info os.FileInfo, err error) error {
+func openLocalFile(path string) func() (io.ReadCloser, error) {
+	return func() (io.ReadCloser, error) {
+		file, err := os.Open(path)
 		if err != nil {
-			return err
+			return nil, fmt.Errorf("failed to open archive: %w", err)
 		}
+		return file, nil
+	}
+}
 
-		// Get relative path within backup
-		relPath, err := filepath.Rel(backupDir, path)
+// openDirectorySource reads a directory backup's manifest files. Resource
+// files are then read in manifest order, followed by any other files so they
+// can be reported.
+func openDirectorySource(dir string) (backupSource, error) {
+	files := make(map[string][]byte)
+	for _, name := range manifestFileNames {
+		content, err := os.ReadFile(filepath.Join(dir, name))
+		if os.IsNotExist(err) {
+			continue
+		}
 		if err != nil {
-			return err
+			return backupSource{}, fmt.Errorf("failed to read backup: %w", err)
 		}
+		files[name] = content
+	}
 
-		// Skip root directory
-		if relPath == "." {
-			return nil
+	var paths []string
+	listed := make(map[string]bool)
+	var manifest types.BackupManifest
+	if err := yaml.Unmarshal(files[types.ManifestFileName], &manifest); err == nil {
+		for _, info := range manifest.Resources {
+			path := filepath.ToSlash(info.RelativePath)
+			paths = append(paths, path)
+			listed[path] = true
 		}
-
-		// Create tar header
-		header, err := tar.FileInfoHeader(info, "")
-		if err != nil {
+	}
+	err := filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || !entry.Type().IsRegular() {
 			return err
 		}
-		header.Name = relPath
-
-		// Write header
-		if err := tarWriter.WriteHeader(header); err != nil {
+		relPath, err := filepath.Rel(dir, path)
+		if err != nil {
 			return err
 		}
-
-		// Write file content if it's a regular file
-		if info.Mode().IsRegular() {
-			file, err := os.Open(path)
-			if err != nil {
-				return err
-			}
-			defer file.Close()
-
-			_, err = io.Copy(tarWriter, file)
-			return err
+		if relPath = filepath.ToSlash(relPath); !listed[relPath] && !isManifestFile(relPath) {
+			paths = append(paths, relPath)
 		}
-
 		return nil
 	})
-
 	if err != nil {
-		return fmt.Errorf("failed to create archive: %w", err)
+		return backupSource{}, fmt.Errorf("failed to read backup: %w", err)
 	}
 
-	// Remove original directory after successful compression
-	return os.RemoveAll(backupDir)
+	// The file returned by next stays open until the following call
+	var current *os.File
+	closeCurrent := func() error {
+		if current == nil {
+			return nil
+		}
+		err := current.Close()
+		current = nil
+		return err
+	}
+	next := func() (string, io.Reader, error) {
+		closeCurrent()
+		for len(paths) > 0 {
+			path := paths[0]
+			paths = paths[1:]
+			file, err := os.Open(filepath.Join(dir, filepath.FromSlash(path)))
+			if os.IsNotExist(err) {
+				// Reported as missing by the reader
+				continue
+			}
+			if err != nil {
+				return "", nil, fmt.Errorf("failed to read %s: %w", path, err)
+			}
+			current = file
+			return path, file, nil
+		}
+		return "", nil, io.EOF
+	}
+	open := func(path string) (io.ReadCloser, error) {
+		return os.Open(filepath.Join(dir, filepath.FromSlash(path)))
+	}
+	return backupSource{manifestFiles: files, next: next, open: open, close: closeCurrent}, nil
 }
 
-// extractBackup extracts a compressed backup to a temporary directory
-func (s *LocalStorage) extractBackup(archivePath string) (string, error) {
-	// Create temporary directory
-	tempDir, err := os.MkdirTemp("", "k8s-backup-extract-*")
-	if err != nil {
-		return "", fmt.Errorf("failed to create temp directory: %w", err)
+// directoryWriter writes a backup as a directory with one file per resource,
+// in a partial directory that is renamed into place once it is complete
+type directoryWriter struct {
+	dir      string
+	path     string
+	metadata *types.BackupMetadata
+	signing  Signing
+	dirs     map[string]bool
+	builder  manifestBuilder
+	done     bool
+}
+
+func (w *directoryWriter) WriteResource(ctx context.Context, resource types.ResourceWithContent) error {
+	info := w.builder.add(resource)
+
+	fullPath := filepath.Join(w.dir, info.RelativePath)
+	if dir := filepath.Dir(fullPath); !w.dirs[dir] {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return fmt.Errorf("failed to create directory %s: %w", dir, err)
+		}
+		w.dirs[dir] = true
 	}
+	if err := os.WriteFile(fullPath, resource.Content, 0600); err != nil {
+		return fmt.Errorf("failed to write resource file %s: %w", info.RelativePath, err)
+	}
+	return nil
+}
 
-	// Open archive file
-	archiveFile, err := os.Open(archivePath)
+func (w *directoryWriter) WriteVolume(ctx context.Context, volume types.VolumeDataInfo, data io.Reader) (types.VolumeDataInfo, error) {
+	fullPath := filepath.Join(w.dir, volumeRelativePath(volume.Namespace, volume.PersistentVolumeClaim))
+	if err := os.MkdirAll(filepath.Dir(fullPath), 0700); err != nil {
+		return volume, fmt.Errorf("failed to create directory %s: %w", filepath.Dir(fullPath), err)
+	}
+	file, err := os.OpenFile(fullPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
 	if err != nil {
-		os.RemoveAll(tempDir)
-		return "", fmt.Errorf("failed to open archive: %w", err)
+		return volume, fmt.Errorf("failed to create volume file: %w", err)
 	}
-	defer archiveFile.Close()
 
-	// Create gzip reader
-	gzipReader, err := gzip.NewReader(archiveFile)
+	volume, err = copyVolume(file, volume, data)
+	if closeErr := file.Close(); err == nil && closeErr != nil {
+		return volume, fmt.Errorf("failed to write volume file %s: %w", volume.RelativePath, closeErr)
+	}
 	if err != nil {
-		os.RemoveAll(tempDir)
-		return "", fmt.Errorf("failed to create gzip reader: %w", err)
+		os.Remove(fullPath)
+		volume = failVolume(volume, err)
+		w.builder.addVolume(volume)
+		return volume, fmt.Errorf("failed to copy volume %s: %w", volume.Key(), err)
 	}
-	defer gzipReader.Close()
+	w.builder.addVolume(volume)
+	return volume, nil
+}
 
-	// Create tar reader
-	tarReader := tar.NewReader(gzipReader)
+func (w *directoryWriter) Commit(ctx context.Context) error {
+	manifest := w.builder.manifest(w.metadata)
 
-	// Extract files
-	for {
-		header, err := tarReader.Next()
-		if err == io.EOF {
-			break
+	// The manifest is written last so incomplete backups are never listed
+	files, err := manifestFiles(manifest, w.signing)
+	if err == nil {
+		for _, name := range manifestFileNames {
+			content, ok := files[name]
+			if !ok {
+				continue
+			}
+			if err = os.WriteFile(filepath.Join(w.dir, name), content, 0600); err != nil {
+				err = fmt.Errorf("failed to write %s: %w", name, err)
+				break
+			}
 		}
-		if err != nil {
-			os.RemoveAll(tempDir)
-			return "", fmt.Errorf("failed to read tar header: %w", err)
+	}
+	if err == nil {
+		if err = os.Rename(w.dir, w.path); err != nil {
+			err = fmt.Errorf("failed to save backup directory: %w", err)
 		}
+	}
+	if err != nil {
+		w.Abort()
+		return err
+	}
 
-		// Full path for extracted file
-		extractPath := filepath.Join(tempDir, header.Name)
+	w.done = true
+	w.metadata.BackupPath = w.path
+	w.metadata.Size = manifest.Metadata.Size
+	return nil
+}
 
-		// Ensure directory exists
-		if err := os.MkdirAll(filepath.Dir(extractPath), 0755); err != nil {
-			os.RemoveAll(tempDir)
-			return "", fmt.Errorf("failed to create directory: %w", err)
-		}
+func (w *directoryWriter) Abort() error {
+	if w.done {
+		return nil
+	}
+	w.done = true
+	return os.RemoveAll(w.dir)
+}
 
-		// Extract file content
-		if header.Typeflag == tar.TypeReg {
-			outFile, err := os.Create(extractPath)
-			if err != nil {
-				os.RemoveAll(tempDir)
-				return "", fmt.Errorf("failed to create file: %w", err)
-			}
+// localArchiveWriter writes a compressed backup to a partial file that is
+// renamed into place once the archive and its sidecar are complete
+type localArchiveWriter struct {
+	path     string
+	file     *os.File
+	archive  *archiveWriter
+	metadata *types.BackupMetadata
+	signing  Signing
+	done     bool
+}
 
-			_, err = io.Copy(outFile, tarReader)
-			outFile.Close()
-			if err != nil {
-				os.RemoveAll(tempDir)
-				return "", fmt.Errorf("failed to extract file: %w", err)
-			}
-		}
+func (w *localArchiveWriter) WriteResource(ctx context.Context, resource types.ResourceWithContent) error {
+	return w.archive.writeResource(resource)
+}
+
+func (w *localArchiveWriter) WriteVolume(ctx context.Context, volume types.VolumeDataInfo, data io.Reader) (types.VolumeDataInfo, error) {
+	return w.archive.writeVolume(volume, data)
+}
+
+func (w *localArchiveWriter) Commit(ctx context.Context) error {
+	if err := w.commit(); err != nil {
+		w.Abort()
+		return fmt.Errorf("failed to write archive: %w", err)
+	}
+	w.done = true
+
+	if stat, err := os.Stat(w.path); err == nil {
+		w.metadata.Size = stat.Size()
+	}
+	return nil
+}
+
+func (w *localArchiveWriter) commit() error {
+	files, err := manifestFiles(w.archive.manifest(w.metadata), w.signing)
+	if err != nil {
+		return err
+	}
+	if err := w.archive.close(files); err != nil {
+		return err
+	}
+	if err := w.file.Close(); err != nil {
+		return err
 	}
 
-	return tempDir, nil
+	// Replace any sidecar left by an earlier backup of the same name before
+	// the archive becomes visible
+	sidecar, err := os.OpenFile(w.path+manifestSidecarSuffix, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	err = writeManifestSidecar(sidecar, files, w.metadata.Timestamp)
+	if closeErr := sidecar.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(w.file.Name(), w.path)
+}
+
+func (w *localArchiveWriter) Abort() error {
+	if w.done {
+		return nil
+	}
+	w.done = true
+	w.file.Close()
+	return os.Remove(w.file.Name())
 }
 
 // loadMetadataFromManifest loads backup metadata from a manifest file
@@ -366,19 +476,11 @@ func (s *LocalStorage) loadMetadataFromManifest(manifestPath string) (*types.Bac
 
 // loadMetadataFromCompressed loads backup metadata from a compressed backup
 func (s *LocalStorage) loadMetadataFromCompressed(archivePath string) (*types.BackupMetadata, error) {
-	// This is a simplified version - in practice, you might want to read just the manifest
-	// without extracting the entire archive
-	tempDir, err := s.extractBackup(archivePath)
-	if err != nil {
-		return nil, err
-	}
-	defer os.RemoveAll(tempDir)
-
-	manifestPath := filepath.Join(tempDir, types.ManifestFileName)
-	metadata, err := s.loadMetadataFromManifest(manifestPath)
+	manifest, err := readArchiveManifest(openLocalFile(archivePath), openLocalFile(archivePath+manifestSidecarSuffix))
 	if err != nil {
 		return nil, err
 	}
+	metadata := &manifest.Metadata
 
 	// Update path to point to the compressed archive
 	metadata.BackupPath = archivePath
@@ -262,3 +262,79 @@ func TestResourcePathGeneration(t *testing.T) {
 		}
 	}
 }
+
+func TestSameKindFromDifferentGroups(t *testing.T) {
+	ctx := context.Background()
+	resources := []types.ResourceWithContent{
+		{
+			Content: []byte("apiVersion: v1\nkind: Service\nmetadata:\n  name: web\n  namespace: shop\n"),
+			Info:    types.ResourceInfo{APIVersion: "v1", Kind: "Service", Namespace: "shop", Name: "web"},
+		},
+		{
+			Content: []byte("apiVersion: serving.knative.dev/v1\nkind: Service\nmetadata:\n  name: web\n  namespace: shop\n"),
+			Info:    types.ResourceInfo{APIVersion: "serving.knative.dev/v1", Kind: "Service", Namespace: "shop", Name: "web"},
+		},
+	}
+
+	for _, compress := range []bool{false, true} {
+		storage := NewLocalStorage(t.TempDir())
+		metadata := &types.BackupMetadata{Name: "groups", Timestamp: time.Now(), Version: types.BackupFormatVersion, Compress: compress}
+		if err := storage.SaveBackup(ctx, metadata, resources); err != nil {
+			t.Fatalf("compress=%v: failed to save backup: %v", compress, err)
+		}
+
+		manifest, loaded, err := storage.LoadBackup(ctx, metadata.BackupPath)
+		if err != nil {
+			t.Fatalf("compress=%v: failed to load backup: %v", compress, err)
+		}
+		if manifest.Resources[0].RelativePath == manifest.Resources[1].RelativePath {
+			t.Errorf("compress=%v: expected distinct paths, got %s twice", compress, manifest.Resources[0].RelativePath)
+		}
+		if len(loaded) != 2 {
+			t.Fatalf("compress=%v: expected 2 resources, got %d", compress, len(loaded))
+		}
+		for i, resource := range loaded {
+			if string(resource.Content) != string(resources[i].Content) {
+				t.Errorf("compress=%v: expected %s, got %s", compress, resources[i].Content, resource.Content)
+			}
+		}
+
+		report, err := storage.VerifyBackup(ctx, metadata.BackupPath, nil)
+		if err != nil || !report.OK() {
+			t.Errorf("compress=%v: expected the backup to verify, got %+v, %v", compress, report, err)
+		}
+	}
+}
+
+func TestSaveBackupPermissions(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "k8s-backup-test-*")
+	if err != nil {
+		t.Fatalf("Failed to create temp directory: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	storage := NewLocalStorage(tempDir)
+	metadata := &types.BackupMetadata{Name: "private-backup", Timestamp: time.Now(), Version: types.BackupFormatVersion}
+	resources := []types.ResourceWithContent{{
+		Content: []byte("apiVersion: v1\nkind: Secret\n"),
+		Info:    types.ResourceInfo{APIVersion: "v1", Kind: "Secret", Namespace: "default", Name: "db"},
+	}}
+	if err := storage.SaveBackup(context.Background(), metadata, resources); err != nil {
+		t.Fatalf("Failed to save backup: %v", err)
+	}
+
+	expected := map[string]os.FileMode{
+		metadata.BackupPath: 0700,
+		filepath.Join(metadata.BackupPath, types.ManifestFileName):      0600,
+		filepath.Join(metadata.BackupPath, "default", "secret-db.yaml"): 0600,
+	}
+	for path, mode := range expected {
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatalf("Failed to stat %s: %v", path, err)
+		}
+		if info.Mode().Perm() != mode {
+			t.Errorf("Expected %s to have mode %o, got %o", path, mode, info.Mode().Perm())
+		}
+	}
+}
@@ -0,0 +1,462 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"k8s-backup/pkg/types"
+)
+
+// BackupWriter streams the resources of a new backup to storage one at a
+// time, so backups of any size are written without holding them in memory.
+// The backup is not listed until Commit succeeds.
+type BackupWriter interface {
+	// WriteResource stores a single resource
+	WriteResource(ctx context.Context, resource types.ResourceWithContent) error
+	// WriteVolume stores the tar stream of a PersistentVolumeClaim's data
+	// under volumes/<namespace>/<claim>.tar and records it in the manifest
+	// with its size and checksum. Copies that fail while data is read are
+	// returned and recorded with the Failed phase, and the backup can still
+	// be committed; after any other error it must be aborted.
+	WriteVolume(ctx context.Context, volume types.VolumeDataInfo, data io.Reader) (types.VolumeDataInfo, error)
+	// Commit writes the manifest, built from the metadata as it is when Commit
+	// is called, and sets the metadata's BackupPath and Size. If Commit fails,
+	// the backup is discarded.
+	Commit(ctx context.Context) error
+	// Abort discards everything written so far. It does nothing after Commit.
+	Abort() error
+}
+
+// BackupReader streams the resources of a stored backup one at a time. Each
+// resource is checked against the manifest before it is returned.
+type BackupReader interface {
+	// Manifest returns the backup's manifest, whose resources are listed in
+	// the order Next returns them
+	Manifest() *types.BackupManifest
+	// Next returns the next resource, or io.EOF once every resource has been
+	// read
+	Next(ctx context.Context) (types.ResourceWithContent, error)
+	// OpenVolume streams the data of a volume listed in the manifest. Reading
+	// fails at the end of the stream if the data does not match its checksum.
+	OpenVolume(ctx context.Context, volume types.VolumeDataInfo) (io.ReadCloser, error)
+	Close() error
+}
+
+// ResourceCheck validates a resource whose content matched its checksum
+// during verification
+type ResourceCheck func(manifest *types.BackupManifest, resource types.ResourceWithContent) error
+
+// WriteBackup saves a complete set of resources through a storage backend's
+// streaming writer
+func WriteBackup(ctx context.Context, s Storage, metadata *types.BackupMetadata, resources []types.ResourceWithContent) error {
+	writer, err := s.OpenBackupWriter(ctx, metadata)
+	if err != nil {
+		return err
+	}
+	for _, resource := range resources {
+		if err := writer.WriteResource(ctx, resource); err != nil {
+			writer.Abort()
+			return err
+		}
+	}
+	return writer.Commit(ctx)
+}
+
+// ReadBackup reads every resource of a backup into memory through a storage
+// backend's streaming reader
+func ReadBackup(ctx context.Context, s Storage, backupPath string) (*types.BackupManifest, []types.ResourceWithContent, error) {
+	reader, err := s.OpenBackupReader(ctx, backupPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer reader.Close()
+
+	var resources []types.ResourceWithContent
+	for {
+		resource, err := reader.Next(ctx)
+		if err == io.EOF {
+			return reader.Manifest(), resources, nil
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		resources = append(resources, resource)
+	}
+}
+
+// manifestBuilder records the manifest entries of a backup as its resources
+// are written
+type manifestBuilder struct {
+	resources []types.ResourceInfo
+	volumes   []types.VolumeDataInfo
+	size      int64
+}
+
+// add assigns a resource its relative path and checksum and records it
+func (b *manifestBuilder) add(resource types.ResourceWithContent) types.ResourceInfo {
+	info := resource.Info
+	info.RelativePath = resourceRelativePath(info)
+	info.Checksum = checksum(resource.Content)
+	b.resources = append(b.resources, info)
+	b.size += int64(len(resource.Content))
+	return info
+}
+
+// addVolume records a volume copy
+func (b *manifestBuilder) addVolume(volume types.VolumeDataInfo) {
+	b.volumes = append(b.volumes, volume)
+	b.size += volume.Size
+}
+
+func (b *manifestBuilder) manifest(metadata *types.BackupMetadata) *types.BackupManifest {
+	manifest := &types.BackupManifest{Metadata: *metadata, Resources: b.resources, Volumes: b.volumes}
+	manifest.Metadata.Size = b.size
+	if manifest.Resources == nil {
+		manifest.Resources = []types.ResourceInfo{}
+	}
+	return manifest
+}
+
+// backupSource is an opened backup: its manifest files, read up front, and
+// an iterator over all of its files in the order they are stored
+type backupSource struct {
+	manifestFiles map[string][]byte
+	// next returns the next file's slash-separated relative path and a
+	// reader of its content, valid until the next call, or io.EOF after the
+	// last file
+	next func() (string, io.Reader, error)
+	// open opens a single file of the backup independently of next
+	open  func(path string) (io.ReadCloser, error)
+	close func() error
+}
+
+// volumeRelativePath returns where a volume's data is stored within a backup
+func volumeRelativePath(namespace, claim string) string {
+	return filepath.Join("volumes", namespace, claim+".tar")
+}
+
+// copyVolume copies a volume's tar stream to w, setting its path, size,
+// checksum and completion time
+func copyVolume(w io.Writer, volume types.VolumeDataInfo, data io.Reader) (types.VolumeDataInfo, error) {
+	volume.RelativePath = volumeRelativePath(volume.Namespace, volume.PersistentVolumeClaim)
+	hash := sha256.New()
+	n, err := io.Copy(io.MultiWriter(w, hash), data)
+	volume.Size = n
+	volume.Checksum = "sha256:" + hex.EncodeToString(hash.Sum(nil))
+	volume.Phase = types.VolumeDataCompleted
+	volume.CompletionTime = time.Now()
+	return volume, err
+}
+
+// failVolume marks a volume copy as failed, dropping what was stored of it
+func failVolume(volume types.VolumeDataInfo, err error) types.VolumeDataInfo {
+	volume.RelativePath = ""
+	volume.Size = 0
+	volume.Checksum = ""
+	volume.Phase = types.VolumeDataFailed
+	volume.Error = err.Error()
+	return volume
+}
+
+// openVolume opens a completed volume copy of a source, checking its
+// checksum as it is read
+func openVolume(source backupSource, manifest *types.BackupManifest, volume types.VolumeDataInfo) (io.ReadCloser, error) {
+	var recorded *types.VolumeDataInfo
+	for i := range manifest.Volumes {
+		if manifest.Volumes[i].Key() == volume.Key() {
+			recorded = &manifest.Volumes[i]
+		}
+	}
+	if recorded == nil {
+		return nil, fmt.Errorf("volume %s is not in the backup", volume.Key())
+	}
+	if recorded.Phase != types.VolumeDataCompleted {
+		return nil, fmt.Errorf("volume %s was not copied: %s", volume.Key(), recorded.Error)
+	}
+
+	r, err := source.open(filepath.ToSlash(recorded.RelativePath))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open volume %s: %w", volume.Key(), err)
+	}
+	return &checksumReader{ReadCloser: r, hash: sha256.New(), checksum: recorded.Checksum, path: recorded.RelativePath}, nil
+}
+
+// checksumReader fails at the end of a stream that does not match its
+// checksum
+type checksumReader struct {
+	io.ReadCloser
+	hash     hash.Hash
+	checksum string
+	path     string
+}
+
+func (r *checksumReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.hash.Write(p[:n])
+	if err == io.EOF && r.checksum != "sha256:"+hex.EncodeToString(r.hash.Sum(nil)) {
+		return n, fmt.Errorf("checksum mismatch for %s", filepath.ToSlash(r.path))
+	}
+	return n, err
+}
+
+// manifestFileNames lists the files written alongside every backup's
+// resources, in the order they are written
+var manifestFileNames = []string{types.ManifestFileName, types.ManifestDigestFileName, types.ManifestSignatureFileName}
+
+func isManifestFile(name string) bool {
+	for _, manifestFile := range manifestFileNames {
+		if name == manifestFile {
+			return true
+		}
+	}
+	return false
+}
+
+type fileProblem int
+
+const (
+	corruptFile fileProblem = iota
+	extraFile
+	conflictingManifestFile
+)
+
+// fileError reports a file that does not match the manifest. Reading can
+// continue after it.
+type fileError struct {
+	path    string
+	problem fileProblem
+}
+
+func (e *fileError) Error() string {
+	switch e.problem {
+	case corruptFile:
+		return fmt.Sprintf("checksum mismatch for %s", e.path)
+	case extraFile:
+		return fmt.Sprintf("%s is not in the manifest", e.path)
+	default:
+		return fmt.Sprintf("%s differs from the copy the backup was read with", e.path)
+	}
+}
+
+// resourceScanner checks the files of a backup source against its manifest
+type resourceScanner struct {
+	source   backupSource
+	manifest *types.BackupManifest
+	// pending maps the paths not read yet to their manifest entries
+	pending   map[string]int
+	unchecked int
+	// volumes maps the paths of volume copies to their checksums. When
+	// checkVolumes is set they are verified and reported missing like
+	// resources, otherwise they are skipped.
+	volumes         map[string]string
+	checkVolumes    bool
+	verifiedVolumes int
+}
+
+func newResourceScanner(source backupSource, manifest *types.BackupManifest, checkVolumes bool) *resourceScanner {
+	pending := make(map[string]int, len(manifest.Resources))
+	for i, info := range manifest.Resources {
+		pending[filepath.ToSlash(info.RelativePath)] = i
+	}
+	volumes := make(map[string]string, len(manifest.Volumes))
+	for _, volume := range manifest.Volumes {
+		if volume.Phase == types.VolumeDataCompleted {
+			volumes[filepath.ToSlash(volume.RelativePath)] = volume.Checksum
+		}
+	}
+	return &resourceScanner{source: source, manifest: manifest, pending: pending, volumes: volumes, checkVolumes: checkVolumes}
+}
+
+// next returns the next resource in the manifest whose content matches its
+// checksum. Files that do not match the manifest are returned as *fileError.
+func (s *resourceScanner) next() (types.ResourceWithContent, error) {
+	for {
+		name, r, err := s.source.next()
+		if err != nil {
+			return types.ResourceWithContent{}, err
+		}
+
+		if sum, ok := s.volumes[name]; ok {
+			if !s.checkVolumes {
+				continue
+			}
+			delete(s.volumes, name)
+			hash := sha256.New()
+			if _, err := io.Copy(hash, r); err != nil {
+				return types.ResourceWithContent{}, fmt.Errorf("failed to read %s: %w", name, err)
+			}
+			if "sha256:"+hex.EncodeToString(hash.Sum(nil)) != sum {
+				return types.ResourceWithContent{}, &fileError{path: name, problem: corruptFile}
+			}
+			s.verifiedVolumes++
+			continue
+		}
+
+		_, listed := s.pending[name]
+		if !listed && !isManifestFile(name) {
+			return types.ResourceWithContent{}, &fileError{path: name, problem: extraFile}
+		}
+		content, err := io.ReadAll(r)
+		if err != nil {
+			return types.ResourceWithContent{}, fmt.Errorf("failed to read %s: %w", name, err)
+		}
+
+		if isManifestFile(name) {
+			// Archives carry their own copy of the manifest files, which
+			// must match the copy read before the resources
+			if !bytes.Equal(content, s.source.manifestFiles[name]) {
+				return types.ResourceWithContent{}, &fileError{path: name, problem: conflictingManifestFile}
+			}
+			continue
+		}
+
+		i := s.pending[name]
+		delete(s.pending, name)
+
+		info := s.manifest.Resources[i]
+		if info.Checksum == "" {
+			s.unchecked++
+		} else if checksum(content) != info.Checksum {
+			return types.ResourceWithContent{}, &fileError{path: name, problem: corruptFile}
+		}
+		return types.ResourceWithContent{Content: content, Info: info}, nil
+	}
+}
+
+// missing returns the manifest entries that were not read, in manifest order
+func (s *resourceScanner) missing() []string {
+	var missing []string
+	for _, info := range s.manifest.Resources {
+		path := filepath.ToSlash(info.RelativePath)
+		if _, ok := s.pending[path]; ok {
+			missing = append(missing, path)
+		}
+	}
+	if s.checkVolumes {
+		for _, volume := range s.manifest.Volumes {
+			path := filepath.ToSlash(volume.RelativePath)
+			if _, ok := s.volumes[path]; ok {
+				missing = append(missing, path)
+			}
+		}
+	}
+	return missing
+}
+
+// backupReader is the BackupReader of every storage backend. Anything that
+// would restore the wrong data is an error; extra files are ignored.
+type backupReader struct {
+	scanner *resourceScanner
+}
+
+// newBackupReader checks a source's manifest, and its signature when a public
+// key is given, before any resource is read
+func newBackupReader(source backupSource, publicKey ed25519.PublicKey) (*backupReader, error) {
+	report := &types.VerificationReport{}
+	manifest := verifyManifest(source.manifestFiles, publicKey, report)
+	if len(report.Errors) > 0 {
+		source.close()
+		return nil, fmt.Errorf("backup failed verification: %w", errors.Join(report.Errors...))
+	}
+	return &backupReader{scanner: newResourceScanner(source, manifest, false)}, nil
+}
+
+func (r *backupReader) Manifest() *types.BackupManifest {
+	return r.scanner.manifest
+}
+
+func (r *backupReader) Next(ctx context.Context) (types.ResourceWithContent, error) {
+	for {
+		if ctx.Err() != nil {
+			return types.ResourceWithContent{}, ctx.Err()
+		}
+
+		resource, err := r.scanner.next()
+		var fileErr *fileError
+		switch {
+		case errors.As(err, &fileErr) && fileErr.problem == extraFile:
+			continue
+		case err == io.EOF:
+			if missing := r.scanner.missing(); len(missing) > 0 {
+				return types.ResourceWithContent{}, fmt.Errorf("backup failed verification: missing resource files: %s", strings.Join(missing, ", "))
+			}
+			return types.ResourceWithContent{}, io.EOF
+		case err != nil:
+			return types.ResourceWithContent{}, fmt.Errorf("backup failed verification: %w", err)
+		}
+		return resource, nil
+	}
+}
+
+func (r *backupReader) OpenVolume(ctx context.Context, volume types.VolumeDataInfo) (io.ReadCloser, error) {
+	return openVolume(r.scanner.source, r.scanner.manifest, volume)
+}
+
+func (r *backupReader) Close() error {
+	return r.scanner.source.close()
+}
+
+// verifyBackup checks every file of a source against its manifest, calling
+// check for each resource whose content matched its checksum
+func verifyBackup(ctx context.Context, source backupSource, publicKey ed25519.PublicKey, check ResourceCheck) (*types.VerificationReport, error) {
+	defer source.close()
+
+	report := &types.VerificationReport{}
+	manifest := verifyManifest(source.manifestFiles, publicKey, report)
+	if manifest == nil {
+		return report, nil
+	}
+
+	scanner := newResourceScanner(source, manifest, true)
+	for {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+
+		resource, err := scanner.next()
+		var fileErr *fileError
+		if errors.As(err, &fileErr) {
+			switch fileErr.problem {
+			case corruptFile:
+				report.Corrupt = append(report.Corrupt, fileErr.path)
+			case extraFile:
+				report.Extra = append(report.Extra, fileErr.path)
+			default:
+				report.Errors = append(report.Errors, fileErr)
+			}
+			continue
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		report.Verified++
+		if check != nil {
+			if err := check(manifest, resource); err != nil {
+				report.Invalid = append(report.Invalid, fmt.Sprintf("%s: %v", filepath.ToSlash(resource.Info.RelativePath), err))
+			}
+		}
+	}
+
+	report.Missing = scanner.missing()
+	report.VerifiedVolumes = scanner.verifiedVolumes
+	sort.Strings(report.Extra)
+	if scanner.unchecked > 0 {
+		report.Warnings = append(report.Warnings, fmt.Sprintf("%d resources have no recorded checksum", scanner.unchecked))
+	}
+	return report, nil
+}
@@ -0,0 +1,322 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"k8s-backup/pkg/types"
+)
+
+func TestBackupWriterCommitAndAbort(t *testing.T) {
+	ctx := context.Background()
+	resource := types.ResourceWithContent{
+		Content: []byte("apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: app\n  namespace: default\n"),
+		Info:    types.ResourceInfo{APIVersion: "v1", Kind: "ConfigMap", Namespace: "default", Name: "app"},
+	}
+
+	for _, compress := range []bool{false, true} {
+		dir := t.TempDir()
+		storage := NewLocalStorage(dir)
+
+		metadata := &types.BackupMetadata{Name: "committed", Timestamp: time.Now(), Version: types.BackupFormatVersion, Compress: compress}
+		writer, err := storage.OpenBackupWriter(ctx, metadata)
+		if err != nil {
+			t.Fatalf("compress=%v: OpenBackupWriter failed: %v", compress, err)
+		}
+		if err := writer.WriteResource(ctx, resource); err != nil {
+			t.Fatalf("compress=%v: WriteResource failed: %v", compress, err)
+		}
+		if backups, _ := storage.ListBackups(); len(backups) != 0 {
+			t.Errorf("compress=%v: expected no backups before Commit, got %d", compress, len(backups))
+		}
+
+		// The metadata is read at Commit, so it can be completed while writing
+		metadata.TotalResources = 1
+		if err := writer.Commit(ctx); err != nil {
+			t.Fatalf("compress=%v: Commit failed: %v", compress, err)
+		}
+		if err := writer.Abort(); err != nil {
+			t.Errorf("compress=%v: Abort after Commit failed: %v", compress, err)
+		}
+
+		manifest, resources, err := storage.LoadBackup(ctx, metadata.BackupPath)
+		if err != nil {
+			t.Fatalf("compress=%v: LoadBackup failed: %v", compress, err)
+		}
+		if manifest.Metadata.TotalResources != 1 || len(resources) != 1 || metadata.Size == 0 {
+			t.Errorf("compress=%v: unexpected backup: %+v, %d resources", compress, manifest.Metadata, len(resources))
+		}
+
+		aborted, err := storage.OpenBackupWriter(ctx, &types.BackupMetadata{Name: "aborted", Timestamp: time.Now(), Compress: compress})
+		if err != nil {
+			t.Fatalf("compress=%v: OpenBackupWriter failed: %v", compress, err)
+		}
+		if err := aborted.WriteResource(ctx, resource); err != nil {
+			t.Fatalf("compress=%v: WriteResource failed: %v", compress, err)
+		}
+		if err := aborted.Abort(); err != nil {
+			t.Fatalf("compress=%v: Abort failed: %v", compress, err)
+		}
+
+		entries, _ := os.ReadDir(dir)
+		var names []string
+		for _, entry := range entries {
+			names = append(names, entry.Name())
+		}
+		expected := []string{"committed"}
+		if compress {
+			expected = []string{"committed.tar.gz", "committed.tar.gz.manifest"}
+		}
+		if !reflect.DeepEqual(names, expected) {
+			t.Errorf("compress=%v: expected only %v after Abort, got %v", compress, expected, names)
+		}
+
+		// A backup of the same name, compressed or not, leaves the existing
+		// one untouched
+		for _, again := range []bool{false, true} {
+			_, err := storage.OpenBackupWriter(ctx, &types.BackupMetadata{Name: "committed", Timestamp: time.Now(), Compress: again})
+			if err == nil || !strings.Contains(err.Error(), "already exists") {
+				t.Errorf("compress=%v: expected a second backup named committed to fail, got %v", compress, err)
+			}
+		}
+		if _, resources, err := storage.LoadBackup(ctx, metadata.BackupPath); err != nil || len(resources) != 1 {
+			t.Errorf("compress=%v: expected the existing backup to remain, got %d resources, %v", compress, len(resources), err)
+		}
+	}
+}
+
+func TestS3BackupWriterKeepsExistingBackups(t *testing.T) {
+	ctx := context.Background()
+	fake := newFakeS3("backups")
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	storage := newTestS3Storage(t, server, "cluster-a")
+
+	metadata := &types.BackupMetadata{Name: "committed", Timestamp: time.Now(), Version: types.BackupFormatVersion}
+	if err := storage.SaveBackup(ctx, metadata, testBackupResources(1)); err != nil {
+		t.Fatalf("SaveBackup failed: %v", err)
+	}
+
+	// Either the archive or its sidecar marks the name as taken
+	for _, remaining := range []string{"cluster-a/committed.tar.gz", "cluster-a/committed.tar.gz.manifest"} {
+		fake.mu.Lock()
+		objects := map[string][]byte{remaining: fake.objects[remaining]}
+		fake.objects = objects
+		fake.mu.Unlock()
+
+		_, err := storage.OpenBackupWriter(ctx, &types.BackupMetadata{Name: "committed", Timestamp: time.Now()})
+		if err == nil || !strings.Contains(err.Error(), "already exists") {
+			t.Errorf("%s: expected a second backup named committed to fail, got %v", remaining, err)
+		}
+		fake.mu.Lock()
+		_, kept := fake.objects[remaining]
+		uploads := len(fake.uploads)
+		fake.mu.Unlock()
+		if !kept || uploads != 0 {
+			t.Errorf("%s: expected the existing object to remain and no upload to start, got %v and %d uploads", remaining, kept, uploads)
+		}
+	}
+}
+
+func TestCompressedBackupWithoutSidecar(t *testing.T) {
+	ctx := context.Background()
+	storage := NewLocalStorage(t.TempDir())
+	archivePath := saveIntegrityTestBackup(t, storage, true)
+
+	if err := os.Remove(archivePath + manifestSidecarSuffix); err != nil {
+		t.Fatalf("Failed to remove sidecar: %v", err)
+	}
+
+	backups, err := storage.ListBackups()
+	if err != nil || len(backups) != 1 || backups[0].Name != "integrity" {
+		t.Fatalf("Expected the backup to be listed from its archive, got %v, %v", backups, err)
+	}
+	if _, resources, err := storage.LoadBackup(ctx, archivePath); err != nil || len(resources) != 2 {
+		t.Errorf("Expected the backup to load from its archive, got %d resources, %v", len(resources), err)
+	}
+}
+
+func TestLoadManifestFirstArchive(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	storage := NewLocalStorage(dir)
+	backupDir := saveIntegrityTestBackup(t, storage, false)
+
+	_, resources, err := storage.LoadBackup(ctx, backupDir)
+	if err != nil {
+		t.Fatalf("LoadBackup failed: %v", err)
+	}
+
+	// Archives written before streaming store the manifest files first
+	archivePath := filepath.Join(dir, "legacy.tar.gz")
+	file, err := os.Create(archivePath)
+	if err != nil {
+		t.Fatalf("Failed to create archive: %v", err)
+	}
+	archive := newArchiveWriter(file, time.Now())
+	for _, name := range manifestFileNames {
+		if content, err := os.ReadFile(filepath.Join(backupDir, name)); err == nil {
+			if err := archive.writeFile(name, content); err != nil {
+				t.Fatalf("Failed to write %s: %v", name, err)
+			}
+		}
+	}
+	for _, resource := range resources {
+		if err := archive.writeFile(resource.Info.RelativePath, resource.Content); err != nil {
+			t.Fatalf("Failed to write %s: %v", resource.Info.RelativePath, err)
+		}
+	}
+	if err := archive.close(nil); err != nil {
+		t.Fatalf("Failed to close archive: %v", err)
+	}
+	file.Close()
+
+	manifest, loaded, err := storage.LoadBackup(ctx, archivePath)
+	if err != nil {
+		t.Fatalf("LoadBackup of a manifest-first archive failed: %v", err)
+	}
+	if len(loaded) != len(resources) || len(manifest.Resources) != len(resources) {
+		t.Errorf("Expected %d resources, got %d", len(resources), len(loaded))
+	}
+	if metadata, err := storage.loadMetadataFromCompressed(archivePath); err != nil || metadata.Name != "integrity" {
+		t.Errorf("Expected metadata from the archive, got %v, %v", metadata, err)
+	}
+}
+
+func TestBackupVolumeData(t *testing.T) {
+	ctx := context.Background()
+	resource := types.ResourceWithContent{
+		Content: []byte("apiVersion: v1\nkind: PersistentVolumeClaim\nmetadata:\n  name: data\n  namespace: db\n"),
+		Info:    types.ResourceInfo{APIVersion: "v1", Kind: "PersistentVolumeClaim", Namespace: "db", Name: "data"},
+	}
+	data := bytes.Repeat([]byte("tar stream of the volume "), 1000)
+
+	for _, compress := range []bool{false, true} {
+		storage := NewLocalStorage(t.TempDir())
+		metadata := &types.BackupMetadata{Name: "volumes", Timestamp: time.Now(), Version: types.BackupFormatVersion, Compress: compress}
+		writer, err := storage.OpenBackupWriter(ctx, metadata)
+		if err != nil {
+			t.Fatalf("compress=%v: OpenBackupWriter failed: %v", compress, err)
+		}
+		if err := writer.WriteResource(ctx, resource); err != nil {
+			t.Fatalf("compress=%v: WriteResource failed: %v", compress, err)
+		}
+		volume, err := writer.WriteVolume(ctx, types.VolumeDataInfo{Namespace: "db", PersistentVolumeClaim: "data"}, bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("compress=%v: WriteVolume failed: %v", compress, err)
+		}
+		if volume.Phase != types.VolumeDataCompleted || volume.Size != int64(len(data)) || volume.Checksum != checksum(data) {
+			t.Errorf("compress=%v: unexpected volume %+v", compress, volume)
+		}
+
+		// A copy that fails is recorded and the backup is still committed
+		failed, err := writer.WriteVolume(ctx, types.VolumeDataInfo{Namespace: "db", PersistentVolumeClaim: "logs"}, iotest.ErrReader(errors.New("helper pod did not start")))
+		if err == nil || failed.Phase != types.VolumeDataFailed || failed.RelativePath != "" {
+			t.Fatalf("compress=%v: expected a failed copy, got %+v, %v", compress, failed, err)
+		}
+		if err := writer.Commit(ctx); err != nil {
+			t.Fatalf("compress=%v: Commit failed: %v", compress, err)
+		}
+
+		reader, err := storage.OpenBackupReader(ctx, metadata.BackupPath)
+		if err != nil {
+			t.Fatalf("compress=%v: OpenBackupReader failed: %v", compress, err)
+		}
+		manifest := reader.Manifest()
+		if len(manifest.Volumes) != 2 || manifest.Volumes[0].Checksum != volume.Checksum || manifest.Volumes[1].Error != "helper pod did not start" {
+			t.Errorf("compress=%v: unexpected manifest volumes %+v", compress, manifest.Volumes)
+		}
+		// Volume data is not returned as a resource
+		if _, err := reader.Next(ctx); err != nil {
+			t.Fatalf("compress=%v: Next failed: %v", compress, err)
+		}
+		if _, err := reader.Next(ctx); err != io.EOF {
+			t.Errorf("compress=%v: expected io.EOF after the only resource, got %v", compress, err)
+		}
+
+		stream, err := reader.OpenVolume(ctx, volume)
+		if err != nil {
+			t.Fatalf("compress=%v: OpenVolume failed: %v", compress, err)
+		}
+		read, err := io.ReadAll(stream)
+		stream.Close()
+		if err != nil || !bytes.Equal(read, data) {
+			t.Errorf("compress=%v: expected the volume data back, got %d bytes, %v", compress, len(read), err)
+		}
+		if _, err := reader.OpenVolume(ctx, failed); err == nil {
+			t.Errorf("compress=%v: expected the failed copy not to open", compress)
+		}
+		reader.Close()
+
+		report, err := storage.VerifyBackup(ctx, metadata.BackupPath, nil)
+		if err != nil {
+			t.Fatalf("compress=%v: VerifyBackup failed: %v", compress, err)
+		}
+		if !report.OK() || report.VerifiedVolumes != 1 {
+			t.Errorf("compress=%v: expected the volume to verify, got %+v", compress, report)
+		}
+	}
+}
+
+func TestCorruptVolumeData(t *testing.T) {
+	ctx := context.Background()
+	storage := NewLocalStorage(t.TempDir())
+	metadata := &types.BackupMetadata{Name: "volumes", Timestamp: time.Now(), Version: types.BackupFormatVersion}
+	writer, err := storage.OpenBackupWriter(ctx, metadata)
+	if err != nil {
+		t.Fatalf("OpenBackupWriter failed: %v", err)
+	}
+	volume, err := writer.WriteVolume(ctx, types.VolumeDataInfo{Namespace: "db", PersistentVolumeClaim: "data"}, strings.NewReader("original"))
+	if err != nil {
+		t.Fatalf("WriteVolume failed: %v", err)
+	}
+	if err := writer.Commit(ctx); err != nil {
+		t.Fatalf("Commit failed: %v", err)
+	}
+
+	path := filepath.Join(metadata.BackupPath, "volumes", "db", "data.tar")
+	if err := os.WriteFile(path, []byte("modified"), 0600); err != nil {
+		t.Fatalf("Failed to modify volume data: %v", err)
+	}
+
+	report, err := storage.VerifyBackup(ctx, metadata.BackupPath, nil)
+	if err != nil {
+		t.Fatalf("VerifyBackup failed: %v", err)
+	}
+	if !reflect.DeepEqual(report.Corrupt, []string{"volumes/db/data.tar"}) {
+		t.Errorf("Expected the volume data to be reported corrupt, got %+v", report)
+	}
+
+	reader, err := storage.OpenBackupReader(ctx, metadata.BackupPath)
+	if err != nil {
+		t.Fatalf("OpenBackupReader failed: %v", err)
+	}
+	defer reader.Close()
+	stream, err := reader.OpenVolume(ctx, volume)
+	if err != nil {
+		t.Fatalf("OpenVolume failed: %v", err)
+	}
+	defer stream.Close()
+	if _, err := io.ReadAll(stream); err == nil || !strings.Contains(err.Error(), "checksum mismatch") {
+		t.Errorf("Expected a checksum mismatch, got %v", err)
+	}
+
+	os.Remove(path)
+	report, err = storage.VerifyBackup(ctx, metadata.BackupPath, nil)
+	if err != nil {
+		t.Fatalf("VerifyBackup failed: %v", err)
+	}
+	if !reflect.DeepEqual(report.Missing, []string{"volumes/db/data.tar"}) {
+		t.Errorf("Expected the volume data to be reported missing, got %+v", report)
+	}
+}
@@ -0,0 +1,250 @@
+package transform
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+
+	jsonpatch "github.com/evanphx/json-patch"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	utiljson "k8s.io/apimachinery/pkg/util/json"
+)
+
+// storageClassAnnotation is the pre-storageClassName way of requesting a
+// storage class, still honoured by the API server
+const storageClassAnnotation = "volume.beta.kubernetes.io/storage-class"
+
+func init() {
+	Register("jsonPatch", newJSONPatch)
+	Register("mergePatch", newMergePatch)
+	Register("imageReplace", newImageReplace)
+	Register("storageClass", newStorageClassMap)
+	Register("labels", newMetadataMap("labels"))
+	Register("annotations", newMetadataMap("annotations"))
+}
+
+// jsonPatchTransformer applies an RFC 6902 JSON Patch
+type jsonPatchTransformer struct {
+	patch jsonpatch.Patch
+}
+
+func newJSONPatch(rule []byte) (Transformer, error) {
+	var config struct {
+		Patch json.RawMessage `json:"patch"`
+	}
+	if err := decodeRule(rule, &config); err != nil {
+		return nil, err
+	}
+	patch, err := jsonpatch.DecodePatch(config.Patch)
+	if err != nil {
+		return nil, fmt.Errorf("invalid patch: %w", err)
+	}
+	if len(patch) == 0 {
+		return nil, fmt.Errorf("patch has no operations")
+	}
+	return &jsonPatchTransformer{patch: patch}, nil
+}
+
+func (t *jsonPatchTransformer) Transform(obj *unstructured.Unstructured) error {
+	return patchObject(obj, func(doc []byte) ([]byte, error) {
+		return t.patch.Apply(doc)
+	})
+}
+
+// mergePatchTransformer applies an RFC 7386 JSON merge patch
+type mergePatchTransformer struct {
+	patch []byte
+}
+
+func newMergePatch(rule []byte) (Transformer, error) {
+	var config struct {
+		Patch map[string]interface{} `json:"patch"`
+	}
+	if err := decodeRule(rule, &config); err != nil {
+		return nil, err
+	}
+	if len(config.Patch) == 0 {
+		return nil, fmt.Errorf("patch is empty")
+	}
+	patch, err := json.Marshal(config.Patch)
+	if err != nil {
+		return nil, err
+	}
+	return &mergePatchTransformer{patch: patch}, nil
+}
+
+func (t *mergePatchTransformer) Transform(obj *unstructured.Unstructured) error {
+	return patchObject(obj, func(doc []byte) ([]byte, error) {
+		return jsonpatch.MergePatch(doc, t.patch)
+	})
+}
+
+// patchObject replaces the content of an object with a patched copy
+func patchObject(obj *unstructured.Unstructured, patch func(doc []byte) ([]byte, error)) error {
+	doc, err := obj.MarshalJSON()
+	if err != nil {
+		return fmt.Errorf("failed to encode object: %w", err)
+	}
+	patched, err := patch(doc)
+	if err != nil {
+		return fmt.Errorf("failed to apply patch: %w", err)
+	}
+	var content map[string]interface{}
+	if err := utiljson.Unmarshal(patched, &content); err != nil {
+		return fmt.Errorf("failed to decode patched object: %w", err)
+	}
+	obj.Object = content
+	return nil
+}
+
+// imageReplaceTransformer rewrites container images matching a regular
+// expression, in Pods and anything with a pod template
+type imageReplaceTransformer struct {
+	pattern     *regexp.Regexp
+	replacement string
+}
+
+func newImageReplace(rule []byte) (Transformer, error) {
+	var config struct {
+		Pattern     string `json:"pattern"`
+		Replacement string `json:"replacement"`
+	}
+	if err := decodeRule(rule, &config); err != nil {
+		return nil, err
+	}
+	if config.Pattern == "" {
+		return nil, fmt.Errorf("pattern is required")
+	}
+	pattern, err := regexp.Compile(config.Pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pattern: %w", err)
+	}
+	return &imageReplaceTransformer{pattern: pattern, replacement: config.Replacement}, nil
+}
+
+func (t *imageReplaceTransformer) Transform(obj *unstructured.Unstructured) error {
+	t.replaceImages(obj.Object)
+	return nil
+}
+
+// replaceImages walks the object for container lists, so that Pods,
+// workloads, CronJobs and custom resources embedding pod specs are all
+// covered
+func (t *imageReplaceTransformer) replaceImages(value interface{}) {
+	switch value := value.(type) {
+	case map[string]interface{}:
+		for key, field := range value {
+			if containers, ok := field.([]interface{}); ok && (key == "containers" || key == "initContainers" || key == "ephemeralContainers") {
+				for _, container := range containers {
+					if container, ok := container.(map[string]interface{}); ok {
+						if image, ok := container["image"].(string); ok {
+							container["image"] = t.pattern.ReplaceAllString(image, t.replacement)
+						}
+					}
+				}
+				continue
+			}
+			t.replaceImages(field)
+		}
+	case []interface{}:
+		for _, item := range value {
+			t.replaceImages(item)
+		}
+	}
+}
+
+// storageClassTransformer renames storage classes of volumes and volume
+// claims, including the claim templates of StatefulSets
+type storageClassTransformer struct {
+	mapping map[string]string
+}
+
+func newStorageClassMap(rule []byte) (Transformer, error) {
+	var config struct {
+		Mapping map[string]string `json:"mapping"`
+	}
+	if err := decodeRule(rule, &config); err != nil {
+		return nil, err
+	}
+	if len(config.Mapping) == 0 {
+		return nil, fmt.Errorf("mapping is empty")
+	}
+	return &storageClassTransformer{mapping: config.Mapping}, nil
+}
+
+func (t *storageClassTransformer) Transform(obj *unstructured.Unstructured) error {
+	gvk := obj.GroupVersionKind()
+	switch {
+	case gvk.Group == "" && (gvk.Kind == "PersistentVolumeClaim" || gvk.Kind == "PersistentVolume"):
+		t.mapClaim(obj.Object)
+	case gvk.Group == "apps" && gvk.Kind == "StatefulSet":
+		templates, _, _ := unstructured.NestedSlice(obj.Object, "spec", "volumeClaimTemplates")
+		for _, template := range templates {
+			if template, ok := template.(map[string]interface{}); ok {
+				t.mapClaim(template)
+			}
+		}
+		if len(templates) > 0 {
+			return unstructured.SetNestedSlice(obj.Object, templates, "spec", "volumeClaimTemplates")
+		}
+	}
+	return nil
+}
+
+// mapClaim renames the storage class of a volume, claim or claim template
+func (t *storageClassTransformer) mapClaim(obj map[string]interface{}) {
+	if class, found, _ := unstructured.NestedString(obj, "spec", "storageClassName"); found {
+		if target, ok := t.mapping[class]; ok {
+			unstructured.SetNestedField(obj, target, "spec", "storageClassName")
+		}
+	}
+	if class, found, _ := unstructured.NestedString(obj, "metadata", "annotations", storageClassAnnotation); found {
+		if target, ok := t.mapping[class]; ok {
+			unstructured.SetNestedField(obj, target, "metadata", "annotations", storageClassAnnotation)
+		}
+	}
+}
+
+// metadataTransformer adds and removes labels or annotations
+type metadataTransformer struct {
+	field  string
+	add    map[string]string
+	remove []string
+}
+
+func newMetadataMap(field string) Factory {
+	return func(rule []byte) (Transformer, error) {
+		var config struct {
+			Add    map[string]string `json:"add"`
+			Remove []string          `json:"remove"`
+		}
+		if err := decodeRule(rule, &config); err != nil {
+			return nil, err
+		}
+		if len(config.Add) == 0 && len(config.Remove) == 0 {
+			return nil, fmt.Errorf("nothing to add or remove")
+		}
+		return &metadataTransformer{field: field, add: config.Add, remove: config.Remove}, nil
+	}
+}
+
+func (t *metadataTransformer) Transform(obj *unstructured.Unstructured) error {
+	values, _, err := unstructured.NestedStringMap(obj.Object, "metadata", t.field)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", t.field, err)
+	}
+	if values == nil {
+		values = make(map[string]string, len(t.add))
+	}
+	for _, key := range t.remove {
+		delete(values, key)
+	}
+	for key, value := range t.add {
+		values[key] = value
+	}
+	if len(values) == 0 {
+		unstructured.RemoveNestedField(obj.Object, "metadata", t.field)
+		return nil
+	}
+	return unstructured.SetNestedStringMap(obj.Object, values, "metadata", t.field)
+}
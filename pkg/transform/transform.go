@@ -0,0 +1,175 @@
+// Package transform rewrites objects on their way from a backup into a
+// cluster, e.g. to change storage classes or image registries when restoring
+// into a different cluster.
+package transform
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"sigs.k8s.io/yaml"
+)
+
+// Transformer rewrites an object before it is restored
+type Transformer interface {
+	Transform(obj *unstructured.Unstructured) error
+}
+
+// Factory builds a transformer from the JSON of its rule in a rules file
+type Factory func(rule []byte) (Transformer, error)
+
+var factories = map[string]Factory{}
+
+// Register makes a transformer available to rules files under the given
+// type name. It is meant to be called from init functions, and panics if the
+// name is already registered.
+func Register(name string, factory Factory) {
+	if _, ok := factories[name]; ok {
+		panic(fmt.Sprintf("transformer %s is already registered", name))
+	}
+	factories[name] = factory
+}
+
+// Types returns the registered transformer type names
+func Types() []string {
+	names := make([]string, 0, len(factories))
+	for name := range factories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Pipeline runs transformers in order
+type Pipeline []Transformer
+
+// Transform runs every transformer of the pipeline on the object
+func (p Pipeline) Transform(obj *unstructured.Unstructured) error {
+	for _, transformer := range p {
+		if err := transformer.Transform(obj); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Match selects the objects a rule applies to. Empty fields match anything.
+type Match struct {
+	Group      string   `json:"group,omitempty"`
+	Version    string   `json:"version,omitempty"`
+	Kind       string   `json:"kind,omitempty"`
+	Namespaces []string `json:"namespaces,omitempty"`
+	// Selector is a label selector such as app=web,tier!=cache
+	Selector string `json:"selector,omitempty"`
+}
+
+// rule is a transformer from a rules file, applied to the objects its match
+// selects
+type rule struct {
+	name        string
+	index       int
+	match       Match
+	namespaces  sets.String
+	selector    labels.Selector
+	transformer Transformer
+}
+
+func (r *rule) Transform(obj *unstructured.Unstructured) error {
+	gvk := obj.GroupVersionKind()
+	if (r.match.Group != "" && r.match.Group != gvk.Group) ||
+		(r.match.Version != "" && r.match.Version != gvk.Version) ||
+		(r.match.Kind != "" && r.match.Kind != gvk.Kind) ||
+		(r.namespaces.Len() > 0 && !r.namespaces.Has(obj.GetNamespace())) ||
+		!r.selector.Matches(labels.Set(obj.GetLabels())) {
+		return nil
+	}
+	if err := r.transformer.Transform(obj); err != nil {
+		return fmt.Errorf("transform %d (%s) failed: %w", r.index+1, r.name, err)
+	}
+	return nil
+}
+
+// rulesFile is the format of a rules file
+type rulesFile struct {
+	Transforms []json.RawMessage `json:"transforms"`
+}
+
+// ruleHeader holds the fields every rule has
+type ruleHeader struct {
+	Type  string `json:"type"`
+	Match Match  `json:"match"`
+}
+
+// LoadRules reads a pipeline from a YAML rules file
+func LoadRules(path string) (Pipeline, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read rules file: %w", err)
+	}
+	pipeline, err := ParseRules(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid rules file %s: %w", path, err)
+	}
+	return pipeline, nil
+}
+
+// ParseRules parses a pipeline from the YAML of a rules file. Each entry of
+// its transforms list has a type naming a registered transformer, an
+// optional match, and the transformer's own fields.
+func ParseRules(data []byte) (Pipeline, error) {
+	var file rulesFile
+	if err := yaml.UnmarshalStrict(data, &file); err != nil {
+		return nil, err
+	}
+
+	pipeline := make(Pipeline, 0, len(file.Transforms))
+	for i, raw := range file.Transforms {
+		var header ruleHeader
+		if err := json.Unmarshal(raw, &header); err != nil {
+			return nil, fmt.Errorf("transform %d: %w", i+1, err)
+		}
+		factory, ok := factories[header.Type]
+		if !ok {
+			return nil, fmt.Errorf("transform %d: unknown type %q (known types: %v)", i+1, header.Type, Types())
+		}
+		selector, err := labels.Parse(header.Match.Selector)
+		if err != nil {
+			return nil, fmt.Errorf("transform %d: invalid selector: %w", i+1, err)
+		}
+		transformer, err := factory(raw)
+		if err != nil {
+			return nil, fmt.Errorf("transform %d (%s): %w", i+1, header.Type, err)
+		}
+
+		pipeline = append(pipeline, &rule{
+			name:        header.Type,
+			index:       i,
+			match:       header.Match,
+			namespaces:  sets.NewString(header.Match.Namespaces...),
+			selector:    selector,
+			transformer: transformer,
+		})
+	}
+	return pipeline, nil
+}
+
+// decodeRule unmarshals a rule into a transformer's configuration, rejecting
+// fields neither the rule nor the transformer knows
+func decodeRule(rule []byte, config interface{}) error {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(rule, &fields); err != nil {
+		return err
+	}
+	delete(fields, "type")
+	delete(fields, "match")
+	rest, err := json.Marshal(fields)
+	if err != nil {
+		return err
+	}
+	return yaml.UnmarshalStrict(rest, config)
+}
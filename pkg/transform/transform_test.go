@@ -0,0 +1,241 @@
+package transform
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"sigs.k8s.io/yaml"
+)
+
+func newTestObject(t *testing.T, content string) *unstructured.Unstructured {
+	t.Helper()
+	obj := &unstructured.Unstructured{}
+	if err := yaml.Unmarshal([]byte(content), &obj.Object); err != nil {
+		t.Fatalf("Failed to parse test object: %v", err)
+	}
+	return obj
+}
+
+const testDeployment = `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: web
+  namespace: prod
+  labels:
+    app: web
+    team: shop
+spec:
+  replicas: 3
+  template:
+    spec:
+      initContainers:
+      - name: migrate
+        image: registry.old.io/shop/migrate:1.0
+      containers:
+      - name: web
+        image: registry.old.io/shop/web:2.1
+      - name: proxy
+        image: docker.io/envoyproxy/envoy:v1.28
+`
+
+const testRules = `
+transforms:
+- type: jsonPatch
+  match:
+    group: apps
+    kind: Deployment
+    selector: app=web
+  patch:
+  - op: replace
+    path: /spec/replicas
+    value: 1
+- type: mergePatch
+  match:
+    namespaces: [staging]
+  patch:
+    spec:
+      paused: true
+- type: imageReplace
+  pattern: ^registry\.old\.io/
+  replacement: registry.new.io/
+- type: storageClass
+  mapping:
+    gp2: standard
+- type: labels
+  add:
+    restored: "true"
+  remove: [team]
+- type: annotations
+  add:
+    note: copied
+`
+
+func TestParseRules(t *testing.T) {
+	pipeline, err := ParseRules([]byte(testRules))
+	if err != nil {
+		t.Fatalf("ParseRules failed: %v", err)
+	}
+	if len(pipeline) != 6 {
+		t.Fatalf("Expected 6 transformers, got %d", len(pipeline))
+	}
+
+	obj := newTestObject(t, testDeployment)
+	if err := pipeline.Transform(obj); err != nil {
+		t.Fatalf("Transform failed: %v", err)
+	}
+
+	if replicas, _, _ := unstructured.NestedInt64(obj.Object, "spec", "replicas"); replicas != 1 {
+		t.Errorf("Expected the JSON patch to set replicas to 1, got %d", replicas)
+	}
+	if _, found, _ := unstructured.NestedFieldNoCopy(obj.Object, "spec", "paused"); found {
+		t.Errorf("Expected the merge patch to only apply in staging")
+	}
+	if expected := map[string]string{"app": "web", "restored": "true"}; !reflect.DeepEqual(obj.GetLabels(), expected) {
+		t.Errorf("Expected labels %v, got %v", expected, obj.GetLabels())
+	}
+	if expected := map[string]string{"note": "copied"}; !reflect.DeepEqual(obj.GetAnnotations(), expected) {
+		t.Errorf("Expected annotations %v, got %v", expected, obj.GetAnnotations())
+	}
+
+	var images []string
+	for _, field := range []string{"initContainers", "containers"} {
+		containers, _, _ := unstructured.NestedSlice(obj.Object, "spec", "template", "spec", field)
+		for _, container := range containers {
+			images = append(images, container.(map[string]interface{})["image"].(string))
+		}
+	}
+	expected := []string{"registry.new.io/shop/migrate:1.0", "registry.new.io/shop/web:2.1", "docker.io/envoyproxy/envoy:v1.28"}
+	if !reflect.DeepEqual(images, expected) {
+		t.Errorf("Expected images %v, got %v", expected, images)
+	}
+}
+
+func TestParseRulesInvalid(t *testing.T) {
+	tests := []struct {
+		rules    string
+		expected string
+	}{
+		{"transforms:\n- type: unknown\n", "unknown type"},
+		{"transforms:\n- type: labels\n  add: {a: b}\n  extra: true\n", "unknown field"},
+		{"transforms:\n- type: labels\n", "nothing to add or remove"},
+		{"transforms:\n- type: imageReplace\n  pattern: '('\n", "invalid pattern"},
+		{"transforms:\n- type: jsonPatch\n  patch: []\n", "no operations"},
+		{"transforms:\n- type: labels\n  add: {a: b}\n  match: {selector: 'app in (web'}\n", "invalid selector"},
+		{"rules: []\n", "unknown field"},
+	}
+
+	for _, test := range tests {
+		_, err := ParseRules([]byte(test.rules))
+		if err == nil || !strings.Contains(err.Error(), test.expected) {
+			t.Errorf("%q: expected an error containing %q, got %v", test.rules, test.expected, err)
+		}
+	}
+}
+
+func TestStorageClassMapping(t *testing.T) {
+	transformer, err := newStorageClassMap([]byte(`{"type": "storageClass", "mapping": {"gp2": "standard"}}`))
+	if err != nil {
+		t.Fatalf("newStorageClassMap failed: %v", err)
+	}
+
+	claim := newTestObject(t, `
+apiVersion: v1
+kind: PersistentVolumeClaim
+metadata:
+  name: data
+  annotations:
+    volume.beta.kubernetes.io/storage-class: gp2
+spec:
+  storageClassName: gp2
+`)
+	if err := transformer.Transform(claim); err != nil {
+		t.Fatalf("Transform failed: %v", err)
+	}
+	if class, _, _ := unstructured.NestedString(claim.Object, "spec", "storageClassName"); class != "standard" {
+		t.Errorf("Expected storageClassName standard, got %s", class)
+	}
+	if class := claim.GetAnnotations()[storageClassAnnotation]; class != "standard" {
+		t.Errorf("Expected the storage class annotation to be mapped, got %s", class)
+	}
+
+	statefulSet := newTestObject(t, `
+apiVersion: apps/v1
+kind: StatefulSet
+metadata:
+  name: db
+spec:
+  volumeClaimTemplates:
+  - metadata:
+      name: data
+    spec:
+      storageClassName: gp2
+  - metadata:
+      name: logs
+    spec:
+      storageClassName: io1
+`)
+	if err := transformer.Transform(statefulSet); err != nil {
+		t.Fatalf("Transform failed: %v", err)
+	}
+	templates, _, _ := unstructured.NestedSlice(statefulSet.Object, "spec", "volumeClaimTemplates")
+	var classes []string
+	for _, template := range templates {
+		class, _, _ := unstructured.NestedString(template.(map[string]interface{}), "spec", "storageClassName")
+		classes = append(classes, class)
+	}
+	if expected := []string{"standard", "io1"}; !reflect.DeepEqual(classes, expected) {
+		t.Errorf("Expected claim template classes %v, got %v", expected, classes)
+	}
+}
+
+// prefixTransformer is a custom transformer registered by the tests
+type prefixTransformer struct {
+	prefix string
+}
+
+func (p *prefixTransformer) Transform(obj *unstructured.Unstructured) error {
+	obj.SetName(p.prefix + obj.GetName())
+	return nil
+}
+
+func TestRegisterAndLoadRules(t *testing.T) {
+	Register("testPrefix", func(rule []byte) (Transformer, error) {
+		var config struct {
+			Prefix string `json:"prefix"`
+		}
+		if err := decodeRule(rule, &config); err != nil {
+			return nil, err
+		}
+		return &prefixTransformer{prefix: config.Prefix}, nil
+	})
+
+	path := filepath.Join(t.TempDir(), "rules.yaml")
+	rules := "transforms:\n- type: testPrefix\n  match: {kind: Deployment}\n  prefix: copy-\n"
+	if err := os.WriteFile(path, []byte(rules), 0600); err != nil {
+		t.Fatalf("Failed to write rules: %v", err)
+	}
+	pipeline, err := LoadRules(path)
+	if err != nil {
+		t.Fatalf("LoadRules failed: %v", err)
+	}
+
+	obj := newTestObject(t, testDeployment)
+	if err := pipeline.Transform(obj); err != nil {
+		t.Fatalf("Transform failed: %v", err)
+	}
+	if obj.GetName() != "copy-web" {
+		t.Errorf("Expected the registered transformer to rename the object, got %s", obj.GetName())
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Errorf("Expected registering a name twice to panic")
+		}
+	}()
+	Register("testPrefix", nil)
+}
@@ -1,6 +1,9 @@
 package types
 
 import (
+	"fmt"
+	"io"
+	"strings"
 	"time"
 
 	"k8s.io/apimachinery/pkg/runtime"
@@ -18,6 +21,82 @@ type BackupMetadata struct {
 	BackupPath        string    `json:"backupPath" yaml:"backupPath"`
 	Size              int64     `json:"size" yaml:"size"`
 	Compress          bool      `json:"compress" yaml:"compress"`
+	// Encryption is set when resource contents are encrypted
+	Encryption *EncryptionInfo `json:"encryption,omitempty" yaml:"encryption,omitempty"`
+	// Parent is set on incremental backups, which only store resources that
+	// changed since the parent backup. Chain lists every ancestor, oldest first.
+	Parent string   `json:"parent,omitempty" yaml:"parent,omitempty"`
+	Chain  []string `json:"chain,omitempty" yaml:"chain,omitempty"`
+	// Deleted lists resources that existed in the parent backup but no longer do
+	Deleted []ResourceInfo `json:"deleted,omitempty" yaml:"deleted,omitempty"`
+	// VolumeSnapshots lists the CSI snapshots taken of PersistentVolumeClaims
+	VolumeSnapshots []VolumeSnapshotInfo `json:"volumeSnapshots,omitempty" yaml:"volumeSnapshots,omitempty"`
+	// Schedule names the schedule that took the backup, if any
+	Schedule string `json:"schedule,omitempty" yaml:"schedule,omitempty"`
+	// Hooks lists the commands run in application pods around the backup
+	Hooks []HookResult `json:"hooks,omitempty" yaml:"hooks,omitempty"`
+}
+
+// HookPhase is when a hook runs: before anything is captured, or once
+// everything has been
+type HookPhase string
+
+const (
+	HookPre  HookPhase = "pre"
+	HookPost HookPhase = "post"
+)
+
+// HookOnError decides whether a failing hook fails the backup
+type HookOnError string
+
+const (
+	HookFail     HookOnError = "fail"
+	HookContinue HookOnError = "continue"
+)
+
+// HookResult records a hook run in a pod. The command itself is not
+// recorded, as it may carry credentials and backups are not always encrypted.
+type HookResult struct {
+	// Hook names the rule of the hooks file the hook came from, or is
+	// "annotations" for hooks declared on the pod
+	Hook           string      `json:"hook" yaml:"hook"`
+	Phase          HookPhase   `json:"phase" yaml:"phase"`
+	Namespace      string      `json:"namespace" yaml:"namespace"`
+	Pod            string      `json:"pod" yaml:"pod"`
+	Container      string      `json:"container" yaml:"container"`
+	OnError        HookOnError `json:"onError" yaml:"onError"`
+	Succeeded      bool        `json:"succeeded" yaml:"succeeded"`
+	Error          string      `json:"error,omitempty" yaml:"error,omitempty"`
+	StartTime      time.Time   `json:"startTime" yaml:"startTime"`
+	CompletionTime time.Time   `json:"completionTime" yaml:"completionTime"`
+}
+
+// VolumeSnapshotInfo records a CSI snapshot of a PersistentVolumeClaim's data
+type VolumeSnapshotInfo struct {
+	Namespace             string `json:"namespace" yaml:"namespace"`
+	PersistentVolumeClaim string `json:"persistentVolumeClaim" yaml:"persistentVolumeClaim"`
+	// VolumeSnapshot and VolumeSnapshotContent name the objects created for
+	// the snapshot in the cluster it was taken in
+	VolumeSnapshot        string `json:"volumeSnapshot" yaml:"volumeSnapshot"`
+	VolumeSnapshotContent string `json:"volumeSnapshotContent" yaml:"volumeSnapshotContent"`
+	VolumeSnapshotClass   string `json:"volumeSnapshotClass" yaml:"volumeSnapshotClass"`
+	Driver                string `json:"driver" yaml:"driver"`
+	// SnapshotHandle identifies the snapshot in the storage system
+	SnapshotHandle string `json:"snapshotHandle" yaml:"snapshotHandle"`
+	RestoreSize    string `json:"restoreSize,omitempty" yaml:"restoreSize,omitempty"`
+}
+
+// EncryptionInfo describes how a backup's resource contents are encrypted.
+// Each backup has its own data key, stored wrapped by the user's key.
+type EncryptionInfo struct {
+	Algorithm  string `json:"algorithm" yaml:"algorithm"`
+	KeyScheme  string `json:"keyScheme" yaml:"keyScheme"`
+	KeyID      string `json:"keyID,omitempty" yaml:"keyID,omitempty"`
+	WrappedKey []byte `json:"wrappedKey" yaml:"wrappedKey"`
+	// Index holds what the manifest records about the backed up objects,
+	// sealed with the data key. Without it, as in backups encrypted before
+	// it was added, the manifest lists them in plaintext.
+	Index []byte `json:"index,omitempty" yaml:"index,omitempty"`
 }
 
 // BackupOptions contains configuration for backup operations
@@ -29,8 +108,42 @@ type BackupOptions struct {
 	OutputPath           string
 	BackupName           string
 	Compress             bool
+	// IncrementalFrom names the parent backup of an incremental backup
+	IncrementalFrom string
+	// Concurrency is the number of List calls made in parallel (default 1)
+	Concurrency int
+	// LabelSelector and FieldSelector filter every List call
+	LabelSelector string
+	FieldSelector string
+	// NamespaceSelector limits the backup to namespaces with matching labels
+	NamespaceSelector string
+	// ExcludeClusterResources leaves every cluster-scoped resource,
+	// Namespace objects included, out of the backup
+	ExcludeClusterResources bool
+	// SnapshotVolumes takes a CSI VolumeSnapshot of every backed up
+	// PersistentVolumeClaim, waiting up to SnapshotTimeout for each
+	SnapshotVolumes bool
+	SnapshotTimeout time.Duration
+	// VolumeData selects PersistentVolumeClaims, as "namespace/name" or
+	// "namespace/*", whose files are copied into the backup by the data
+	// mover, in addition to claims annotated with VolumeDataAnnotation.
+	// Claims copied this way are not snapshotted.
+	VolumeData []string
+	// DataMoverImage is the image of the helper pods that copy volume data
+	DataMoverImage string
+	// VolumeDataTimeout bounds how long a helper pod may take to start
+	VolumeDataTimeout time.Duration
+	// SkipHooks backs up without running the hooks declared on pods or set
+	// on the backup manager
+	SkipHooks bool
+	// Schedule names the schedule the backup is taken for
+	Schedule string
 }
 
+// VolumeDataAnnotation selects a PersistentVolumeClaim for file-level backup
+// of its data when set to "true"
+const VolumeDataAnnotation = "k8s-backup.io/backup-volume-data"
+
 // RestoreOptions contains configuration for restore operations
 type RestoreOptions struct {
 	BackupPath        string
@@ -40,23 +153,184 @@ type RestoreOptions struct {
 	Wait              bool
 	Timeout           time.Duration
 	OverwriteExisting bool
+	FieldManager      string
+	ForceConflicts    bool
+	// ServerDryRun sends every resource through the apply path with
+	// dryRun=All, so the API server validates and admits it without
+	// persisting anything. DryRun stays an offline check.
+	ServerDryRun bool
+	// LabelSelector limits the restore to resources whose recorded labels
+	// match
+	LabelSelector string
+	// NamespaceMapping restores the resources of each source namespace into
+	// the target namespace it maps to
+	NamespaceMapping map[string]string
+	// RemapClusterResources also rewrites the namespace references of
+	// cluster-scoped objects under NamespaceMapping, such as the subjects
+	// of ClusterRoleBindings and the claimRef of PersistentVolumes. They
+	// keep their names, so this changes the objects of the source
+	// namespaces when restoring into the same cluster.
+	RemapClusterResources bool
+	// DryRunOutput receives the YAML of every object a dry run would apply,
+	// after transformation and namespace mapping
+	DryRunOutput io.Writer
+	// ExistingPolicy decides what happens to resources that already exist.
+	// When unset, OverwriteExisting selects ExistingUpdate over ExistingSkip.
+	ExistingPolicy ExistingPolicy
+	// ExistingPolicyOverrides sets the policy per kind, keyed by the
+	// lowercase kind, its plural or kind.group (e.g. "job.batch")
+	ExistingPolicyOverrides map[string]ExistingPolicy
+	// SkipVolumeSnapshots restores PersistentVolumeClaims as backed up,
+	// instead of provisioning them from the backup's volume snapshots
+	SkipVolumeSnapshots bool
+	// SkipVolumeData restores PersistentVolumeClaims without copying the
+	// backed up volume data into them
+	SkipVolumeData bool
+	// DataMoverImage is the image of the helper pods that copy volume data
+	DataMoverImage string
+}
+
+// ExistingPolicy decides what a restore does with a resource that already
+// exists in the cluster
+type ExistingPolicy string
+
+const (
+	// ExistingSkip leaves the live object untouched
+	ExistingSkip ExistingPolicy = "skip"
+	// ExistingUpdate server-side applies the backed up object over the live one
+	ExistingUpdate ExistingPolicy = "update"
+	// ExistingReplace deletes the live object and creates it again, for
+	// changes to immutable fields
+	ExistingReplace ExistingPolicy = "replace"
+	// ExistingMerge patches the live object with a three-way JSON merge
+	// patch, keeping fields that are only set in the cluster
+	ExistingMerge ExistingPolicy = "merge"
+	// ExistingFail reports the resource as an error
+	ExistingFail ExistingPolicy = "fail"
+)
+
+// ExistingPolicies lists every valid ExistingPolicy
+var ExistingPolicies = []ExistingPolicy{ExistingSkip, ExistingUpdate, ExistingReplace, ExistingMerge, ExistingFail}
+
+// ParseExistingPolicy parses the name of an ExistingPolicy
+func ParseExistingPolicy(name string) (ExistingPolicy, error) {
+	for _, policy := range ExistingPolicies {
+		if string(policy) == name {
+			return policy, nil
+		}
+	}
+	return "", fmt.Errorf("unknown existing policy %q: expected skip, update, replace, merge or fail", name)
+}
+
+// DiffOptions contains configuration for diff operations
+type DiffOptions struct {
+	BackupPath string
+	// Namespaces limits the diff to these namespaces; cluster-scoped objects
+	// are included when the list contains "cluster"
+	Namespaces []string
+}
+
+// BackupDiffOptions contains configuration for comparing two backups
+type BackupDiffOptions struct {
+	From string
+	To   string
+	// Namespaces limits the comparison to these namespaces; cluster-scoped
+	// objects are included when the list contains "cluster"
+	Namespaces []string
+	// Kinds limits the comparison to these kinds, matched case-insensitively
+	Kinds []string
 }
 
 // ResourceInfo contains metadata about a backed up resource
 type ResourceInfo struct {
-	APIVersion   string            `json:"apiVersion" yaml:"apiVersion"`
-	Kind         string            `json:"kind" yaml:"kind"`
-	Namespace    string            `json:"namespace" yaml:"namespace"`
-	Name         string            `json:"name" yaml:"name"`
-	RelativePath string            `json:"relativePath" yaml:"relativePath"`
-	Labels       map[string]string `json:"labels,omitempty" yaml:"labels,omitempty"`
-	Annotations  map[string]string `json:"annotations,omitempty" yaml:"annotations,omitempty"`
+	APIVersion   string `json:"apiVersion" yaml:"apiVersion"`
+	Kind         string `json:"kind" yaml:"kind"`
+	Namespace    string `json:"namespace" yaml:"namespace"`
+	Name         string `json:"name" yaml:"name"`
+	RelativePath string `json:"relativePath" yaml:"relativePath"`
+	Checksum     string `json:"checksum,omitempty" yaml:"checksum,omitempty"`
+	// ResourceVersion is the resourceVersion of the collection the resource
+	// was listed from, identifying the point in time it was backed up at
+	ResourceVersion string            `json:"resourceVersion,omitempty" yaml:"resourceVersion,omitempty"`
+	Labels          map[string]string `json:"labels,omitempty" yaml:"labels,omitempty"`
+	Annotations     map[string]string `json:"annotations,omitempty" yaml:"annotations,omitempty"`
+}
+
+// Key identifies the object a resource was backed up from, independently of
+// its API version
+func (r ResourceInfo) Key() string {
+	group := ""
+	if i := strings.LastIndex(r.APIVersion, "/"); i >= 0 {
+		group = r.APIVersion[:i]
+	}
+	return group + "/" + r.Kind + "/" + r.Namespace + "/" + r.Name
 }
 
 // BackupManifest contains the complete manifest of a backup
 type BackupManifest struct {
 	Metadata  BackupMetadata `json:"metadata" yaml:"metadata"`
 	Resources []ResourceInfo `json:"resources" yaml:"resources"`
+	// Volumes lists the volume data copied by the data mover, including
+	// copies that failed
+	Volumes []VolumeDataInfo `json:"volumes,omitempty" yaml:"volumes,omitempty"`
+}
+
+// VolumeDataPhase is the outcome of copying a volume's data
+type VolumeDataPhase string
+
+const (
+	VolumeDataCompleted VolumeDataPhase = "Completed"
+	VolumeDataFailed    VolumeDataPhase = "Failed"
+)
+
+// VolumeDataInfo records the file-level copy of a PersistentVolumeClaim's
+// data, stored in the backup as a tar stream
+type VolumeDataInfo struct {
+	Namespace             string `json:"namespace" yaml:"namespace"`
+	PersistentVolumeClaim string `json:"persistentVolumeClaim" yaml:"persistentVolumeClaim"`
+	// RelativePath, Size and Checksum describe the stored tar stream. They
+	// are not set for failed copies.
+	RelativePath   string          `json:"relativePath,omitempty" yaml:"relativePath,omitempty"`
+	Size           int64           `json:"size" yaml:"size"`
+	Checksum       string          `json:"checksum,omitempty" yaml:"checksum,omitempty"`
+	Phase          VolumeDataPhase `json:"phase" yaml:"phase"`
+	Error          string          `json:"error,omitempty" yaml:"error,omitempty"`
+	StartTime      time.Time       `json:"startTime" yaml:"startTime"`
+	CompletionTime time.Time       `json:"completionTime" yaml:"completionTime"`
+}
+
+// Key identifies the claim a volume's data was copied from
+func (v VolumeDataInfo) Key() string {
+	return v.Namespace + "/" + v.PersistentVolumeClaim
+}
+
+// VerificationReport describes the integrity of a stored backup
+type VerificationReport struct {
+	Manifest *BackupManifest
+	// ManifestVerified is set when the manifest matched its recorded digest
+	ManifestVerified bool
+	Signed           bool
+	// SignatureVerified is set when the signature was checked against a public key
+	SignatureVerified bool
+	// Missing, Corrupt, Extra and Invalid list relative paths of resource and
+	// volume files
+	Missing []string
+	Corrupt []string
+	Extra   []string
+	Invalid []string
+	// Errors are problems with the backup as a whole
+	Errors   []error
+	Warnings []string
+	// Verified counts the resources whose content matched their checksum
+	Verified int
+	// VerifiedVolumes counts the volume copies that matched their checksum
+	VerifiedVolumes int
+}
+
+// OK reports whether the backup passed verification
+func (r *VerificationReport) OK() bool {
+	return len(r.Errors) == 0 && len(r.Missing) == 0 && len(r.Corrupt) == 0 &&
+		len(r.Extra) == 0 && len(r.Invalid) == 0
 }
 
 // ResourceOrder defines the dependency-ordered restore sequence
@@ -90,14 +364,21 @@ const (
 	BackupFormatVersion = "v1"
 	DefaultBackupDir    = "./backups"
 	ManifestFileName    = "manifest.yaml"
+	// ManifestDigestFileName holds the manifest's SHA-256 in sha256sum format
+	ManifestDigestFileName = "manifest.sha256"
+	// ManifestSignatureFileName holds an optional base64 ed25519 signature of the manifest
+	ManifestSignatureFileName = "manifest.sig"
 )
 
-var SupportedResourceTypes = []string{
-	"namespaces", "clusterroles", "clusterrolebindings", "persistentvolumes",
-	"deployments", "services", "configmaps", "secrets", "persistentvolumeclaims",
-	"serviceaccounts", "roles", "rolebindings", "ingresses", "networkpolicies",
-	"horizontalpodautoscalers", "poddisruptionbudgets", "statefulsets",
-	"daemonsets", "jobs", "cronjobs", "replicasets", "pods",
+// DefaultExcludedResourceTypes lists discovered resources that describe runtime
+// state rather than desired configuration. They are skipped unless requested
+// explicitly via BackupOptions.ResourceTypes.
+var DefaultExcludedResourceTypes = []string{
+	"events", "events.events.k8s.io", "nodes", "componentstatuses",
+	"leases.coordination.k8s.io", "endpointslices.discovery.k8s.io",
+	"pods.metrics.k8s.io", "nodes.metrics.k8s.io",
+	// Snapshots of backed up claims are recorded in the manifest instead
+	"volumesnapshots.snapshot.storage.k8s.io", "volumesnapshotcontents.snapshot.storage.k8s.io",
 }
 
 // IsClusterScoped returns true if the resource type is cluster-scoped